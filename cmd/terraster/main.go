@@ -13,6 +13,7 @@ import (
 	"github.com/unkn0wn-root/terraster/internal/config"
 	"github.com/unkn0wn-root/terraster/internal/server"
 	"github.com/unkn0wn-root/terraster/pkg/logger"
+	"github.com/unkn0wn-root/terraster/pkg/watcher"
 	"go.uber.org/zap"
 )
 
@@ -21,6 +22,8 @@ func main() {
 	servicesDir := flag.String("services", "", "optional directory containing services configurations")
 	apiConfigPath := flag.String("api_config", "api.config.yaml", "path to API config file")
 	customLogConfigs := flag.String("log_configs", "", "comma-separated paths to custom provided log config files")
+	watchConfig := flag.Bool("watch", true, "reload configuration when the main config or services directory changes")
+	watchInterval := flag.Duration("watch_interval", watcher.DefaultInterval, "how often configuration files are checked for changes")
 
 	flag.Parse()
 
@@ -36,8 +39,22 @@ func main() {
 	// build server and initialize components
 	srv := initializeServer(ctx, cfg, apiConfig, errChan, logger, logManager)
 
+	// reload configuration on SIGHUP or when configuration files change
+	reloadChan := make(chan struct{}, 1)
+	if *watchConfig {
+		w := watcher.New(*watchInterval, *configPath, *servicesDir)
+		go w.Run(ctx, func() {
+			logger.Info("Configuration change detected")
+			requestReload(reloadChan)
+		})
+	}
+
+	reload := func() {
+		reloadConfig(srv, *configPath, *servicesDir, logger)
+	}
+
 	// run server
-	runServer(ctx, cancel, srv, errChan, logger)
+	runServer(ctx, cancel, srv, errChan, reloadChan, reload, logger)
 
 }
 
@@ -86,12 +103,36 @@ func loadConfigs(configPath, servicesDir, apiConfigPath *string, logger *zap.Log
 	return cfg, apiConfig
 }
 
-// runServerWithGracefulShutdown starts the server and listens for shutdown signals
+// requestReload schedules a configuration reload. Requests arriving while one is pending are coalesced.
+func requestReload(reloadChan chan<- struct{}) {
+	select {
+	case reloadChan <- struct{}{}:
+	default:
+	}
+}
+
+// reloadConfig loads and validates configuration files and applies them to the running server.
+// On error the running configuration is kept.
+func reloadConfig(srv *server.Server, configPath, servicesDir string, logger *zap.Logger) {
+	cfg, err := config.MergeConfigs(configPath, servicesDir, logger)
+	if err != nil {
+		logger.Error("Failed to reload configuration. Keeping current configuration", zap.Error(err))
+		return
+	}
+
+	if err := srv.Reload(cfg); err != nil {
+		logger.Error("Failed to apply reloaded configuration. Keeping current configuration", zap.Error(err))
+	}
+}
+
+// runServerWithGracefulShutdown starts the server and listens for shutdown and reload signals
 func runServer(
 	ctx context.Context,
 	cancel context.CancelFunc,
 	srv *server.Server,
 	errChan chan error,
+	reloadChan chan struct{},
+	reload func(),
 	logger *zap.Logger,
 ) {
 	go func() {
@@ -104,14 +145,27 @@ func runServer(
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	select {
-	case <-sigChan:
-		logger.Warn("Shutdown signal received. Initializing graceful shutdown")
-		cancel()
-	case err := <-errChan:
-		logger.Fatal("Server error triggered shutdown", zap.Error(err))
-	case <-ctx.Done():
-		return
+	// SIGHUP triggers a configuration reload
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+
+wait:
+	for {
+		select {
+		case <-hupChan:
+			logger.Info("SIGHUP received. Reloading configuration")
+			requestReload(reloadChan)
+		case <-reloadChan:
+			reload()
+		case <-sigChan:
+			logger.Warn("Shutdown signal received. Initializing graceful shutdown")
+			cancel()
+			break wait
+		case err := <-errChan:
+			logger.Fatal("Server error triggered shutdown", zap.Error(err))
+		case <-ctx.Done():
+			return
+		}
 	}
 
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 15*time.Second)
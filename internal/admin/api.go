@@ -8,7 +8,9 @@ import (
 	"github.com/unkn0wn-root/terraster/internal/auth/models"
 	auth_service "github.com/unkn0wn-root/terraster/internal/auth/service"
 	"github.com/unkn0wn-root/terraster/internal/config"
+	certmanager "github.com/unkn0wn-root/terraster/internal/crypto"
 	"github.com/unkn0wn-root/terraster/internal/service"
+	"github.com/unkn0wn-root/terraster/pkg/metrics"
 	"go.uber.org/zap"
 )
 
@@ -16,6 +18,7 @@ import (
 type AdminAPI struct {
 	enabled        bool
 	serviceManager *service.Manager
+	certManager    *certmanager.CertManager
 	mux            *http.ServeMux
 	config         *config.APIConfig
 	authService    *auth_service.AuthService
@@ -23,10 +26,11 @@ type AdminAPI struct {
 	logger         *zap.Logger
 }
 
-// NewAdminAPI creates a new instance of AdminAPI with the provided service manager and configuration.
+// NewAdminAPI creates a new instance of AdminAPI with the provided service manager, certificate manager and configuration.
 // It initializes the HTTP mux and registers all API routes.
 func NewAdminAPI(
 	manager *service.Manager,
+	certManager *certmanager.CertManager,
 	cfg *config.APIConfig,
 	authService *auth_service.AuthService,
 	logger *zap.Logger,
@@ -34,6 +38,7 @@ func NewAdminAPI(
 	api := &AdminAPI{
 		enabled:        cfg.AdminAPI.Enabled,
 		serviceManager: manager,
+		certManager:    certManager,
 		mux:            http.NewServeMux(),
 		config:         cfg,
 		authService:    authService,
@@ -57,8 +62,18 @@ func (a *AdminAPI) registerRoutes() {
 	// Admin-only routes
 	a.mux.Handle("/api/backends",
 		a.requireAuth(a.requireRole(models.RoleAdmin, http.HandlerFunc(a.handleBackends))))
+	a.mux.Handle("/api/backends/drain",
+		a.requireAuth(a.requireRole(models.RoleAdmin, http.HandlerFunc(a.handleDrain))))
+	a.mux.Handle("/api/backends/circuit",
+		a.requireAuth(a.requireRole(models.RoleAdmin, http.HandlerFunc(a.handleCircuit))))
+	a.mux.Handle("/api/locations/groups",
+		a.requireAuth(a.requireRole(models.RoleAdmin, http.HandlerFunc(a.handleGroups))))
 	a.mux.Handle("/api/config",
 		a.requireAuth(a.requireRole(models.RoleAdmin, http.HandlerFunc(a.handleConfig))))
+	a.mux.Handle("/api/certificates/upload",
+		a.requireAuth(a.requireRole(models.RoleAdmin, http.HandlerFunc(a.handleCertificateUpload))))
+	a.mux.Handle("/api/certificates/renew",
+		a.requireAuth(a.requireRole(models.RoleAdmin, http.HandlerFunc(a.handleCertificateRenew))))
 
 	// Reader routes
 	a.mux.Handle("/api/services",
@@ -69,6 +84,13 @@ func (a *AdminAPI) registerRoutes() {
 		a.requireAuth(a.requireRole(models.RoleReader, http.HandlerFunc(a.handleStats))))
 	a.mux.Handle("/api/locations",
 		a.requireAuth(a.requireRole(models.RoleReader, http.HandlerFunc(a.handleLocations))))
+	a.mux.Handle("/api/certificates",
+		a.requireAuth(a.requireRole(models.RoleReader, http.HandlerFunc(a.handleCertificates))))
+
+	// Metrics are scraped without authentication unless they are exposed on a dedicated port
+	if a.config.Metrics.Enabled && a.config.Metrics.Port == 0 {
+		a.mux.Handle(a.config.MetricsPath(), metrics.Handler())
+	}
 }
 
 func (a *AdminAPI) requireRole(role models.Role, next http.Handler) http.Handler {
@@ -3,11 +3,15 @@ package admin
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"time"
 
+	"github.com/golang-jwt/jwt/v4"
 	admin "github.com/unkn0wn-root/terraster/internal/admin/middleware"
 	apierr "github.com/unkn0wn-root/terraster/internal/auth"
 	"github.com/unkn0wn-root/terraster/internal/config"
+	certmanager "github.com/unkn0wn-root/terraster/internal/crypto"
 	"github.com/unkn0wn-root/terraster/internal/middleware"
 	"github.com/unkn0wn-root/terraster/internal/pool"
 	"github.com/unkn0wn-root/terraster/internal/service"
@@ -73,44 +77,8 @@ func (a *AdminAPI) handleServices(w http.ResponseWriter, r *http.Request) {
 // handleBackends manages the backends for a specific service and location.
 // Supports GET, POST, and DELETE methods to retrieve, add, or remove backends.
 func (a *AdminAPI) handleBackends(w http.ResponseWriter, r *http.Request) {
-	serviceName := r.URL.Query().Get("service_name")
-	servicePath := r.URL.Query().Get("path")
-	if serviceName == "" {
-		http.Error(w, "service_name and path is required", http.StatusBadRequest)
-		return
-	}
-
-	srvc := a.serviceManager.GetServiceByName(serviceName)
-	if srvc == nil {
-		http.Error(w, "Service not found", http.StatusNotFound)
-		return
-	}
-
-	svlc := srvc.Locations
-	if len(svlc) == 0 {
-		http.Error(w, "Service has no locations", http.StatusNotFound)
-		return
-	}
-
-	var location *service.LocationInfo
-	if servicePath == "" {
-		if len(svlc) > 1 {
-			http.Error(w, "'path' parameter is required for services with multiple locations",
-				http.StatusBadRequest)
-			return
-		}
-		location = svlc[0]
-	} else {
-		for _, loc := range svlc {
-			if loc.Path == servicePath {
-				location = loc
-				break
-			}
-		}
-	}
-
-	if location == nil {
-		http.Error(w, "Location not found", http.StatusNotFound)
+	srvc, location, ok := a.lookupLocation(w, r)
+	if !ok {
 		return
 	}
 
@@ -130,13 +98,18 @@ func (a *AdminAPI) handleBackends(w http.ResponseWriter, r *http.Request) {
 			Weight:         req.Weight,
 			MaxConnections: req.MaxConnections,
 			SkipTLSVerify:  req.SkipTLSVerify,
+			Protocol:       req.Protocol,
+			ProxyProtocol:  req.ProxyProtocol,
+			TLS:            req.TLS,
 			HealthCheck:    req.HealthCheck, // May be nil
 		}
 
 		// @TODO: Add Redirect from location
 		rc := pool.RouteConfig{
-			Path:       location.Path,
-			RewriteURL: location.Rewrite,
+			Path:          location.ProxyPath(),
+			RewriteURL:    location.Rewrite,
+			Protocol:      req.Protocol,
+			ProxyProtocol: req.ProxyProtocol,
 		}
 
 		// Determine the HealthCheckConfig to pass:
@@ -174,6 +147,224 @@ func (a *AdminAPI) handleBackends(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// lookupLocation resolves the location addressed by the service_name and path query parameters.
+// The path may be omitted for services with a single location. The optional group parameter selects a backend group.
+// Writes an error response and returns false if the location cannot be resolved.
+func (a *AdminAPI) lookupLocation(w http.ResponseWriter, r *http.Request) (*service.ServiceInfo, *service.LocationInfo, bool) {
+	serviceName := r.URL.Query().Get("service_name")
+	servicePath := r.URL.Query().Get("path")
+	if serviceName == "" {
+		http.Error(w, "service_name and path is required", http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	srvc := a.serviceManager.GetServiceByName(serviceName)
+	if srvc == nil {
+		http.Error(w, "Service not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	svlc := srvc.Locations
+	if len(svlc) == 0 {
+		http.Error(w, "Service has no locations", http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	var location *service.LocationInfo
+	if servicePath == "" {
+		if len(svlc) > 1 {
+			http.Error(w, "'path' parameter is required for services with multiple locations",
+				http.StatusBadRequest)
+			return nil, nil, false
+		}
+		location = svlc[0]
+	} else {
+		for _, loc := range svlc {
+			if loc.Path == servicePath {
+				location = loc
+				break
+			}
+		}
+	}
+
+	if location == nil {
+		http.Error(w, "Location not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	// Locations with backend groups address the backends of a group by its name.
+	if groupName := r.URL.Query().Get("group"); groupName != "" {
+		for _, group := range location.Groups {
+			if group.Group == groupName {
+				return srvc, group, true
+			}
+		}
+		http.Error(w, "Backend group not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	return srvc, location, true
+}
+
+// locationBackends returns the backends of all backend groups of a location.
+func locationBackends(loc *service.LocationInfo) []*pool.Backend {
+	var backends []*pool.Backend
+	for _, p := range loc.Pools() {
+		backends = append(backends, p.GetAllBackends()...)
+	}
+	return backends
+}
+
+// handleGroups handles HTTP requests to read and change the traffic weights of a location's backend groups.
+// GET returns the current weights, POST updates the weights of the groups in the request body.
+func (a *AdminAPI) handleGroups(w http.ResponseWriter, r *http.Request) {
+	_, location, ok := a.lookupLocation(w, r)
+	if !ok {
+		return
+	}
+
+	if len(location.Groups) == 0 {
+		http.Error(w, "Location has no backend groups", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req GroupWeightsRequest
+		if err := DecodeAndValidate(w, r, &req); err != nil {
+			return
+		}
+
+		if err := location.SetGroupWeights(req.Weights); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		a.logger.Info("Backend group weights changed",
+			zap.String("path", location.Path),
+			zap.Any("weights", req.Weights))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(location.GroupWeights())
+}
+
+// handleDrain handles HTTP POST requests to put a backend in or out of drain mode.
+// A draining backend keeps its existing sticky sessions, but no new sessions are pinned to it.
+func (a *AdminAPI) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, location, ok := a.lookupLocation(w, r)
+	if !ok {
+		return
+	}
+
+	var req DrainRequest
+	if err := DecodeAndValidate(w, r, &req); err != nil {
+		return
+	}
+
+	backend := location.ServerPool.GetBackendByURL(req.URL)
+	if backend == nil {
+		http.Error(w, "Backend not found", http.StatusNotFound)
+		return
+	}
+
+	backend.SetDraining(req.Drain)
+	a.logger.Info("Backend drain mode changed",
+		zap.String("backend", req.URL),
+		zap.Bool("drain", req.Drain))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"url":   req.URL,
+		"drain": backend.IsDraining(),
+	})
+}
+
+// handleCircuit handles HTTP requests to inspect and change the circuit breaker state of a location's backends.
+// GET returns the state of all backends, POST forces the circuit of the backend in the request body into a state.
+func (a *AdminAPI) handleCircuit(w http.ResponseWriter, r *http.Request) {
+	_, location, ok := a.lookupLocation(w, r)
+	if !ok {
+		return
+	}
+
+	type CircuitResponse struct {
+		URL      string     `json:"url"`
+		Group    string     `json:"group,omitempty"`
+		State    string     `json:"state"`
+		OpenedAt *time.Time `json:"opened_at,omitempty"`
+	}
+
+	circuitResponse := func(group string, backend *pool.Backend) CircuitResponse {
+		resp := CircuitResponse{
+			URL:   backend.URL.String(),
+			Group: group,
+			State: backend.CircuitState().String(),
+		}
+		if openedAt := backend.CircuitOpenedAt(); !openedAt.IsZero() {
+			resp.OpenedAt = &openedAt
+		}
+		return resp
+	}
+
+	groups := location.Groups
+	if len(groups) == 0 {
+		groups = []*service.LocationInfo{location}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var circuits []CircuitResponse
+		for _, group := range groups {
+			for _, backend := range group.ServerPool.GetAllBackends() {
+				circuits = append(circuits, circuitResponse(group.Group, backend))
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(circuits)
+	case http.MethodPost:
+		var req CircuitRequest
+		if err := DecodeAndValidate(w, r, &req); err != nil {
+			return
+		}
+		state, _ := pool.ParseCircuitState(req.State)
+
+		for _, group := range groups {
+			backend := group.ServerPool.GetBackendByURL(req.URL)
+			if backend == nil {
+				continue
+			}
+
+			if err := group.ServerPool.SetCircuitState(backend, state); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+
+			a.logger.Info("Backend circuit state changed",
+				zap.String("backend", req.URL),
+				zap.String("state", state.String()))
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(circuitResponse(group.Group, backend))
+			return
+		}
+
+		http.Error(w, "Backend not found", http.StatusNotFound)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 // handleLocations handles HTTP GET requests to retrieve locations for a specific service.
 // It returns information about each location, including path, algorithm, and backend count
 func (a *AdminAPI) handleLocations(w http.ResponseWriter, r *http.Request) {
@@ -188,24 +379,31 @@ func (a *AdminAPI) handleLocations(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	service := a.serviceManager.GetServiceByName(serviceName)
-	if service == nil {
+	svc := a.serviceManager.GetServiceByName(serviceName)
+	if svc == nil {
 		http.Error(w, "Service not found", http.StatusNotFound)
 		return
 	}
 
 	type LocationResponse struct {
-		Path      string `json:"path"`
-		Algorithm string `json:"algorithm"`
-		Backends  int    `json:"backends_count"`
+		Path      string                `json:"path"`
+		Algorithm string                `json:"algorithm"`
+		Backends  int                   `json:"backends_count"`
+		Groups    []service.GroupWeight `json:"groups,omitempty"`
 	}
 
-	locations := make([]LocationResponse, 0, len(service.Locations))
-	for _, loc := range service.Locations {
+	locations := make([]LocationResponse, 0, len(svc.Locations))
+	for _, loc := range svc.Locations {
+		backends := 0
+		for _, p := range loc.Pools() {
+			backends += len(p.GetBackends())
+		}
+
 		locations = append(locations, LocationResponse{
 			Path:      loc.Path,
 			Algorithm: loc.Algorithm.Name(),
-			Backends:  len(loc.ServerPool.GetBackends()),
+			Backends:  backends,
+			Groups:    loc.GroupWeights(),
 		})
 	}
 
@@ -213,7 +411,7 @@ func (a *AdminAPI) handleLocations(w http.ResponseWriter, r *http.Request) {
 }
 
 // handleHealth provides a health check endpoint that reports the status of all services and their backends.
-// It returns whether each backend is alive and the number of active connections.
+// It returns whether each backend is alive, the number of active connections, its outlier ejection and circuit breaker state.
 func (a *AdminAPI) handleHealth(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -223,17 +421,24 @@ func (a *AdminAPI) handleHealth(w http.ResponseWriter, r *http.Request) {
 	healthStatus := make(map[string]interface{})
 	services := a.serviceManager.GetServices()
 	for _, service := range services {
+		serviceHealth := make(map[string]interface{})
 		for _, loc := range service.Locations {
-			backends := loc.ServerPool.GetBackends()
-			serviceHealth := make(map[string]interface{})
-			for _, backend := range backends {
-				serviceHealth[backend.URL] = map[string]interface{}{
-					"alive":       backend.Alive,
-					"connections": backend.ConnectionCount,
+			for _, backend := range locationBackends(loc) {
+				status := map[string]interface{}{
+					"alive":       backend.Alive.Load(),
+					"connections": backend.GetConnectionCount(),
+					"ejected":     backend.IsEjected(),
+					"ejections":   backend.Ejections(),
+					"draining":    backend.IsDraining(),
+					"circuit":     backend.CircuitState().String(),
 				}
+				if backend.IsEjected() {
+					status["ejected_until"] = backend.EjectedUntil()
+				}
+				serviceHealth[backend.URL.String()] = status
 			}
-			healthStatus[service.Name] = serviceHealth
 		}
+		healthStatus[service.Name] = serviceHealth
 	}
 
 	json.NewEncoder(w).Encode(healthStatus)
@@ -252,7 +457,7 @@ func (a *AdminAPI) handleStats(w http.ResponseWriter, r *http.Request) {
 
 	for _, service := range services {
 		for _, loc := range service.Locations {
-			backends := loc.ServerPool.GetBackends()
+			backends := locationBackends(loc)
 			totalConnections := 0
 			activeBackends := 0
 			for _, backend := range backends {
@@ -272,6 +477,120 @@ func (a *AdminAPI) handleStats(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(stats)
 }
 
+// maxCertificateUploadSize limits the body of certificate uploads.
+const maxCertificateUploadSize = 1 << 20
+
+// handleCertificates handles HTTP GET requests to list the certificates served,
+// local certificates as well as certificates issued through ACME.
+func (a *AdminAPI) handleCertificates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	certs := a.certManager.Certificates()
+	a.audit(r, "list_certificates", "success", map[string]interface{}{"count": len(certs)})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(certs)
+}
+
+// handleCertificateUpload handles HTTP POST requests replacing the certificate of a host by a PEM encoded
+// certificate and key. The key has to match the certificate, which has to be valid for the host.
+func (a *AdminAPI) handleCertificateUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxCertificateUploadSize)
+	var req CertificateUploadRequest
+	if err := DecodeAndValidate(w, r, &req); err != nil {
+		a.audit(r, "upload_certificate", "failure", map[string]interface{}{"host": req.Host, "error": err.Error()})
+		return
+	}
+
+	info, err := a.certManager.InstallCertificate(req.Host, []byte(req.Cert), []byte(req.Key))
+	if err != nil {
+		a.audit(r, "upload_certificate", "failure", map[string]interface{}{"host": req.Host, "error": err.Error()})
+		switch {
+		case errors.Is(err, certmanager.ErrUnknownHost):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, certmanager.ErrInvalidCertificate):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	a.audit(r, "upload_certificate", "success", map[string]interface{}{
+		"host":      req.Host,
+		"cert_file": info.CertFile,
+		"serial":    info.Serial,
+		"not_after": info.NotAfter,
+	})
+	a.logger.Info("Certificate uploaded",
+		zap.String("host", req.Host),
+		zap.String("cert_file", info.CertFile),
+		zap.String("serial", info.Serial))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// handleCertificateRenew handles HTTP POST requests to renew the certificate of a host through ACME right away.
+// Responds once the new certificate is issued and served.
+func (a *AdminAPI) handleCertificateRenew(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req CertificateRenewRequest
+	if err := DecodeAndValidate(w, r, &req); err != nil {
+		a.audit(r, "renew_certificate", "failure", map[string]interface{}{"host": req.Host, "error": err.Error()})
+		return
+	}
+
+	// Issuance takes longer than the write timeout of the admin server allows
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(certmanager.ACMERenewTimeout)); err != nil {
+		a.logger.Warn("Failed to extend write deadline for certificate renewal", zap.Error(err))
+	}
+
+	info, err := a.certManager.RenewCertificate(req.Host)
+	if err != nil {
+		a.audit(r, "renew_certificate", "failure", map[string]interface{}{"host": req.Host, "error": err.Error()})
+		if errors.Is(err, certmanager.ErrNotACMEHost) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	a.audit(r, "renew_certificate", "success", map[string]interface{}{
+		"host":      req.Host,
+		"serial":    info.Serial,
+		"not_after": info.NotAfter,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// audit records an action on a resource in the audit log of the authentication database.
+func (a *AdminAPI) audit(r *http.Request, action, status string, details interface{}) {
+	var userID int64
+	if claims, ok := r.Context().Value("user_claims").(*jwt.MapClaims); ok {
+		// Numbers of parsed claims are float64
+		if id, ok := (*claims)["user_id"].(float64); ok {
+			userID = int64(id)
+		}
+	}
+	a.authService.LogAudit(userID, action, "certificate", status, r, details)
+}
+
 // Helper methods for route protection
 func (a *AdminAPI) requireAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
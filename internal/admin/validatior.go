@@ -4,8 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/unkn0wn-root/terraster/internal/config"
+	"github.com/unkn0wn-root/terraster/internal/pool"
+	"github.com/unkn0wn-root/terraster/pkg/proxyproto"
 )
 
 type ValidationError struct {
@@ -26,6 +29,9 @@ type BackendRequest struct {
 	Weight         int                       `json:"weight"`
 	MaxConnections int32                     `json:"maxConnections"`
 	SkipTLSVerify  bool                      `json:"skipTLSVerify"`
+	Protocol       string                    `json:"protocol"`
+	ProxyProtocol  string                    `json:"proxyProtocol"`
+	TLS            *config.BackendTLSConfig  `json:"tls"`
 	HealthCheck    *config.HealthCheckConfig `json:"healthCheck"`
 }
 
@@ -41,6 +47,21 @@ func (r BackendRequest) Validate() []ValidationError {
 	if r.MaxConnections <= 0 {
 		errors = append(errors, ValidationError{"maxConnections", "must be positive"})
 	}
+	if r.Protocol != "" && r.Protocol != pool.ProtocolHTTP && r.Protocol != pool.ProtocolH2C {
+		errors = append(errors, ValidationError{"protocol", "must be 'http' or 'h2c'"})
+	}
+	if r.ProxyProtocol != "" && !proxyproto.ValidVersion(r.ProxyProtocol) {
+		errors = append(errors, ValidationError{"proxyProtocol", "must be 'v1' or 'v2'"})
+	} else if r.ProxyProtocol != "" && r.Protocol == pool.ProtocolH2C {
+		errors = append(errors, ValidationError{"proxyProtocol", "is not supported for h2c backends"})
+	}
+	if r.TLS != nil {
+		if err := r.TLS.Validate(); err != nil {
+			errors = append(errors, ValidationError{"tls", err.Error()})
+		} else if !strings.HasPrefix(r.URL, "https://") {
+			errors = append(errors, ValidationError{"tls", "requires an https url"})
+		}
+	}
 
 	if r.HealthCheck != nil {
 		if errs := validateHealthCheck(r.HealthCheck); len(errs) > 0 {
@@ -51,11 +72,99 @@ func (r BackendRequest) Validate() []ValidationError {
 	return errors
 }
 
+type DrainRequest struct {
+	URL   string `json:"url"`
+	Drain bool   `json:"drain"`
+}
+
+func (r DrainRequest) Validate() []ValidationError {
+	var errors []ValidationError
+
+	if r.URL == "" {
+		errors = append(errors, ValidationError{"url", "required"})
+	}
+
+	return errors
+}
+
+type CircuitRequest struct {
+	URL   string `json:"url"`
+	State string `json:"state"`
+}
+
+func (r CircuitRequest) Validate() []ValidationError {
+	var errors []ValidationError
+
+	if r.URL == "" {
+		errors = append(errors, ValidationError{"url", "required"})
+	}
+	if _, err := pool.ParseCircuitState(r.State); err != nil {
+		errors = append(errors, ValidationError{"state", "must be closed, half-open or open"})
+	}
+
+	return errors
+}
+
+type GroupWeightsRequest struct {
+	Weights map[string]int `json:"weights"`
+}
+
+func (r GroupWeightsRequest) Validate() []ValidationError {
+	var errors []ValidationError
+
+	if len(r.Weights) == 0 {
+		errors = append(errors, ValidationError{"weights", "required"})
+	}
+	for name, weight := range r.Weights {
+		if weight < 0 {
+			errors = append(errors, ValidationError{"weights." + name, "must not be negative"})
+		}
+	}
+
+	return errors
+}
+
+type CertificateUploadRequest struct {
+	Host string `json:"host"`
+	Cert string `json:"cert"` // PEM encoded certificate chain, leaf first.
+	Key  string `json:"key"`  // PEM encoded private key.
+}
+
+func (r CertificateUploadRequest) Validate() []ValidationError {
+	var errors []ValidationError
+
+	if r.Host == "" {
+		errors = append(errors, ValidationError{"host", "required"})
+	}
+	if !strings.Contains(r.Cert, "-----BEGIN CERTIFICATE-----") {
+		errors = append(errors, ValidationError{"cert", "must be a PEM encoded certificate"})
+	}
+	if !strings.Contains(r.Key, "PRIVATE KEY-----") {
+		errors = append(errors, ValidationError{"key", "must be a PEM encoded private key"})
+	}
+
+	return errors
+}
+
+type CertificateRenewRequest struct {
+	Host string `json:"host"`
+}
+
+func (r CertificateRenewRequest) Validate() []ValidationError {
+	var errors []ValidationError
+
+	if r.Host == "" {
+		errors = append(errors, ValidationError{"host", "required"})
+	}
+
+	return errors
+}
+
 func validateHealthCheck(hc *config.HealthCheckConfig) []ValidationError {
 	var errors []ValidationError
 
-	if hc.Type != "http" && hc.Type != "tcp" {
-		errors = append(errors, ValidationError{"healthCheck.type", "must be 'http' or 'tcp'"})
+	if !config.ValidHealthCheckType(hc.Type) {
+		errors = append(errors, ValidationError{"healthCheck.type", "must be 'http', 'tcp' or 'grpc'"})
 	}
 	if hc.Interval <= 0 {
 		errors = append(errors, ValidationError{"healthCheck.interval", "must be positive"})
@@ -262,7 +262,7 @@ func (s *AuthService) AuthenticateUser(username, password string, r *http.Reques
 		return nil, err
 	}
 
-	s.logAudit(user.ID, "login", "auth", "success", r, nil)
+	s.LogAudit(user.ID, "login", "auth", "success", r, nil)
 
 	return token, nil
 }
@@ -467,10 +467,10 @@ func (s *AuthService) GetActiveSessions(userID int64) ([]models.Session, error)
 	return s.db.GetUserSessions(userID)
 }
 
-// logAudit records an audit log entry for a specific action performed by a user.
+// LogAudit records an audit log entry for a specific action performed by a user.
 // It captures details such as the user ID, action type, resource affected, status,
 // client IP, user agent, and any additional details provided.
-func (s *AuthService) logAudit(userID int64, action, resource, status string, r *http.Request, details interface{}) {
+func (s *AuthService) LogAudit(userID int64, action, resource, status string, r *http.Request, details interface{}) {
 	detailsJSON, _ := json.Marshal(details)
 
 	log := &models.AuditLog{
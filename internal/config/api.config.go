@@ -12,6 +12,7 @@ type APIConfig struct {
 	AdminAPI      API            `yaml:"api"`
 	AdminDatabase DatabaseConfig `yaml:"database"`
 	AdminAuth     AuthConfig     `yaml:"auth"`
+	Metrics       MetricsConfig  `yaml:"metrics"`
 	Insecure      bool           `yaml:"insecure"`
 }
 
@@ -22,6 +23,14 @@ type API struct {
 	TLS     *TLSConfig `yaml:"tls"`
 }
 
+// MetricsConfig defines where the Prometheus metrics endpoint is exposed.
+// If Port is not set, metrics are served by the admin API server.
+type MetricsConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Path    string `yaml:"path"`
+	Port    int    `yaml:"port"`
+}
+
 type DatabaseConfig struct {
 	Path string `yaml:"path"`
 }
@@ -34,6 +43,14 @@ type AuthConfig struct {
 	TokenCleanupInterval string `yaml:"token_cleanup_interval"`
 }
 
+// MetricsPath returns the path of the metrics endpoint, defaulting to /metrics.
+func (c *APIConfig) MetricsPath() string {
+	if c.Metrics.Path == "" {
+		return "/metrics"
+	}
+	return c.Metrics.Path
+}
+
 func LoadAPIConfig(path string) (*APIConfig, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -1,12 +1,17 @@
 package config
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/unkn0wn-root/terraster/pkg/clientip"
+	"github.com/unkn0wn-root/terraster/pkg/proxyproto"
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v2"
 )
@@ -106,7 +111,9 @@ type Config struct {
 	HealthCheck *HealthCheckConfig `yaml:"health_check"`    // Global health check configuration.
 	Services    []Service          `yaml:"services"`        // A list of services with their specific configurations.
 	Middleware  []Middleware       `yaml:"middleware"`      // Global middleware configurations.
-	CertManager CertManagerConfig  `json:"cert_manager"`    // Configuration for the certificate manager.
+	CertManager CertManagerConfig  `yaml:"cert_manager"`    // Configuration for the certificate manager.
+
+	ForwardedHeaders *ForwardedHeadersConfig `yaml:"forwarded_headers"` // Handling of forwarding headers for services without their own.
 }
 
 // TLSConfig holds configuration settings related to TLS (HTTPS) for the server.
@@ -118,17 +125,122 @@ type TLSConfig struct {
 	CipherSuites           []uint16 `yaml:"cipher_suites"`            // List of supported cipher suites.
 	SessionTicketsDisabled bool     `yaml:"session_tickets_disabled"` // Disables session ticket support if true.
 	NextProtos             []string `yaml:"next_protos"`              // List of supported application protocols.
+	HTTP3                  bool     `yaml:"http3"`                    // Also serve HTTP/3 (QUIC) on the same UDP port.
+
+	Certificates []CertificateConfig `yaml:"certificates,omitempty"` // Additional certificates, e.g. an ECDSA next to an RSA certificate.
+
+	ClientAuth *ClientAuthConfig `yaml:"client_auth,omitempty"` // Verify client certificates (mutual TLS).
+}
+
+// CertificateConfig is a certificate chain and its private key.
+type CertificateConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// Validate checks that both files are set.
+func (c CertificateConfig) Validate() error {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return fmt.Errorf("certificates require cert_file and key_file")
+	}
+	return nil
+}
+
+// Client authentication modes of ClientAuthConfig.
+const (
+	ClientAuthRequire  = "require"  // Clients without a valid certificate are rejected during the handshake.
+	ClientAuthOptional = "optional" // Certificates are verified if the client presents one.
+)
+
+// ClientAuthConfig enables client certificate verification (mutual TLS) for a service.
+// The verified identity of the client is forwarded to the backends in headers and can be matched by locations.
+type ClientAuthConfig struct {
+	CAFile          string                   `yaml:"ca_file"`          // PEM bundle of the CAs issuing client certificates.
+	Mode            string                   `yaml:"mode"`             // "require" (default) or "optional".
+	AllowedSubjects []string                 `yaml:"allowed_subjects"` // Common names or subject DNs (e.g. "CN=billing,O=Acme") allowed to connect.
+	AllowedSANs     []string                 `yaml:"allowed_sans"`     // DNS names (wildcards like *.example.com), emails, URIs or IPs allowed to connect.
+	CRLFile         string                   `yaml:"crl_file"`         // PEM or DER certificate revocation lists signed by the CAs. Re-read when it changes.
+	Headers         *ClientCertHeadersConfig `yaml:"headers"`          // Headers carrying the client identity to the backends.
+}
+
+// ClientCertHeadersConfig names the headers carrying the verified client certificate to the backends.
+// Empty names are not sent. Headers with these names sent by clients are always removed.
+type ClientCertHeadersConfig struct {
+	Subject     string `yaml:"subject"`     // Subject DN of the certificate.
+	SANs        string `yaml:"sans"`        // Comma separated subject alternative names.
+	Fingerprint string `yaml:"fingerprint"` // Hex encoded SHA-256 fingerprint of the certificate.
+	Serial      string `yaml:"serial"`      // Serial number of the certificate.
+	Cert        string `yaml:"cert"`        // URL encoded PEM of the certificate.
+	Verify      string `yaml:"verify"`      // "SUCCESS" for verified certificates, "NONE" without one.
+}
+
+// DefaultClientCertHeaders are sent if client_auth does not configure headers.
+var DefaultClientCertHeaders = ClientCertHeadersConfig{
+	Subject:     "X-Client-Cert-Subject",
+	SANs:        "X-Client-Cert-SAN",
+	Fingerprint: "X-Client-Cert-Fingerprint",
+	Verify:      "X-Client-Cert-Verify",
+}
+
+// Validate checks the client authentication settings.
+func (c *ClientAuthConfig) Validate() error {
+	if c.CAFile == "" {
+		return fmt.Errorf("client_auth: ca_file is required")
+	}
+	switch c.Mode {
+	case "", ClientAuthRequire, ClientAuthOptional:
+	default:
+		return fmt.Errorf("client_auth: invalid mode %q, must be require or optional", c.Mode)
+	}
+	return nil
 }
 
 // BackendConfig defines the configuration for a single backend service.
 // It includes the backend's URL, load balancing weight, connection limits,
 // TLS verification settings, and optional health check configurations.
 type BackendConfig struct {
-	URL            string             `yaml:"url"`                    // The URL of the backend service.
-	Weight         int                `yaml:"weight"`                 // The weight for load balancing purposes.
-	MaxConnections int32              `yaml:"max_connections"`        // Maximum number of concurrent connections to the backend.
-	SkipTLSVerify  bool               `yaml:"skip_tls_verify"`        // Whether to skip TLS certificate verification for the backend.
-	HealthCheck    *HealthCheckConfig `yaml:"health_check,omitempty"` // Optional health check configuration specific to the backend.
+	URL            string             `yaml:"url"`                      // The URL of the backend service.
+	Weight         int                `yaml:"weight"`                   // The weight for load balancing purposes.
+	MaxConnections int32              `yaml:"max_connections"`          // Maximum number of concurrent connections to the backend.
+	SkipTLSVerify  bool               `yaml:"skip_tls_verify"`          // Whether to skip TLS certificate verification for the backend.
+	HealthCheck    *HealthCheckConfig `yaml:"health_check,omitempty"`   // Optional health check configuration specific to the backend.
+	Drain          bool               `yaml:"drain"`                    // Stop pinning new sticky sessions to the backend.
+	Protocol       string             `yaml:"protocol,omitempty"`       // Protocol spoken by the backend: "http" (default) or "h2c".
+	ProxyProtocol  string             `yaml:"proxy_protocol,omitempty"` // Send a PROXY protocol header ("v1" or "v2") with the client address on upstream connections.
+	TLS            *BackendTLSConfig  `yaml:"tls,omitempty"`            // TLS settings of connections to https backends.
+}
+
+// BackendTLSConfig configures TLS connections to an https backend, e.g. to trust a private CA
+// or to authenticate with a client certificate (mutual TLS).
+type BackendTLSConfig struct {
+	CAFile     string `yaml:"ca_file"`     // PEM bundle of the CAs trusted for the backend certificate instead of the system roots.
+	CertFile   string `yaml:"cert_file"`   // Client certificate presented to the backend. Re-read when it changes.
+	KeyFile    string `yaml:"key_file"`    // Private key of the client certificate.
+	ServerName string `yaml:"server_name"` // Server name sent (SNI) and verified. Defaults to the host of the backend URL.
+	MinVersion string `yaml:"min_version"` // Minimum TLS version, "1.2" (default) or "1.3".
+}
+
+// Validate checks the backend TLS settings.
+func (t *BackendTLSConfig) Validate() error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("tls: cert_file and key_file must be set together")
+	}
+	if _, err := ParseTLSVersion(t.MinVersion); err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	return nil
+}
+
+// ParseTLSVersion parses a TLS version like "1.3". An empty version defaults to TLS 1.2.
+func ParseTLSVersion(v string) (uint16, error) {
+	switch v {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version %q, must be 1.2 or 1.3", v)
+	}
 }
 
 // Thresholds defines the thresholds for determining the health status of a backend.
@@ -141,20 +253,104 @@ type Thresholds struct {
 // HealthCheckConfig holds configuration settings for performing health checks on backends.
 // It defines the type of health check, intervals, timeouts, and success/failure thresholds.
 type HealthCheckConfig struct {
-	Type       string        `yaml:"type"`           // "http" or "tcp"
-	Path       string        `yaml:"path,omitempty"` // Applicable for HTTP health checks
-	Interval   time.Duration `yaml:"interval"`       // e.g., "10s"
-	Timeout    time.Duration `yaml:"timeout"`        // e.g., "2s"
-	Thresholds Thresholds    `yaml:"thresholds"`     // Healthy and Unhealthy thresholds
+	Type       string        `yaml:"type"`              // "http", "tcp" or "grpc"
+	Path       string        `yaml:"path,omitempty"`    // Applicable for HTTP health checks
+	Service    string        `yaml:"service,omitempty"` // Service name sent in gRPC health checks, empty checks the whole server
+	Interval   time.Duration `yaml:"interval"`          // e.g., "10s"
+	Timeout    time.Duration `yaml:"timeout"`           // e.g., "2s"
+	Thresholds Thresholds    `yaml:"thresholds"`        // Healthy and Unhealthy thresholds
 }
 
 // RateLimitConfig defines the configuration for rate limiting middleware.
 // It specifies the number of requests allowed per second and the burst size.
+// With a key, every client gets its own limit instead of sharing one limit for the whole service.
 type RateLimitConfig struct {
+	RequestsPerSecond float64          `yaml:"requests_per_second"` // Number of allowed requests per second.
+	Burst             int              `yaml:"burst"`               // Maximum number of burst requests allowed.
+	Algorithm         string           `yaml:"algorithm"`           // token-bucket (default) or sliding-window.
+	Window            time.Duration    `yaml:"window"`              // Window of the sliding-window algorithm. Default 1s.
+	Key               string           `yaml:"key"`                 // ip, header:<name>, path or jwt:<claim>. Empty shares one limit.
+	TrustedProxies    []string         `yaml:"trusted_proxies"`     // Proxies whose X-Forwarded-For header is trusted for the ip key. Default: client IP of forwarded_headers.
+	JWTSecret         string           `yaml:"jwt_secret"`          // HMAC secret verifying tokens of the jwt key. Required by the jwt key.
+	MaxKeys           int              `yaml:"max_keys"`            // Maximum number of tracked keys, least recently used are evicted. Default 10000.
+	KeyTTL            time.Duration    `yaml:"key_ttl"`             // Idle keys are forgotten after this duration. Default 10m.
+	Routes            []RateLimitRoute `yaml:"routes"`              // Limits overriding the defaults for specific paths.
+	Backend           string           `yaml:"backend"`             // local (default) keeps limits in process, redis shares them between instances.
+	Redis             *RedisConfig     `yaml:"redis"`               // Shared store of the redis backend.
+	FailureMode       string           `yaml:"failure_mode"`        // open (default) allows, closed rejects requests while the shared store is unreachable.
+}
+
+// RedisConfig configures the connection to a Redis compatible server.
+type RedisConfig struct {
+	Address   string        `yaml:"address"`    // host:port of the server.
+	Password  string        `yaml:"password"`   // Optional password.
+	DB        int           `yaml:"db"`         // Database number.
+	KeyPrefix string        `yaml:"key_prefix"` // Prefix of all keys. Default "terraster:ratelimit:".
+	Timeout   time.Duration `yaml:"timeout"`    // Timeout of a single operation. Default 100ms.
+	PoolSize  int           `yaml:"pool_size"`  // Maximum number of idle connections. Default 16.
+}
+
+// RateLimitRoute overrides the limits for requests whose path starts with Path.
+type RateLimitRoute struct {
+	Path              string  `yaml:"path"`                // Path prefix. The longest matching prefix wins.
 	RequestsPerSecond float64 `yaml:"requests_per_second"` // Number of allowed requests per second.
 	Burst             int     `yaml:"burst"`               // Maximum number of burst requests allowed.
 }
 
+// Validate checks the algorithm, key and trusted proxies of the rate limit configuration.
+func (c *RateLimitConfig) Validate() error {
+	switch c.Algorithm {
+	case "", "token-bucket", "sliding-window":
+	default:
+		return fmt.Errorf("invalid rate_limit algorithm %q, must be token-bucket or sliding-window", c.Algorithm)
+	}
+
+	source, name, _ := strings.Cut(c.Key, ":")
+	switch source {
+	case "", "ip", "path":
+	case "header", "jwt":
+		if name == "" {
+			return fmt.Errorf("rate_limit key %q requires a name, e.g. %s:name", c.Key, source)
+		}
+		// Unverified claims can be chosen freely by clients, who would get a fresh limit with every token
+		if source == "jwt" && c.JWTSecret == "" {
+			return fmt.Errorf("rate_limit key %q requires jwt_secret to verify tokens", c.Key)
+		}
+	default:
+		return fmt.Errorf("invalid rate_limit key %q, must be ip, header:<name>, path or jwt:<claim>", c.Key)
+	}
+
+	for _, proxy := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			return fmt.Errorf("invalid rate_limit trusted proxy %q", proxy)
+		}
+	}
+
+	for _, route := range c.Routes {
+		if route.Path == "" {
+			return fmt.Errorf("rate_limit route requires a path")
+		}
+	}
+
+	switch c.Backend {
+	case "", "local":
+	case "redis":
+		if c.Redis == nil || c.Redis.Address == "" {
+			return fmt.Errorf("rate_limit backend redis requires redis.address")
+		}
+	default:
+		return fmt.Errorf("invalid rate_limit backend %q, must be local or redis", c.Backend)
+	}
+
+	switch c.FailureMode {
+	case "", "open", "closed":
+	default:
+		return fmt.Errorf("invalid rate_limit failure_mode %q, must be open or closed", c.FailureMode)
+	}
+
+	return nil
+}
+
 // PoolConfig configures the connection pool used by the server.
 // It sets limits on idle and open connections and defines the idle timeout duration.
 type PoolConfig struct {
@@ -167,16 +363,137 @@ type PoolConfig struct {
 // It includes service identification, routing settings, TLS configurations,
 // redirection policies, health checks, middleware, and associated locations.
 type Service struct {
-	Name         string             `yaml:"name"`                   // Unique name of the service.
-	Host         string             `yaml:"host"`                   // Host address where the service is accessible.
-	Port         int                `yaml:"port"`                   // Port number on which the service listens.
-	TLS          *TLSConfig         `yaml:"tls"`                    // Optional TLS configuration for the service.
-	HTTPRedirect bool               `yaml:"http_redirect"`          // Indicates whether HTTP requests should be redirected to HTTPS.
-	RedirectPort int                `yaml:"redirect_port"`          // Custom port for redirection if applicable.
-	HealthCheck  *HealthCheckConfig `yaml:"health_check,omitempty"` // Optional Per-Service Health Check
-	Middleware   []Middleware       `yaml:"middleware"`             // Middleware configurations specific to the service.
-	Locations    []Location         `yaml:"locations"`              // Routing paths and backend configurations for the service.
-	LogName      string             `yaml:"log_name,omitempty"`     // Name of the logger to use for this service.
+	Name          string               `yaml:"name"`                     // Unique name of the service.
+	Host          string               `yaml:"host"`                     // Host address where the service is accessible.
+	Port          int                  `yaml:"port"`                     // Port number on which the service listens.
+	TLS           *TLSConfig           `yaml:"tls"`                      // Optional TLS configuration for the service.
+	HTTPRedirect  bool                 `yaml:"http_redirect"`            // Indicates whether HTTP requests should be redirected to HTTPS.
+	RedirectPort  int                  `yaml:"redirect_port"`            // Custom port for redirection if applicable.
+	HealthCheck   *HealthCheckConfig   `yaml:"health_check,omitempty"`   // Optional Per-Service Health Check
+	Middleware    []Middleware         `yaml:"middleware"`               // Middleware configurations specific to the service.
+	Locations     []Location           `yaml:"locations"`                // Routing paths and backend configurations for the service.
+	LogName       string               `yaml:"log_name,omitempty"`       // Name of the logger to use for this service.
+	H2C           bool                 `yaml:"h2c"`                      // Accept HTTP/2 over cleartext (h2c) from clients, e.g. for gRPC.
+	Protocol      string               `yaml:"protocol,omitempty"`       // "http" (default), "tcp" and "udp" for layer 4 load balancing, or "tls-passthrough".
+	Stream        *StreamConfig        `yaml:"stream,omitempty"`         // Options of tcp, udp and tls-passthrough services.
+	ProxyProtocol *ProxyProtocolConfig `yaml:"proxy_protocol,omitempty"` // Accept PROXY protocol headers from trusted load balancers in front of the listener.
+
+	ForwardedHeaders *ForwardedHeadersConfig `yaml:"forwarded_headers,omitempty"` // Handling of forwarding headers, overrides the global one.
+}
+
+// ForwardedHeadersConfig defines how X-Forwarded-*, X-Real-IP and Forwarded (RFC 7239) headers are handled.
+// Headers sent by trusted proxies determine the client IP and are passed on to the backends with this hop appended.
+// Headers sent by anyone else are replaced, so clients cannot spoof their address.
+type ForwardedHeadersConfig struct {
+	TrustedProxies []string `yaml:"trusted_proxies"` // Networks or IP addresses of proxies in front of Terraster.
+	Forwarded      bool     `yaml:"forwarded"`       // Also send the Forwarded header to the backends.
+}
+
+// Validate checks the trusted proxies.
+func (f *ForwardedHeadersConfig) Validate() error {
+	for _, proxy := range f.TrustedProxies {
+		if _, err := clientip.ParseNetwork(proxy); err != nil {
+			return fmt.Errorf("forwarded_headers: %w", err)
+		}
+	}
+	return nil
+}
+
+// ProxyProtocolConfig enables the PROXY protocol (v1 and v2) on the listener of a service.
+// Connections from trusted sources may start with a PROXY header, whose client address replaces the address of the connection.
+// Services sharing a port must use the same settings.
+type ProxyProtocolConfig struct {
+	TrustedCIDRs  []string      `yaml:"trusted_cidrs"`  // Networks or IP addresses allowed to send a PROXY header, e.g. the subnets of the load balancer.
+	HeaderTimeout time.Duration `yaml:"header_timeout"` // Time trusted sources have to send the header. Default 5s.
+}
+
+// Validate checks the PROXY protocol settings.
+func (p *ProxyProtocolConfig) Validate() error {
+	if len(p.TrustedCIDRs) == 0 {
+		return fmt.Errorf("proxy_protocol: trusted_cidrs is required")
+	}
+	for _, cidr := range p.TrustedCIDRs {
+		if _, err := clientip.ParseNetwork(cidr); err != nil {
+			return fmt.Errorf("proxy_protocol: %w", err)
+		}
+	}
+	if p.HeaderTimeout < 0 {
+		return fmt.Errorf("proxy_protocol: header_timeout must not be negative")
+	}
+	return nil
+}
+
+// StreamConfig holds the options of layer 4 (tcp, udp and tls-passthrough) services.
+// Their connections and datagrams are forwarded to the backends of the service's single location as they are.
+type StreamConfig struct {
+	ConnectTimeout time.Duration `yaml:"connect_timeout"` // Timeout for connecting to a tcp backend. Default 5s.
+	IdleTimeout    time.Duration `yaml:"idle_timeout"`    // Connections and udp sessions without traffic are closed after this time. Default 10m for tcp, 30s for udp.
+	MaxSessions    int           `yaml:"max_sessions"`    // Maximum number of concurrent udp sessions, datagrams of new clients are dropped above. Default 10000.
+	Responses      int           `yaml:"responses"`       // Datagrams expected from the backend per udp session, e.g. 1 for DNS. 0 keeps sessions until idle.
+}
+
+// Service protocols.
+const (
+	ProtocolHTTP           = "http"
+	ProtocolTCP            = "tcp"
+	ProtocolUDP            = "udp"
+	ProtocolTLSPassthrough = "tls-passthrough" // TLS connections routed by SNI to backends terminating TLS themselves.
+)
+
+// IsStream reports whether the service is load balanced at layer 4.
+func (s Service) IsStream() bool {
+	return s.Protocol == ProtocolTCP || s.Protocol == ProtocolUDP || s.Protocol == ProtocolTLSPassthrough
+}
+
+// UsesACME reports whether the certificate of the service is issued through ACME, i.e. it terminates TLS without a cert_file.
+func (s Service) UsesACME() bool {
+	return s.TLS != nil && s.TLS.Enabled && s.TLS.CertFile == "" && len(s.TLS.Certificates) == 0 && !s.IsStream()
+}
+
+// validateStream checks the options of layer 4 services which only support a subset of the HTTP features.
+func (s Service) validateStream() error {
+	switch s.Protocol {
+	case "", ProtocolHTTP:
+		return nil
+	case ProtocolTCP, ProtocolUDP, ProtocolTLSPassthrough:
+	default:
+		return fmt.Errorf("invalid protocol %q, must be http, tcp, udp or tls-passthrough", s.Protocol)
+	}
+
+	if s.Port <= 0 {
+		return fmt.Errorf("port is required for %s services", s.Protocol)
+	}
+	if s.TLS != nil && s.TLS.Enabled {
+		return fmt.Errorf("tls is not supported for %s services", s.Protocol)
+	}
+	// Connections are routed by the server name the client sends in its ClientHello (SNI)
+	if s.Protocol == ProtocolTLSPassthrough && s.Host == "" {
+		return fmt.Errorf("host is required for %s services", s.Protocol)
+	}
+	if len(s.Locations) != 1 {
+		return fmt.Errorf("%s services must have exactly one location", s.Protocol)
+	}
+
+	loc := s.Locations[0]
+	if len(loc.Groups) > 0 || loc.Mirror != nil || loc.Retry != nil || loc.Sticky != nil || loc.Match != nil {
+		return fmt.Errorf("groups, mirror, retry, sticky and match are not supported for %s services", s.Protocol)
+	}
+
+	// Backends are dialed by address, e.g. tcp://10.0.0.1:5432
+	for _, backend := range loc.Backends {
+		u, err := url.Parse(backend.URL)
+		if err != nil || u.Hostname() == "" || u.Port() == "" {
+			return fmt.Errorf("backend %s must be an URL with host and port, e.g. %s://10.0.0.1:5432", backend.URL, s.Protocol)
+		}
+	}
+
+	if s.Stream != nil {
+		if s.Stream.ConnectTimeout < 0 || s.Stream.IdleTimeout < 0 || s.Stream.MaxSessions < 0 || s.Stream.Responses < 0 {
+			return fmt.Errorf("stream options must not be negative")
+		}
+	}
+
+	return nil
 }
 
 // Middleware defines the configuration for various middleware components.
@@ -192,18 +509,142 @@ type Middleware struct {
 // Location defines the routing and backend configurations for a specific path within a service.
 // It includes path matching, URL rewriting, redirection targets, load balancing policies, and associated backends.
 type Location struct {
-	Path         string          `yaml:"path"`      // URL path that this location handles.
-	Rewrite      string          `yaml:"rewrite"`   // URL rewrite rule applied to incoming requests.
-	Redirect     string          `yaml:"redirect"`  // URL to redirect to, if applicable.
-	LoadBalancer string          `yaml:"lb_policy"` // Load balancing policy (e.g., "round-robin").
-	Backends     []BackendConfig `yaml:"backends"`  // List of backend configurations for this location.
+	Path             string                  `yaml:"path"`              // URL path that this location handles.
+	PathType         string                  `yaml:"path_type"`         // How the path is matched: prefix (default), exact or regex.
+	Match            *MatchConfig            `yaml:"match"`             // Optional additional conditions a request has to meet.
+	Priority         int                     `yaml:"priority"`          // Locations with a higher priority are matched first.
+	Rewrite          string                  `yaml:"rewrite"`           // URL rewrite rule applied to incoming requests.
+	Redirect         string                  `yaml:"redirect"`          // URL to redirect to, if applicable.
+	LoadBalancer     string                  `yaml:"lb_policy"`         // Load balancing policy (e.g., "round-robin").
+	Hash             *HashConfig             `yaml:"hash"`              // Options of the consistent-hash policy.
+	Backends         []BackendConfig         `yaml:"backends"`          // List of backend configurations for this location.
+	Groups           []BackendGroupConfig    `yaml:"groups"`            // Named backend groups the traffic is split across. Replaces backends.
+	Split            *SplitConfig            `yaml:"split"`             // Options of the traffic split between groups.
+	Retry            *RetryConfig            `yaml:"retry"`             // Optional retry policy for failed requests.
+	OutlierDetection *OutlierDetectionConfig `yaml:"outlier_detection"` // Optional passive health checking based on live traffic.
+	Sticky           *StickyConfig           `yaml:"sticky"`            // Optional cookie based session affinity.
+	Mirror           *MirrorConfig           `yaml:"mirror"`            // Optional shadow traffic to a secondary set of backends.
+	CircuitBreaker   *CircuitBreaker         `yaml:"circuit_breaker"`   // Optional per backend circuit breaking. Defaults to the circuit_breaker middleware.
 }
 
-// CircuitBreaker defines the configuration for a circuit breaker middleware.
-// It sets thresholds for failures and the timeout before attempting to reset the circuit.
+// AllBackends returns the backends of the location, including those of its backend groups and its mirror.
+func (l Location) AllBackends() []BackendConfig {
+	backends := append([]BackendConfig(nil), l.Backends...)
+	for _, group := range l.Groups {
+		backends = append(backends, group.Backends...)
+	}
+	if l.Mirror != nil {
+		backends = append(backends, l.Mirror.Backends...)
+	}
+	return backends
+}
+
+// MirrorConfig duplicates a share of a location's requests to a secondary set of backends.
+// Mirrored requests are sent in the background and their responses are discarded.
+type MirrorConfig struct {
+	Percentage    *float64        `yaml:"percentage"`     // Share of requests to mirror, 0-100. Default 100, 0 pauses mirroring.
+	LoadBalancer  string          `yaml:"lb_policy"`      // Load balancing policy of the mirror backends. Defaults to the location's.
+	Backends      []BackendConfig `yaml:"backends"`       // Backends receiving the mirrored requests.
+	MaxBodySize   int64           `yaml:"max_body_size"`  // Requests with larger bodies are not mirrored. Default 64 KiB.
+	Timeout       time.Duration   `yaml:"timeout"`        // Timeout of a mirrored request. Default 10s.
+	MaxConcurrent int             `yaml:"max_concurrent"` // Maximum mirrored requests in flight, further requests are not mirrored. Default 100.
+}
+
+// BackendGroupConfig defines a named set of backends with its own pool and load balancing policy,
+// e.g. a versioned release. Traffic is split across the groups of a location by weight.
+type BackendGroupConfig struct {
+	Name         string          `yaml:"name"`      // Name of the group, used by the Admin API.
+	Weight       int             `yaml:"weight"`    // Share of the location's traffic relative to the other groups.
+	LoadBalancer string          `yaml:"lb_policy"` // Load balancing policy within the group. Defaults to the location's.
+	Hash         *HashConfig     `yaml:"hash"`      // Options of the consistent-hash policy. Defaults to the location's.
+	Backends     []BackendConfig `yaml:"backends"`  // Backends of the group.
+}
+
+// SplitConfig configures how requests are assigned to backend groups.
+type SplitConfig struct {
+	StickyKey string `yaml:"sticky_key"` // Assign clients by hashing ip, header:<name>, cookie:<name> or query:<name> instead of at random.
+}
+
+// MatchConfig defines request conditions a location requires in addition to its path.
+// All configured conditions have to match.
+type MatchConfig struct {
+	Methods     []string           `yaml:"methods"`      // Allowed HTTP methods.
+	Headers     []ValueMatchConfig `yaml:"headers"`      // Header conditions.
+	Query       []ValueMatchConfig `yaml:"query"`        // Query parameter conditions.
+	Cookies     []ValueMatchConfig `yaml:"cookies"`      // Cookie conditions.
+	SourceCIDRs []string           `yaml:"source_cidrs"` // Client networks, e.g. 10.0.0.0/8.
+	ClientCert  *ClientCertMatch   `yaml:"client_cert"`  // Verified client certificate (mutual TLS).
+}
+
+// ClientCertMatch requires a client certificate verified by the client_auth of the service.
+// Without subjects and SANs, any verified certificate matches. Otherwise one of them has to match.
+type ClientCertMatch struct {
+	Subjects []string `yaml:"subjects"` // Common names or subject DNs.
+	SANs     []string `yaml:"sans"`     // DNS names (wildcards like *.example.com), emails, URIs or IPs.
+}
+
+// ValueMatchConfig matches a named header, query parameter or cookie.
+// Without Value and Regex, the name only has to be present.
+type ValueMatchConfig struct {
+	Name  string `yaml:"name"`  // Header, query parameter or cookie name.
+	Value string `yaml:"value"` // Exact value.
+	Regex string `yaml:"regex"` // Regular expression the value has to match.
+}
+
+// StickyConfig pins clients to the backend that served their first request with a cookie issued by the load balancer.
+// The pin is ignored while the backend is down or at max connections, and the configured lb_policy is used instead.
+type StickyConfig struct {
+	CookieName string        `yaml:"cookie_name"` // Name of the cookie. Default terraster_sticky.
+	TTL        time.Duration `yaml:"ttl"`         // Lifetime of the cookie. Zero issues a session cookie.
+	Path       string        `yaml:"path"`        // Cookie path. Default /.
+	SameSite   string        `yaml:"same_site"`   // lax (default), strict or none.
+	Secure     bool          `yaml:"secure"`      // Only send the cookie over HTTPS.
+	Secret     string        `yaml:"secret"`      // Optional HMAC secret used to sign the cookie.
+}
+
+// OutlierDetectionConfig defines when backends are ejected from a location based on live traffic.
+// A backend is ejected after too many consecutive failures or when its error rate within the window is too high.
+// Failures are 5xx responses and transport errors (connection refused, reset, timeout).
+type OutlierDetectionConfig struct {
+	ConsecutiveErrors  int           `yaml:"consecutive_errors"`   // Consecutive failures before ejection. Default 5.
+	ErrorRate          float64       `yaml:"error_rate"`           // Error rate (0-1) within the window before ejection. 0 disables.
+	MinRequests        int           `yaml:"min_requests"`         // Minimum requests in the window to evaluate the error rate.
+	Window             time.Duration `yaml:"window"`               // Window the error rate is computed over. Default 30s.
+	BaseEjectionTime   time.Duration `yaml:"base_ejection_time"`   // Ejection time, doubled on every subsequent ejection. Default 30s.
+	MaxEjectionTime    time.Duration `yaml:"max_ejection_time"`    // Upper bound of the ejection time. Default 5m.
+	MaxEjectionPercent int           `yaml:"max_ejection_percent"` // Maximum percentage of backends ejected at once. Default 50.
+}
+
+// HashConfig configures the consistent-hash load balancing policy.
+type HashConfig struct {
+	Key          string  `yaml:"key"`           // ip (default), path, header:<name>, cookie:<name> or query:<name>.
+	VirtualNodes int     `yaml:"virtual_nodes"` // Virtual nodes per unit of backend weight. Default 160.
+	LoadFactor   float64 `yaml:"load_factor"`   // Bounded load factor, e.g. 1.25. Values <= 1 disable bounded load.
+}
+
+// RetryConfig defines how failed requests are retried on other backends of a location.
+// Only idempotent requests are retried unless RetryNonIdempotent is set.
+type RetryConfig struct {
+	Attempts           int           `yaml:"attempts"`             // Total number of attempts, including the first one.
+	RetryOn            []string      `yaml:"retry_on"`             // Conditions to retry on: connect-failure, timeout, reset, gateway-error, 5xx.
+	StatusCodes        []int         `yaml:"status_codes"`         // Additional response status codes to retry on.
+	PerTryTimeout      time.Duration `yaml:"per_try_timeout"`      // Maximum time to wait for the response headers of a single attempt.
+	Backoff            time.Duration `yaml:"backoff"`              // Base delay between attempts, doubled on every retry.
+	MaxBackoff         time.Duration `yaml:"max_backoff"`          // Upper bound of the delay between attempts.
+	RetryNonIdempotent bool          `yaml:"retry_non_idempotent"` // Retry non-idempotent methods (e.g. POST) as well.
+	MaxBodySize        int64         `yaml:"max_body_size"`        // Maximum request body size in bytes buffered for replay.
+}
+
+// CircuitBreaker defines the configuration of the circuit breakers of a location's backends.
+// Each backend has its own circuit, so a failing backend does not take the healthy ones out of rotation.
+// Configured as middleware, it applies to all locations of the service (or all services) without their own circuit_breaker.
 type CircuitBreaker struct {
-	FailureThreshold int           `yaml:"failure_threshold"` // Number of consecutive failures to trigger the circuit breaker.
-	ResetTimeout     time.Duration `yaml:"reset_timeout"`     // Duration to wait before attempting to reset the circuit after it has been tripped.
+	FailureThreshold int           `yaml:"failure_threshold"`  // Number of consecutive failures to trigger the circuit breaker. Default 5.
+	ResetTimeout     time.Duration `yaml:"reset_timeout"`      // Duration to wait before attempting to reset the circuit after it has been tripped. Default 30s.
+	ErrorRate        float64       `yaml:"error_rate"`         // Error rate (0-1) within the window that trips the circuit. 0 disables.
+	MinRequests      int           `yaml:"min_requests"`       // Minimum requests in the window to evaluate the error rate. Default 20.
+	Window           time.Duration `yaml:"window"`             // Window the error rate is computed over. Default 30s.
+	HalfOpenRequests int           `yaml:"half_open_requests"` // Probe requests let through while half-open, all have to succeed to close. Default 1.
 }
 
 // SecurityConfig holds configuration settings for security-related HTTP headers.
@@ -231,20 +672,125 @@ type CORS struct {
 
 // CertManagerConfig holds configuration settings for the certificate manager.
 type CertManagerConfig struct {
-	CertDir          string         `json:"cert_dir"`
-	Alerting         AlertingConfig `json:"alerting"`
-	CheckInterval    time.Duration  `yaml:"check_interval"`
-	ExpirationThresh time.Duration  `yaml:"expiration_threshold"`
+	CertDir          string         `yaml:"cert_dir"`             // Directory where certificates issued through ACME are stored.
+	Alerting         AlertingConfig `yaml:"alerting"`             // Alerts about expiring, invalid and revoked certificates.
+	CheckInterval    time.Duration  `yaml:"check_interval"`       // How often certificates are checked for expiration.
+	ExpirationThresh time.Duration  `yaml:"expiration_threshold"` // Certificates expiring within this duration raise alerts.
+	ACME             *ACMEConfig    `yaml:"acme,omitempty"`       // Issue certificates of services without cert_file through ACME.
+
+	DefaultCertificate *CertificateConfig `yaml:"default_certificate,omitempty"` // Served to clients whose server name matches no certificate.
+	ReloadInterval     time.Duration      `yaml:"reload_interval"`               // How often certificate files are checked for changes.
+	OCSP               *OCSPConfig        `yaml:"ocsp,omitempty"`                // OCSP stapling, enabled by default.
+}
+
+// OCSPConfig holds settings for stapling OCSP responses of certificates to handshakes.
+type OCSPConfig struct {
+	Disabled        bool          `yaml:"disabled"`         // Disables stapling and revocation monitoring.
+	RefreshInterval time.Duration `yaml:"refresh_interval"` // How often responses are checked for refresh, 1 hour by default.
+	AlertAfter      time.Duration `yaml:"alert_after"`      // Alert once a responder is unreachable for this long, 24 hours by default.
+}
+
+// Validate checks the OCSP configuration.
+func (o *OCSPConfig) Validate() error {
+	if o.RefreshInterval < 0 || o.AlertAfter < 0 {
+		return fmt.Errorf("cert_manager: ocsp refresh_interval and alert_after must not be negative")
+	}
+	return nil
+}
+
+// Default ACME settings.
+const (
+	DefaultACMEDirectoryURL = "https://acme-v02.api.letsencrypt.org/directory" // Let's Encrypt production.
+	DefaultACMERenewBefore  = 30 * 24 * time.Hour
+)
+
+// ACMEConfig holds settings for issuing certificates through ACME (e.g. Let's Encrypt).
+// Certificates are requested for HTTPS services which enable TLS without a cert_file,
+// and their hosts have to resolve to Terraster for the HTTP-01 or TLS-ALPN-01 challenges.
+type ACMEConfig struct {
+	Enabled      bool          `yaml:"enabled"`       // Enables certificate issuance.
+	Email        string        `yaml:"email"`         // Contact address of the ACME account, used for expiry notices (optional).
+	DirectoryURL string        `yaml:"directory_url"` // Directory of the ACME server, Let's Encrypt production by default.
+	CAFile       string        `yaml:"ca_file"`       // CAs trusted for the ACME server itself, e.g. of a local test server (optional).
+	RenewBefore  time.Duration `yaml:"renew_before"`  // Certificates are renewed this long before they expire, 30 days by default.
 }
 
-// AlertingConfig holds SMTP settings for alerting.
+// Validate checks the ACME configuration. Issued certificates are stored in the cert_dir of the certificate manager.
+func (a *ACMEConfig) Validate(certDir string) error {
+	if !a.Enabled {
+		return nil
+	}
+	if certDir == "" {
+		return fmt.Errorf("cert_manager: acme requires cert_dir to store certificates")
+	}
+	if a.DirectoryURL != "" {
+		u, err := url.Parse(a.DirectoryURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("cert_manager: acme directory_url must be an https URL")
+		}
+	}
+	if a.RenewBefore < 0 {
+		return fmt.Errorf("cert_manager: acme renew_before must not be negative")
+	}
+	return nil
+}
+
+// Formats of webhook alert payloads.
+const (
+	WebhookFormatJSON  = "json"  // Generic JSON object with all fields of the alert.
+	WebhookFormatSlack = "slack" // {"text": ...} accepted by Slack and Teams incoming webhooks.
+)
+
+// DefaultWebhookTimeout limits each webhook request, unless configured otherwise.
+const DefaultWebhookTimeout = 10 * time.Second
+
+// AlertingConfig holds settings for alerts about certificates.
+// Alerts are sent by email if smtp_host is set, to every webhook and to the log if enabled.
 type AlertingConfig struct {
-	Enabled   bool     `json:"enabled"`
-	SMTPHost  string   `json:"smtp_host"`
-	SMTPPort  int      `json:"smtp_port"`
-	FromEmail string   `json:"from_email"`
-	FromPass  string   `json:"from_password"`
-	ToEmails  []string `json:"to_emails"`
+	Enabled   bool     `yaml:"enabled"`
+	SMTPHost  string   `yaml:"smtp_host"`
+	SMTPPort  int      `yaml:"smtp_port"`
+	FromEmail string   `yaml:"from_email"`
+	FromPass  string   `yaml:"from_password"`
+	ToEmails  []string `yaml:"to_emails"`
+
+	Webhooks   []WebhookAlertConfig `yaml:"webhooks,omitempty"`   // HTTP receivers of alerts, e.g. Slack, Teams or PagerDuty.
+	Log        bool                 `yaml:"log"`                  // Logs alerts as warnings.
+	Thresholds []time.Duration      `yaml:"thresholds,omitempty"` // Expiry alerts are sent once per threshold crossed, expiration_threshold by default.
+}
+
+// WebhookAlertConfig holds settings for posting alerts to an HTTP endpoint.
+type WebhookAlertConfig struct {
+	URL      string            `yaml:"url"`
+	Headers  map[string]string `yaml:"headers,omitempty"`  // Sent with every request, e.g. Authorization.
+	Format   string            `yaml:"format"`             // json (default) or slack. Ignored if template is set.
+	Template string            `yaml:"template,omitempty"` // Go template rendering the JSON payload.
+	Timeout  time.Duration     `yaml:"timeout"`            // Limits each request, 10 seconds by default.
+}
+
+// Validate checks the alerting configuration.
+func (a *AlertingConfig) Validate() error {
+	for _, threshold := range a.Thresholds {
+		if threshold <= 0 {
+			return fmt.Errorf("cert_manager: alerting thresholds must be positive")
+		}
+	}
+
+	for _, wh := range a.Webhooks {
+		u, err := url.Parse(wh.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("cert_manager: alerting webhook url %q must be an http or https URL", wh.URL)
+		}
+		switch wh.Format {
+		case "", WebhookFormatJSON, WebhookFormatSlack:
+		default:
+			return fmt.Errorf("cert_manager: unknown alerting webhook format %q", wh.Format)
+		}
+		if wh.Timeout < 0 {
+			return fmt.Errorf("cert_manager: alerting webhook timeout must not be negative")
+		}
+	}
+	return nil
 }
 
 // DefaultHealthCheck provides a default configuration for health checks.
@@ -283,7 +829,7 @@ func (cfg *Config) Validate(logger *zap.Logger) error {
 		cfg.HealthCheck = DefaultHealthCheck.Copy()
 	} else {
 		// Validate global health check
-		if cfg.HealthCheck.Type != "http" && cfg.HealthCheck.Type != "tcp" {
+		if !ValidHealthCheckType(cfg.HealthCheck.Type) {
 			return fmt.Errorf("invalid global health_check type: %s", cfg.HealthCheck.Type)
 		}
 		if cfg.HealthCheck.Interval <= 0 {
@@ -297,9 +843,157 @@ func (cfg *Config) Validate(logger *zap.Logger) error {
 		}
 	}
 
+	for _, mw := range cfg.Middleware {
+		if mw.RateLimit != nil {
+			if err := mw.RateLimit.Validate(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if cfg.TLS.ClientAuth != nil {
+		if err := cfg.TLS.ClientAuth.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if cfg.ForwardedHeaders != nil {
+		if err := cfg.ForwardedHeaders.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if cfg.CertManager.DefaultCertificate != nil {
+		if err := cfg.CertManager.DefaultCertificate.Validate(); err != nil {
+			return fmt.Errorf("cert_manager default_certificate: %w", err)
+		}
+	}
+	if cfg.CertManager.ReloadInterval < 0 {
+		return fmt.Errorf("cert_manager reload_interval must not be negative")
+	}
+	if err := cfg.CertManager.Alerting.Validate(); err != nil {
+		return err
+	}
+	if cfg.CertManager.OCSP != nil {
+		if err := cfg.CertManager.OCSP.Validate(); err != nil {
+			return err
+		}
+	}
+
+	acme := cfg.CertManager.ACME != nil && cfg.CertManager.ACME.Enabled
+	if cfg.CertManager.ACME != nil {
+		if err := cfg.CertManager.ACME.Validate(cfg.CertManager.CertDir); err != nil {
+			return err
+		}
+	}
+
+	for _, svc := range cfg.Services {
+		for _, mw := range svc.Middleware {
+			if mw.RateLimit != nil {
+				if err := mw.RateLimit.Validate(); err != nil {
+					return fmt.Errorf("service %s: %w", svc.Name, err)
+				}
+			}
+		}
+
+		if err := svc.validateStream(); err != nil {
+			return fmt.Errorf("service %s: %w", svc.Name, err)
+		}
+
+		if svc.ProxyProtocol != nil {
+			if svc.Protocol == ProtocolUDP {
+				return fmt.Errorf("service %s: proxy_protocol is not supported for udp services", svc.Name)
+			}
+			if err := svc.ProxyProtocol.Validate(); err != nil {
+				return fmt.Errorf("service %s: %w", svc.Name, err)
+			}
+		}
+
+		if svc.TLS != nil {
+			for _, cert := range svc.TLS.Certificates {
+				if err := cert.Validate(); err != nil {
+					return fmt.Errorf("service %s: tls: %w", svc.Name, err)
+				}
+			}
+		}
+
+		if svc.UsesACME() {
+			if !acme {
+				return fmt.Errorf("service %s: tls requires cert_file and key_file unless cert_manager acme is enabled", svc.Name)
+			}
+			if strings.Contains(svc.Host, "*") {
+				return fmt.Errorf("service %s: certificates for wildcard hosts cannot be issued through acme, set cert_file", svc.Name)
+			}
+		}
+
+		if svc.TLS != nil && svc.TLS.ClientAuth != nil {
+			if !svc.TLS.Enabled || svc.Protocol == ProtocolTLSPassthrough {
+				return fmt.Errorf("service %s: client_auth requires TLS termination", svc.Name)
+			}
+			if err := svc.TLS.ClientAuth.Validate(); err != nil {
+				return fmt.Errorf("service %s: %w", svc.Name, err)
+			}
+		}
+
+		if svc.ForwardedHeaders != nil {
+			if err := svc.ForwardedHeaders.Validate(); err != nil {
+				return fmt.Errorf("service %s: %w", svc.Name, err)
+			}
+		}
+
+		if svc.HealthCheck != nil && svc.HealthCheck.Type != "" && !ValidHealthCheckType(svc.HealthCheck.Type) {
+			return fmt.Errorf("service %s: invalid health_check type: %s", svc.Name, svc.HealthCheck.Type)
+		}
+
+		for _, loc := range svc.Locations {
+			for _, backend := range loc.AllBackends() {
+				switch backend.Protocol {
+				case "", "http", "h2c":
+				default:
+					return fmt.Errorf("service %s, location %s: invalid protocol %q for backend %s, must be http or h2c",
+						svc.Name, loc.Path, backend.Protocol, backend.URL)
+				}
+				if backend.ProxyProtocol != "" {
+					if !proxyproto.ValidVersion(backend.ProxyProtocol) {
+						return fmt.Errorf("service %s, location %s: invalid proxy_protocol %q for backend %s, must be v1 or v2",
+							svc.Name, loc.Path, backend.ProxyProtocol, backend.URL)
+					}
+					// Connections to udp backends are not announced, and h2c connections are shared by many clients
+					if svc.Protocol == ProtocolUDP || backend.Protocol == "h2c" {
+						return fmt.Errorf("service %s, location %s: proxy_protocol is not supported for udp and h2c backend %s",
+							svc.Name, loc.Path, backend.URL)
+					}
+				}
+				if backend.TLS != nil {
+					if err := backend.TLS.Validate(); err != nil {
+						return fmt.Errorf("service %s, location %s, backend %s: %w", svc.Name, loc.Path, backend.URL, err)
+					}
+					if svc.IsStream() || !strings.HasPrefix(backend.URL, "https://") {
+						return fmt.Errorf("service %s, location %s: tls requires an https url for backend %s",
+							svc.Name, loc.Path, backend.URL)
+					}
+				}
+				if backend.HealthCheck != nil && backend.HealthCheck.Type != "" && !ValidHealthCheckType(backend.HealthCheck.Type) {
+					return fmt.Errorf("service %s, location %s: invalid health_check type %s for backend %s",
+						svc.Name, loc.Path, backend.HealthCheck.Type, backend.URL)
+				}
+			}
+		}
+	}
+
 	return nil
 }
 
+// ValidHealthCheckType reports whether the health check type is supported.
+func ValidHealthCheckType(t string) bool {
+	switch t {
+	case "http", "tcp", "grpc":
+		return true
+	default:
+		return false
+	}
+}
+
 func (hc *HealthCheckConfig) Copy() *HealthCheckConfig {
 	if hc == nil {
 		return nil
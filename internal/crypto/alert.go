@@ -0,0 +1,313 @@
+package certmanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+	"github.com/wneessen/go-mail"
+	"go.uber.org/zap"
+)
+
+// Kinds of certificate alerts.
+const (
+	AlertExpiring        = "expiring"         // The certificate crossed one of the expiry thresholds.
+	AlertInvalid         = "invalid"          // The certificate failed to load, is expired or not valid yet.
+	AlertRevoked         = "revoked"          // The OCSP responder reported the certificate as revoked.
+	AlertOCSPUnreachable = "ocsp_unreachable" // The OCSP responder did not answer for longer than allowed.
+)
+
+// Alert describes a problem with a certificate.
+type Alert struct {
+	Kind    string    // One of the alert kinds, e.g. AlertExpiring.
+	Domain  string    // Name of the certificate.
+	Expiry  time.Time // Expiry time of the certificate, zero if it could not be loaded.
+	Message string    // Details, e.g. the error of the OCSP responder (optional).
+}
+
+// Alerter defines the interface for certificate alerting
+type Alerter interface {
+	Alert(alert Alert) error
+}
+
+// newAlerter creates the alerter sending alerts to all configured channels.
+func newAlerter(cfg AlertingConfig, logger *zap.Logger) (Alerter, error) {
+	if !cfg.Enabled {
+		return &NoopAlerter{}, nil
+	}
+
+	var alerters []Alerter
+	if cfg.SMTPHost != "" {
+		emailAlerter, err := NewEmailAlerter(cfg, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create email alerter: %w", err)
+		}
+		alerters = append(alerters, emailAlerter)
+	}
+	for _, wh := range cfg.Webhooks {
+		webhookAlerter, err := NewWebhookAlerter(wh)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create webhook alerter: %w", err)
+		}
+		alerters = append(alerters, webhookAlerter)
+	}
+	if cfg.Log {
+		alerters = append(alerters, NewLogAlerter(logger))
+	}
+
+	switch len(alerters) {
+	case 0:
+		logger.Warn("Alerting is enabled but no alert channel is configured")
+		return &NoopAlerter{}, nil
+	case 1:
+		return alerters[0], nil
+	}
+	return NewMultiAlerter(logger, alerters...), nil
+}
+
+type EmailAlerter struct {
+	client    *mail.Client
+	fromEmail string
+	toEmails  []string
+	logger    *zap.Logger
+}
+
+func NewEmailAlerter(cfg AlertingConfig, logger *zap.Logger) (*EmailAlerter, error) {
+	client, err := mail.NewClient(cfg.SMTPHost,
+		mail.WithPort(cfg.SMTPPort),
+		mail.WithSMTPAuth(mail.SMTPAuthPlain),
+		mail.WithUsername(cfg.FromEmail),
+		mail.WithPassword(cfg.FromPass),
+		mail.WithTLSPolicy(mail.TLSMandatory),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mail client: %w", err)
+	}
+
+	return &EmailAlerter{
+		client:    client,
+		fromEmail: cfg.FromEmail,
+		toEmails:  cfg.ToEmails,
+		logger:    logger,
+	}, nil
+}
+
+func (e *EmailAlerter) Alert(alert Alert) error {
+	msg := mail.NewMsg()
+	if err := msg.From(e.fromEmail); err != nil {
+		return fmt.Errorf("failed to set From address: %w", err)
+	}
+
+	if err := msg.To(e.toEmails...); err != nil {
+		return fmt.Errorf("failed to set To address: %w", err)
+	}
+
+	subject, body := alertText(alert)
+	msg.Subject(subject)
+	msg.SetBodyString(mail.TypeTextPlain, body)
+
+	if err := e.client.DialAndSend(msg); err != nil {
+		return fmt.Errorf("failed to send alert email: %w", err)
+	}
+
+	return nil
+}
+
+// Built-in payloads of webhook alerts.
+var webhookTemplates = map[string]string{
+	config.WebhookFormatJSON: `{"kind":{{json .Kind}},"domain":{{json .Domain}},"expiry":{{json .Expiry}},` +
+		`"days_left":{{.DaysLeft}},"subject":{{json .Subject}},"text":{{json .Text}},"message":{{json .Message}}}`,
+	config.WebhookFormatSlack: `{"text":{{json (printf "*%s*\n%s" .Subject .Text)}}}`,
+}
+
+// webhookData is the data webhook templates are executed with.
+type webhookData struct {
+	Alert
+	DaysLeft int    // Whole days until the certificate expires, negative once expired.
+	Subject  string // Subject of the notification, e.g. "Certificate Revoked - example.com".
+	Text     string // Body of the notification, including the message.
+}
+
+// WebhookAlerter posts alerts as JSON to an HTTP endpoint, e.g. an incoming webhook of Slack or Teams
+// or the events API of PagerDuty. The payload is rendered by a Go template, see webhookData for its fields.
+type WebhookAlerter struct {
+	url      string
+	headers  map[string]string
+	template *template.Template
+	client   *http.Client
+}
+
+func NewWebhookAlerter(cfg config.WebhookAlertConfig) (*WebhookAlerter, error) {
+	text := cfg.Template
+	if text == "" {
+		format := cfg.Format
+		if format == "" {
+			format = config.WebhookFormatJSON
+		}
+		text = webhookTemplates[format]
+	}
+
+	tmpl, err := template.New("webhook").Funcs(template.FuncMap{"json": jsonValue}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template of webhook %s: %w", cfg.URL, err)
+	}
+
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = config.DefaultWebhookTimeout
+	}
+
+	return &WebhookAlerter{
+		url:      cfg.URL,
+		headers:  cfg.Headers,
+		template: tmpl,
+		client:   &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// jsonValue encodes a template value as JSON, e.g. to quote and escape strings.
+func jsonValue(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+func (w *WebhookAlerter) Alert(alert Alert) error {
+	subject, text := alertText(alert)
+	data := webhookData{Alert: alert, Subject: subject, Text: text}
+	if !alert.Expiry.IsZero() {
+		data.DaysLeft = int(time.Until(alert.Expiry).Hours() / 24)
+	}
+
+	var payload bytes.Buffer
+	if err := w.template.Execute(&payload, data); err != nil {
+		return fmt.Errorf("failed to render webhook payload: %w", err)
+	}
+	if !json.Valid(payload.Bytes()) {
+		return fmt.Errorf("template of webhook %s did not render valid JSON", w.url)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.url, &payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range w.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send webhook alert: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s returned status %d", w.url, resp.StatusCode)
+	}
+	return nil
+}
+
+// LogAlerter writes alerts to the log, e.g. for log based alerting or when no other channel is available.
+type LogAlerter struct {
+	logger *zap.Logger
+}
+
+func NewLogAlerter(logger *zap.Logger) *LogAlerter {
+	return &LogAlerter{logger: logger}
+}
+
+func (l *LogAlerter) Alert(alert Alert) error {
+	subject, _ := alertText(alert)
+	fields := []zap.Field{
+		zap.String("kind", alert.Kind),
+		zap.String("domain", alert.Domain),
+		zap.String("subject", subject),
+	}
+	if !alert.Expiry.IsZero() {
+		fields = append(fields, zap.Time("expires_at", alert.Expiry))
+	}
+	if alert.Message != "" {
+		fields = append(fields, zap.String("message", alert.Message))
+	}
+	l.logger.Warn("Certificate alert", fields...)
+	return nil
+}
+
+// MultiAlerter sends alerts to several channels. A failing channel is logged and does not keep the alert
+// from the others, an error is only returned if no channel received the alert.
+type MultiAlerter struct {
+	alerters []Alerter
+	logger   *zap.Logger
+}
+
+func NewMultiAlerter(logger *zap.Logger, alerters ...Alerter) *MultiAlerter {
+	return &MultiAlerter{alerters: alerters, logger: logger}
+}
+
+func (m *MultiAlerter) Alert(alert Alert) error {
+	var errs []error
+	for _, alerter := range m.alerters {
+		if err := alerter.Alert(alert); err != nil {
+			m.logger.Error("Failed to send alert to channel",
+				zap.String("domain", alert.Domain),
+				zap.String("kind", alert.Kind),
+				zap.Error(err))
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == len(m.alerters) {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// NoopAlerter implements Alerter but does nothing
+type NoopAlerter struct{}
+
+func (n *NoopAlerter) Alert(alert Alert) error {
+	return nil
+}
+
+// alertText returns the subject and the body of a notification about the alert.
+func alertText(alert Alert) (string, string) {
+	var subject, body string
+	switch alert.Kind {
+	case AlertInvalid:
+		subject = fmt.Sprintf("Invalid Certificate - %s", alert.Domain)
+		body = fmt.Sprintf(
+			"The TLS certificate for %s failed validation.\n\nPlease replace the certificate, clients will reject it.",
+			alert.Domain,
+		)
+	case AlertRevoked:
+		subject = fmt.Sprintf("Certificate Revoked - %s", alert.Domain)
+		body = fmt.Sprintf(
+			"The TLS certificate for %s was reported as revoked by its OCSP responder.\n\nPlease replace the certificate, clients may reject it.",
+			alert.Domain,
+		)
+	case AlertOCSPUnreachable:
+		subject = fmt.Sprintf("OCSP Responder Unreachable - %s", alert.Domain)
+		body = fmt.Sprintf(
+			"The OCSP responder of the TLS certificate for %s could not be reached.\n\nThe revocation status is not stapled to handshakes until the responder answers again.",
+			alert.Domain,
+		)
+	default:
+		subject = fmt.Sprintf("Certificate Expiration Warning - %s", alert.Domain)
+		body = fmt.Sprintf(
+			"The TLS certificate for %s will expire on %s.\n\nPlease renew the certificate before expiration to prevent service interruption.",
+			alert.Domain,
+			alert.Expiry.Format(time.RFC3339),
+		)
+	}
+
+	if alert.Message != "" {
+		body += "\n\nDetails: " + alert.Message
+	}
+	return subject, body
+}
@@ -0,0 +1,377 @@
+package certmanager
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+	"go.uber.org/zap"
+)
+
+// webhookServer records the requests posted to it and answers them with status.
+type webhookServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+	status   int
+}
+
+func newWebhookServer(t *testing.T, status int) *webhookServer {
+	t.Helper()
+
+	s := &webhookServer{status: status}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		s.requests = append(s.requests, r)
+		s.bodies = append(s.bodies, body)
+		s.mu.Unlock()
+		w.WriteHeader(s.status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// received returns the number of requests received so far.
+func (s *webhookServer) received() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+// payload decodes the body of the last request.
+func (s *webhookServer) payload(t *testing.T) map[string]interface{} {
+	t.Helper()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.bodies) == 0 {
+		t.Fatal("expected a webhook request")
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(s.bodies[len(s.bodies)-1], &payload); err != nil {
+		t.Fatalf("invalid payload %q: %v", s.bodies[len(s.bodies)-1], err)
+	}
+	return payload
+}
+
+func testAlert() Alert {
+	return Alert{
+		Kind:    AlertExpiring,
+		Domain:  "example.com",
+		Expiry:  time.Now().Add(10*24*time.Hour + time.Hour),
+		Message: `10 days left, "quoted"`,
+	}
+}
+
+func TestWebhookAlerterTemplates(t *testing.T) {
+	alert := testAlert()
+	subject, text := alertText(alert)
+
+	tests := []struct {
+		name   string
+		config config.WebhookAlertConfig
+		want   map[string]interface{}
+	}{
+		{
+			name:   "json",
+			config: config.WebhookAlertConfig{Format: config.WebhookFormatJSON},
+			want: map[string]interface{}{
+				"kind":      AlertExpiring,
+				"domain":    "example.com",
+				"expiry":    alert.Expiry.Format(time.RFC3339Nano),
+				"days_left": float64(10),
+				"subject":   subject,
+				"text":      text,
+				"message":   alert.Message,
+			},
+		},
+		{
+			name:   "default",
+			config: config.WebhookAlertConfig{},
+			want: map[string]interface{}{
+				"kind":      AlertExpiring,
+				"domain":    "example.com",
+				"expiry":    alert.Expiry.Format(time.RFC3339Nano),
+				"days_left": float64(10),
+				"subject":   subject,
+				"text":      text,
+				"message":   alert.Message,
+			},
+		},
+		{
+			name:   "slack",
+			config: config.WebhookAlertConfig{Format: config.WebhookFormatSlack},
+			want: map[string]interface{}{
+				"text": "*" + subject + "*\n" + text,
+			},
+		},
+		{
+			name: "custom",
+			config: config.WebhookAlertConfig{
+				Template: `{"summary":{{json .Subject}},"source":{{json .Domain}},"days":{{.DaysLeft}}}`,
+				Headers:  map[string]string{"Authorization": "Token secret"},
+			},
+			want: map[string]interface{}{
+				"summary": subject,
+				"source":  "example.com",
+				"days":    float64(10),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newWebhookServer(t, http.StatusOK)
+			tt.config.URL = srv.URL
+
+			alerter, err := NewWebhookAlerter(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := alerter.Alert(alert); err != nil {
+				t.Fatalf("alert: %v", err)
+			}
+
+			got := srv.payload(t)
+			if len(got) != len(tt.want) {
+				t.Fatalf("expected payload %v, got %v", tt.want, got)
+			}
+			for key, value := range tt.want {
+				if got[key] != value {
+					t.Errorf("field %s: expected %q, got %q", key, value, got[key])
+				}
+			}
+
+			req := srv.requests[0]
+			if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+				t.Errorf("expected JSON POST request, got %s with %q", req.Method, req.Header.Get("Content-Type"))
+			}
+			for name, value := range tt.config.Headers {
+				if req.Header.Get(name) != value {
+					t.Errorf("header %s: expected %q, got %q", name, value, req.Header.Get(name))
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookAlerterRejectsInvalidJSON(t *testing.T) {
+	srv := newWebhookServer(t, http.StatusOK)
+
+	// The subject is not quoted with the json function.
+	alerter, err := NewWebhookAlerter(config.WebhookAlertConfig{
+		URL:      srv.URL,
+		Template: `{"text":{{.Subject}}}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = alerter.Alert(testAlert())
+	if err == nil || !strings.Contains(err.Error(), "did not render valid JSON") {
+		t.Fatalf("expected invalid JSON error, got %v", err)
+	}
+	if srv.received() != 0 {
+		t.Fatal("expected invalid payload not to be sent")
+	}
+}
+
+func TestWebhookAlerterStatus(t *testing.T) {
+	tests := []struct {
+		status  int
+		wantErr bool
+	}{
+		{status: http.StatusOK},
+		{status: http.StatusAccepted},
+		{status: http.StatusNoContent},
+		{status: http.StatusMovedPermanently, wantErr: true},
+		{status: http.StatusBadRequest, wantErr: true},
+		{status: http.StatusInternalServerError, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			srv := newWebhookServer(t, tt.status)
+			alerter, err := NewWebhookAlerter(config.WebhookAlertConfig{URL: srv.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = alerter.Alert(testAlert())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("status %d: expected error %v, got %v", tt.status, tt.wantErr, err)
+			}
+		})
+	}
+}
+
+// recordingAlerter records alerts and fails with err, if set.
+type recordingAlerter struct {
+	alerts []Alert
+	err    error
+}
+
+func (a *recordingAlerter) Alert(alert Alert) error {
+	a.alerts = append(a.alerts, alert)
+	return a.err
+}
+
+func TestMultiAlerter(t *testing.T) {
+	failing := errors.New("channel down")
+
+	tests := []struct {
+		name    string
+		errs    []error
+		wantErr bool
+	}{
+		{name: "all succeed", errs: []error{nil, nil}},
+		{name: "one fails", errs: []error{failing, nil}},
+		{name: "all fail", errs: []error{failing, failing}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var alerters []Alerter
+			var recorders []*recordingAlerter
+			for _, err := range tt.errs {
+				r := &recordingAlerter{err: err}
+				recorders = append(recorders, r)
+				alerters = append(alerters, r)
+			}
+
+			err := NewMultiAlerter(zap.NewNop(), alerters...).Alert(testAlert())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if tt.wantErr && !errors.Is(err, failing) {
+				t.Fatalf("expected error of the channels, got %v", err)
+			}
+
+			// A failing channel does not keep the alert from the others.
+			for i, r := range recorders {
+				if len(r.alerts) != 1 {
+					t.Fatalf("channel %d: expected 1 alert, got %d", i, len(r.alerts))
+				}
+			}
+		})
+	}
+}
+
+// selfSignedCert creates a certificate for the domain, with a parsed Leaf.
+func selfSignedCert(t *testing.T, domain string) *tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestCheckCertsEscalatesOncePerThreshold(t *testing.T) {
+	day := 24 * time.Hour
+	alerter := &recordingAlerter{}
+	cm := &CertManager{
+		alerter:    alerter,
+		logger:     zap.NewNop(),
+		thresholds: expiryThresholds([]time.Duration{7 * day, 30 * day, 1 * day, 14 * day}, 0),
+	}
+
+	cert := selfSignedCert(t, "example.com")
+	cm.store.Store(newCertStore([]*certFile{{certPath: "example.com.crt", cert: cert}}, nil, nil))
+
+	// The expiry of the certificate is moved closer, like time passing between checks.
+	steps := []struct {
+		timeLeft time.Duration
+		alerts   int // Total number of alerts after the check.
+	}{
+		{timeLeft: 40 * day, alerts: 0},
+		{timeLeft: 29 * day, alerts: 1},
+		{timeLeft: 28 * day, alerts: 1},
+		{timeLeft: 13 * day, alerts: 2},
+		{timeLeft: 10 * day, alerts: 2},
+		{timeLeft: 6 * day, alerts: 3},
+		{timeLeft: 6 * day, alerts: 3},
+		{timeLeft: 12 * time.Hour, alerts: 4},
+		{timeLeft: time.Hour, alerts: 4},
+	}
+
+	for _, step := range steps {
+		cert.Leaf.NotAfter = time.Now().Add(step.timeLeft)
+		cm.checkCerts()
+
+		if len(alerter.alerts) != step.alerts {
+			t.Fatalf("%s left: expected %d alerts, got %d", step.timeLeft, step.alerts, len(alerter.alerts))
+		}
+	}
+
+	for _, alert := range alerter.alerts {
+		if alert.Kind != AlertExpiring || alert.Domain != "example.com" {
+			t.Fatalf("unexpected alert %+v", alert)
+		}
+	}
+
+	// Once expired, the certificate is alerted about as invalid, once.
+	cert.Leaf.NotAfter = time.Now().Add(-time.Hour)
+	cm.checkCerts()
+	cm.checkCerts()
+	if len(alerter.alerts) != 5 || alerter.alerts[4].Kind != AlertInvalid {
+		t.Fatalf("expected one invalid alert after expiry, got %+v", alerter.alerts[4:])
+	}
+}
+
+func TestCheckCertsRetriesFailedAlerts(t *testing.T) {
+	alerter := &recordingAlerter{err: errors.New("channel down")}
+	cm := &CertManager{
+		alerter:    alerter,
+		logger:     zap.NewNop(),
+		thresholds: expiryThresholds([]time.Duration{30 * 24 * time.Hour}, 0),
+	}
+
+	cert := selfSignedCert(t, "example.com")
+	cert.Leaf.NotAfter = time.Now().Add(10 * 24 * time.Hour)
+	cm.store.Store(newCertStore([]*certFile{{certPath: "example.com.crt", cert: cert}}, nil, nil))
+
+	// Alerts which could not be sent are sent again on the next check, until they succeed.
+	cm.checkCerts()
+	cm.checkCerts()
+	alerter.err = nil
+	cm.checkCerts()
+	cm.checkCerts()
+
+	if len(alerter.alerts) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(alerter.alerts))
+	}
+}
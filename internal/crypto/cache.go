@@ -0,0 +1,121 @@
+package certmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// DiskCertCache stores certificates and the ACME account key as files of a directory,
+// so that they survive restarts and are not requested again. Both include private keys,
+// so the directory and its files are only accessible by the owner.
+type DiskCertCache struct {
+	dir string
+}
+
+// NewDiskCertCache creates a cache in the directory, creating the directory if it does not exist.
+// An existing directory accessible by group or others (e.g. created by the operator with 0755)
+// is restricted to the owner, so that other users cannot read the keys stored in it.
+func NewDiskCertCache(dir string, logger *zap.Logger) (*DiskCertCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create cert_dir: %w", err)
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if perm := info.Mode().Perm(); perm&0o077 != 0 {
+		if err := os.Chmod(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("cert_dir %s is accessible by other users (%v) and could not be restricted: %w", dir, perm, err)
+		}
+		logger.Warn("cert_dir was accessible by other users. Restricted it to the owner",
+			zap.String("dir", dir),
+			zap.Stringer("previous_mode", perm))
+	}
+
+	return &DiskCertCache{dir: dir}, nil
+}
+
+// path returns the file of a cache key. Keys are chosen by autocert (e.g. "example.com+rsa") and never contain separators.
+func (c *DiskCertCache) path(key string) (string, error) {
+	if key == "" || key == "." || key == ".." || strings.ContainsAny(key, `/\`) {
+		return "", fmt.Errorf("invalid cache key %q", key)
+	}
+	return filepath.Join(c.dir, key), nil
+}
+
+func (c *DiskCertCache) Get(ctx context.Context, key string) ([]byte, error) {
+	path, err := c.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, err
+}
+
+// Put writes the data to a temporary file which replaces the entry once written completely,
+// so that readers and crashes never see partial entries.
+func (c *DiskCertCache) Put(ctx context.Context, key string, data []byte) error {
+	path, err := c.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create cert_dir: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0o600)
+}
+
+func (c *DiskCertCache) Delete(ctx context.Context, key string) error {
+	path, err := c.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// writeFileAtomic writes the data to a temporary file in the directory of path and renames it to path,
+// so that readers never see a partially written file.
+func writeFileAtomic(path string, data []byte, perm fs.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
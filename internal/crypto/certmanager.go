@@ -1,59 +1,30 @@
 package certmanager
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 
 	"github.com/unkn0wn-root/terraster/internal/config"
-	"github.com/wneessen/go-mail"
+	"github.com/unkn0wn-root/terraster/pkg/metrics"
 )
 
-// Alerter defines the interface for certificate expiration alerting
-type Alerter interface {
-	Alert(domain string, expiry time.Time) error
-}
-
-type EmailAlerter struct {
-	client    *mail.Client
-	fromEmail string
-	toEmails  []string
-	logger    *zap.Logger
-}
-
-func NewEmailAlerter(cfg AlertingConfig, logger *zap.Logger) (*EmailAlerter, error) {
-	client, err := mail.NewClient(cfg.SMTPHost,
-		mail.WithPort(cfg.SMTPPort),
-		mail.WithSMTPAuth(mail.SMTPAuthPlain),
-		mail.WithUsername(cfg.FromEmail),
-		mail.WithPassword(cfg.FromPass),
-		mail.WithTLSPolicy(mail.TLSMandatory),
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create mail client: %w", err)
-	}
-
-	return &EmailAlerter{
-		client:    client,
-		fromEmail: cfg.FromEmail,
-		toEmails:  cfg.ToEmails,
-		logger:    logger,
-	}, nil
-}
-
-// NoopAlerter implements Alerter but does nothing
-type NoopAlerter struct{}
-
-func (n *NoopAlerter) Alert(domain string, expiry time.Time) error {
-	return nil
-}
-
 type CertCache interface {
 	Get(ctx context.Context, key string) ([]byte, error)
 	Put(ctx context.Context, key string, data []byte) error
@@ -76,7 +47,7 @@ func (c *InMemoryCertCache) Get(ctx context.Context, key string) ([]byte, error)
 	defer c.mu.RUnlock()
 	data, exists := c.cache[key]
 	if !exists {
-		return nil, fmt.Errorf("no cache entry for %s", key)
+		return nil, autocert.ErrCacheMiss
 	}
 	return data, nil
 }
@@ -103,26 +74,39 @@ type certStatus struct {
 }
 
 type CertManager struct {
-	manager          *autocert.Manager
+	acme             atomic.Value // *acmeIssuer - issues certificates through ACME, unset if ACME is disabled
+	renewMu          sync.Mutex   // Serializes renewals on demand.
 	cache            CertCache
 	domains          []string
+	acmeHosts        map[string]bool // Hosts of services whose certificates are issued through ACME.
 	certDir          string
-	certs            sync.Map // map[string]*tls.Certificate
+	store            atomic.Value // *certStore - local certificates, replaced when files or the configuration change
+	loadMu           sync.Mutex   // Serializes loading of local certificates.
+	reloadInterval   time.Duration
+	issued           sync.Map     // map[string]*tls.Certificate - last certificate issued through ACME, for expiry checks
+	ocsp             *ocspStapler // Staples OCSP responses, nil if disabled.
 	logger           *zap.Logger
 	config           *config.Config
 	alerter          Alerter
+	alerted          map[string]string // Alerts sent by the last check to the state they were sent for, only used by checkCerts.
+	loadFailures     map[string]string // Errors of certificate files which failed to load, guarded by loadMu.
 	checkInterval    time.Duration
 	expirationThresh time.Duration
+	thresholds       []time.Duration // Expiry alert thresholds, longest first.
 	stopChan         chan struct{}
+	mu               sync.RWMutex // Guards domains and config, which can be replaced on reload.
 }
 
 type AlertingConfig struct {
-	Enabled   bool
-	SMTPHost  string
-	SMTPPort  int
-	FromEmail string
-	FromPass  string
-	ToEmails  []string
+	Enabled    bool
+	SMTPHost   string
+	SMTPPort   int
+	FromEmail  string
+	FromPass   string
+	ToEmails   []string
+	Webhooks   []config.WebhookAlertConfig
+	Log        bool
+	Thresholds []time.Duration
 }
 
 func NewCertManager(
@@ -134,13 +118,9 @@ func NewCertManager(
 	alerting AlertingConfig,
 	logger *zap.Logger,
 ) (*CertManager, error) {
-	var alerter Alerter = &NoopAlerter{}
-	if alerting.Enabled {
-		emailAlerter, err := NewEmailAlerter(alerting, logger)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create email alerter: %w", err)
-		}
-		alerter = emailAlerter
+	alerter, err := newAlerter(alerting, logger)
+	if err != nil {
+		return nil, err
 	}
 
 	checkInterval := cfg.CertManager.CheckInterval
@@ -165,93 +145,426 @@ func NewCertManager(
 
 	cm.checkInterval = checkInterval
 	cm.expirationThresh = expirationThresh
+	cm.thresholds = expiryThresholds(alerting.Thresholds, expirationThresh)
+	cm.reloadInterval = cfg.CertManager.ReloadInterval
+	if cm.reloadInterval == 0 {
+		cm.reloadInterval = DefaultCertReloadInterval
+	}
 
-	cm.manager = &autocert.Manager{
-		Cache:      cache,
-		Prompt:     autocert.AcceptTOS,
-		HostPolicy: cm.hostPolicy,
+	if acmeCfg := cfg.CertManager.ACME; acmeCfg != nil && acmeCfg.Enabled {
+		issuer, err := cm.newACMEIssuer(acmeCfg, cache)
+		if err != nil {
+			return nil, err
+		}
+		cm.acme.Store(issuer)
+	}
+
+	if ocspCfg := cfg.CertManager.OCSP; ocspCfg == nil || !ocspCfg.Disabled {
+		var interval, alertAfter time.Duration
+		if ocspCfg != nil {
+			interval, alertAfter = ocspCfg.RefreshInterval, ocspCfg.AlertAfter
+		}
+		cm.ocsp = newOCSPStapler(cache, alerter, interval, alertAfter, logger)
+		go cm.ocsp.run(ctx, cm.stopChan, cm.servedCertificates)
 	}
 
 	// Load local certificates during initialization
 	cm.loadLocalCertificates()
 
-	// Start periodic certificate check
+	// Start periodic certificate check and reload of changed certificate files
 	go cm.periodicCertCheck(ctx)
+	go cm.watchCertificates(ctx)
 
 	return cm, nil
 }
 
 func NewAlertingConfig(cfg *config.Config) AlertingConfig {
 	return AlertingConfig{
-		Enabled:   cfg.CertManager.Alerting.Enabled,
-		SMTPHost:  cfg.CertManager.Alerting.SMTPHost,
-		SMTPPort:  cfg.CertManager.Alerting.SMTPPort,
-		FromEmail: cfg.CertManager.Alerting.FromEmail,
-		FromPass:  cfg.CertManager.Alerting.FromPass,
-		ToEmails:  cfg.CertManager.Alerting.ToEmails,
+		Enabled:    cfg.CertManager.Alerting.Enabled,
+		SMTPHost:   cfg.CertManager.Alerting.SMTPHost,
+		SMTPPort:   cfg.CertManager.Alerting.SMTPPort,
+		FromEmail:  cfg.CertManager.Alerting.FromEmail,
+		FromPass:   cfg.CertManager.Alerting.FromPass,
+		ToEmails:   cfg.CertManager.Alerting.ToEmails,
+		Webhooks:   cfg.CertManager.Alerting.Webhooks,
+		Log:        cfg.CertManager.Alerting.Log,
+		Thresholds: cfg.CertManager.Alerting.Thresholds,
 	}
 }
 
-// hostPolicy ensures that only configured domains are allowed.
-func (cm *CertManager) hostPolicy(ctx context.Context, host string) error {
-	for _, domain := range cm.domains {
-		if host == domain {
-			return nil
+// expiryThresholds returns the thresholds sorted longest first, the expiration threshold if none are configured.
+func expiryThresholds(thresholds []time.Duration, expirationThresh time.Duration) []time.Duration {
+	if len(thresholds) == 0 {
+		return []time.Duration{expirationThresh}
+	}
+	sorted := append([]time.Duration(nil), thresholds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] > sorted[j] })
+	return sorted
+}
+
+// acmeIssuer is an autocert manager along with the handler of its HTTP-01 challenges.
+// It lives as long as the certificate manager, so that autocert schedules one renewal per certificate.
+type acmeIssuer struct {
+	manager    *autocert.Manager
+	challenges http.Handler
+	cache      CertCache
+	client     *acme.Client // Orders certificates renewed on demand, registered on first use.
+	email      string
+	renewed    sync.Map // map[string]*tls.Certificate - certificates renewed on demand by cache key, until the manager serves them
+	tokens     sync.Map // map[string]*tls.Certificate - TLS-ALPN-01 challenge certificates of renewals on demand by host
+}
+
+// newACMEIssuer creates the autocert manager issuing certificates from the configured ACME server into the cache.
+func (cm *CertManager) newACMEIssuer(cfg *config.ACMEConfig, cache CertCache) (*acmeIssuer, error) {
+	directoryURL := cfg.DirectoryURL
+	if directoryURL == "" {
+		directoryURL = config.DefaultACMEDirectoryURL
+	}
+
+	var httpClient *http.Client // nil uses http.DefaultClient
+	if cfg.CAFile != "" {
+		pemCAs, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("acme: failed to read ca_file: %w", err)
 		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pemCAs) {
+			return nil, fmt.Errorf("acme: no certificates found in ca_file %s", cfg.CAFile)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		httpClient = &http.Client{Transport: transport}
+	}
+
+	renewBefore := cfg.RenewBefore
+	if renewBefore == 0 {
+		renewBefore = config.DefaultACMERenewBefore
+	}
+
+	manager := &autocert.Manager{
+		Client:      &acme.Client{DirectoryURL: directoryURL, HTTPClient: httpClient},
+		Cache:       cache,
+		Prompt:      autocert.AcceptTOS,
+		HostPolicy:  cm.hostPolicy,
+		Email:       cfg.Email,
+		RenewBefore: renewBefore,
+	}
+
+	return &acmeIssuer{
+		manager: manager,
+		// Offering HTTP-01 next to TLS-ALPN-01 requires the handler to exist before certificates are ordered
+		challenges: manager.HTTPHandler(http.NotFoundHandler()),
+		// autocert sets the account key of its client on first use, renewals on demand use a client of their own
+		cache:  cache,
+		client: &acme.Client{DirectoryURL: directoryURL, HTTPClient: httpClient},
+		email:  cfg.Email,
+	}, nil
+}
+
+// acmeIssuer returns the issuer of ACME certificates, nil if ACME is disabled.
+func (cm *CertManager) acmeIssuer() *acmeIssuer {
+	issuer, _ := cm.acme.Load().(*acmeIssuer)
+	return issuer
+}
+
+// hostPolicy ensures that certificates are only issued for hosts of services without a local certificate.
+func (cm *CertManager) hostPolicy(ctx context.Context, host string) error {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	if cm.acmeHosts[host] {
+		return nil
 	}
 
 	return fmt.Errorf("host %q not configured", host)
 }
 
-// loadLocalCertificates loads local TLS certificates and stores them in the certs map.
+// loadLocalCertificates loads the certificates of services and the default certificate into a new store.
+// Certificates whose files did not change are reused. A certificate which fails to load keeps the
+// previously loaded one in use, e.g. while its files are being replaced. Services without a certificate
+// file get theirs through ACME.
 func (cm *CertManager) loadLocalCertificates() {
-	for _, svc := range cm.config.Services {
-		if svc.TLS != nil && svc.TLS.Enabled {
-			cert, err := tls.LoadX509KeyPair(svc.TLS.CertFile, svc.TLS.KeyFile)
+	cm.loadMu.Lock()
+	defer cm.loadMu.Unlock()
+
+	cm.mu.RLock()
+	services := cm.config.Services
+	defaultCert := cm.config.CertManager.DefaultCertificate
+	cm.mu.RUnlock()
+
+	previous := make(map[string]*certFile)
+	if store := cm.certStore(); store != nil {
+		for _, f := range store.files {
+			previous[certFileKey(f.certPath, f.keyPath)] = f
+		}
+	}
+
+	var files []*certFile
+	hosts := make(map[*certFile][]string)
+	loaded := make(map[string]*certFile)
+	failures := make(map[string]string)
+	load := func(certPath, keyPath, host string) *certFile {
+		key := certFileKey(certPath, keyPath)
+		if f, ok := loaded[key]; ok {
+			return f
+		}
+
+		f, ok := previous[key]
+		if !ok || f.changed() {
+			next, err := loadCertFile(certPath, keyPath)
 			if err != nil {
-				cm.logger.Warn("Failed to load local certificate. Will use autocert",
-					zap.String("host", svc.Host),
+				cm.logger.Error("Failed to load local certificate",
+					zap.String("host", host),
+					zap.String("cert_file", certPath),
 					zap.Error(err))
-				continue
+				// Alert once per error, the file is tried again on every reload until it loads
+				failures[key] = err.Error()
+				if cm.loadFailures[key] != failures[key] &&
+					!cm.sendAlert(Alert{Kind: AlertInvalid, Domain: host, Message: fmt.Sprintf("%s: %v", certPath, err)}) {
+					failures[key] = "" // Sent again on the next reload
+				}
+			} else {
+				f = next
+				cm.observeExpiry(f.name(), f.cert)
+				if ok {
+					cm.logger.Info("Reloaded changed certificate", zap.String("host", host), zap.String("cert_file", certPath))
+				} else {
+					cm.logger.Info("Loaded local certificate", zap.String("host", host), zap.String("cert_file", certPath))
+				}
+			}
+		}
+		if f == nil {
+			return nil
+		}
+
+		loaded[key] = f
+		files = append(files, f)
+		return f
+	}
+
+	acmeHosts := make(map[string]bool)
+	for _, svc := range services {
+		if svc.UsesACME() {
+			acmeHosts[svc.Host] = true
+			continue
+		}
+
+		if svc.TLS != nil && svc.TLS.Enabled && !svc.IsStream() {
+			pairs := append([]config.CertificateConfig{{CertFile: svc.TLS.CertFile, KeyFile: svc.TLS.KeyFile}}, svc.TLS.Certificates...)
+			for _, pair := range pairs {
+				if pair.CertFile == "" {
+					continue
+				}
+				if f := load(pair.CertFile, pair.KeyFile, svc.Host); f != nil && svc.Host != "" {
+					hosts[f] = append(hosts[f], svc.Host)
+				}
+			}
+		}
+	}
+
+	var fallback *certFile
+	if defaultCert != nil {
+		fallback = load(defaultCert.CertFile, defaultCert.KeyFile, "default")
+	}
+
+	cm.store.Store(newCertStore(files, hosts, fallback))
+	cm.ocsp.refreshSoon()
+	cm.loadFailures = failures
+
+	cm.mu.Lock()
+	cm.acmeHosts = acmeHosts
+	cm.mu.Unlock()
+}
+
+// certStore returns the current local certificates, nil before they were loaded.
+func (cm *CertManager) certStore() *certStore {
+	store, _ := cm.store.Load().(*certStore)
+	return store
+}
+
+// watchCertificates reloads certificate files when they change, so rotated certificates are served without a restart.
+func (cm *CertManager) watchCertificates(ctx context.Context) {
+	ticker := time.NewTicker(cm.reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if cm.certificatesChanged() {
+				cm.loadLocalCertificates()
 			}
-			cm.certs.Store(svc.Host, &cert)
-			cm.logger.Info("Loaded local certificate", zap.String("host", svc.Host))
+		case <-cm.stopChan:
+			return
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
+// certificatesChanged reports whether any loaded certificate file changed or any certificate failed to load.
+func (cm *CertManager) certificatesChanged() bool {
+	cm.loadMu.Lock()
+	failing := len(cm.loadFailures) > 0
+	cm.loadMu.Unlock()
+
+	store := cm.certStore()
+	if store == nil || failing {
+		return failing
+	}
+	for _, f := range store.files {
+		if f.changed() {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload replaces the configured domains and (re)loads local certificates of the given configuration.
+// Handshakes in flight keep the certificate they already selected.
+func (cm *CertManager) Reload(cfg *config.Config, domains []string) {
+	cm.mu.Lock()
+	cm.config = cfg
+	cm.domains = domains
+	cm.mu.Unlock()
+
+	cm.loadLocalCertificates()
+}
+
+// servedCertificates returns the local certificates and the certificates issued through ACME with their names.
+func (cm *CertManager) servedCertificates() map[*tls.Certificate]string {
+	certs := make(map[*tls.Certificate]string)
+	if store := cm.certStore(); store != nil {
+		for _, f := range store.files {
+			certs[f.cert] = f.name()
+		}
+	}
+	cm.issued.Range(func(key, value interface{}) bool {
+		certs[value.(*tls.Certificate)] = key.(string)
+		return true
+	})
+	return certs
+}
+
+// isACMEHost reports whether the certificate of the host is issued through ACME.
+func (cm *CertManager) isACMEHost(host string) bool {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	return cm.acmeHosts[host]
+}
+
 // GetCertificate retrieves the TLS certificate for the given client hello.
 func (cm *CertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-	// Try local certificate first (if any)
-	if cert, ok := cm.certs.Load(hello.ServerName); ok {
-		return cert.(*tls.Certificate), nil
+	issuer := cm.acmeIssuer()
+
+	// TLS-ALPN-01 challenges of the ACME server are answered with a challenge certificate
+	if issuer != nil && IsACMEChallenge(hello) {
+		if token, ok := issuer.tokens.Load(hello.ServerName); ok {
+			return token.(*tls.Certificate), nil
+		}
+		return issuer.manager.GetCertificate(hello)
+	}
+
+	// Local certificates are looked up by the names they are valid for, including wildcards
+	if issuer == nil || !cm.isACMEHost(hello.ServerName) {
+		if store := cm.certStore(); store != nil {
+			if cert := store.selectCertificate(hello); cert != nil {
+				return cm.ocsp.staple(cert), nil
+			}
+		}
+		return nil, fmt.Errorf("no certificate for host %q", hello.ServerName)
 	}
 
-	// If not found, fetch using autocert - slow path
-	// You should own domain and configure Let's Encrypt to accept fetching certs
-	cert, err := cm.manager.GetCertificate(hello)
+	// Fetch using autocert - slow path on first use only.
+	// Issued certificates are cached and renewed by autocert, so they are not stored with local certificates.
+	cert, err := issuer.manager.GetCertificate(hello)
 	if err != nil {
 		return nil, err
 	}
+	cert = issuer.current(hello.ServerName, cert)
 
-	cm.certs.Store(hello.ServerName, cert)
+	// autocert returns a new certificate value on every handshake, only a new leaf is a renewed certificate
+	if previous, ok := cm.issued.Load(hello.ServerName); !ok || !sameLeaf(previous.(*tls.Certificate), cert) {
+		cm.issued.Store(hello.ServerName, cert)
+		cm.observeExpiry(hello.ServerName, cert)
+		cm.ocsp.refreshSoon()
+	}
 
-	return cert, nil
+	return cm.ocsp.staple(cert), nil
 }
 
-// periodicCertCheck periodically checks for certificate expirations.
-func (cm *CertManager) periodicCertCheck(ctx context.Context) {
-	if cm.domains == nil || len(cm.domains) == 0 {
-		cm.logger.Warn("No domains configured for certificate check. Periodic check will not run.")
+// IsACMEChallenge reports whether the client hello comes from an ACME server validating a TLS-ALPN-01 challenge.
+func IsACMEChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+// ACMEEnabled reports whether certificates are issued through ACME.
+func (cm *CertManager) ACMEEnabled() bool {
+	return cm.acmeIssuer() != nil
+}
+
+// ServeHTTPChallenge answers HTTP-01 challenges of the ACME server.
+// Returns false if the request is not a challenge, so that it is served as usual.
+func (cm *CertManager) ServeHTTPChallenge(w http.ResponseWriter, r *http.Request) bool {
+	issuer := cm.acmeIssuer()
+	if issuer == nil || !strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") {
+		return false
+	}
+	// Tokens of renewals on demand are found in the shared cache
+	issuer.challenges.ServeHTTP(w, r)
+	return true
+}
+
+// ObtainCertificates requests certificates of all ACME hosts in the background, so that the first client
+// does not wait for the issuance. Certificates found in the cache are loaded and scheduled for renewal.
+func (cm *CertManager) ObtainCertificates() {
+	if cm.acmeIssuer() == nil {
 		return
 	}
 
+	cm.mu.RLock()
+	hosts := make([]string, 0, len(cm.acmeHosts))
+	for host := range cm.acmeHosts {
+		hosts = append(hosts, host)
+	}
+	cm.mu.RUnlock()
+
+	go func() {
+		for _, host := range hosts {
+			if _, err := cm.GetCertificate(acmeHello(host)); err != nil {
+				cm.logger.Error("Failed to obtain certificate through ACME", zap.String("host", host), zap.Error(err))
+				continue
+			}
+			cm.logger.Info("Obtained certificate through ACME", zap.String("host", host))
+		}
+	}()
+}
+
+// observeExpiry exports the expiry time of a certificate as a metric.
+func (cm *CertManager) observeExpiry(domain string, cert *tls.Certificate) {
+	status := cm.validateCertificate(cert)
+	if status.error != nil {
+		return
+	}
+	metrics.CertificateExpiry.WithLabelValues(domain).Set(float64(status.expiresAt.Unix()))
+}
+
+// periodicCertCheck periodically checks for certificate expirations.
+// Domains are read on every tick, so that services with TLS added on reload are checked as well.
+func (cm *CertManager) periodicCertCheck(ctx context.Context) {
 	ticker := time.NewTicker(cm.checkInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
+			cm.mu.RLock()
+			domainCount := len(cm.domains)
+			cm.mu.RUnlock()
+
+			if domainCount == 0 {
+				cm.logger.Debug("No domains configured for certificate check. Skipping")
+				continue
+			}
 			cm.checkCerts()
 		case <-cm.stopChan:
 			cm.logger.Info("Periodic certificate check stopped")
@@ -296,12 +609,39 @@ func (cm *CertManager) validateCertificate(cert *tls.Certificate) certStatus {
 	return status
 }
 
-// checkCerts checks the certificates for expiration and sends alerts if necessary.
+// acmeHello returns the hello of a client supporting ECDSA, which autocert prefers, to look up ACME certificates.
+func acmeHello(host string) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		ServerName:   host,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	}
+}
+
+// checkCerts checks the certificates for expiration and validity and sends alerts if necessary.
+// Each alert is sent once: an expiring certificate alerts again when it crosses the next threshold,
+// an invalid certificate only after it was valid in between.
 func (cm *CertManager) checkCerts() {
+	// Certificates issued through ACME may have been renewed since they were last served
+	cm.issued.Range(func(key, _ interface{}) bool {
+		if _, err := cm.GetCertificate(acmeHello(key.(string))); err != nil {
+			cm.logger.Warn("Failed to refresh certificate issued through ACME", zap.String("domain", key.(string)), zap.Error(err))
+		}
+		return true
+	})
+
 	now := time.Now()
 	var checkErrors []error
 
-	cm.certs.Range(func(key, value interface{}) bool {
+	// Alerts of certificates no longer served, or no longer failing, are forgotten
+	alerted := make(map[string]string)
+	alertOnce := func(cert *tls.Certificate, state string, alert Alert) {
+		key := certAlertKey(alert.Kind, cert)
+		if cm.alerted[key] == state || cm.sendAlert(alert) {
+			alerted[key] = state
+		}
+	}
+
+	check := func(key, value interface{}) bool {
 		domain := key.(string)
 		cert := value.(*tls.Certificate)
 
@@ -319,29 +659,39 @@ func (cm *CertManager) checkCerts() {
 				zap.String("domain", domain),
 				zap.Error(status.error))
 			checkErrors = append(checkErrors, fmt.Errorf("domain %s: %w", domain, status.error))
+			alertOnce(cert, status.error.Error(), Alert{Kind: AlertInvalid, Domain: domain, Message: status.error.Error()})
 			return true
 		}
 
+		metrics.CertificateExpiry.WithLabelValues(domain).Set(float64(status.expiresAt.Unix()))
+
 		if !status.isValid {
 			cm.logger.Error("Invalid certificate",
 				zap.String("domain", domain),
 				zap.Time("expires_at", status.expiresAt))
+
+			message := fmt.Sprintf("not valid before %s", cert.Leaf.NotBefore.Format(time.RFC3339))
+			if now.After(status.expiresAt) {
+				message = fmt.Sprintf("expired on %s", status.expiresAt.Format(time.RFC3339))
+			}
+			alertOnce(cert, message, Alert{Kind: AlertInvalid, Domain: domain, Expiry: status.expiresAt, Message: message})
 			return true
 		}
 
 		timeLeft := status.expiresAt.Sub(now)
-		if timeLeft < cm.expirationThresh {
+		if stage := cm.expiryStage(timeLeft); stage > 0 {
 			daysLeft := int(timeLeft.Hours() / 24)
 			cm.logger.Warn("Certificate approaching expiration",
 				zap.String("domain", domain),
 				zap.Time("expires_at", status.expiresAt),
 				zap.Int("time_left", daysLeft))
 
-			if err := cm.alerter.Alert(domain, status.expiresAt); err != nil {
-				cm.logger.Error("Failed to send alert",
-					zap.String("domain", domain),
-					zap.Error(err))
-			}
+			alertOnce(cert, strconv.Itoa(stage), Alert{
+				Kind:    AlertExpiring,
+				Domain:  domain,
+				Expiry:  status.expiresAt,
+				Message: fmt.Sprintf("%d days left", daysLeft),
+			})
 
 			return true
 		}
@@ -352,7 +702,14 @@ func (cm *CertManager) checkCerts() {
 			zap.Duration("time_left", timeLeft))
 
 		return true
-	})
+	}
+	if store := cm.certStore(); store != nil {
+		for _, f := range store.files {
+			check(f.name(), f.cert)
+		}
+	}
+	cm.issued.Range(check)
+	cm.alerted = alerted
 
 	if len(checkErrors) > 0 {
 		cm.logger.Error("Certificate check completed with errors",
@@ -361,28 +718,44 @@ func (cm *CertManager) checkCerts() {
 	}
 }
 
-func (e *EmailAlerter) Alert(domain string, expiry time.Time) error {
-	msg := mail.NewMsg()
-	if err := msg.From(e.fromEmail); err != nil {
-		return fmt.Errorf("failed to set From address: %w", err)
+// expiryStage returns the number of alert thresholds the remaining validity fell below, 0 if none.
+func (cm *CertManager) expiryStage(timeLeft time.Duration) int {
+	stage := 0
+	for _, threshold := range cm.thresholds {
+		if timeLeft < threshold {
+			stage++
+		}
 	}
+	return stage
+}
 
-	if err := msg.To(e.toEmails...); err != nil {
-		return fmt.Errorf("failed to set To address: %w", err)
-	}
+// sameLeaf reports whether both certificates have the same leaf certificate.
+func sameLeaf(a, b *tls.Certificate) bool {
+	return len(a.Certificate) > 0 && len(b.Certificate) > 0 && bytes.Equal(a.Certificate[0], b.Certificate[0])
+}
 
-	msg.Subject(fmt.Sprintf("Certificate Expiration Warning - %s", domain))
-	msg.SetBodyString(mail.TypeTextPlain, fmt.Sprintf(
-		"The TLS certificate for %s will expire on %s.\n\nPlease renew the certificate before expiration to prevent service interruption.",
-		domain,
-		expiry.Format(time.RFC3339),
-	))
+// certAlertKey identifies alerts of a kind about a certificate. Certificates sharing a name,
+// e.g. the RSA and ECDSA certificate of a host, are alerted about separately.
+func certAlertKey(kind string, cert *tls.Certificate) string {
+	return kind + "+" + leafKey(cert)
+}
 
-	if err := e.client.DialAndSend(msg); err != nil {
-		return fmt.Errorf("failed to send alert email: %w", err)
-	}
+// leafKey identifies a certificate by its leaf, the SHA-256 of the leaf certificate in hex.
+func leafKey(cert *tls.Certificate) string {
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
 
-	return nil
+// sendAlert sends the alert to all channels. Returns false if it failed, so that it is sent again on the next check.
+func (cm *CertManager) sendAlert(alert Alert) bool {
+	if err := cm.alerter.Alert(alert); err != nil {
+		cm.logger.Error("Failed to send alert",
+			zap.String("domain", alert.Domain),
+			zap.String("kind", alert.Kind),
+			zap.Error(err))
+		return false
+	}
+	return true
 }
 
 func (cm *CertManager) Stop() {
@@ -0,0 +1,342 @@
+package certmanager
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+	"go.uber.org/zap"
+)
+
+// CRLCheckInterval is how often the CRL file is checked for changes.
+const CRLCheckInterval = time.Minute
+
+// ClientAuth verifies client certificates of a service (mutual TLS).
+// Certificates have to chain to the configured CAs, must not be revoked by the CRL file
+// and have to carry one of the allowed identities, if any are configured.
+type ClientAuth struct {
+	mode     string
+	cas      *x509.CertPool
+	subjects []string
+	sans     []string
+	headers  config.ClientCertHeadersConfig
+	crl      *crlFile
+}
+
+// NewClientAuth loads the CAs and the CRL of the client authentication configuration.
+func NewClientAuth(cfg *config.ClientAuthConfig, logger *zap.Logger) (*ClientAuth, error) {
+	pemCAs, err := os.ReadFile(cfg.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("client_auth: failed to read ca_file: %w", err)
+	}
+
+	cas := x509.NewCertPool()
+	var caCerts []*x509.Certificate
+	for block, rest := pem.Decode(pemCAs); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("client_auth: invalid certificate in ca_file: %w", err)
+		}
+		cas.AddCert(cert)
+		caCerts = append(caCerts, cert)
+	}
+	if len(caCerts) == 0 {
+		return nil, fmt.Errorf("client_auth: no certificates found in ca_file %s", cfg.CAFile)
+	}
+
+	mode := cfg.Mode
+	if mode == "" {
+		mode = config.ClientAuthRequire
+	}
+
+	headers := config.DefaultClientCertHeaders
+	if cfg.Headers != nil {
+		headers = *cfg.Headers
+	}
+
+	ca := &ClientAuth{
+		mode:     mode,
+		cas:      cas,
+		subjects: cfg.AllowedSubjects,
+		sans:     cfg.AllowedSANs,
+		headers:  headers,
+	}
+
+	if cfg.CRLFile != "" {
+		ca.crl = &crlFile{path: cfg.CRLFile, issuers: caCerts, logger: logger}
+		if err := ca.crl.load(); err != nil {
+			return nil, fmt.Errorf("client_auth: %w", err)
+		}
+	}
+
+	return ca, nil
+}
+
+// Apply requests and verifies client certificates on connections using the TLS configuration.
+func (c *ClientAuth) Apply(tlsConfig *tls.Config) {
+	tlsConfig.ClientCAs = c.cas
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	if c.mode == config.ClientAuthOptional {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	tlsConfig.VerifyConnection = c.verifyConnection
+}
+
+// verifyConnection checks revocation and the identity of a certificate which chains to the CAs.
+// Connections without a certificate only get here in optional mode.
+func (c *ClientAuth) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.VerifiedChains) == 0 {
+		return nil
+	}
+
+	if c.crl != nil {
+		for _, chain := range cs.VerifiedChains {
+			if err := c.crl.check(chain); err != nil {
+				return err
+			}
+		}
+	}
+
+	leaf := cs.VerifiedChains[0][0]
+	if (len(c.subjects) > 0 || len(c.sans) > 0) && !MatchIdentity(leaf, c.subjects, c.sans) {
+		return fmt.Errorf("client certificate %q is not allowed", leaf.Subject.String())
+	}
+	return nil
+}
+
+// SetHeaders replaces the client certificate headers of the request with the verified certificate of the connection.
+func (c *ClientAuth) SetHeaders(r *http.Request) {
+	h := c.headers
+	for _, name := range []string{h.Subject, h.SANs, h.Fingerprint, h.Serial, h.Cert, h.Verify} {
+		if name != "" {
+			r.Header.Del(name)
+		}
+	}
+
+	cert := PeerCertificate(r)
+	if cert == nil {
+		setHeader(r.Header, h.Verify, "NONE")
+		return
+	}
+
+	fingerprint := sha256.Sum256(cert.Raw)
+	setHeader(r.Header, h.Verify, "SUCCESS")
+	setHeader(r.Header, h.Subject, cert.Subject.String())
+	setHeader(r.Header, h.SANs, strings.Join(subjectAltNames(cert), ","))
+	setHeader(r.Header, h.Fingerprint, hex.EncodeToString(fingerprint[:]))
+	setHeader(r.Header, h.Serial, cert.SerialNumber.String())
+	if h.Cert != "" {
+		setHeader(r.Header, h.Cert, url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))))
+	}
+}
+
+func setHeader(h http.Header, name, value string) {
+	if name != "" && value != "" {
+		h.Set(name, value)
+	}
+}
+
+// PeerCertificate returns the verified client certificate of the request, nil if the client did not present one.
+func PeerCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// MatchIdentity reports whether the certificate has one of the subjects or subject alternative names.
+// Subjects match the common name or the whole subject DN. SANs match DNS names, with wildcards
+// like *.example.com covering a single label, email addresses, URIs and IP addresses.
+func MatchIdentity(cert *x509.Certificate, subjects, sans []string) bool {
+	if len(subjects) == 0 && len(sans) == 0 {
+		return true
+	}
+
+	for _, subject := range subjects {
+		if subject == cert.Subject.CommonName || subject == cert.Subject.String() {
+			return true
+		}
+	}
+
+	for _, san := range sans {
+		for _, name := range cert.DNSNames {
+			if matchDNSName(san, name) {
+				return true
+			}
+		}
+		for _, email := range cert.EmailAddresses {
+			if strings.EqualFold(san, email) {
+				return true
+			}
+		}
+		for _, uri := range cert.URIs {
+			if san == uri.String() {
+				return true
+			}
+		}
+		if ip := net.ParseIP(san); ip != nil {
+			for _, certIP := range cert.IPAddresses {
+				if ip.Equal(certIP) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// matchDNSName matches a DNS name against a pattern, which may start with a wildcard label.
+func matchDNSName(pattern, name string) bool {
+	if strings.EqualFold(pattern, name) {
+		return true
+	}
+	suffix, ok := strings.CutPrefix(pattern, "*")
+	if !ok || !strings.HasPrefix(suffix, ".") {
+		return false
+	}
+	label, rest, found := strings.Cut(name, ".")
+	return found && label != "" && strings.EqualFold("."+rest, suffix)
+}
+
+// subjectAltNames returns all subject alternative names of the certificate.
+func subjectAltNames(cert *x509.Certificate) []string {
+	names := make([]string, 0, len(cert.DNSNames)+len(cert.EmailAddresses)+len(cert.URIs)+len(cert.IPAddresses))
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// crlFile holds the revoked serial numbers of a CRL file.
+// The file is checked for changes at most every CRLCheckInterval, a file which fails to load keeps the previous lists.
+type crlFile struct {
+	path    string
+	issuers []*x509.Certificate
+	logger  *zap.Logger
+
+	mu        sync.Mutex
+	modTime   time.Time
+	checkedAt time.Time
+	revoked   map[string]map[string]bool // Raw issuer subject to revoked serial numbers.
+}
+
+// load reads the revocation lists of the file. Every list has to be signed by one of the CAs.
+func (f *crlFile) load() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to read crl_file: %w", err)
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to read crl_file: %w", err)
+	}
+
+	var ders [][]byte
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type == "X509 CRL" {
+				ders = append(ders, block.Bytes)
+			}
+		}
+	} else {
+		ders = append(ders, data)
+	}
+	if len(ders) == 0 {
+		return fmt.Errorf("no revocation lists found in crl_file %s", f.path)
+	}
+
+	revoked := make(map[string]map[string]bool)
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return fmt.Errorf("invalid revocation list in crl_file: %w", err)
+		}
+		if !f.signedByIssuer(crl) {
+			return fmt.Errorf("revocation list of %q in crl_file is not signed by a CA of ca_file", crl.Issuer.String())
+		}
+
+		serials := revoked[string(crl.RawIssuer)]
+		if serials == nil {
+			serials = make(map[string]bool)
+			revoked[string(crl.RawIssuer)] = serials
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			serials[entry.SerialNumber.String()] = true
+		}
+	}
+
+	f.mu.Lock()
+	f.revoked = revoked
+	f.modTime = info.ModTime()
+	f.checkedAt = time.Now()
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *crlFile) signedByIssuer(crl *x509.RevocationList) bool {
+	for _, issuer := range f.issuers {
+		if bytes.Equal(issuer.RawSubject, crl.RawIssuer) && crl.CheckSignatureFrom(issuer) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns an error if a certificate of the chain was revoked.
+func (f *crlFile) check(chain []*x509.Certificate) error {
+	f.reloadIfChanged()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, cert := range chain {
+		if f.revoked[string(cert.RawIssuer)][cert.SerialNumber.String()] {
+			return errors.New("client certificate has been revoked")
+		}
+	}
+	return nil
+}
+
+// reloadIfChanged reloads the file if its modification time changed since it was loaded.
+func (f *crlFile) reloadIfChanged() {
+	f.mu.Lock()
+	if time.Since(f.checkedAt) < CRLCheckInterval {
+		f.mu.Unlock()
+		return
+	}
+	f.checkedAt = time.Now()
+	modTime := f.modTime
+	f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil || info.ModTime().Equal(modTime) {
+		return
+	}
+	if err := f.load(); err != nil {
+		f.logger.Error("Failed to reload client_auth crl_file, keeping the previous revocation lists",
+			zap.String("crl_file", f.path), zap.Error(err))
+		return
+	}
+	f.logger.Info("Reloaded client_auth crl_file", zap.String("crl_file", f.path))
+}
@@ -0,0 +1,262 @@
+package certmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+	"go.uber.org/zap"
+)
+
+// Sources of certificates.
+const (
+	CertSourceFile = "file" // Loaded from a cert_file and key_file pair.
+	CertSourceACME = "acme" // Issued through ACME.
+)
+
+// ACMERenewTimeout is how long a renewal on demand may take.
+const ACMERenewTimeout = 5 * time.Minute
+
+// Errors of certificate uploads and renewals.
+var (
+	ErrUnknownHost        = errors.New("no service with a certificate file for host")
+	ErrInvalidCertificate = errors.New("invalid certificate")
+	ErrNotACMEHost        = errors.New("certificate of host is not issued through ACME")
+)
+
+// CertificateInfo describes a certificate served by the certificate manager.
+type CertificateInfo struct {
+	Name        string    `json:"name"`
+	Source      string    `json:"source"`              // CertSourceFile or CertSourceACME.
+	CertFile    string    `json:"cert_file,omitempty"` // File of a local certificate.
+	Default     bool      `json:"default,omitempty"`   // Served to clients whose server name matches no certificate.
+	Subject     string    `json:"subject"`
+	SANs        []string  `json:"sans"`
+	Issuer      string    `json:"issuer"`
+	Serial      string    `json:"serial"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	KeyType     string    `json:"key_type"` // e.g. "ECDSA P-256" or "RSA 2048".
+	OCSPStapled bool      `json:"ocsp_stapled"`
+}
+
+func (cm *CertManager) certificateInfo(name, source string, cert *tls.Certificate) CertificateInfo {
+	leaf := cert.Leaf
+	return CertificateInfo{
+		Name:        name,
+		Source:      source,
+		Subject:     leaf.Subject.String(),
+		SANs:        subjectAltNames(leaf),
+		Issuer:      leaf.Issuer.String(),
+		Serial:      leaf.SerialNumber.String(),
+		NotBefore:   leaf.NotBefore,
+		NotAfter:    leaf.NotAfter,
+		KeyType:     keyType(leaf),
+		OCSPStapled: len(cm.ocsp.staple(cert).OCSPStaple) > 0,
+	}
+}
+
+// keyType describes the public key of the certificate, e.g. "RSA 2048".
+func keyType(leaf *x509.Certificate) string {
+	switch key := leaf.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + key.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return leaf.PublicKeyAlgorithm.String()
+}
+
+// Certificates returns the local certificates and the certificates issued through ACME, ordered by name.
+func (cm *CertManager) Certificates() []CertificateInfo {
+	certs := []CertificateInfo{}
+	if store := cm.certStore(); store != nil {
+		for _, f := range store.files {
+			info := cm.certificateInfo(f.name(), CertSourceFile, f.cert)
+			info.CertFile = f.certPath
+			info.Default = f.cert == store.fallback
+			certs = append(certs, info)
+		}
+	}
+	cm.issued.Range(func(key, value interface{}) bool {
+		certs = append(certs, cm.certificateInfo(key.(string), CertSourceACME, value.(*tls.Certificate)))
+		return true
+	})
+
+	sort.SliceStable(certs, func(i, j int) bool { return certs[i].Name < certs[j].Name })
+	return certs
+}
+
+// InstallCertificate replaces the certificate files of the service with the host by the PEM encoded certificate
+// chain and private key, and serves the certificate right away. Hosts with RSA and ECDSA certificates get
+// the one with the key type of the new certificate replaced. The files survive restarts.
+func (cm *CertManager) InstallCertificate(host string, certPEM, keyPEM []byte) (CertificateInfo, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return CertificateInfo{}, fmt.Errorf("%w: %v", ErrInvalidCertificate, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return CertificateInfo{}, fmt.Errorf("%w: %v", ErrInvalidCertificate, err)
+	}
+
+	if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return CertificateInfo{}, fmt.Errorf("%w: certificate is only valid from %s to %s", ErrInvalidCertificate,
+			leaf.NotBefore.Format(time.RFC3339), leaf.NotAfter.Format(time.RFC3339))
+	}
+	if !coversHost(leaf, host) {
+		return CertificateInfo{}, fmt.Errorf("%w: certificate is not valid for %s", ErrInvalidCertificate, host)
+	}
+
+	pair, err := cm.certificateFiles(host, leaf)
+	if err != nil {
+		return CertificateInfo{}, err
+	}
+
+	// The watcher must not load the new certificate with the old key
+	cm.loadMu.Lock()
+	err = replaceCertificateFiles(pair, certPEM, keyPEM)
+	cm.loadMu.Unlock()
+	if err != nil {
+		return CertificateInfo{}, err
+	}
+
+	cm.loadLocalCertificates()
+
+	key := certFileKey(pair.CertFile, pair.KeyFile)
+	if store := cm.certStore(); store != nil {
+		for _, f := range store.files {
+			if certFileKey(f.certPath, f.keyPath) == key && bytes.Equal(f.cert.Certificate[0], cert.Certificate[0]) {
+				info := cm.certificateInfo(f.name(), CertSourceFile, f.cert)
+				info.CertFile = f.certPath
+				info.Default = f.cert == store.fallback
+				return info, nil
+			}
+		}
+	}
+	return CertificateInfo{}, fmt.Errorf("certificate was written to %s but failed to load", pair.CertFile)
+}
+
+// coversHost reports whether the certificate is valid for the host. Wildcard hosts need the same wildcard name.
+func coversHost(leaf *x509.Certificate, host string) bool {
+	if strings.HasPrefix(host, "*.") {
+		for _, name := range certificateNames(leaf) {
+			if strings.EqualFold(name, host) {
+				return true
+			}
+		}
+		return false
+	}
+	return leaf.VerifyHostname(host) == nil
+}
+
+// certificateFiles returns the cert_file and key_file pair of the host to replace by a certificate like leaf.
+func (cm *CertManager) certificateFiles(host string, leaf *x509.Certificate) (config.CertificateConfig, error) {
+	cm.mu.RLock()
+	services := cm.config.Services
+	cm.mu.RUnlock()
+
+	loaded := make(map[string]*certFile)
+	if store := cm.certStore(); store != nil {
+		for _, f := range store.files {
+			loaded[certFileKey(f.certPath, f.keyPath)] = f
+		}
+	}
+
+	for _, svc := range services {
+		if !strings.EqualFold(svc.Host, host) || svc.UsesACME() || svc.TLS == nil || !svc.TLS.Enabled || svc.IsStream() {
+			continue
+		}
+
+		var pairs []config.CertificateConfig
+		for _, pair := range append([]config.CertificateConfig{{CertFile: svc.TLS.CertFile, KeyFile: svc.TLS.KeyFile}}, svc.TLS.Certificates...) {
+			if pair.CertFile != "" {
+				pairs = append(pairs, pair)
+			}
+		}
+		for _, pair := range pairs {
+			if f, ok := loaded[certFileKey(pair.CertFile, pair.KeyFile)]; ok && f.cert.Leaf.PublicKeyAlgorithm == leaf.PublicKeyAlgorithm {
+				return pair, nil
+			}
+		}
+		if len(pairs) == 1 {
+			return pairs[0], nil
+		}
+		return config.CertificateConfig{}, fmt.Errorf("%w: %s has no %s certificate to replace",
+			ErrInvalidCertificate, host, leaf.PublicKeyAlgorithm)
+	}
+
+	return config.CertificateConfig{}, fmt.Errorf("%w %s", ErrUnknownHost, host)
+}
+
+// replaceCertificateFiles writes the key and then the certificate. The previous key is restored
+// if the certificate cannot be written, so that the files keep matching.
+func replaceCertificateFiles(pair config.CertificateConfig, certPEM, keyPEM []byte) error {
+	oldKey, err := os.ReadFile(pair.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read key_file: %w", err)
+	}
+
+	if err := writeFileAtomic(pair.KeyFile, keyPEM, fileMode(pair.KeyFile, 0o600)); err != nil {
+		return fmt.Errorf("failed to write key_file: %w", err)
+	}
+	if err := writeFileAtomic(pair.CertFile, certPEM, fileMode(pair.CertFile, 0o644)); err != nil {
+		if restoreErr := writeFileAtomic(pair.KeyFile, oldKey, fileMode(pair.KeyFile, 0o600)); restoreErr != nil {
+			return fmt.Errorf("failed to write cert_file: %w (restoring key_file failed: %v)", err, restoreErr)
+		}
+		return fmt.Errorf("failed to write cert_file: %w", err)
+	}
+	return nil
+}
+
+// fileMode returns the permissions of the file, or def if it does not exist.
+func fileMode(path string, def os.FileMode) os.FileMode {
+	if info, err := os.Stat(path); err == nil {
+		return info.Mode().Perm()
+	}
+	return def
+}
+
+// RenewCertificate orders a new certificate for an ACME host right away, e.g. after its key was compromised.
+// The current certificate is served until the new one is issued.
+func (cm *CertManager) RenewCertificate(host string) (CertificateInfo, error) {
+	issuer := cm.acmeIssuer()
+	if issuer == nil || !cm.isACMEHost(host) {
+		return CertificateInfo{}, fmt.Errorf("%w: %s", ErrNotACMEHost, host)
+	}
+
+	cm.renewMu.Lock()
+	defer cm.renewMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), ACMERenewTimeout)
+	defer cancel()
+
+	// The issuer orders the certificate itself, as autocert would serve the current one from memory.
+	// Its manager keeps the renewal it scheduled and finds the new certificate in the cache when it is due.
+	if err := issuer.renew(ctx, host); err != nil {
+		return CertificateInfo{}, fmt.Errorf("failed to renew certificate of %s: %w", host, err)
+	}
+
+	cert, err := cm.GetCertificate(acmeHello(host))
+	if err != nil {
+		return CertificateInfo{}, err
+	}
+
+	cm.logger.Info("Renewed certificate through ACME on demand",
+		zap.String("host", host),
+		zap.Time("expires_at", cert.Leaf.NotAfter))
+	return cm.certificateInfo(host, CertSourceACME, cert), nil
+}
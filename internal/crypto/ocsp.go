@@ -0,0 +1,317 @@
+package certmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
+)
+
+// Default OCSP settings.
+const (
+	DefaultOCSPRefreshInterval = time.Hour
+	DefaultOCSPAlertAfter      = 24 * time.Hour
+	OCSPTimeout                = 10 * time.Second // Limits each request to an OCSP responder.
+	maxOCSPResponseSize        = 1 << 20
+)
+
+// errNoOCSP is returned for certificates without an OCSP responder or without their issuer in the chain.
+var errNoOCSP = errors.New("certificate has no OCSP responder or issuer")
+
+// ocspStapler staples OCSP responses to the certificates served, so clients need not ask the responder themselves.
+// Responses are refreshed halfway through their validity. The last good response is stored in the cache,
+// so that it is stapled again right after a restart.
+type ocspStapler struct {
+	cache      CertCache
+	alerter    Alerter
+	client     *http.Client
+	interval   time.Duration
+	alertAfter time.Duration
+	logger     *zap.Logger
+
+	staples sync.Map               // leaf key -> *tls.Certificate - copy of the certificate with its OCSP response
+	status  map[string]*ocspStatus // By leaf key, only used by the refresh loop.
+	kick    chan struct{}
+}
+
+// ocspStatus is the revocation status of a certificate as last reported by its responder.
+type ocspStatus struct {
+	response     *ocsp.Response // Last good response, nil if there is none.
+	unsupported  bool           // The certificate has no responder, it is never checked again.
+	revoked      bool
+	failingSince time.Time // Time of the first failed request since the responder last answered.
+	alerted      bool      // An alert was sent about the unreachable responder.
+}
+
+func newOCSPStapler(cache CertCache, alerter Alerter, interval, alertAfter time.Duration, logger *zap.Logger) *ocspStapler {
+	if interval == 0 {
+		interval = DefaultOCSPRefreshInterval
+	}
+	if alertAfter == 0 {
+		alertAfter = DefaultOCSPAlertAfter
+	}
+
+	return &ocspStapler{
+		cache:      cache,
+		alerter:    alerter,
+		client:     &http.Client{Timeout: OCSPTimeout},
+		interval:   interval,
+		alertAfter: alertAfter,
+		logger:     logger,
+		status:     make(map[string]*ocspStatus),
+		kick:       make(chan struct{}, 1),
+	}
+}
+
+// staple returns the certificate with its OCSP response, or the certificate itself if there is no good response.
+// Responses are looked up by the leaf, as autocert returns a new certificate value on every handshake.
+func (s *ocspStapler) staple(cert *tls.Certificate) *tls.Certificate {
+	if s == nil || len(cert.Certificate) == 0 {
+		return cert
+	}
+	if stapled, ok := s.staples.Load(leafKey(cert)); ok {
+		return stapled.(*tls.Certificate)
+	}
+	return cert
+}
+
+// refreshSoon makes the refresh loop check the certificates now, e.g. after new certificates were loaded.
+func (s *ocspStapler) refreshSoon() {
+	if s == nil {
+		return
+	}
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// run refreshes the responses of the certificates returned by certs until stopped.
+// certs returns the certificates served along with their names.
+func (s *ocspStapler) run(ctx context.Context, stop <-chan struct{}, certs func() map[*tls.Certificate]string) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.refresh(ctx, certs())
+
+		select {
+		case <-ticker.C:
+		case <-s.kick:
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refresh requests new responses for certificates whose response is due for refresh.
+func (s *ocspStapler) refresh(ctx context.Context, certs map[*tls.Certificate]string) {
+	served := make(map[string]bool, len(certs))
+	for cert := range certs {
+		served[leafKey(cert)] = true
+	}
+
+	// Forget certificates which are no longer served
+	for key := range s.status {
+		if !served[key] {
+			delete(s.status, key)
+			s.staples.Delete(key)
+		}
+	}
+
+	now := time.Now()
+	for cert, name := range certs {
+		key := leafKey(cert)
+		status, ok := s.status[key]
+		if !ok {
+			status = &ocspStatus{}
+			s.status[key] = status
+			if resp := s.loadCached(ctx, cert); resp != nil {
+				s.setResponse(cert, status, resp)
+			}
+		}
+
+		if status.unsupported || (status.response != nil && !refreshDue(status.response, now, s.interval)) {
+			continue
+		}
+
+		resp, err := s.fetch(ctx, cert)
+		switch {
+		case errors.Is(err, errNoOCSP):
+			status.unsupported = true
+			s.logger.Debug("Certificate has no OCSP responder. Not stapling", zap.String("domain", name))
+		case err != nil:
+			s.failed(cert, name, status, err, now)
+		case resp.Status == ocsp.Good:
+			s.setResponse(cert, status, resp)
+			s.storeCached(ctx, cert, resp)
+			s.logger.Debug("Stapled OCSP response",
+				zap.String("domain", name),
+				zap.Time("next_update", resp.NextUpdate))
+		case resp.Status == ocsp.Revoked:
+			s.revoked(cert, name, status, resp)
+		default:
+			s.failed(cert, name, status, errors.New("responder does not know the certificate"), now)
+		}
+	}
+}
+
+// refreshDue reports whether a response should be replaced, i.e. half of its validity passed.
+// Responses without a next update are refreshed every interval.
+func refreshDue(resp *ocsp.Response, now time.Time, interval time.Duration) bool {
+	if resp.NextUpdate.IsZero() {
+		return now.Sub(resp.ThisUpdate) >= interval
+	}
+	return now.After(resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2))
+}
+
+// setResponse staples a good response to the certificate.
+func (s *ocspStapler) setResponse(cert *tls.Certificate, status *ocspStatus, resp *ocsp.Response) {
+	stapled := *cert
+	stapled.OCSPStaple = resp.Raw
+	s.staples.Store(leafKey(cert), &stapled)
+
+	status.response = resp
+	status.revoked = false
+	status.failingSince = time.Time{}
+	status.alerted = false
+}
+
+// failed keeps the current response while it is valid and alerts once the responder is unreachable for too long.
+func (s *ocspStapler) failed(cert *tls.Certificate, name string, status *ocspStatus, err error, now time.Time) {
+	if status.failingSince.IsZero() {
+		status.failingSince = now
+	}
+	s.logger.Warn("Failed to refresh OCSP response",
+		zap.String("domain", name),
+		zap.Duration("failing_for", now.Sub(status.failingSince)),
+		zap.Error(err))
+
+	if status.response != nil && !status.response.NextUpdate.IsZero() && now.After(status.response.NextUpdate) {
+		s.logger.Warn("OCSP response expired. Not stapling", zap.String("domain", name))
+		status.response = nil
+		s.staples.Delete(leafKey(cert))
+	}
+
+	if !status.alerted && now.Sub(status.failingSince) >= s.alertAfter {
+		status.alerted = true
+		s.alert(Alert{Kind: AlertOCSPUnreachable, Domain: name, Expiry: cert.Leaf.NotAfter, Message: err.Error()})
+	}
+}
+
+// revoked stops stapling and alerts once for a certificate reported as revoked.
+func (s *ocspStapler) revoked(cert *tls.Certificate, name string, status *ocspStatus, resp *ocsp.Response) {
+	s.staples.Delete(leafKey(cert))
+	status.response = nil
+	status.failingSince = time.Time{}
+
+	s.logger.Error("Certificate has been revoked",
+		zap.String("domain", name),
+		zap.Time("revoked_at", resp.RevokedAt))
+
+	if !status.revoked {
+		status.revoked = true
+		s.alert(Alert{
+			Kind:    AlertRevoked,
+			Domain:  name,
+			Expiry:  cert.Leaf.NotAfter,
+			Message: fmt.Sprintf("revoked at %s", resp.RevokedAt.Format(time.RFC3339)),
+		})
+	}
+}
+
+func (s *ocspStapler) alert(alert Alert) {
+	if err := s.alerter.Alert(alert); err != nil {
+		s.logger.Error("Failed to send alert", zap.String("domain", alert.Domain), zap.Error(err))
+	}
+}
+
+// fetch requests the status of the certificate from its OCSP responder.
+func (s *ocspStapler) fetch(ctx context.Context, cert *tls.Certificate) (*ocsp.Response, error) {
+	leaf, issuer, err := ocspCertificates(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OCSP request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, leaf.OCSPServer[0], bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder %s returned status %d", leaf.OCSPServer[0], resp.StatusCode)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return ocsp.ParseResponseForCert(raw, leaf, issuer)
+}
+
+// ocspCertificates returns the leaf and the issuer of the certificate chain.
+func ocspCertificates(cert *tls.Certificate) (*x509.Certificate, *x509.Certificate, error) {
+	if cert.Leaf == nil || len(cert.Leaf.OCSPServer) == 0 || len(cert.Certificate) < 2 {
+		return nil, nil, errNoOCSP
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse issuer certificate: %w", err)
+	}
+	return cert.Leaf, issuer, nil
+}
+
+// ocspCacheKey is the cache key of the last good response of a certificate.
+func ocspCacheKey(cert *tls.Certificate) string {
+	return "ocsp+" + leafKey(cert)
+}
+
+// loadCached returns the cached response of the certificate if it is still good.
+func (s *ocspStapler) loadCached(ctx context.Context, cert *tls.Certificate) *ocsp.Response {
+	leaf, issuer, err := ocspCertificates(cert)
+	if err != nil {
+		return nil
+	}
+
+	raw, err := s.cache.Get(ctx, ocspCacheKey(cert))
+	if err != nil {
+		return nil
+	}
+
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil || resp.Status != ocsp.Good || (!resp.NextUpdate.IsZero() && time.Now().After(resp.NextUpdate)) {
+		return nil
+	}
+	return resp
+}
+
+func (s *ocspStapler) storeCached(ctx context.Context, cert *tls.Certificate, resp *ocsp.Response) {
+	if err := s.cache.Put(ctx, ocspCacheKey(cert), resp.Raw); err != nil {
+		s.logger.Warn("Failed to store OCSP response", zap.Error(err))
+	}
+}
@@ -0,0 +1,308 @@
+package certmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Cache keys of the ACME account key, shared with autocert. Older versions of autocert used the legacy key.
+const (
+	acmeAccountKey       = "acme_account+key"
+	acmeLegacyAccountKey = "acme_account.key"
+)
+
+// Challenge types answered by renewals on demand, in order of preference.
+var acmeChallengeTypes = []string{"tls-alpn-01", "http-01"}
+
+// current returns the certificate to serve in place of the one the manager holds for the host.
+// autocert keeps certificates in memory until their renewal is due, so a certificate renewed on demand
+// is served from the issuer until the manager loaded it from the cache, or a newer one.
+func (i *acmeIssuer) current(host string, cert *tls.Certificate) *tls.Certificate {
+	key := host
+	if cert.Leaf.PublicKeyAlgorithm == x509.RSA {
+		key += "+rsa"
+	}
+
+	value, ok := i.renewed.Load(key)
+	if !ok {
+		return cert
+	}
+	renewed := value.(*tls.Certificate)
+	if renewed.Leaf.NotBefore.After(cert.Leaf.NotBefore) {
+		return renewed
+	}
+	i.renewed.CompareAndDelete(key, renewed)
+	return cert
+}
+
+// renew orders new certificates for the host, with new keys. The RSA certificate is only renewed
+// if one was issued, i.e. clients without ECDSA support connected. The certificates are stored in the cache,
+// where the manager finds them when their renewal is due, rather than ordering certificates of its own.
+func (i *acmeIssuer) renew(ctx context.Context, host string) error {
+	keys := []string{host}
+	if _, err := i.cache.Get(ctx, host+"+rsa"); err == nil {
+		keys = append(keys, host+"+rsa")
+	}
+
+	for _, key := range keys {
+		cert, err := i.order(ctx, host, strings.HasSuffix(key, "+rsa"))
+		if err != nil {
+			return err
+		}
+
+		data, err := encodeCachedCert(cert)
+		if err != nil {
+			return err
+		}
+		if err := i.cache.Put(ctx, key, data); err != nil {
+			return fmt.Errorf("failed to store renewed certificate: %w", err)
+		}
+		i.renewed.Store(key, cert)
+	}
+	return nil
+}
+
+// order orders a certificate for the host with a new key, trying the next challenge type with a new order
+// if one fails. Challenges are answered like those of the manager: TLS-ALPN-01 by routing handshakes
+// to the issuer, HTTP-01 through the cache read by the challenge handler.
+func (i *acmeIssuer) order(ctx context.Context, host string, rsaKey bool) (*tls.Certificate, error) {
+	if err := i.register(ctx); err != nil {
+		return nil, err
+	}
+
+	var key crypto.Signer
+	var err error
+	if rsaKey {
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: host},
+		DNSNames: []string{host},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, typ := range acmeChallengeTypes {
+		o, err := i.authorize(ctx, host, typ)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", typ, err))
+			continue
+		}
+
+		chain, _, err := i.client.CreateOrderCert(ctx, o.FinalizeURL, csr, true)
+		if err != nil {
+			return nil, err
+		}
+		if len(chain) == 0 {
+			return nil, errors.New("acme: no certificate issued")
+		}
+		leaf, err := x509.ParseCertificate(chain[0])
+		if err != nil {
+			return nil, err
+		}
+		if err := leaf.VerifyHostname(host); err != nil {
+			return nil, err
+		}
+		if pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(leaf.PublicKey) {
+			return nil, errors.New("acme: issued certificate does not match the key")
+		}
+		return &tls.Certificate{Certificate: chain, PrivateKey: key, Leaf: leaf}, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// authorize creates an order for the host and satisfies its pending authorizations with challenges of the type.
+func (i *acmeIssuer) authorize(ctx context.Context, host, typ string) (*acme.Order, error) {
+	o, err := i.client.AuthorizeOrder(ctx, acme.DomainIDs(host))
+	if err != nil {
+		return nil, err
+	}
+
+	switch o.Status {
+	case acme.StatusReady:
+		return o, nil
+	case acme.StatusPending:
+	default:
+		return nil, fmt.Errorf("unexpected order status %q", o.Status)
+	}
+
+	for _, zurl := range o.AuthzURLs {
+		z, err := i.client.GetAuthorization(ctx, zurl)
+		if err != nil {
+			return nil, err
+		}
+		if z.Status != acme.StatusPending {
+			continue
+		}
+
+		var chal *acme.Challenge
+		for _, c := range z.Challenges {
+			if c.Type == typ {
+				chal = c
+			}
+		}
+		if chal == nil {
+			return nil, fmt.Errorf("challenge type not offered for %s", host)
+		}
+
+		cleanup, err := i.fulfill(ctx, host, chal)
+		if err != nil {
+			return nil, err
+		}
+		_, err = i.client.Accept(ctx, chal)
+		if err == nil {
+			_, err = i.client.WaitAuthorization(ctx, z.URI)
+		}
+		cleanup()
+		if err != nil {
+			i.client.RevokeAuthorization(ctx, z.URI)
+			return nil, err
+		}
+	}
+
+	return i.client.WaitOrder(ctx, o.URI)
+}
+
+// fulfill provides the response to the challenge and returns the function removing it.
+func (i *acmeIssuer) fulfill(ctx context.Context, host string, chal *acme.Challenge) (func(), error) {
+	switch chal.Type {
+	case "tls-alpn-01":
+		cert, err := i.client.TLSALPN01ChallengeCert(chal.Token, host)
+		if err != nil {
+			return nil, err
+		}
+		i.tokens.Store(host, &cert)
+		return func() { i.tokens.Delete(host) }, nil
+	case "http-01":
+		resp, err := i.client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return nil, err
+		}
+		// The challenge handler of autocert looks up unknown tokens in the cache
+		key := path.Base(i.client.HTTP01ChallengePath(chal.Token)) + "+http-01"
+		if err := i.cache.Put(ctx, key, []byte(resp)); err != nil {
+			return nil, err
+		}
+		return func() { i.cache.Delete(context.Background(), key) }, nil
+	}
+	return nil, fmt.Errorf("unsupported challenge type %q", chal.Type)
+}
+
+// register registers the ACME account of the manager with the client, once.
+func (i *acmeIssuer) register(ctx context.Context) error {
+	if i.client.Key != nil {
+		return nil
+	}
+
+	key, err := i.accountKey(ctx)
+	if err != nil {
+		return fmt.Errorf("acme: failed to load account key: %w", err)
+	}
+	i.client.Key = key
+
+	var contact []string
+	if i.email != "" {
+		contact = []string{"mailto:" + i.email}
+	}
+	_, err = i.client.Register(ctx, &acme.Account{Contact: contact}, acme.AcceptTOS)
+	var acmeErr *acme.Error
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) &&
+		!(errors.As(err, &acmeErr) && acmeErr.StatusCode == http.StatusConflict) {
+		i.client.Key = nil
+		return fmt.Errorf("acme: failed to register account: %w", err)
+	}
+	return nil
+}
+
+// accountKey returns the account key autocert stored in the cache, creating it if autocert did not yet.
+func (i *acmeIssuer) accountKey(ctx context.Context) (crypto.Signer, error) {
+	data, err := i.cache.Get(ctx, acmeAccountKey)
+	if errors.Is(err, autocert.ErrCacheMiss) {
+		data, err = i.cache.Get(ctx, acmeLegacyAccountKey)
+	}
+	if errors.Is(err, autocert.ErrCacheMiss) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := i.cache.Put(ctx, acmeAccountKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || !strings.Contains(block.Type, "PRIVATE") {
+		return nil, errors.New("invalid account key in cache")
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New("invalid account key in cache")
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("invalid account key in cache")
+	}
+	return signer, nil
+}
+
+// encodeCachedCert encodes the certificate in the format autocert caches certificates in:
+// the private key followed by the chain, as PEM.
+func encodeCachedCert(cert *tls.Certificate) ([]byte, error) {
+	var buf bytes.Buffer
+	switch key := cert.PrivateKey.(type) {
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	case *rsa.PrivateKey:
+		pem.Encode(&buf, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", cert.PrivateKey)
+	}
+
+	for _, der := range cert.Certificate {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,193 @@
+package certmanager
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultCertReloadInterval is how often certificate files are checked for changes, unless configured otherwise.
+const DefaultCertReloadInterval = 30 * time.Second
+
+// fileStamp identifies the version of a file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func stampOf(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// certFile is a certificate loaded from a cert_file and key_file pair. It is never modified once loaded,
+// changed files are loaded into a new certFile.
+type certFile struct {
+	certPath string
+	keyPath  string
+	certStat fileStamp
+	keyStat  fileStamp
+	cert     *tls.Certificate
+}
+
+// certFileKey identifies the certificate of a cert_file and key_file pair.
+func certFileKey(certPath, keyPath string) string {
+	return certPath + "\x00" + keyPath
+}
+
+// loadCertFile loads the certificate and its private key.
+func loadCertFile(certPath, keyPath string) (*certFile, error) {
+	certStat, err := stampOf(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cert_file: %w", err)
+	}
+	keyStat, err := stampOf(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key_file: %w", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		cert.Leaf = leaf
+	}
+
+	return &certFile{
+		certPath: certPath,
+		keyPath:  keyPath,
+		certStat: certStat,
+		keyStat:  keyStat,
+		cert:     &cert,
+	}, nil
+}
+
+// changed reports whether the files were modified since they were loaded.
+// Files which can not be read right now, e.g. while being replaced, are not considered changed yet.
+func (f *certFile) changed() bool {
+	certStat, err := stampOf(f.certPath)
+	if err != nil {
+		return false
+	}
+	keyStat, err := stampOf(f.keyPath)
+	if err != nil {
+		return false
+	}
+	return certStat != f.certStat || keyStat != f.keyStat
+}
+
+// name returns the name the certificate is reported under, e.g. in metrics and alerts.
+func (f *certFile) name() string {
+	if names := certificateNames(f.cert.Leaf); len(names) > 0 {
+		return names[0]
+	}
+	return f.certPath
+}
+
+// certStore is a snapshot of the local certificates, indexed by the DNS names they are valid for.
+// Snapshots are replaced as a whole, so handshakes never see a certificate without its key.
+type certStore struct {
+	files    []*certFile                   // In configuration order.
+	names    map[string][]*tls.Certificate // Exact and wildcard names (e.g. "*.example.com"), ECDSA certificates first.
+	fallback *tls.Certificate              // Default certificate, nil if not configured.
+}
+
+// newCertStore indexes the certificates of the files by their names and by the hosts of the services they are configured for.
+// fallback is one of the files or nil.
+func newCertStore(files []*certFile, hosts map[*certFile][]string, fallback *certFile) *certStore {
+	store := &certStore{
+		files: files,
+		names: make(map[string][]*tls.Certificate),
+	}
+	if fallback != nil {
+		store.fallback = fallback.cert
+	}
+
+	for _, f := range files {
+		names := append(certificateNames(f.cert.Leaf), hosts[f]...)
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if !containsCert(store.names[name], f.cert) {
+				store.names[name] = append(store.names[name], f.cert)
+			}
+		}
+	}
+
+	// Clients supporting ECDSA get the smaller and faster ECDSA certificate, all others fall back to RSA
+	for _, certs := range store.names {
+		sort.SliceStable(certs, func(i, j int) bool {
+			return certs[i].Leaf.PublicKeyAlgorithm != x509.RSA && certs[j].Leaf.PublicKeyAlgorithm == x509.RSA
+		})
+	}
+
+	return store
+}
+
+func containsCert(certs []*tls.Certificate, cert *tls.Certificate) bool {
+	for _, c := range certs {
+		if c == cert {
+			return true
+		}
+	}
+	return false
+}
+
+// certificateNames returns the lower cased DNS names of the certificate.
+// The common name is only used by certificates without DNS names.
+func certificateNames(leaf *x509.Certificate) []string {
+	names := leaf.DNSNames
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = []string{leaf.Subject.CommonName}
+	}
+
+	lower := make([]string, 0, len(names))
+	for _, name := range names {
+		lower = append(lower, strings.ToLower(name))
+	}
+	return lower
+}
+
+// lookup returns the certificates valid for the server name. Certificates for the exact name are preferred
+// over wildcard certificates, which cover a single label like *.example.com covers app.example.com.
+func (s *certStore) lookup(serverName string) []*tls.Certificate {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if name == "" {
+		return nil
+	}
+	if certs := s.names[name]; len(certs) > 0 {
+		return certs
+	}
+	if _, parent, found := strings.Cut(name, "."); found && parent != "" {
+		return s.names["*."+parent]
+	}
+	return nil
+}
+
+// selectCertificate returns the certificate for the client hello: the first certificate valid for the server name
+// which the client supports, the default certificate for unknown names, nil if there is none.
+func (s *certStore) selectCertificate(hello *tls.ClientHelloInfo) *tls.Certificate {
+	certs := s.lookup(hello.ServerName)
+	if len(certs) == 0 {
+		return s.fallback
+	}
+
+	for _, cert := range certs {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert
+		}
+	}
+	// Let the handshake fail with a meaningful error rather than without a certificate
+	return certs[0]
+}
@@ -2,6 +2,7 @@ package health
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
@@ -11,23 +12,31 @@ import (
 	"time"
 
 	"github.com/unkn0wn-root/terraster/internal/pool"
+	"github.com/unkn0wn-root/terraster/pkg/metrics"
+	"github.com/unkn0wn-root/terraster/pkg/proxyproto"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"golang.org/x/net/http2"
 )
 
 // Supported health check types
 const (
 	HealthCheckTypeHTTP = "http"
 	HealthCheckTypeTCP  = "tcp"
+	HealthCheckTypeGRPC = "grpc"
 )
 
 // Checker periodically checks the health of backends in registered ServerPools.
 type Checker struct {
+	service  string // Name of the service the checker belongs to, used as metrics label.
 	interval time.Duration
 	timeout  time.Duration
 	pools    []*pool.ServerPool
 	mu       sync.RWMutex
-	client   *http.Client
+	client   *http.Client               // HTTP health checks of plaintext backends.
+	grpcH2C  *http.Client               // gRPC health checks of plaintext backends.
+	clients  map[clientKey]*http.Client // Health checks of https backends and backends expecting a PROXY header.
+	clientMu sync.Mutex                 // Guards clients.
 	logger   *zap.Logger
 	running  atomic.Bool
 	cancel   context.CancelFunc
@@ -35,17 +44,20 @@ type Checker struct {
 	prefix   string
 }
 
-// creates a new health checker with the given interval and timeout.
-func NewChecker(interval, timeout time.Duration, logger *zap.Logger, prefix string) *Checker {
+// creates a new health checker for the named service with the given interval and timeout.
+func NewChecker(service string, interval, timeout time.Duration, logger *zap.Logger, prefix string) *Checker {
 	return &Checker{
+		service:  service,
 		interval: interval,
 		timeout:  timeout,
 		pools:    make([]*pool.ServerPool, 0),
 		client: &http.Client{
 			Timeout: timeout,
 		},
-		logger: logger,
-		prefix: prefix,
+		grpcH2C: &http.Client{Timeout: timeout, Transport: pool.NewH2CTransport()},
+		clients: make(map[clientKey]*http.Client),
+		logger:  logger,
+		prefix:  prefix,
 	}
 }
 
@@ -133,6 +145,8 @@ func (c *Checker) checkBackend(b *pool.Backend) {
 		c.performHTTPHealthCheck(b)
 	case HealthCheckTypeTCP:
 		c.performTCPHealthCheck(b)
+	case HealthCheckTypeGRPC:
+		c.performGRPCHealthCheck(b)
 	default:
 		c.logf(zap.WarnLevel, "Unsupported health check type '%s' for backend %s", b.HealthCheckCfg.Type, b.URL)
 		c.updateBackendHealth(b, false)
@@ -156,7 +170,7 @@ func (c *Checker) performHTTPHealthCheck(b *pool.Backend) {
 		return
 	}
 
-	resp, err := c.client.Do(req)
+	resp, err := c.httpClient(b, false).Do(req)
 	if err != nil {
 		c.logf(zap.WarnLevel, "HTTP health check failed for %s: %v", b.URL, err)
 		c.updateBackendHealth(b, false)
@@ -193,18 +207,35 @@ func (c *Checker) performTCPHealthCheck(b *pool.Backend) {
 		c.updateBackendHealth(b, false)
 		return
 	}
+	// Backends expecting the PROXY protocol may log connections closed without a header as errors
+	if b.ProxyProtocol != "" {
+		conn.SetWriteDeadline(time.Now().Add(c.timeout))
+		proxyproto.WriteHeader(conn, b.ProxyProtocol, nil, nil)
+	}
 	conn.Close()
 	c.updateBackendHealth(b, true)
 }
 
 // updates the backend's health status based on the check result.
 func (c *Checker) updateBackendHealth(b *pool.Backend, healthy bool) {
+	backendURL := b.URL.String()
+	defer func() {
+		up := 0.0
+		if b.Alive.Load() {
+			up = 1
+		}
+		metrics.BackendUp.WithLabelValues(c.service, backendURL).Set(up)
+	}()
+
 	if healthy {
+		metrics.HealthChecksTotal.WithLabelValues(c.service, backendURL, "success").Inc()
 		newSuccess := atomic.AddInt32(&b.SuccessCount, 1)
 		atomic.StoreInt32(&b.FailureCount, 0)
 		if newSuccess >= int32(b.HealthCheckCfg.Thresholds.Healthy) {
-			if !b.Alive.Load() {
+			// Ejected backends are restored by outlier detection, not by the health checker.
+			if !b.Alive.Load() && (!b.IsEjected() || b.HealthCheckFailed()) {
 				c.logf(zap.InfoLevel, "Backend %s marked as healthy", b.URL)
+				metrics.HealthTransitionsTotal.WithLabelValues(c.service, backendURL, "healthy").Inc()
 				s := findServerPool(c.pools, b)
 				if s != nil {
 					s.MarkBackendStatus(b.URL, true)
@@ -212,11 +243,13 @@ func (c *Checker) updateBackendHealth(b *pool.Backend, healthy bool) {
 			}
 		}
 	} else {
+		metrics.HealthChecksTotal.WithLabelValues(c.service, backendURL, "failure").Inc()
 		newFailure := atomic.AddInt32(&b.FailureCount, 1)
 		atomic.StoreInt32(&b.SuccessCount, 0)
 		if newFailure >= int32(b.HealthCheckCfg.Thresholds.Unhealthy) {
-			if b.Alive.Load() {
+			if b.Alive.Load() || (b.IsEjected() && !b.HealthCheckFailed()) {
 				c.logf(zap.WarnLevel, "Backend %s marked as unhealthy", b.URL)
+				metrics.HealthTransitionsTotal.WithLabelValues(c.service, backendURL, "unhealthy").Inc()
 				s := findServerPool(c.pools, b)
 				if s != nil {
 					s.MarkBackendStatus(b.URL, false)
@@ -251,3 +284,63 @@ func findServerPool(pools []*pool.ServerPool, backend *pool.Backend) *pool.Serve
 	}
 	return nil
 }
+
+// clientKey identifies the client used for health checks of backends with the same connection settings.
+type clientKey struct {
+	tlsConfig     *tls.Config
+	proxyProtocol string
+	grpc          bool
+}
+
+// httpClient returns the client checking the backend. Backends are checked with the TLS configuration
+// used to proxy requests to them, and announce health checks to backends expecting a PROXY header.
+func (c *Checker) httpClient(b *pool.Backend, grpc bool) *http.Client {
+	if b.TLSConfig == nil && b.ProxyProtocol == "" {
+		if grpc {
+			return c.grpcH2C
+		}
+		return c.client
+	}
+
+	key := clientKey{tlsConfig: b.TLSConfig, proxyProtocol: b.ProxyProtocol, grpc: grpc}
+	c.clientMu.Lock()
+	defer c.clientMu.Unlock()
+	if client, ok := c.clients[key]; ok {
+		return client
+	}
+
+	var client *http.Client
+	if grpc {
+		client = &http.Client{Timeout: c.timeout, Transport: &http2.Transport{TLSClientConfig: key.tlsConfig}}
+	} else {
+		client = newHTTPClient(key, c.timeout)
+	}
+	c.clients[key] = client
+	return client
+}
+
+// newHTTPClient creates a client for HTTP health checks.
+// Health checks are made by Terraster itself, so connections to backends expecting a PROXY header
+// are announced as LOCAL (v2) or UNKNOWN (v1).
+func newHTTPClient(key clientKey, timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     key.tlsConfig,
+		MaxIdleConnsPerHost: 1,
+	}
+	if key.proxyProtocol != "" {
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			if err := proxyproto.WriteHeader(conn, key.proxyProtocol, nil, nil); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
@@ -0,0 +1,145 @@
+package health
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/unkn0wn-root/terraster/internal/pool"
+	"go.uber.org/zap"
+)
+
+// grpcHealthPath is the method of the standard gRPC health checking protocol (grpc.health.v1).
+const grpcHealthPath = "/grpc.health.v1.Health/Check"
+
+// grpcServing is the SERVING value of grpc.health.v1.HealthCheckResponse.ServingStatus.
+const grpcServing = 1
+
+// gRPC-based health check using the grpc.health.v1 protocol.
+// The backend is healthy if it answers the Check call with SERVING.
+func (c *Checker) performGRPCHealthCheck(b *pool.Backend) {
+	err := c.grpcHealthCheck(c.httpClient(b, true), b.URL, b.HealthCheckCfg.Service)
+	if err != nil {
+		c.logf(zap.WarnLevel, "gRPC health check failed for %s: %v", b.URL, err)
+		c.updateBackendHealth(b, false)
+		return
+	}
+	c.updateBackendHealth(b, true)
+}
+
+func (c *Checker) grpcHealthCheck(client *http.Client, target *url.URL, service string) error {
+	healthURL := *target
+	healthURL.Path = grpcHealthPath
+	healthURL.RawQuery = ""
+
+	req, err := http.NewRequest(http.MethodPost, healthURL.String(), bytes.NewReader(encodeGRPCHealthRequest(service)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected HTTP status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return err
+	}
+
+	// A trailers-only response carries the status in the headers.
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if status != "0" {
+		msg := resp.Trailer.Get("Grpc-Message")
+		if msg == "" {
+			msg = resp.Header.Get("Grpc-Message")
+		}
+		return fmt.Errorf("grpc-status %s: %s", status, msg)
+	}
+
+	servingStatus, err := decodeGRPCHealthResponse(body)
+	if err != nil {
+		return err
+	}
+	if servingStatus != grpcServing {
+		return fmt.Errorf("serving status %d", servingStatus)
+	}
+
+	return nil
+}
+
+// encodeGRPCHealthRequest encodes a HealthCheckRequest{service} message in a gRPC frame.
+func encodeGRPCHealthRequest(service string) []byte {
+	var msg []byte
+	if service != "" {
+		msg = append(msg, 0x0a) // field 1, length-delimited
+		msg = binary.AppendUvarint(msg, uint64(len(service)))
+		msg = append(msg, service...)
+	}
+
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// decodeGRPCHealthResponse returns the status of a HealthCheckResponse message in a gRPC frame.
+func decodeGRPCHealthResponse(frame []byte) (uint64, error) {
+	if len(frame) < 5 {
+		return 0, errors.New("short gRPC response")
+	}
+	if frame[0] != 0 {
+		return 0, errors.New("compressed gRPC response is not supported")
+	}
+
+	size := binary.BigEndian.Uint32(frame[1:5])
+	if uint32(len(frame)-5) < size {
+		return 0, errors.New("truncated gRPC response")
+	}
+	msg := frame[5 : 5+size]
+
+	// The status defaults to UNKNOWN (0) if the field is not present.
+	var status uint64
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0, errors.New("malformed health check response")
+		}
+		msg = msg[n:]
+
+		switch tag & 0x7 {
+		case 0: // varint
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0, errors.New("malformed health check response")
+			}
+			if tag>>3 == 1 {
+				status = v
+			}
+			msg = msg[n:]
+		case 2: // length-delimited
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return 0, errors.New("malformed health check response")
+			}
+			msg = msg[n+int(l):]
+		default:
+			return 0, fmt.Errorf("unexpected wire type %d in health check response", tag&0x7)
+		}
+	}
+
+	return status, nil
+}
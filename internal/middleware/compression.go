@@ -28,7 +28,9 @@ func NewCompressionMiddleware() Middleware {
 func (c *CompressionMiddleware) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Check if the client accepts gzip encoding by inspecting the "Accept-Encoding" header.
-		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		// gRPC has its own message compression and its framing must reach the client untouched.
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") ||
+			strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -43,6 +45,7 @@ func (c *CompressionMiddleware) Middleware(next http.Handler) http.Handler {
 		compressedWriter := compressionWriter{
 			Writer:         gz, // Set the gzip.Writer as the writer to handle compression.
 			ResponseWriter: w,  // Embed the original ResponseWriter to maintain interface compliance.
+			gz:             gz, // Flushed before the ResponseWriter on Flush.
 		}
 
 		next.ServeHTTP(compressedWriter, r)
@@ -55,6 +58,7 @@ func (c *CompressionMiddleware) Middleware(next http.Handler) http.Handler {
 type compressionWriter struct {
 	io.Writer           // Embeds io.Writer to handle the actual writing of compressed data.
 	http.ResponseWriter // Embeds http.ResponseWriter to satisfy the http.ResponseWriter interface.
+	gz                  *gzip.Writer
 }
 
 // Write overrides the default Write method to write compressed data.
@@ -65,8 +69,10 @@ func (c compressionWriter) Write(b []byte) (int, error) {
 }
 
 // Flush allows the compressionWriter to support flushing of the response.
-// It delegates the flush operation to the embedded ResponseWriter if it implements the http.Flusher interface.
+// It flushes the data buffered by the gzip.Writer first, so that streamed responses reach the client,
+// then delegates the flush operation to the embedded ResponseWriter if it implements the http.Flusher interface.
 func (c compressionWriter) Flush() {
+	_ = c.gz.Flush()
 	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
 		flusher.Flush()
 	}
@@ -1,8 +1,17 @@
 package middleware
 
+import "net/http"
+
 type contextKey int
 
 const (
 	BackendKey contextKey = iota
 	RetryKey
+	ServiceKey
 )
+
+// serviceName returns the name of the service handling the request or an empty string if unknown.
+func serviceName(r *http.Request) string {
+	name, _ := r.Context().Value(ServiceKey).(string)
+	return name
+}
@@ -5,6 +5,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/unkn0wn-root/terraster/pkg/clientip"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -82,6 +83,18 @@ func (rw *responseWriter) Write(b []byte) (int, error) {
 	return size, err
 }
 
+// flushes the underlying ResponseWriter so that streamed responses (e.g. gRPC) are not held back.
+func (rw *responseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// returns the underlying ResponseWriter for http.ResponseController.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 func (l *LoggingMiddleware) shouldExcludePath(path string) bool {
 	for _, excludePath := range l.excludePaths {
 		if strings.HasPrefix(path, excludePath) {
@@ -109,7 +122,7 @@ func (l *LoggingMiddleware) Middleware(next http.Handler) http.Handler {
 			zap.String("path", r.URL.Path),
 			zap.Int("status", rw.status),
 			zap.Duration("duration", duration),
-			zap.String("ip", getIPAddress(r)),
+			zap.String("ip", clientip.FromRequest(r)),
 			zap.String("user_agent", r.UserAgent()),
 			zap.Int64("response_size", rw.size),
 		)
@@ -140,22 +153,3 @@ func (l *LoggingMiddleware) Middleware(next http.Handler) http.Handler {
 		}
 	})
 }
-
-// extracts the IP address from the request.
-func getIPAddress(r *http.Request) string {
-	// Attempt to get the IP from the X-Forwarded-For header
-	xff := r.Header.Get("X-Forwarded-For")
-	if xff != "" {
-		// X-Forwarded-For can contain multiple IPs, the first is the client
-		parts := strings.Split(xff, ",")
-		return strings.TrimSpace(parts[0])
-	}
-
-	// Fallback to the remote address
-	ip := r.RemoteAddr
-	// Remove the port if present
-	if colon := strings.LastIndex(ip, ":"); colon != -1 {
-		return ip[:colon]
-	}
-	return ip
-}
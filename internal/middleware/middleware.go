@@ -6,7 +6,6 @@ import (
 	"net"
 	"net/http"
 	"reflect"
-	"time"
 
 	"github.com/unkn0wn-root/terraster/internal/config"
 	"go.uber.org/zap"
@@ -128,39 +127,32 @@ func (c *MiddlewareChain) Then(final http.Handler) http.Handler {
 }
 
 // AddConfiguredMiddlewars adds middleware to the chain based on the provided configuration.
-// It checks the configuration for enabled middleware features like Circuit Breaker, Rate Limiting, and Security,
+// It checks the configuration for enabled middleware features like Rate Limiting, Security and CORS,
 // and adds the corresponding middleware to the chain.
-func (c *MiddlewareChain) AddConfiguredMiddlewares(config *config.Config, logger *zap.Logger) {
+// Returns an error if the rate limiter cannot be created.
+func (c *MiddlewareChain) AddConfiguredMiddlewares(config *config.Config, logger *zap.Logger) error {
 	for _, mw := range config.Middleware {
 		switch {
-		// Circuit Breaker Middleware
+		// Circuit Breaker
+		// Circuits are kept per backend in the server pools, see service.Manager.
 		case mw.CircuitBreaker != nil:
-			cir := mw.CircuitBreaker
-			threshold := cir.FailureThreshold
-			resetTimeout := cir.ResetTimeout
-			if threshold == 0 {
-				threshold = 5
-			}
-
-			if resetTimeout == 0 {
-				resetTimeout = 30 * time.Second
-			}
-
-			cb := NewCircuitBreaker(threshold, resetTimeout)
-			c.Use(cb)
-
-			logger.Info("Global Circuit Breaker middleware configured",
-				zap.Int("failure_threshold", threshold),
-				zap.Duration("reset_timeout", resetTimeout))
+			logger.Info("Global Circuit Breaker configured for backends of all locations",
+				zap.Int("failure_threshold", mw.CircuitBreaker.FailureThreshold),
+				zap.Duration("reset_timeout", mw.CircuitBreaker.ResetTimeout))
 		// Rate Limiting Middleware
 		case mw.RateLimit != nil:
 			rml := mw.RateLimit
-			rl := NewRateLimiterMiddleware(rml.RequestsPerSecond, rml.Burst)
+			rl, err := NewRateLimiterMiddleware(*rml)
+			if err != nil {
+				return fmt.Errorf("failed to configure global rate limiter: %w", err)
+			}
 			c.Use(rl)
 
 			logger.Info("Global Rate Limiter middleware configured",
 				zap.Float64("requests_per_second", rml.RequestsPerSecond),
-				zap.Int("burst", rml.Burst))
+				zap.Int("burst", rml.Burst),
+				zap.String("key", rml.Key),
+				zap.String("backend", rml.Backend))
 		// Security Middleware (HTTP Headers)
 		case mw.Security != nil:
 			sec := NewSecurityMiddleware(config)
@@ -175,4 +167,5 @@ func (c *MiddlewareChain) AddConfiguredMiddlewares(config *config.Config, logger
 			logger.Info("Global CORS middleware enabled configured")
 		}
 	}
+	return nil
 }
@@ -0,0 +1,227 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+	"github.com/unkn0wn-root/terraster/pkg/redis"
+)
+
+const (
+	DefaultRedisKeyPrefix = "terraster:ratelimit:"
+
+	// redisRetryInterval is how long the store is skipped after a failure,
+	// so that an unreachable server does not add its timeout to every request.
+	redisRetryInterval = time.Second
+)
+
+// maxRedisAttempts limits how often a request retries to store its state while other instances change it.
+const maxRedisAttempts = 5
+
+var (
+	errRedisUnavailable = errors.New("rate limit store unavailable")
+	errRedisContended   = errors.New("rate limit state changed concurrently too often")
+)
+
+// stateScript reads and replaces the state of a key atomically. The limits are computed in Go,
+// so the script only compares and sets: called with the state read before (ARGV[1]), the new state
+// (ARGV[2]) and its TTL in milliseconds (ARGV[3]), it stores the new state if the key still holds the old one
+// and returns {1}. Otherwise, or when called without arguments, it returns {0, state, seconds, microseconds}
+// with the current state ("" if there is none) and the server time, so that clocks of instances do not matter.
+var stateScript = redis.NewScript(`
+local t = redis.call('TIME')
+local state = redis.call('GET', KEYS[1]) or ''
+if #ARGV == 3 and state == ARGV[1] then
+  redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+  return {1}
+end
+return {0, state, t[1], t[2]}
+`)
+
+// sharedLimiter computes the decision of a request from the state of its key in Redis, "" if there is none.
+// Returns the new state and how long it has to be kept, which is only stored if the request is allowed.
+type sharedLimiter interface {
+	allow(state string, now time.Time) (RateDecision, string, time.Duration)
+}
+
+// gcra implements the generic cell rate algorithm, which behaves like a token bucket
+// but only stores the theoretical arrival time (TAT) of the next request, in microseconds.
+type gcra struct {
+	interval float64 // Time between requests at the sustained rate, in microseconds.
+	burst    int
+}
+
+func (g gcra) allow(state string, now time.Time) (RateDecision, string, time.Duration) {
+	t := float64(now.UnixMicro())
+	tat := t
+	if v, err := strconv.ParseFloat(state, 64); err == nil && v > tat {
+		tat = v
+	}
+
+	d := RateDecision{Limit: g.burst}
+	next := tat + g.interval
+	allowAt := next - g.interval*float64(g.burst)
+	if allowAt > t {
+		d.RetryAfter = microseconds(allowAt - t)
+		d.Reset = microseconds(tat - t)
+		return d, state, 0
+	}
+
+	d.Allowed = true
+	d.Remaining = int((t - allowAt) / g.interval)
+	d.Reset = microseconds(next - t)
+	return d, strconv.FormatFloat(next, 'f', 0, 64), d.Reset
+}
+
+// sharedSlidingWindow is the shared variant of slidingWindow, storing its start (in microseconds)
+// and the two counters as "start:prev:cur".
+type sharedSlidingWindow struct {
+	limit  int
+	window time.Duration
+}
+
+func (s sharedSlidingWindow) allow(state string, now time.Time) (RateDecision, string, time.Duration) {
+	w := newSlidingWindow(s.limit, s.window, now)
+	var start int64
+	if _, err := fmt.Sscanf(state, "%d:%d:%d", &start, &w.prev, &w.cur); err == nil && start <= now.UnixMicro() {
+		w.start = time.UnixMicro(start)
+	} else {
+		// Unknown or invalid state, e.g. of a limit which changed its algorithm, starts over.
+		w.prev, w.cur = 0, 0
+	}
+
+	d := w.allow(now)
+	return d, fmt.Sprintf("%d:%d:%d", w.start.UnixMicro(), w.prev, w.cur), 2 * s.window
+}
+
+func microseconds(us float64) time.Duration {
+	return time.Duration(math.Ceil(us)) * time.Microsecond
+}
+
+// redisStore is a RateLimitStore sharing the limits between all instances using the same server.
+// Keys are scoped by service and route, so services do not share their quota.
+type redisStore struct {
+	client    *redis.Client
+	limiter   sharedLimiter
+	prefix    string // Key prefix including the route scope.
+	downUntil atomic.Int64
+}
+
+func newRedisStore(cfg config.RateLimitConfig, scope string, rps float64, burst int) *redisStore {
+	prefix := cfg.Redis.KeyPrefix
+	if prefix == "" {
+		prefix = DefaultRedisKeyPrefix
+	}
+
+	s := &redisStore{
+		client: sharedRedisClient(cfg.Redis),
+		prefix: prefix + scope + ":",
+	}
+
+	if cfg.Algorithm == "sliding-window" {
+		window := cfg.Window
+		if window <= 0 {
+			window = DefaultRateLimitWindow
+		}
+		s.limiter = sharedSlidingWindow{limit: int(math.Max(1, math.Floor(rps*window.Seconds()))), window: window}
+		return s
+	}
+
+	s.limiter = gcra{interval: 1e6 / rps, burst: burst}
+	return s
+}
+
+// Allow reads the state of the key of the service in the request context, computes the decision
+// and stores the new state if the request is allowed. If another instance changed the state in between,
+// the decision is computed again from the changed state.
+func (s *redisStore) Allow(ctx context.Context, key string) (RateDecision, error) {
+	if time.Now().UnixNano() < s.downUntil.Load() {
+		return RateDecision{}, errRedisUnavailable
+	}
+
+	name, _ := ctx.Value(ServiceKey).(string)
+	keys := []string{s.prefix + name + ":" + key}
+
+	state, now, _, err := s.run(ctx, keys)
+	for attempt := 1; err == nil; attempt++ {
+		d, next, ttl := s.limiter.allow(state, now)
+		if !d.Allowed {
+			return d, nil
+		}
+
+		var stored bool
+		ttlMillis := strconv.FormatInt(max(1, int64(math.Ceil(float64(ttl)/float64(time.Millisecond)))), 10)
+		state, now, stored, err = s.run(ctx, keys, state, next, ttlMillis)
+		if err == nil && stored {
+			return d, nil
+		}
+		if err == nil && attempt == maxRedisAttempts {
+			err = errRedisContended
+		}
+	}
+	return RateDecision{}, err
+}
+
+// run executes the state script. Returns whether the state was stored, or the current state and server time.
+// Failing connections make the store back off, error replies of the server do not.
+func (s *redisStore) run(ctx context.Context, keys []string, args ...string) (string, time.Time, bool, error) {
+	reply, err := stateScript.Run(ctx, s.client, keys, args...)
+	if err != nil {
+		var replyErr redis.Error
+		if !errors.As(err, &replyErr) {
+			s.downUntil.Store(time.Now().Add(redisRetryInterval).UnixNano())
+		}
+		return "", time.Time{}, false, err
+	}
+
+	values, ok := reply.([]interface{})
+	if ok && len(values) == 1 && values[0] == int64(1) {
+		return "", time.Time{}, true, nil
+	}
+	if !ok || len(values) != 4 || values[0] != int64(0) {
+		return "", time.Time{}, false, fmt.Errorf("unexpected rate limit script reply %v", reply)
+	}
+
+	state, _ := values[1].(string)
+	sec, secErr := strconv.ParseInt(fmt.Sprint(values[2]), 10, 64)
+	usec, usecErr := strconv.ParseInt(fmt.Sprint(values[3]), 10, 64)
+	if secErr != nil || usecErr != nil {
+		return "", time.Time{}, false, fmt.Errorf("unexpected rate limit script reply %v", reply)
+	}
+	return state, time.Unix(sec, usec*int64(time.Microsecond)), false, nil
+}
+
+var (
+	redisClientsMu sync.Mutex
+	redisClients   = make(map[config.RedisConfig]*redis.Client)
+)
+
+// sharedRedisClient returns a client for the configuration. Clients are shared between
+// services and kept across config reloads, so connections are not leaked when middleware is rebuilt.
+func sharedRedisClient(cfg *config.RedisConfig) *redis.Client {
+	redisClientsMu.Lock()
+	defer redisClientsMu.Unlock()
+
+	key := *cfg
+	key.KeyPrefix = ""
+	if client, ok := redisClients[key]; ok {
+		return client
+	}
+
+	client := redis.NewClient(redis.Options{
+		Address:  cfg.Address,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+		Timeout:  cfg.Timeout,
+		PoolSize: cfg.PoolSize,
+	})
+	redisClients[key] = client
+	return client
+}
@@ -0,0 +1,476 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+)
+
+// fakeRedis is an in-process stand-in for a Redis server. It speaks RESP and answers EVAL and EVALSHA
+// of the state script by doing what the script does: comparing and setting the state of a key and
+// returning it along with the time. Expiry of keys is not emulated.
+type fakeRedis struct {
+	ln    net.Listener
+	conns atomic.Int64 // Number of accepted connections.
+	down  atomic.Bool  // Connections are closed without a reply, like an unreachable server.
+
+	mu       sync.Mutex
+	scripts  map[string]bool // SHA1 digests of the scripts sent with EVAL.
+	state    map[string]string
+	now      time.Time // Server time, advanced by tests.
+	commands []string
+	replyErr string       // Error reply to scripts, e.g. of a failing script.
+	onRead   func(string) // Called with the lock held after the state of the key was read, e.g. to change it concurrently.
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	f := &fakeRedis{
+		ln:      ln,
+		scripts: make(map[string]bool),
+		state:   make(map[string]string),
+		now:     time.Unix(1700000000, 0),
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.conns.Add(1)
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) addr() string {
+	return f.ln.Addr().String()
+}
+
+// received returns the names of the commands received so far.
+func (f *fakeRedis) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if f.down.Load() {
+			return
+		}
+		if _, err := io.WriteString(conn, f.reply(args)); err != nil {
+			return
+		}
+	}
+}
+
+// reply executes a command and returns its RESP encoded reply.
+func (f *fakeRedis) reply(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commands = append(f.commands, args[0])
+
+	switch args[0] {
+	case "EVAL":
+		sum := sha1.Sum([]byte(args[1]))
+		f.scripts[hex.EncodeToString(sum[:])] = true
+	case "EVALSHA":
+		if !f.scripts[args[1]] {
+			return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+		}
+	default:
+		return "-ERR unknown command\r\n"
+	}
+	if f.replyErr != "" {
+		return "-" + f.replyErr + "\r\n"
+	}
+
+	// EVAL(SHA) script numkeys key [old new ttl]
+	key, argv := args[3], args[4:]
+	state := f.state[key]
+	if len(argv) == 3 && state == argv[0] {
+		f.state[key] = argv[1]
+		return "*1\r\n:1\r\n"
+	}
+	reply := fmt.Sprintf("*4\r\n:0\r\n%s%s%s", bulk(state),
+		bulk(strconv.FormatInt(f.now.Unix(), 10)), bulk(strconv.Itoa(f.now.Nanosecond()/1000)))
+	if f.onRead != nil {
+		f.onRead(key)
+	}
+	return reply
+}
+
+// advance moves the server time forward.
+func (f *fakeRedis) advance(d time.Duration) {
+	f.mu.Lock()
+	f.now = f.now.Add(d)
+	f.mu.Unlock()
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+// readCommand reads a command sent as an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	n, err := readLength(r, '*')
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		size, err := readLength(r, '$')
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// readLength reads a line with the given type prefix and returns its length, e.g. "$5\r\n".
+func readLength(r *bufio.Reader, prefix byte) (int, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 3 || line[0] != prefix {
+		return 0, fmt.Errorf("unexpected line %q", line)
+	}
+	return strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+}
+
+func redisRateLimitConfig(addr, algorithm, failureMode string) config.RateLimitConfig {
+	return config.RateLimitConfig{
+		RequestsPerSecond: 2,
+		Burst:             2,
+		Algorithm:         algorithm,
+		Window:            time.Second,
+		Backend:           "redis",
+		Redis:             &config.RedisConfig{Address: addr, Timeout: time.Second},
+		FailureMode:       failureMode,
+	}
+}
+
+func TestGCRA(t *testing.T) {
+	// 2 requests per second with a burst of 2: one request every 500ms.
+	g := gcra{interval: 500000, burst: 2}
+	start := time.Unix(1700000000, 0)
+
+	steps := []struct {
+		at         time.Duration // Time of the request since start.
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+		reset      time.Duration
+	}{
+		{at: 0, allowed: true, remaining: 1, reset: 500 * time.Millisecond},
+		{at: 0, allowed: true, remaining: 0, reset: time.Second},
+		{at: 0, retryAfter: 500 * time.Millisecond, reset: time.Second},
+		{at: 100 * time.Millisecond, retryAfter: 400 * time.Millisecond, reset: 900 * time.Millisecond},
+		{at: 500 * time.Millisecond, allowed: true, remaining: 0, reset: time.Second},
+		// After a quiet period, the full burst is available again.
+		{at: 5 * time.Second, allowed: true, remaining: 1, reset: 500 * time.Millisecond},
+		{at: 5 * time.Second, allowed: true, remaining: 0, reset: time.Second},
+		{at: 5*time.Second + 250*time.Millisecond, retryAfter: 250 * time.Millisecond, reset: 750 * time.Millisecond},
+	}
+
+	state := ""
+	for i, step := range steps {
+		d, next, ttl := g.allow(state, start.Add(step.at))
+		want := RateDecision{Allowed: step.allowed, Limit: 2, Remaining: step.remaining, RetryAfter: step.retryAfter, Reset: step.reset}
+		if d != want {
+			t.Fatalf("step %d: expected %+v, got %+v", i, want, d)
+		}
+		if d.Allowed {
+			if ttl != d.Reset {
+				t.Fatalf("step %d: expected state to be kept for %v, got %v", i, d.Reset, ttl)
+			}
+			state = next
+		} else if next != state {
+			t.Fatalf("step %d: expected rejected request not to change the state", i)
+		}
+	}
+
+	// An invalid state, e.g. of another algorithm, starts over.
+	if d, _, _ := g.allow("1:2:3", start); !d.Allowed || d.Remaining != 1 {
+		t.Fatalf("expected invalid state to be ignored, got %+v", d)
+	}
+}
+
+func TestSharedSlidingWindow(t *testing.T) {
+	w := sharedSlidingWindow{limit: 4, window: time.Second}
+	start := time.Unix(1700000000, 0)
+
+	steps := []struct {
+		at        time.Duration
+		allowed   bool
+		remaining int
+		state     string // State after the request.
+	}{
+		{at: 0, allowed: true, remaining: 3, state: "1700000000000000:0:1"},
+		{at: 100 * time.Millisecond, allowed: true, remaining: 2, state: "1700000000000000:0:2"},
+		{at: 200 * time.Millisecond, allowed: true, remaining: 1, state: "1700000000000000:0:3"},
+		{at: 300 * time.Millisecond, allowed: true, remaining: 0, state: "1700000000000000:0:4"},
+		{at: 400 * time.Millisecond, state: "1700000000000000:0:4"},
+		// The next window starts with the previous count weighted by its overlap: 4 * 0.75 = 3.
+		{at: 1250 * time.Millisecond, allowed: true, remaining: 0, state: "1700000001000000:4:1"},
+		{at: 1300 * time.Millisecond, state: "1700000001000000:4:1"},
+		// Two windows later, nothing is left of the previous counts.
+		{at: 3500 * time.Millisecond, allowed: true, remaining: 3, state: "1700000003000000:0:1"},
+	}
+
+	state := ""
+	for i, step := range steps {
+		d, next, ttl := w.allow(state, start.Add(step.at))
+		if d.Allowed != step.allowed || d.Remaining != step.remaining || d.Limit != 4 {
+			t.Fatalf("step %d: unexpected decision %+v", i, d)
+		}
+		if !d.Allowed && d.RetryAfter <= 0 {
+			t.Fatalf("step %d: expected retry after for rejected request", i)
+		}
+		if next != step.state {
+			t.Fatalf("step %d: expected state %q, got %q", i, step.state, next)
+		}
+		if ttl != 2*time.Second {
+			t.Fatalf("step %d: expected state to be kept for two windows, got %v", i, ttl)
+		}
+		state = next
+	}
+}
+
+func TestRedisStoreAllowAndDeny(t *testing.T) {
+	tests := []struct {
+		algorithm  string
+		resets     []time.Duration // Reset of the allowed requests.
+		retryAfter time.Duration
+	}{
+		{algorithm: "token-bucket", resets: []time.Duration{500 * time.Millisecond, time.Second}, retryAfter: 500 * time.Millisecond},
+		{algorithm: "sliding-window", resets: []time.Duration{time.Second, time.Second}, retryAfter: time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			srv := newFakeRedis(t)
+			cfg := redisRateLimitConfig(srv.addr(), tt.algorithm, "")
+			store := newRedisStore(cfg, "*", cfg.RequestsPerSecond, cfg.Burst)
+			ctx := context.WithValue(context.Background(), ServiceKey, "api")
+
+			for i, reset := range tt.resets {
+				d, err := store.Allow(ctx, "client-a")
+				if err != nil {
+					t.Fatalf("request %d: %v", i, err)
+				}
+				if !d.Allowed || d.Limit != 2 || d.Remaining != 1-i || d.Reset != reset {
+					t.Fatalf("request %d: unexpected decision %+v", i, d)
+				}
+			}
+
+			d, err := store.Allow(ctx, "client-a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.Allowed || d.RetryAfter != tt.retryAfter {
+				t.Fatalf("expected request over the limit to be denied, got %+v", d)
+			}
+
+			// Keys are limited independently, and scoped by route and service.
+			if d, err := store.Allow(ctx, "client-b"); err != nil || !d.Allowed {
+				t.Fatalf("expected other key to be allowed, got %+v, %v", d, err)
+			}
+			srv.mu.Lock()
+			_, ok := srv.state["terraster:ratelimit:*:api:client-a"]
+			srv.mu.Unlock()
+			if !ok {
+				t.Fatal("expected state to be stored under the scoped key")
+			}
+
+			// The server clock decides when requests are allowed again.
+			srv.advance(2 * time.Second)
+			if d, err := store.Allow(ctx, "client-a"); err != nil || !d.Allowed {
+				t.Fatalf("expected request to be allowed later, got %+v, %v", d, err)
+			}
+		})
+	}
+}
+
+func TestRedisScriptFallsBackToEval(t *testing.T) {
+	srv := newFakeRedis(t)
+	cfg := redisRateLimitConfig(srv.addr(), "", "")
+	store := newRedisStore(cfg, "*", cfg.RequestsPerSecond, cfg.Burst)
+
+	for i := 0; i < 2; i++ {
+		if _, err := store.Allow(context.Background(), "client"); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+
+	// The unknown script is loaded with EVAL once, later runs use its digest.
+	// Each allowed request reads and then stores the state.
+	want := []string{"EVALSHA", "EVAL", "EVALSHA", "EVALSHA", "EVALSHA"}
+	got := srv.received()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected commands %v, got %v", want, got)
+	}
+}
+
+func TestRedisStoreRetriesChangedState(t *testing.T) {
+	srv := newFakeRedis(t)
+	cfg := redisRateLimitConfig(srv.addr(), "", "")
+	store := newRedisStore(cfg, "*", cfg.RequestsPerSecond, cfg.Burst)
+
+	// Another instance takes a token between the read and the write of the first request.
+	other := gcra{interval: 500000, burst: 2}
+	srv.onRead = func(key string) {
+		_, srv.state[key], _ = other.allow(srv.state[key], srv.now)
+		srv.onRead = nil
+	}
+
+	d, err := store.Allow(context.Background(), "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.Allowed || d.Remaining != 0 {
+		t.Fatalf("expected decision from the changed state, got %+v", d)
+	}
+	if d, _ := store.Allow(context.Background(), "client"); d.Allowed {
+		t.Fatal("expected both tokens to be taken")
+	}
+}
+
+func TestRedisStoreContended(t *testing.T) {
+	srv := newFakeRedis(t)
+	cfg := redisRateLimitConfig(srv.addr(), "", "")
+	store := newRedisStore(cfg, "*", cfg.RequestsPerSecond, cfg.Burst)
+
+	// The state changes after every read, so it is never stored.
+	var changes int
+	srv.onRead = func(key string) {
+		changes++
+		srv.state[key] = strconv.Itoa(changes)
+	}
+
+	if _, err := store.Allow(context.Background(), "client"); !errors.Is(err, errRedisContended) {
+		t.Fatalf("expected errRedisContended, got %v", err)
+	}
+	// The first read and every failed write return the state.
+	if changes != maxRedisAttempts+1 {
+		t.Fatalf("expected %d reads, got %d", maxRedisAttempts+1, changes)
+	}
+	if store.downUntil.Load() != 0 {
+		t.Fatal("expected no backoff for a contended state")
+	}
+}
+
+func TestRedisStoreBackoff(t *testing.T) {
+	srv := newFakeRedis(t)
+	cfg := redisRateLimitConfig(srv.addr(), "", "")
+	store := newRedisStore(cfg, "*", cfg.RequestsPerSecond, cfg.Burst)
+	ctx := context.Background()
+
+	srv.down.Store(true)
+	if _, err := store.Allow(ctx, "client"); err == nil || errors.Is(err, errRedisUnavailable) {
+		t.Fatalf("expected connection error, got %v", err)
+	}
+	if store.downUntil.Load() <= time.Now().UnixNano() {
+		t.Fatal("expected store to back off after a connection error")
+	}
+
+	// While backing off, the server is not contacted at all.
+	conns := srv.conns.Load()
+	if _, err := store.Allow(ctx, "client"); !errors.Is(err, errRedisUnavailable) {
+		t.Fatalf("expected errRedisUnavailable while backing off, got %v", err)
+	}
+	if srv.conns.Load() != conns {
+		t.Fatal("expected no connection while backing off")
+	}
+
+	// Once the retry interval passed, the server is used again.
+	srv.down.Store(false)
+	store.downUntil.Store(0)
+	if d, err := store.Allow(ctx, "client"); err != nil || !d.Allowed {
+		t.Fatalf("expected request to be allowed after recovery, got %+v, %v", d, err)
+	}
+
+	// Error replies come from a reachable server and do not trigger the backoff.
+	srv.mu.Lock()
+	srv.replyErr = "ERR script failed"
+	srv.mu.Unlock()
+	if _, err := store.Allow(ctx, "client"); err == nil || errors.Is(err, errRedisUnavailable) {
+		t.Fatalf("expected error reply, got %v", err)
+	}
+	if store.downUntil.Load() != 0 {
+		t.Fatal("expected no backoff after an error reply")
+	}
+}
+
+func TestRedisFailureMode(t *testing.T) {
+	tests := []struct {
+		failureMode string
+		status      int
+	}{
+		{failureMode: "open", status: http.StatusOK},
+		{failureMode: "closed", status: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.failureMode, func(t *testing.T) {
+			srv := newFakeRedis(t)
+			srv.down.Store(true)
+
+			mw, err := NewRateLimiterMiddleware(redisRateLimitConfig(srv.addr(), "", tt.failureMode))
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler := mw.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			// The first request fails on the connection, the second one while backing off.
+			for i := 0; i < 2; i++ {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+				if rec.Code != tt.status {
+					t.Fatalf("request %d: expected status %d, got %d", i, tt.status, rec.Code)
+				}
+				if rec.Header().Get("RateLimit-Limit") != "" {
+					t.Fatalf("request %d: expected no RateLimit headers without a decision", i)
+				}
+			}
+		})
+	}
+}
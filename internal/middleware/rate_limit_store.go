@@ -0,0 +1,221 @@
+package middleware
+
+import (
+	"container/list"
+	"context"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateDecision is the outcome of a rate limit check, used to answer with RateLimit headers.
+type RateDecision struct {
+	Allowed    bool
+	Limit      int           // Maximum number of requests (bucket size or requests per window).
+	Remaining  int           // Requests left before the client is limited.
+	Reset      time.Duration // Time until the full quota is available again.
+	RetryAfter time.Duration // Time until the next request is allowed. Only set if not allowed.
+}
+
+// RateLimitStore holds the rate limit state of all keys for a single limit.
+// The local store keeps the state in process, the redis store shares it between instances.
+// An error means the state is unavailable and the request was not counted.
+type RateLimitStore interface {
+	Allow(ctx context.Context, key string) (RateDecision, error)
+}
+
+// limiter limits the requests of a single key.
+type limiter interface {
+	allow(now time.Time) RateDecision
+}
+
+// tokenBucket allows bursts up to the bucket size and refills at a constant rate.
+type tokenBucket struct {
+	limiter *rate.Limiter
+	rps     float64
+	burst   int
+}
+
+func newTokenBucket(rps float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		limiter: rate.NewLimiter(rate.Limit(rps), burst),
+		rps:     rps,
+		burst:   burst,
+	}
+}
+
+func (b *tokenBucket) allow(now time.Time) RateDecision {
+	d := RateDecision{Limit: b.burst}
+
+	r := b.limiter.ReserveN(now, 1)
+	if delay := r.DelayFrom(now); !r.OK() || delay > 0 {
+		r.CancelAt(now)
+		d.RetryAfter = delay
+		d.Reset = b.refill(b.limiter.TokensAt(now))
+		return d
+	}
+
+	tokens := b.limiter.TokensAt(now)
+	d.Allowed = true
+	d.Remaining = int(math.Max(0, math.Floor(tokens)))
+	d.Reset = b.refill(tokens)
+	return d
+}
+
+// refill returns the time it takes to fill the bucket from the given number of tokens.
+func (b *tokenBucket) refill(tokens float64) time.Duration {
+	missing := float64(b.burst) - tokens
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / b.rps * float64(time.Second))
+}
+
+// slidingWindow approximates a sliding window log with two fixed window counters.
+// The count of the previous window is weighted by how much of it still overlaps the sliding window.
+// Unlike a token bucket, it does not allow a full burst right after a quiet period.
+type slidingWindow struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	start  time.Time // Start of the current fixed window.
+	prev   int       // Requests in the previous fixed window.
+	cur    int       // Requests in the current fixed window.
+}
+
+func newSlidingWindow(limit int, window time.Duration, now time.Time) *slidingWindow {
+	return &slidingWindow{limit: limit, window: window, start: now}
+}
+
+func (w *slidingWindow) allow(now time.Time) RateDecision {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	elapsed := now.Sub(w.start)
+	if elapsed >= w.window {
+		if elapsed >= 2*w.window {
+			w.prev = 0
+		} else {
+			w.prev = w.cur
+		}
+		w.cur = 0
+		w.start = w.start.Add(elapsed.Truncate(w.window))
+		elapsed = now.Sub(w.start)
+	}
+
+	d := RateDecision{Limit: w.limit, Reset: w.window - elapsed}
+
+	overlap := 1 - float64(elapsed)/float64(w.window)
+	estimated := float64(w.prev)*overlap + float64(w.cur)
+	if estimated+1 > float64(w.limit) {
+		d.RetryAfter = w.retryAfter(elapsed)
+		return d
+	}
+
+	w.cur++
+	d.Allowed = true
+	d.Remaining = int(math.Max(0, float64(w.limit)-math.Ceil(estimated+1)))
+	return d
+}
+
+// retryAfter returns when the weighted count drops enough to allow another request.
+func (w *slidingWindow) retryAfter(elapsed time.Duration) time.Duration {
+	free := float64(w.limit - w.cur - 1)
+	if free < 0 || w.prev == 0 {
+		// Nothing left in the current window, wait for the next one.
+		return w.window - elapsed
+	}
+
+	// Solve prev * (1 - (elapsed + t) / window) + cur + 1 <= limit for t.
+	t := time.Duration((1-free/float64(w.prev))*float64(w.window)) - elapsed
+	if t <= 0 {
+		return time.Millisecond
+	}
+	return t
+}
+
+const storeShards = 16
+
+// limiterStore is the local RateLimitStore. It keeps a limiter per key. Keys are evicted when they have not been seen
+// for the TTL or when the store is full, least recently used first. The store is sharded
+// to keep lock contention low.
+type limiterStore struct {
+	shards     [storeShards]storeShard
+	maxKeys    int // Per shard.
+	ttl        time.Duration
+	newLimiter func(now time.Time) limiter
+}
+
+type storeShard struct {
+	mu    sync.Mutex
+	items map[string]*list.Element
+	lru   *list.List // Front is the most recently used entry.
+}
+
+type storeEntry struct {
+	key      string
+	limiter  limiter
+	lastSeen time.Time
+}
+
+func newLimiterStore(maxKeys int, ttl time.Duration, newLimiter func(now time.Time) limiter) *limiterStore {
+	s := &limiterStore{
+		maxKeys:    (maxKeys + storeShards - 1) / storeShards,
+		ttl:        ttl,
+		newLimiter: newLimiter,
+	}
+
+	for i := range s.shards {
+		s.shards[i].items = make(map[string]*list.Element)
+		s.shards[i].lru = list.New()
+	}
+
+	return s
+}
+
+// Allow checks the request against the limiter of the key. It never fails.
+func (s *limiterStore) Allow(_ context.Context, key string) (RateDecision, error) {
+	now := time.Now()
+	return s.get(key, now).allow(now), nil
+}
+
+// get returns the limiter of the key, creating it if needed.
+func (s *limiterStore) get(key string, now time.Time) limiter {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	shard := &s.shards[h.Sum32()%storeShards]
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	// Forget idle keys, oldest first.
+	for back := shard.lru.Back(); back != nil; back = shard.lru.Back() {
+		entry := back.Value.(*storeEntry)
+		if now.Sub(entry.lastSeen) <= s.ttl {
+			break
+		}
+		shard.lru.Remove(back)
+		delete(shard.items, entry.key)
+	}
+
+	if el, ok := shard.items[key]; ok {
+		entry := el.Value.(*storeEntry)
+		entry.lastSeen = now
+		shard.lru.MoveToFront(el)
+		return entry.limiter
+	}
+
+	entry := &storeEntry{key: key, limiter: s.newLimiter(now), lastSeen: now}
+	shard.items[key] = shard.lru.PushFront(entry)
+
+	if shard.lru.Len() > s.maxKeys {
+		back := shard.lru.Back()
+		shard.lru.Remove(back)
+		delete(shard.items, back.Value.(*storeEntry).key)
+	}
+
+	return entry.limiter
+}
@@ -1,46 +1,230 @@
 package middleware
 
 import (
+	"fmt"
+	"math"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
-	"golang.org/x/time/rate"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/unkn0wn-root/terraster/internal/config"
+	"github.com/unkn0wn-root/terraster/pkg/clientip"
+	"github.com/unkn0wn-root/terraster/pkg/metrics"
+)
+
+// Defaults applied to the rate limiter.
+const (
+	DefaultRateLimitRPS     = 20
+	DefaultRateLimitBurst   = 50
+	DefaultRateLimitWindow  = time.Second
+	DefaultRateLimitMaxKeys = 10000
+	DefaultRateLimitKeyTTL  = 10 * time.Minute
 )
 
 // RateLimiterMiddleware provides rate limiting functionality to HTTP handlers.
 // It ensures that incoming requests are processed at a controlled rate,
 // preventing abuse and ensuring fair usage of server resources.
+// Requests are grouped by a key (e.g. the client IP), so that every client gets its own limit.
 type RateLimiterMiddleware struct {
-	limiter *rate.Limiter // limiter is the rate limiter instance that controls the request rate.
+	keyFunc    func(r *http.Request) string // keyFunc extracts the rate limit key. Nil shares one limit between all requests.
+	defaults   RateLimitStore               // defaults holds the limits of requests not matching any route.
+	routes     []rateLimitRoute             // routes override the limits for path prefixes, longest prefix first.
+	failClosed bool                         // failClosed rejects requests while the store is unavailable.
+}
+
+type rateLimitRoute struct {
+	path  string
+	store RateLimitStore
 }
 
 // NewRateLimiterMiddleware initializes and returns a new RateLimiterMiddleware.
-// Sets up the rate limiter with the specified requests per second (rps) and burst size.
+// Sets up the rate limiter with the configured requests per second (rps), burst size, algorithm and key.
 // If the burst size or rps are not provided (i.e., zero), default values are used.
-func NewRateLimiterMiddleware(rps float64, burst int) Middleware {
+func NewRateLimiterMiddleware(cfg config.RateLimitConfig) (Middleware, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	keyFunc, err := rateLimitKeyFunc(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &RateLimiterMiddleware{
+		keyFunc:    keyFunc,
+		defaults:   newRateLimitStore(cfg, "*", cfg.RequestsPerSecond, cfg.Burst),
+		failClosed: cfg.FailureMode == "closed",
+	}
+
+	for _, route := range cfg.Routes {
+		m.routes = append(m.routes, rateLimitRoute{
+			path:  route.Path,
+			store: newRateLimitStore(cfg, route.Path, route.RequestsPerSecond, route.Burst),
+		})
+	}
+
+	sort.SliceStable(m.routes, func(i, j int) bool {
+		return len(m.routes[i].path) > len(m.routes[j].path)
+	})
+
+	return m, nil
+}
+
+// newRateLimitStore creates the store of the configured backend for the given limits.
+// The scope identifies the limit in a shared store.
+func newRateLimitStore(cfg config.RateLimitConfig, scope string, rps float64, burst int) RateLimitStore {
 	// Set default burst size if not provided.
 	if burst == 0 {
-		burst = 50
+		burst = DefaultRateLimitBurst
 	}
 
 	// Set default requests per second if not provided.
 	if rps == 0 {
-		rps = 20
+		rps = DefaultRateLimitRPS
+	}
+
+	if cfg.Backend == "redis" {
+		return newRedisStore(cfg, scope, rps, burst)
 	}
 
-	return &RateLimiterMiddleware{
-		limiter: rate.NewLimiter(rate.Limit(rps), burst), // Initialize the rate limiter with the specified limits.
+	maxKeys := cfg.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = DefaultRateLimitMaxKeys
 	}
+
+	ttl := cfg.KeyTTL
+	if ttl <= 0 {
+		ttl = DefaultRateLimitKeyTTL
+	}
+
+	if cfg.Algorithm == "sliding-window" {
+		window := cfg.Window
+		if window <= 0 {
+			window = DefaultRateLimitWindow
+		}
+
+		limit := int(math.Max(1, math.Floor(rps*window.Seconds())))
+		return newLimiterStore(maxKeys, ttl, func(now time.Time) limiter {
+			return newSlidingWindow(limit, window, now)
+		})
+	}
+
+	return newLimiterStore(maxKeys, ttl, func(time.Time) limiter {
+		return newTokenBucket(rps, burst)
+	})
+}
+
+// rateLimitKeyFunc returns the function extracting the rate limit key from requests.
+// Requests without the configured header or claim fall back to the client IP.
+func rateLimitKeyFunc(cfg config.RateLimitConfig) (func(r *http.Request) string, error) {
+	// The client IP resolved with the forwarded headers policy of the service is used,
+	// unless the rate limit trusts proxies of its own.
+	clientIP := clientip.FromRequest
+	if len(cfg.TrustedProxies) > 0 {
+		resolver, err := clientip.NewResolver(cfg.TrustedProxies)
+		if err != nil {
+			return nil, err
+		}
+		clientIP = resolver.ClientIP
+	}
+
+	source, name, _ := strings.Cut(cfg.Key, ":")
+	switch source {
+	case "":
+		return nil, nil
+	case "ip":
+		return clientIP, nil
+	case "path":
+		return func(r *http.Request) string {
+			return r.URL.Path
+		}, nil
+	case "header":
+		name = http.CanonicalHeaderKey(name)
+		return func(r *http.Request) string {
+			if v := r.Header.Get(name); v != "" {
+				return "header:" + v
+			}
+			return clientIP(r)
+		}, nil
+	case "jwt":
+		secret := []byte(cfg.JWTSecret)
+		return func(r *http.Request) string {
+			if v := jwtClaim(r, name, secret); v != "" {
+				return "jwt:" + v
+			}
+			return clientIP(r)
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid rate limit key %q", cfg.Key)
+	}
+}
+
+// jwtClaim returns the claim of the bearer token in the Authorization header.
+// The token signature is verified with the secret. Returns an empty string
+// if there is no valid token or the claim is missing.
+func jwtClaim(r *http.Request, claim string, secret []byte) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	token := strings.TrimSpace(auth[7:])
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+		}
+		return secret, nil
+	})
+	if err != nil {
+		return ""
+	}
+
+	value, ok := claims[claim]
+	if !ok || value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
 }
 
 // Middleware is the core function that applies the rate limiting to incoming HTTP requests.
 // It wraps the next handler in the chain, allowing controlled access based on the rate limiter's state.
-// For each incoming request, the middleware checks if the request is allowed by the rate limiter.
+// For each incoming request, the middleware checks if the request is allowed by the limiter of its key.
 // If the request exceeds the rate limit, it responds with a "Too Many Requests" error.
 // Otherwise, it forwards the request to the next handler in the chain.
+// Both responses carry RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers.
+// If the store is unavailable, the request is allowed without headers or rejected
+// with "Service Unavailable", depending on the failure mode.
 func (m *RateLimiterMiddleware) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Attempt to allow the request based on the current rate limiter state.
-		if !m.limiter.Allow() {
+		var key string
+		if m.keyFunc != nil {
+			key = m.keyFunc(r)
+		}
+
+		decision, err := m.storeFor(r).Allow(r.Context(), key)
+		if err != nil {
+			if m.failClosed {
+				metrics.RateLimitStoreErrorsTotal.WithLabelValues(serviceName(r), "closed").Inc()
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			metrics.RateLimitStoreErrorsTotal.WithLabelValues(serviceName(r), "open").Inc()
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(decision.Limit))
+		h.Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+		h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.Reset)))
+
+		if !decision.Allowed {
+			metrics.RateLimitRejectionsTotal.WithLabelValues(serviceName(r)).Inc()
+			h.Set("Retry-After", strconv.Itoa(max(1, ceilSeconds(decision.RetryAfter))))
 			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
 			return
 		}
@@ -48,3 +232,17 @@ func (m *RateLimiterMiddleware) Middleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// storeFor returns the limiters of the route matching the request path.
+func (m *RateLimiterMiddleware) storeFor(r *http.Request) RateLimitStore {
+	for _, route := range m.routes {
+		if strings.HasPrefix(r.URL.Path, route.path) {
+			return route.store
+		}
+	}
+	return m.defaults
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -1,8 +1,10 @@
 package pool
 
 import (
+	"crypto/tls"
 	"net/url"
 	"sync/atomic"
+	"time"
 
 	"github.com/unkn0wn-root/terraster/internal/config"
 )
@@ -19,6 +21,17 @@ type Backend struct {
 	SuccessCount    int32                     // The total number of successful requests processed by this backend.
 	FailureCount    int32                     // The total number of failed requests processed by this backend.
 	HealthCheckCfg  *config.HealthCheckConfig // Configuration settings for health checks specific to this backend.
+	Draining        atomic.Bool               // Whether the backend is draining, i.e. no new sticky sessions are pinned to it.
+	ProxyProtocol   string                    // PROXY protocol version sent on connections to the backend, empty if none.
+	TLSConfig       *tls.Config               // TLS configuration of connections to the backend, nil for plaintext backends.
+
+	id                string       // Opaque identifier derived from the URL, used in sticky session cookies.
+	healthCheckFailed atomic.Bool  // Whether active health checks currently consider the backend unhealthy.
+	outlier           outlierStats // Passive health statistics used by outlier detection.
+	circuit           circuitStats // Circuit breaker state.
+
+	cfg   config.BackendConfig // Configuration the backend was created from. Used to keep the backend on reload.
+	route RouteConfig          // Route settings of the proxy, without the TLS configuration.
 }
 
 // GetURL returns the string representation of the backend's URL.
@@ -58,6 +71,17 @@ func (b *Backend) SetAlive(alive bool) {
 	b.Alive.Store(alive)
 }
 
+// IsDraining checks whether the backend is draining.
+func (b *Backend) IsDraining() bool {
+	return b.Draining.Load()
+}
+
+// SetDraining updates the drain status of the backend.
+// A draining backend keeps serving its existing sticky sessions and regular traffic, but no new sessions are pinned to it.
+func (b *Backend) SetDraining(draining bool) {
+	b.Draining.Store(draining)
+}
+
 // IncrementConnections attempts to increment the active connection count for the backend.
 // It ensures that the connection count does not exceed the maximum allowed.
 // Returns true if the increment was successful, or false if the backend is at maximum capacity.
@@ -80,3 +104,27 @@ func (b *Backend) IncrementConnections() bool {
 func (b *Backend) DecrementConnections() {
 	atomic.AddInt32(&b.ConnectionCount, -1)
 }
+
+// IsEjected reports whether the backend is currently ejected by outlier detection.
+func (b *Backend) IsEjected() bool {
+	return b.outlier.ejectedUntil.Load() != 0
+}
+
+// EjectedUntil returns the time the current ejection ends. Zero if the backend is not ejected.
+func (b *Backend) EjectedUntil() time.Time {
+	until := b.outlier.ejectedUntil.Load()
+	if until == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, until)
+}
+
+// Ejections returns how many times the backend was ejected by outlier detection.
+func (b *Backend) Ejections() int {
+	return int(b.outlier.ejections.Load())
+}
+
+// HealthCheckFailed reports whether active health checks currently consider the backend unhealthy.
+func (b *Backend) HealthCheckFailed() bool {
+	return b.healthCheckFailed.Load()
+}
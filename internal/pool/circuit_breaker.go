@@ -0,0 +1,322 @@
+package pool
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+	"github.com/unkn0wn-root/terraster/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// Defaults applied to circuit breakers.
+const (
+	DefaultCircuitFailureThreshold = 5
+	DefaultCircuitResetTimeout     = 30 * time.Second
+	DefaultCircuitWindow           = 30 * time.Second
+	DefaultCircuitMinRequests      = 20
+	DefaultCircuitHalfOpenRequests = 1
+)
+
+// CircuitState is the state of the circuit breaker of a backend.
+// The values match the values reported by the terraster_circuit_breaker_state metric.
+type CircuitState int32
+
+const (
+	CircuitClosed   CircuitState = metrics.CircuitClosed   // Requests flow normally.
+	CircuitHalfOpen CircuitState = metrics.CircuitHalfOpen // A limited number of probe requests is let through.
+	CircuitOpen     CircuitState = metrics.CircuitOpen     // The backend is not selected until the reset timeout passed.
+)
+
+// String returns the name of the state.
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// ParseCircuitState parses the name of a state.
+func ParseCircuitState(s string) (CircuitState, error) {
+	switch s {
+	case "closed":
+		return CircuitClosed, nil
+	case "half-open":
+		return CircuitHalfOpen, nil
+	case "open":
+		return CircuitOpen, nil
+	default:
+		return CircuitClosed, fmt.Errorf("invalid circuit state %q, must be closed, half-open or open", s)
+	}
+}
+
+// CircuitBreaker stops sending requests to failing backends of a ServerPool.
+// A closed circuit opens after too many consecutive failures or when the error rate within the window is too high.
+// After the reset timeout the circuit is half-open and lets a limited number of probe requests through.
+// It closes once that many probes succeeded and opens again on the first failed probe.
+// The settings are shared by the pools of a location, the state is kept per backend.
+type CircuitBreaker struct {
+	service          string
+	failureThreshold int32
+	errorRate        float64
+	minRequests      int64
+	window           time.Duration
+	resetTimeout     time.Duration
+	halfOpenRequests int32
+}
+
+// circuitStats holds the circuit breaker state of a single backend.
+// The state, open time and probes are atomic so that backend selection does not take the lock.
+type circuitStats struct {
+	mu          sync.Mutex
+	state       atomic.Int32 // CircuitState.
+	openedAt    atomic.Int64 // Time the circuit opened (unix nano).
+	probes      atomic.Int32 // Probe requests in flight while half-open.
+	successes   int32        // Successful probes while half-open.
+	consecutive int32        // Consecutive failures while closed.
+	windowStart time.Time    // Start of the current error rate window.
+	requests    int64        // Requests in the current window.
+	failures    int64        // Failures in the current window.
+}
+
+// NewCircuitBreaker builds a CircuitBreaker from the provided configuration.
+// The service name is used to label metrics. Returns nil if the configuration is nil.
+func NewCircuitBreaker(cfg *config.CircuitBreaker, service string) (*CircuitBreaker, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	if cfg.ErrorRate < 0 || cfg.ErrorRate > 1 {
+		return nil, fmt.Errorf("circuit breaker error_rate must be between 0 and 1")
+	}
+
+	cb := &CircuitBreaker{
+		service:          service,
+		failureThreshold: int32(cfg.FailureThreshold),
+		errorRate:        cfg.ErrorRate,
+		minRequests:      int64(cfg.MinRequests),
+		window:           cfg.Window,
+		resetTimeout:     cfg.ResetTimeout,
+		halfOpenRequests: int32(cfg.HalfOpenRequests),
+	}
+
+	if cb.failureThreshold <= 0 {
+		cb.failureThreshold = DefaultCircuitFailureThreshold
+	}
+	if cb.minRequests <= 0 {
+		cb.minRequests = DefaultCircuitMinRequests
+	}
+	if cb.window <= 0 {
+		cb.window = DefaultCircuitWindow
+	}
+	if cb.resetTimeout <= 0 {
+		cb.resetTimeout = DefaultCircuitResetTimeout
+	}
+	if cb.halfOpenRequests <= 0 {
+		cb.halfOpenRequests = DefaultCircuitHalfOpenRequests
+	}
+
+	return cb, nil
+}
+
+// SetCircuitBreaker enables circuit breaking on the pool. A nil breaker disables it.
+func (s *ServerPool) SetCircuitBreaker(cb *CircuitBreaker) {
+	s.circuit.Store(cb)
+}
+
+// IsAvailable reports whether the backend can be selected for a request.
+// The backend has to be alive and its circuit must let requests through.
+func (s *ServerPool) IsAvailable(b *Backend) bool {
+	return b.Alive.Load() && s.circuitAllows(b)
+}
+
+// circuitAllows reports whether the circuit of the backend lets a request through without changing its state.
+func (s *ServerPool) circuitAllows(b *Backend) bool {
+	cb := s.circuit.Load()
+	if cb == nil {
+		return true
+	}
+
+	st := &b.circuit
+	switch CircuitState(st.state.Load()) {
+	case CircuitOpen:
+		return time.Since(time.Unix(0, st.openedAt.Load())) >= cb.resetTimeout
+	case CircuitHalfOpen:
+		return st.probes.Load() < cb.halfOpenRequests
+	default:
+		return true
+	}
+}
+
+// AcquireCircuit admits a request to the backend. It moves an open circuit to half-open once the reset timeout passed
+// and takes a probe slot while the circuit is half-open. Returns false if the request must not be sent.
+// Every admitted request has to be followed by ReportResult or ReleaseCircuit.
+func (s *ServerPool) AcquireCircuit(b *Backend) bool {
+	cb := s.circuit.Load()
+	st := &b.circuit
+	if cb == nil || CircuitState(st.state.Load()) == CircuitClosed {
+		return true
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	switch CircuitState(st.state.Load()) {
+	case CircuitOpen:
+		if time.Since(time.Unix(0, st.openedAt.Load())) < cb.resetTimeout {
+			return false
+		}
+		cb.setState(s, b, CircuitHalfOpen, "reset timeout passed")
+		st.probes.Store(1)
+		return true
+	case CircuitHalfOpen:
+		if st.probes.Load() >= cb.halfOpenRequests {
+			return false
+		}
+		st.probes.Add(1)
+		return true
+	default:
+		return true
+	}
+}
+
+// ReleaseCircuit gives back the probe slot of an admitted request whose result says nothing about the backend,
+// e.g. because the client went away.
+func (s *ServerPool) ReleaseCircuit(b *Backend) {
+	if s.circuit.Load() == nil {
+		return
+	}
+
+	st := &b.circuit
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if CircuitState(st.state.Load()) == CircuitHalfOpen && st.probes.Load() > 0 {
+		st.probes.Add(-1)
+	}
+}
+
+// recordCircuit feeds the result of a request to the circuit breaker of the backend.
+func (s *ServerPool) recordCircuit(b *Backend, failed bool) {
+	cb := s.circuit.Load()
+	if cb == nil {
+		return
+	}
+
+	st := &b.circuit
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	switch CircuitState(st.state.Load()) {
+	case CircuitClosed:
+		now := time.Now()
+		if now.Sub(st.windowStart) > cb.window {
+			st.windowStart = now
+			st.requests = 0
+			st.failures = 0
+		}
+
+		st.requests++
+		if !failed {
+			st.consecutive = 0
+			return
+		}
+		st.failures++
+		st.consecutive++
+
+		switch {
+		case st.consecutive >= cb.failureThreshold:
+			cb.setState(s, b, CircuitOpen, "consecutive failures")
+		case cb.errorRate > 0 && st.requests >= cb.minRequests && float64(st.failures)/float64(st.requests) >= cb.errorRate:
+			cb.setState(s, b, CircuitOpen, "error rate")
+		}
+	case CircuitHalfOpen:
+		if st.probes.Load() > 0 {
+			st.probes.Add(-1)
+		}
+		if failed {
+			cb.setState(s, b, CircuitOpen, "probe failed")
+			return
+		}
+		st.successes++
+		if st.successes >= cb.halfOpenRequests {
+			cb.setState(s, b, CircuitClosed, "probes succeeded")
+		}
+	}
+}
+
+// SetCircuitState forces the circuit of the backend into the given state, e.g. to take a backend
+// out of rotation or to close a circuit early. An open circuit still moves to half-open after the reset timeout.
+func (s *ServerPool) SetCircuitState(b *Backend, state CircuitState) error {
+	cb := s.circuit.Load()
+	if cb == nil {
+		return fmt.Errorf("circuit breaker is not enabled")
+	}
+
+	st := &b.circuit
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	cb.setState(s, b, state, "admin")
+	return nil
+}
+
+// setState moves the circuit to the given state and resets the counters of the new state.
+// Must be called with the lock of the backend's circuit held.
+func (cb *CircuitBreaker) setState(s *ServerPool, b *Backend, state CircuitState, reason string) {
+	st := &b.circuit
+	previous := CircuitState(st.state.Swap(int32(state)))
+
+	switch state {
+	case CircuitOpen:
+		st.openedAt.Store(time.Now().UnixNano())
+	case CircuitHalfOpen:
+		st.successes = 0
+		st.probes.Store(0)
+	case CircuitClosed:
+		st.consecutive = 0
+		st.windowStart = time.Now()
+		st.requests = 0
+		st.failures = 0
+	}
+
+	if previous == state {
+		return
+	}
+
+	backendURL := b.URL.String()
+	metrics.CircuitBreakerState.WithLabelValues(cb.service, backendURL).Set(float64(state))
+	metrics.CircuitBreakerTransitionsTotal.WithLabelValues(cb.service, backendURL, state.String()).Inc()
+
+	log := s.log.Info
+	if state == CircuitOpen {
+		log = s.log.Warn
+	}
+	log("Backend circuit breaker state changed",
+		zap.String("service", cb.service),
+		zap.String("backend", backendURL),
+		zap.String("from", previous.String()),
+		zap.String("to", state.String()),
+		zap.String("reason", reason))
+}
+
+// CircuitState returns the state of the backend's circuit breaker.
+// An open circuit whose reset timeout passed is reported as open until the next request probes it.
+func (b *Backend) CircuitState() CircuitState {
+	return CircuitState(b.circuit.state.Load())
+}
+
+// CircuitOpenedAt returns the time the circuit last opened. Zero if it never opened.
+func (b *Backend) CircuitOpenedAt() time.Time {
+	openedAt := b.circuit.openedAt.Load()
+	if openedAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, openedAt)
+}
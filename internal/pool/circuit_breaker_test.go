@@ -0,0 +1,256 @@
+package pool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+)
+
+// newBreakerPool returns a pool with a single backend and a circuit breaker built from cfg.
+func newBreakerPool(t *testing.T, cfg config.CircuitBreaker) (*ServerPool, *Backend) {
+	t.Helper()
+
+	cb, err := NewCircuitBreaker(&cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPool(t, "http://127.0.0.1:9001")
+	p.SetCircuitBreaker(cb)
+	return p, p.GetAllBackends()[0]
+}
+
+// passResetTimeout moves the time the circuit opened back, as if the reset timeout passed.
+func passResetTimeout(b *Backend) {
+	b.circuit.openedAt.Store(time.Now().Add(-time.Hour).UnixNano())
+}
+
+func TestNewCircuitBreaker(t *testing.T) {
+	cb, err := NewCircuitBreaker(nil, "test")
+	if cb != nil || err != nil {
+		t.Fatalf("expected no breaker without configuration, got %+v, %v", cb, err)
+	}
+
+	for _, rate := range []float64{-0.1, 1.1} {
+		if _, err := NewCircuitBreaker(&config.CircuitBreaker{ErrorRate: rate}, "test"); err == nil {
+			t.Fatalf("expected error rate %v to be rejected", rate)
+		}
+	}
+
+	cb, err = NewCircuitBreaker(&config.CircuitBreaker{}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cb.failureThreshold != DefaultCircuitFailureThreshold ||
+		cb.resetTimeout != DefaultCircuitResetTimeout ||
+		cb.window != DefaultCircuitWindow ||
+		cb.minRequests != DefaultCircuitMinRequests ||
+		cb.halfOpenRequests != DefaultCircuitHalfOpenRequests {
+		t.Fatalf("expected defaults, got %+v", cb)
+	}
+}
+
+func TestCircuitBreakerOpens(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.CircuitBreaker
+		results []bool // Failed requests are true.
+		want    CircuitState
+	}{
+		{
+			name:    "below the failure threshold",
+			cfg:     config.CircuitBreaker{FailureThreshold: 3},
+			results: []bool{true, true},
+			want:    CircuitClosed,
+		},
+		{
+			name:    "consecutive failures",
+			cfg:     config.CircuitBreaker{FailureThreshold: 3},
+			results: []bool{true, true, true},
+			want:    CircuitOpen,
+		},
+		{
+			name:    "success resets consecutive failures",
+			cfg:     config.CircuitBreaker{FailureThreshold: 3},
+			results: []bool{true, true, false, true, true},
+			want:    CircuitClosed,
+		},
+		{
+			name:    "error rate",
+			cfg:     config.CircuitBreaker{FailureThreshold: 100, ErrorRate: 0.5, MinRequests: 4},
+			results: []bool{false, true, false, true},
+			want:    CircuitOpen,
+		},
+		{
+			name:    "error rate below min requests",
+			cfg:     config.CircuitBreaker{FailureThreshold: 100, ErrorRate: 0.5, MinRequests: 5},
+			results: []bool{false, true, false, true},
+			want:    CircuitClosed,
+		},
+		{
+			name:    "error rate below threshold",
+			cfg:     config.CircuitBreaker{FailureThreshold: 100, ErrorRate: 0.5, MinRequests: 4},
+			results: []bool{false, false, true, false, true},
+			want:    CircuitClosed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, b := newBreakerPool(t, tt.cfg)
+			for _, failed := range tt.results {
+				if !p.AcquireCircuit(b) {
+					t.Fatal("expected a closed circuit to admit requests")
+				}
+				p.ReportResult(b, failed)
+			}
+
+			if b.CircuitState() != tt.want {
+				t.Fatalf("expected state %s, got %s", tt.want, b.CircuitState())
+			}
+			if open := tt.want == CircuitOpen; p.IsAvailable(b) == open || p.AcquireCircuit(b) == open {
+				t.Fatalf("expected the backend to be available %v", !open)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerErrorRateWindow(t *testing.T) {
+	p, b := newBreakerPool(t, config.CircuitBreaker{FailureThreshold: 100, ErrorRate: 0.5, MinRequests: 4, Window: time.Minute})
+
+	p.ReportResult(b, true)
+	p.ReportResult(b, true)
+	p.ReportResult(b, true)
+
+	// Results of a past window are forgotten.
+	b.circuit.windowStart = time.Now().Add(-2 * time.Minute)
+	p.ReportResult(b, false)
+	p.ReportResult(b, false)
+	p.ReportResult(b, false)
+	p.ReportResult(b, true)
+
+	if b.CircuitState() != CircuitClosed {
+		t.Fatalf("expected the failures of the past window to be forgotten, got %s", b.CircuitState())
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	p, b := newBreakerPool(t, config.CircuitBreaker{FailureThreshold: 1, HalfOpenRequests: 2, ResetTimeout: time.Minute})
+
+	p.ReportResult(b, true)
+	if b.CircuitState() != CircuitOpen || p.AcquireCircuit(b) {
+		t.Fatal("expected an open circuit to reject requests until the reset timeout passed")
+	}
+
+	passResetTimeout(b)
+	if !p.IsAvailable(b) {
+		t.Fatal("expected the backend to be available once the reset timeout passed")
+	}
+
+	// Two probe slots, the state only changes when a request is admitted.
+	if b.CircuitState() != CircuitOpen {
+		t.Fatalf("expected the circuit to stay open until probed, got %s", b.CircuitState())
+	}
+	if !p.AcquireCircuit(b) || b.CircuitState() != CircuitHalfOpen {
+		t.Fatal("expected the first probe to move the circuit to half-open")
+	}
+	if !p.AcquireCircuit(b) {
+		t.Fatal("expected a second probe slot")
+	}
+	if p.AcquireCircuit(b) || p.IsAvailable(b) {
+		t.Fatal("expected no third probe slot")
+	}
+
+	// A probe without a result gives its slot back.
+	p.ReleaseCircuit(b)
+	if !p.IsAvailable(b) || !p.AcquireCircuit(b) {
+		t.Fatal("expected the released slot to be available")
+	}
+
+	p.ReportResult(b, false)
+	if b.CircuitState() != CircuitHalfOpen {
+		t.Fatalf("expected the circuit to stay half-open until all probes succeeded, got %s", b.CircuitState())
+	}
+	p.ReportResult(b, false)
+	if b.CircuitState() != CircuitClosed {
+		t.Fatalf("expected the circuit to close after the probes succeeded, got %s", b.CircuitState())
+	}
+
+	// The closed circuit starts counting anew.
+	p.ReportResult(b, false)
+	if !p.AcquireCircuit(b) || !p.IsAvailable(b) {
+		t.Fatal("expected a closed circuit to admit requests")
+	}
+}
+
+func TestCircuitBreakerFailedProbe(t *testing.T) {
+	p, b := newBreakerPool(t, config.CircuitBreaker{FailureThreshold: 1, HalfOpenRequests: 2, ResetTimeout: time.Minute})
+
+	p.ReportResult(b, true)
+	passResetTimeout(b)
+	if !p.AcquireCircuit(b) || !p.AcquireCircuit(b) {
+		t.Fatal("expected two probes")
+	}
+
+	p.ReportResult(b, false)
+	p.ReportResult(b, true)
+	if b.CircuitState() != CircuitOpen {
+		t.Fatalf("expected a failed probe to open the circuit, got %s", b.CircuitState())
+	}
+	if time.Since(b.CircuitOpenedAt()) > time.Second {
+		t.Fatal("expected the reset timeout to start again")
+	}
+	if p.AcquireCircuit(b) || p.IsAvailable(b) {
+		t.Fatal("expected the reopened circuit to reject requests")
+	}
+}
+
+func TestSetCircuitState(t *testing.T) {
+	p, b := newBreakerPool(t, config.CircuitBreaker{ResetTimeout: time.Minute})
+
+	if err := p.SetCircuitState(b, CircuitOpen); err != nil {
+		t.Fatal(err)
+	}
+	if p.IsAvailable(b) || b.CircuitOpenedAt().IsZero() {
+		t.Fatal("expected a forced open circuit to take the backend out of rotation")
+	}
+
+	if err := p.SetCircuitState(b, CircuitClosed); err != nil {
+		t.Fatal(err)
+	}
+	if !p.IsAvailable(b) {
+		t.Fatal("expected a forced closed circuit to admit requests")
+	}
+
+	plain := newTestPool(t, "http://127.0.0.1:9001")
+	if err := plain.SetCircuitState(plain.GetAllBackends()[0], CircuitOpen); err == nil {
+		t.Fatal("expected an error without circuit breaker")
+	}
+}
+
+func TestWithoutCircuitBreaker(t *testing.T) {
+	p := newTestPool(t, "http://127.0.0.1:9001")
+	b := p.GetAllBackends()[0]
+
+	for i := 0; i < 20; i++ {
+		if !p.AcquireCircuit(b) {
+			t.Fatal("expected requests to be admitted without circuit breaker")
+		}
+		p.ReportResult(b, true)
+	}
+	if b.CircuitState() != CircuitClosed || !p.IsAvailable(b) {
+		t.Fatal("expected failures not to affect backends without circuit breaker")
+	}
+}
+
+func TestParseCircuitState(t *testing.T) {
+	for _, state := range []CircuitState{CircuitClosed, CircuitHalfOpen, CircuitOpen} {
+		parsed, err := ParseCircuitState(state.String())
+		if err != nil || parsed != state {
+			t.Fatalf("expected %s to parse, got %s, %v", state, parsed, err)
+		}
+	}
+	if _, err := ParseCircuitState("broken"); err == nil {
+		t.Fatal("expected an unknown state to be rejected")
+	}
+}
@@ -0,0 +1,118 @@
+package pool
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+	"github.com/unkn0wn-root/terraster/pkg/clientip"
+)
+
+// forwardingHeaders are the headers describing the client of a request, which only trusted proxies may set.
+var forwardingHeaders = []string{
+	HeaderXForwardedFor,
+	HeaderXForwardedHost,
+	HeaderXForwardedProto,
+	HeaderXForwardedPort,
+	HeaderXRealIP,
+	HeaderForwarded,
+}
+
+// ForwardedHeaders is the policy for the forwarding headers of a service.
+// Requests from trusted proxies keep their forwarding headers, which determine the client IP,
+// and this hop is appended. Forwarding headers of all other requests are replaced.
+// A nil ForwardedHeaders trusts nobody and does not send the Forwarded header.
+type ForwardedHeaders struct {
+	resolver  *clientip.Resolver
+	forwarded bool
+}
+
+// NewForwardedHeaders creates the policy from the configuration. A nil configuration trusts nobody.
+func NewForwardedHeaders(cfg *config.ForwardedHeadersConfig) (*ForwardedHeaders, error) {
+	if cfg == nil {
+		return &ForwardedHeaders{}, nil
+	}
+
+	resolver, err := clientip.NewResolver(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return &ForwardedHeaders{resolver: resolver, forwarded: cfg.Forwarded}, nil
+}
+
+// ClientIP returns the IP address of the client, taking the forwarding headers of trusted proxies into account.
+func (f *ForwardedHeaders) ClientIP(r *http.Request) string {
+	if f == nil {
+		return clientip.RemoteIP(r)
+	}
+	return f.resolver.ClientIP(r)
+}
+
+// apply sets the forwarding headers of a request sent to a backend.
+// X-Forwarded-For is completed by httputil.ReverseProxy, which appends the address of the peer.
+func (f *ForwardedHeaders) apply(req *http.Request) {
+	trusted := f != nil && f.resolver.TrustsPeer(req)
+	if !trusted {
+		for _, h := range forwardingHeaders {
+			req.Header.Del(h)
+		}
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	// Values set by a trusted proxy describe the request of the client, not the one of the proxy
+	setDefault(req.Header, HeaderXForwardedProto, proto)
+	setDefault(req.Header, HeaderXForwardedHost, req.Host)
+	if port := localPort(req); port != "" {
+		setDefault(req.Header, HeaderXForwardedPort, port)
+	}
+	req.Header.Set(HeaderXRealIP, clientip.FromRequest(req))
+
+	if f != nil && f.forwarded {
+		element := "for=" + forwardedNode(clientip.RemoteIP(req)) + ";host=" + forwardedValue(req.Host) + ";proto=" + proto
+		if prior := req.Header.Values(HeaderForwarded); len(prior) > 0 {
+			element = strings.Join(prior, ", ") + ", " + element
+		}
+		req.Header.Set(HeaderForwarded, element)
+	}
+}
+
+// setDefault sets the header unless it is already present.
+func setDefault(h http.Header, key, value string) {
+	if h.Get(key) == "" {
+		h.Set(key, value)
+	}
+}
+
+// localPort returns the port of the listener the client connected to.
+func localPort(req *http.Request) string {
+	addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return ""
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return port
+}
+
+// forwardedNode formats an IP address as node of the Forwarded header. IPv6 addresses are bracketed and quoted.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// forwardedValue quotes the value of a Forwarded parameter unless it is a token.
+func forwardedValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, ":[]\"\\ ,;=") {
+		return v
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+}
@@ -0,0 +1,108 @@
+package pool
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// Backend protocols.
+const (
+	ProtocolHTTP = "http" // HTTP/1.1, or HTTP/2 negotiated via ALPN for https backends.
+	ProtocolH2C  = "h2c"  // HTTP/2 over cleartext TCP with prior knowledge, e.g. for gRPC backends.
+)
+
+// gRPC status codes used for errors generated by the proxy.
+// See https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+const (
+	GRPCStatusUnknown           = 2
+	GRPCStatusDeadlineExceeded  = 4
+	GRPCStatusPermissionDenied  = 7
+	GRPCStatusResourceExhausted = 8
+	GRPCStatusUnimplemented     = 12
+	GRPCStatusInternal          = 13
+	GRPCStatusUnavailable       = 14
+	GRPCStatusUnauthenticated   = 16
+)
+
+// IsGRPC reports whether the request is a gRPC call.
+func IsGRPC(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// GRPCStatus maps an HTTP status code of an error generated by the proxy to a gRPC status code.
+func GRPCStatus(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return GRPCStatusInternal
+	case http.StatusUnauthorized:
+		return GRPCStatusUnauthenticated
+	case http.StatusForbidden:
+		return GRPCStatusPermissionDenied
+	case http.StatusNotFound:
+		return GRPCStatusUnimplemented
+	case http.StatusTooManyRequests:
+		return GRPCStatusResourceExhausted
+	case http.StatusGatewayTimeout:
+		return GRPCStatusDeadlineExceeded
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return GRPCStatusUnavailable
+	default:
+		return GRPCStatusUnknown
+	}
+}
+
+// WriteError replies to the request with an error generated by the proxy.
+// gRPC clients do not look at the HTTP status, so gRPC calls are answered with a
+// trailers-only response carrying grpc-status and grpc-message instead.
+func WriteError(w http.ResponseWriter, r *http.Request, msg string, status int) {
+	if !IsGRPC(r) {
+		http.Error(w, msg, status)
+		return
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(GRPCStatus(status)))
+	h.Set("Grpc-Message", grpcEncodeMessage(msg))
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcEncodeMessage percent-encodes the message as required for the grpc-message header.
+func grpcEncodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// h2cTransport speaks HTTP/2 with prior knowledge over cleartext connections.
+// It is shared by all h2c backends, connections are pooled per host.
+var h2cTransport = NewH2CTransport()
+
+// NewH2CTransport creates a transport speaking HTTP/2 with prior knowledge over cleartext TCP.
+func NewH2CTransport() *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			dialer := net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+			return dialer.DialContext(ctx, network, addr)
+		},
+		ReadIdleTimeout: 30 * time.Second,
+		PingTimeout:     15 * time.Second,
+	}
+}
@@ -0,0 +1,116 @@
+package pool
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+	"github.com/unkn0wn-root/terraster/pkg/algorithm"
+)
+
+// Defaults applied to request mirroring.
+const (
+	DefaultMirrorMaxBodySize   = 64 << 10 // 64 KiB
+	DefaultMirrorTimeout       = 10 * time.Second
+	DefaultMirrorMaxConcurrent = 100
+)
+
+// Mirror duplicates a share of requests to a secondary pool of backends.
+// The number of mirrored requests in flight is bounded, so a slow mirror never piles up work.
+type Mirror struct {
+	Pool        *ServerPool         // Backends receiving the mirrored requests.
+	Algorithm   algorithm.Algorithm // Load balancing algorithm of the mirror backends.
+	percentage  float64
+	maxBodySize int64
+	timeout     time.Duration
+	inflight    chan struct{}
+}
+
+// NewMirror builds a Mirror from the provided configuration.
+// Returns nil if the configuration is nil.
+func NewMirror(cfg *config.MirrorConfig, p *ServerPool, algo algorithm.Algorithm) (*Mirror, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	// Only an absent percentage mirrors all requests, an explicit 0 pauses mirroring.
+	percentage := 100.0
+	if cfg.Percentage != nil {
+		percentage = *cfg.Percentage
+	}
+	if percentage < 0 || percentage > 100 {
+		return nil, fmt.Errorf("mirror percentage must be between 0 and 100")
+	}
+
+	m := &Mirror{
+		Pool:        p,
+		Algorithm:   algo,
+		percentage:  percentage,
+		maxBodySize: cfg.MaxBodySize,
+		timeout:     cfg.Timeout,
+	}
+
+	if m.maxBodySize <= 0 {
+		m.maxBodySize = DefaultMirrorMaxBodySize
+	}
+	if m.timeout <= 0 {
+		m.timeout = DefaultMirrorTimeout
+	}
+
+	maxConcurrent := cfg.MaxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = DefaultMirrorMaxConcurrent
+	}
+	m.inflight = make(chan struct{}, maxConcurrent)
+
+	return m, nil
+}
+
+// Sample decides whether a request is mirrored. Safe to call on a nil Mirror.
+func (m *Mirror) Sample() bool {
+	if m == nil {
+		return false
+	}
+	return m.percentage >= 100 || rand.Float64()*100 < m.percentage
+}
+
+// MaxBodySize returns the largest request body that is mirrored.
+func (m *Mirror) MaxBodySize() int64 {
+	if m == nil {
+		return 0
+	}
+	return m.maxBodySize
+}
+
+// Timeout returns the timeout of a mirrored request.
+func (m *Mirror) Timeout() time.Duration {
+	return m.timeout
+}
+
+// Acquire reserves a slot for a mirrored request without blocking.
+// Returns false if the maximum number of mirrored requests is in flight.
+func (m *Mirror) Acquire() bool {
+	select {
+	case m.inflight <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release frees a slot reserved by Acquire.
+func (m *Mirror) Release() {
+	<-m.inflight
+}
+
+// NextBackend selects the mirror backend for the request.
+// Returns nil if no mirror backend is available.
+func (m *Mirror) NextBackend(r *http.Request) *Backend {
+	server := m.Algorithm.NextServer(m.Pool, r)
+	if server == nil {
+		return nil
+	}
+	return m.Pool.GetBackendByURL(server.URL)
+}
@@ -0,0 +1,151 @@
+package pool
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+	"github.com/unkn0wn-root/terraster/pkg/algorithm"
+	"go.uber.org/zap"
+)
+
+// newTestPool returns a pool with a backend per URL.
+func newTestPool(t *testing.T, urls ...string) *ServerPool {
+	t.Helper()
+
+	p := NewServerPool(zap.NewNop())
+	for _, u := range urls {
+		if err := p.AddBackend(config.BackendConfig{URL: u}, RouteConfig{Path: "/"}, config.DefaultHealthCheck.Copy()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p
+}
+
+func percentage(p float64) *float64 {
+	return &p
+}
+
+func TestNewMirror(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     *config.MirrorConfig
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "disabled", wantNil: true},
+		{name: "defaults", cfg: &config.MirrorConfig{}},
+		{name: "paused", cfg: &config.MirrorConfig{Percentage: percentage(0)}},
+		{name: "negative percentage", cfg: &config.MirrorConfig{Percentage: percentage(-1)}, wantErr: true},
+		{name: "percentage above 100", cfg: &config.MirrorConfig{Percentage: percentage(100.5)}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewMirror(tt.cfg, nil, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if (m == nil) != (tt.wantNil || tt.wantErr) {
+				t.Fatalf("unexpected mirror %+v", m)
+			}
+		})
+	}
+
+	m, _ := NewMirror(&config.MirrorConfig{}, nil, nil)
+	if m.MaxBodySize() != DefaultMirrorMaxBodySize || m.Timeout() != DefaultMirrorTimeout || cap(m.inflight) != DefaultMirrorMaxConcurrent {
+		t.Fatalf("expected defaults, got max body %d, timeout %s, max concurrent %d",
+			m.MaxBodySize(), m.Timeout(), cap(m.inflight))
+	}
+}
+
+func TestMirrorSample(t *testing.T) {
+	tests := []struct {
+		name       string
+		percentage *float64
+		want       float64
+	}{
+		{name: "all by default", want: 1},
+		{name: "all", percentage: percentage(100), want: 1},
+		{name: "paused", percentage: percentage(0), want: 0},
+		{name: "quarter", percentage: percentage(25), want: 0.25},
+		{name: "fraction of a percent", percentage: percentage(0.5), want: 0.005},
+	}
+
+	const requests = 40000
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewMirror(&config.MirrorConfig{Percentage: tt.percentage}, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sampled := 0
+			for i := 0; i < requests; i++ {
+				if m.Sample() {
+					sampled++
+				}
+			}
+
+			got := float64(sampled) / requests
+			if (tt.want == 0 || tt.want == 1) && got != tt.want {
+				t.Fatalf("expected share %.0f exactly, got %.4f", tt.want, got)
+			}
+			if got < tt.want*0.9-0.002 || got > tt.want*1.1+0.002 {
+				t.Fatalf("expected share %.3f, got %.4f", tt.want, got)
+			}
+		})
+	}
+
+	var m *Mirror
+	if m.Sample() || m.MaxBodySize() != 0 {
+		t.Fatal("expected a nil mirror never to sample")
+	}
+}
+
+func TestMirrorMaxConcurrent(t *testing.T) {
+	m, err := NewMirror(&config.MirrorConfig{MaxConcurrent: 2}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !m.Acquire() || !m.Acquire() {
+		t.Fatal("expected two slots")
+	}
+	if m.Acquire() {
+		t.Fatal("expected no third slot")
+	}
+
+	m.Release()
+	if !m.Acquire() {
+		t.Fatal("expected a released slot to be available")
+	}
+}
+
+func TestMirrorNextBackend(t *testing.T) {
+	p := newTestPool(t, "http://127.0.0.1:9001", "http://127.0.0.1:9002")
+	m, err := NewMirror(&config.MirrorConfig{}, p, algorithm.CreateAlgorithm("round-robin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		b := m.NextBackend(httptest.NewRequest(http.MethodGet, "/", nil))
+		if b == nil {
+			t.Fatal("expected a mirror backend")
+		}
+		seen[b.URL.String()] = true
+	}
+	if len(seen) != 2 {
+		t.Fatalf("expected requests to be balanced across the mirror backends, got %v", seen)
+	}
+
+	for _, b := range p.GetAllBackends() {
+		p.MarkBackendStatus(b.URL, false)
+	}
+	if b := m.NextBackend(httptest.NewRequest(http.MethodGet, "/", nil)); b != nil {
+		t.Fatalf("expected no backend while all are down, got %s", b.URL)
+	}
+}
@@ -0,0 +1,230 @@
+package pool
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+	"github.com/unkn0wn-root/terraster/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// Defaults applied to outlier detection.
+const (
+	DefaultOutlierConsecutiveErrors  = 5
+	DefaultOutlierWindow             = 30 * time.Second
+	DefaultOutlierMinRequests        = 20
+	DefaultOutlierBaseEjectionTime   = 30 * time.Second
+	DefaultOutlierMaxEjectionTime    = 5 * time.Minute
+	DefaultOutlierMaxEjectionPercent = 50
+)
+
+// OutlierDetector ejects backends of a ServerPool based on the results of live traffic.
+// Results are recorded lock free. Ejection decisions are serialized per pool so that
+// the max ejection percentage is honored.
+type OutlierDetector struct {
+	consecutiveErrors  int32
+	errorRate          float64
+	minRequests        int64
+	window             time.Duration
+	baseEjectionTime   time.Duration
+	maxEjectionTime    time.Duration
+	maxEjectionPercent int
+	mu                 sync.Mutex
+}
+
+// outlierStats holds the passive health statistics of a single backend.
+type outlierStats struct {
+	consecutive  atomic.Int32 // Consecutive failures.
+	windowStart  atomic.Int64 // Start of the current error rate window (unix nano).
+	requests     atomic.Int64 // Requests in the current window.
+	failures     atomic.Int64 // Failures in the current window.
+	ejectedUntil atomic.Int64 // End of the current ejection (unix nano), 0 if not ejected.
+	ejections    atomic.Int32 // Number of ejections, drives the exponential ejection time.
+	lastRestore  atomic.Int64 // Time the backend was last restored (unix nano).
+}
+
+// NewOutlierDetector builds an OutlierDetector from the provided configuration.
+// Returns nil if the configuration is nil.
+func NewOutlierDetector(cfg *config.OutlierDetectionConfig) (*OutlierDetector, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	if cfg.ErrorRate < 0 || cfg.ErrorRate > 1 {
+		return nil, fmt.Errorf("outlier detection error_rate must be between 0 and 1")
+	}
+
+	if cfg.MaxEjectionPercent < 0 || cfg.MaxEjectionPercent > 100 {
+		return nil, fmt.Errorf("outlier detection max_ejection_percent must be between 0 and 100")
+	}
+
+	d := &OutlierDetector{
+		consecutiveErrors:  int32(cfg.ConsecutiveErrors),
+		errorRate:          cfg.ErrorRate,
+		minRequests:        int64(cfg.MinRequests),
+		window:             cfg.Window,
+		baseEjectionTime:   cfg.BaseEjectionTime,
+		maxEjectionTime:    cfg.MaxEjectionTime,
+		maxEjectionPercent: cfg.MaxEjectionPercent,
+	}
+
+	if d.consecutiveErrors <= 0 {
+		d.consecutiveErrors = DefaultOutlierConsecutiveErrors
+	}
+	if d.minRequests <= 0 {
+		d.minRequests = DefaultOutlierMinRequests
+	}
+	if d.window <= 0 {
+		d.window = DefaultOutlierWindow
+	}
+	if d.baseEjectionTime <= 0 {
+		d.baseEjectionTime = DefaultOutlierBaseEjectionTime
+	}
+	if d.maxEjectionTime <= 0 {
+		d.maxEjectionTime = DefaultOutlierMaxEjectionTime
+	}
+	if d.maxEjectionTime < d.baseEjectionTime {
+		d.maxEjectionTime = d.baseEjectionTime
+	}
+	if d.maxEjectionPercent == 0 {
+		d.maxEjectionPercent = DefaultOutlierMaxEjectionPercent
+	}
+
+	return d, nil
+}
+
+// ejectionTime returns how long a backend is ejected for its n-th ejection.
+func (d *OutlierDetector) ejectionTime(n int32) time.Duration {
+	if n < 1 {
+		n = 1
+	}
+
+	t := d.baseEjectionTime
+	for i := int32(1); i < n && t < d.maxEjectionTime; i++ {
+		t *= 2
+	}
+
+	if t > d.maxEjectionTime {
+		t = d.maxEjectionTime
+	}
+
+	return t
+}
+
+// SetOutlierDetector enables passive outlier detection on the pool. A nil detector disables it.
+func (s *ServerPool) SetOutlierDetector(d *OutlierDetector) {
+	s.outlier.Store(d)
+}
+
+// ReportResult records the result of a request proxied to the backend.
+// A failed request is a 5xx response or a transport error.
+// The result is fed to the circuit breaker, and the backend is ejected once it exceeds
+// the consecutive error or error rate thresholds of outlier detection.
+func (s *ServerPool) ReportResult(b *Backend, failed bool) {
+	s.recordCircuit(b, failed)
+
+	d := s.outlier.Load()
+	if d == nil || b.IsEjected() {
+		return
+	}
+
+	st := &b.outlier
+	now := time.Now().UnixNano()
+	start := st.windowStart.Load()
+	if now-start > int64(d.window) && st.windowStart.CompareAndSwap(start, now) {
+		st.requests.Store(0)
+		st.failures.Store(0)
+	}
+
+	requests := st.requests.Add(1)
+	if !failed {
+		st.consecutive.Store(0)
+		return
+	}
+
+	failures := st.failures.Add(1)
+	consecutive := st.consecutive.Add(1)
+
+	switch {
+	case consecutive >= d.consecutiveErrors:
+		s.eject(d, b, "consecutive errors")
+	case d.errorRate > 0 && requests >= d.minRequests && float64(failures)/float64(requests) >= d.errorRate:
+		s.eject(d, b, "error rate")
+	}
+}
+
+// eject removes the backend from rotation for an exponentially increasing time.
+// The ejection is skipped if it would exceed the max ejection percentage of the pool,
+// but a single backend can always be ejected.
+func (s *ServerPool) eject(d *OutlierDetector, b *Backend, reason string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if b.IsEjected() {
+		return
+	}
+
+	backends := s.GetAllBackends()
+	ejected := 0
+	for _, backend := range backends {
+		if backend.IsEjected() {
+			ejected++
+		}
+	}
+
+	if ejected > 0 && (ejected+1)*100 > d.maxEjectionPercent*len(backends) {
+		s.log.Warn("Backend exceeds outlier thresholds but max ejection percent reached",
+			zap.String("backend", b.URL.String()),
+			zap.String("reason", reason),
+			zap.Int("ejected", ejected))
+		return
+	}
+
+	now := time.Now()
+	st := &b.outlier
+
+	// Forget earlier ejections once the backend behaved for a while.
+	if last := st.lastRestore.Load(); last != 0 && now.Sub(time.Unix(0, last)) > d.maxEjectionTime {
+		st.ejections.Store(0)
+	}
+
+	duration := d.ejectionTime(st.ejections.Add(1))
+	st.ejectedUntil.Store(now.Add(duration).UnixNano())
+	st.consecutive.Store(0)
+	st.requests.Store(0)
+	st.failures.Store(0)
+	b.Alive.Store(false)
+
+	backendURL := b.URL.String()
+	metrics.OutlierEjectionsTotal.WithLabelValues(backendURL, reason).Inc()
+	metrics.BackendEjected.WithLabelValues(backendURL).Set(1)
+
+	s.log.Warn("Backend ejected by outlier detection",
+		zap.String("backend", backendURL),
+		zap.String("reason", reason),
+		zap.Duration("ejection_time", duration))
+
+	time.AfterFunc(duration, func() {
+		s.restore(d, b)
+	})
+}
+
+// restore returns an ejected backend to rotation, unless active health checks consider it unhealthy.
+func (s *ServerPool) restore(d *OutlierDetector, b *Backend) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	b.outlier.ejectedUntil.Store(0)
+	b.outlier.lastRestore.Store(time.Now().UnixNano())
+	b.Alive.Store(!b.healthCheckFailed.Load())
+
+	backendURL := b.URL.String()
+	metrics.BackendEjected.WithLabelValues(backendURL).Set(0)
+
+	s.log.Info("Backend restored after outlier ejection",
+		zap.String("backend", backendURL),
+		zap.Bool("alive", b.Alive.Load()))
+}
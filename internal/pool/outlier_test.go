@@ -0,0 +1,223 @@
+package pool
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+)
+
+// newOutlierPool returns a pool with n backends and an outlier detector built from cfg.
+func newOutlierPool(t *testing.T, n int, cfg config.OutlierDetectionConfig) *ServerPool {
+	t.Helper()
+
+	d, err := NewOutlierDetector(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	urls := make([]string, n)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("http://127.0.0.1:%d", 9001+i)
+	}
+	p := newTestPool(t, urls...)
+	p.SetOutlierDetector(d)
+	return p
+}
+
+// fail reports n failed requests to the backend.
+func fail(p *ServerPool, b *Backend, n int) {
+	for i := 0; i < n; i++ {
+		p.ReportResult(b, true)
+	}
+}
+
+func TestNewOutlierDetector(t *testing.T) {
+	d, err := NewOutlierDetector(nil)
+	if d != nil || err != nil {
+		t.Fatalf("expected no detector without configuration, got %+v, %v", d, err)
+	}
+
+	invalid := []config.OutlierDetectionConfig{
+		{ErrorRate: -0.1},
+		{ErrorRate: 1.5},
+		{MaxEjectionPercent: -1},
+		{MaxEjectionPercent: 101},
+	}
+	for _, cfg := range invalid {
+		if _, err := NewOutlierDetector(&cfg); err == nil {
+			t.Fatalf("expected %+v to be rejected", cfg)
+		}
+	}
+
+	d, err = NewOutlierDetector(&config.OutlierDetectionConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.consecutiveErrors != DefaultOutlierConsecutiveErrors ||
+		d.minRequests != DefaultOutlierMinRequests ||
+		d.window != DefaultOutlierWindow ||
+		d.baseEjectionTime != DefaultOutlierBaseEjectionTime ||
+		d.maxEjectionTime != DefaultOutlierMaxEjectionTime ||
+		d.maxEjectionPercent != DefaultOutlierMaxEjectionPercent {
+		t.Fatalf("expected defaults, got %+v", d)
+	}
+
+	d, _ = NewOutlierDetector(&config.OutlierDetectionConfig{BaseEjectionTime: time.Hour, MaxEjectionTime: time.Minute})
+	if d.maxEjectionTime != time.Hour {
+		t.Fatalf("expected the max ejection time to be raised to the base ejection time, got %s", d.maxEjectionTime)
+	}
+}
+
+func TestOutlierEjectionTime(t *testing.T) {
+	d, err := NewOutlierDetector(&config.OutlierDetectionConfig{BaseEjectionTime: 10 * time.Second, MaxEjectionTime: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []time.Duration{10 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute}
+	for n, w := range want {
+		if got := d.ejectionTime(int32(n)); got != w {
+			t.Errorf("ejection %d: expected %s, got %s", n, w, got)
+		}
+	}
+}
+
+func TestOutlierEjection(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.OutlierDetectionConfig
+		results []bool // Failed requests are true.
+		want    bool
+	}{
+		{
+			name:    "below consecutive errors",
+			cfg:     config.OutlierDetectionConfig{ConsecutiveErrors: 3},
+			results: []bool{true, true, false, true, true},
+		},
+		{
+			name:    "consecutive errors",
+			cfg:     config.OutlierDetectionConfig{ConsecutiveErrors: 3},
+			results: []bool{false, true, true, true},
+			want:    true,
+		},
+		{
+			name:    "error rate",
+			cfg:     config.OutlierDetectionConfig{ConsecutiveErrors: 100, ErrorRate: 0.5, MinRequests: 4},
+			results: []bool{false, true, false, true},
+			want:    true,
+		},
+		{
+			name:    "error rate below min requests",
+			cfg:     config.OutlierDetectionConfig{ConsecutiveErrors: 100, ErrorRate: 0.5, MinRequests: 5},
+			results: []bool{false, true, false, true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newOutlierPool(t, 1, tt.cfg)
+			b := p.GetAllBackends()[0]
+			for _, failed := range tt.results {
+				p.ReportResult(b, failed)
+			}
+
+			if b.IsEjected() != tt.want || b.Alive.Load() == tt.want {
+				t.Fatalf("expected ejected %v, got ejected %v, alive %v", tt.want, b.IsEjected(), b.Alive.Load())
+			}
+		})
+	}
+}
+
+func TestOutlierMaxEjectionPercent(t *testing.T) {
+	tests := []struct {
+		name     string
+		backends int
+		percent  int
+		want     int
+	}{
+		{name: "half of the backends", backends: 4, percent: 50, want: 2},
+		{name: "all backends", backends: 3, percent: 100, want: 3},
+		{name: "one backend is always ejected", backends: 4, percent: 10, want: 1},
+		{name: "single backend", backends: 1, percent: 50, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newOutlierPool(t, tt.backends, config.OutlierDetectionConfig{
+				ConsecutiveErrors:  1,
+				MaxEjectionPercent: tt.percent,
+				BaseEjectionTime:   time.Hour,
+			})
+
+			for _, b := range p.GetAllBackends() {
+				fail(p, b, 1)
+			}
+
+			ejected := 0
+			for _, b := range p.GetAllBackends() {
+				if b.IsEjected() {
+					ejected++
+				}
+			}
+			if ejected != tt.want {
+				t.Fatalf("expected %d ejected backends, got %d", tt.want, ejected)
+			}
+		})
+	}
+}
+
+func TestOutlierRestore(t *testing.T) {
+	p := newOutlierPool(t, 2, config.OutlierDetectionConfig{
+		ConsecutiveErrors: 1,
+		BaseEjectionTime:  20 * time.Millisecond,
+		MaxEjectionTime:   time.Hour,
+	})
+	b := p.GetAllBackends()[0]
+
+	fail(p, b, 1)
+	if !b.IsEjected() || b.EjectedUntil().IsZero() {
+		t.Fatal("expected the backend to be ejected")
+	}
+
+	// A passing health check does not end the ejection early.
+	p.MarkBackendStatus(b.URL, true)
+	if b.Alive.Load() {
+		t.Fatal("expected the ejected backend to stay out of rotation")
+	}
+
+	waitFor(t, "the backend to be alive after the ejection", func() bool {
+		return !b.IsEjected() && b.Alive.Load()
+	})
+
+	// The second ejection takes twice as long.
+	start := time.Now()
+	fail(p, b, 1)
+	if b.Ejections() != 2 {
+		t.Fatalf("expected 2 ejections, got %d", b.Ejections())
+	}
+	if d := b.EjectedUntil().Sub(start); d < 40*time.Millisecond {
+		t.Fatalf("expected the ejection time to double, got %s", d)
+	}
+
+	// A backend failing active health checks stays down after the ejection.
+	p.MarkBackendStatus(b.URL, false)
+	waitFor(t, "the ejection to end", func() bool { return !b.IsEjected() })
+	if b.Alive.Load() {
+		t.Fatal("expected the backend failing health checks to stay down")
+	}
+}
+
+// waitFor polls the condition until it holds, failing the test after a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
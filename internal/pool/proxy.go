@@ -21,13 +21,17 @@ const (
 	StatusTemporaryRedirect = http.StatusTemporaryRedirect
 	StatusPermanentRedirect = http.StatusPermanentRedirect
 
-	HeaderServer         = "Server"           // The Server header identifies the server software handling the request.
-	HeaderXPoweredBy     = "X-Powered-By"     // The X-Powered-By header indicates technologies supporting the server.
-	HeaderXProxyBy       = "X-Proxy-By"       // The X-Proxy-By header identifies the proxy handling the request.
-	HeaderLocation       = "Location"         // The Location header is used in redirection or when a new resource has been created.
-	HeaderXForwardedFor  = "X-Forwarded-For"  // The X-Forwarded-For header identifies the originating IP address of a client connecting to a web server through a proxy.
-	HeaderXForwardedHost = "X-Forwarded-Host" // The X-Forwarded-Host header identifies the original host requested by the client.
-	HeaderHost           = "Host"             // The Host header specifies the domain name of the server and the TCP port number on which the server is listening.
+	HeaderServer          = "Server"            // The Server header identifies the server software handling the request.
+	HeaderXPoweredBy      = "X-Powered-By"      // The X-Powered-By header indicates technologies supporting the server.
+	HeaderXProxyBy        = "X-Proxy-By"        // The X-Proxy-By header identifies the proxy handling the request.
+	HeaderLocation        = "Location"          // The Location header is used in redirection or when a new resource has been created.
+	HeaderXForwardedFor   = "X-Forwarded-For"   // The X-Forwarded-For header identifies the originating IP address of a client connecting to a web server through a proxy.
+	HeaderXForwardedHost  = "X-Forwarded-Host"  // The X-Forwarded-Host header identifies the original host requested by the client.
+	HeaderXForwardedProto = "X-Forwarded-Proto" // The X-Forwarded-Proto header identifies the protocol (http or https) the client used.
+	HeaderXForwardedPort  = "X-Forwarded-Port"  // The X-Forwarded-Port header identifies the port the client connected to.
+	HeaderXRealIP         = "X-Real-IP"         // The X-Real-IP header identifies the IP address of the client.
+	HeaderForwarded       = "Forwarded"         // The Forwarded header (RFC 7239) combines the X-Forwarded-* headers.
+	HeaderHost            = "Host"              // The Host header specifies the domain name of the server and the TCP port number on which the server is listening.
 
 	DefaultScheme     = "http"
 	DefaultProxyLabel = "terraster"
@@ -46,10 +50,12 @@ func (e *ProxyError) Error() string {
 
 // RouteConfig holds configuration settings for routing requests through the proxy.
 type RouteConfig struct {
-	Path          string // Path is the proxy path (upstream) used to match incoming requests (optional).
-	RewriteURL    string // RewriteURL is the URL to rewrite the incoming request to (downstream) (optional).
-	Redirect      string // Redirect is the URL to redirect the request to (optional).
-	SkipTLSVerify bool   // SkipTLSVerify determines whether to skip TLS certificate verification for backend connections (optional).
+	Path          string      // Path is the proxy path (upstream) used to match incoming requests (optional).
+	RewriteURL    string      // RewriteURL is the URL to rewrite the incoming request to (downstream) (optional).
+	Redirect      string      // Redirect is the URL to redirect the request to (optional).
+	Protocol      string      // Protocol used to talk to the backend, ProtocolHTTP (default) or ProtocolH2C (optional).
+	ProxyProtocol string      // PROXY protocol version sent to the backend on each connection, "v1" or "v2" (optional).
+	TLSConfig     *tls.Config // TLS configuration of connections to https backends, see NewBackendTLSConfig (optional).
 }
 
 // Transport wraps an http.RoundTripper to allow for custom transport configurations.
@@ -57,11 +63,20 @@ type Transport struct {
 	transport http.RoundTripper
 }
 
-// NewTransport creates a new Transport instance with the provided RoundTripper.
-// It configures the TLS settings based on the skipTLSVerify parameter.
-// If skipTLSVerify is true, the Transport will not verify the server's TLS certificate.
-func NewTransport(transport http.RoundTripper, skipTLSVerify bool) *Transport {
-	transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: skipTLSVerify}
+// NewTransport creates a Transport with a connection pool of its own, using the TLS configuration for https backends.
+// Every backend has its own transport, so that its TLS settings are not shared with other backends.
+func NewTransport(tlsConfig *tls.Config) *Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	// increase idle connection per host, timeout and HTTP/2
+	// any use of those fileds conservatively disables HTTP/2
+	// so we need to force attempt to try to connect to backend via HTTP/2
+	// it will falback to HTTP/1.1 if backend does not support ver. 2
+	transport.MaxIdleConnsPerHost = 32
+	transport.IdleConnTimeout = 30 * time.Second
+	transport.ForceAttemptHTTP2 = true
+	transport.TLSClientConfig = tlsConfig
+
 	return &Transport{transport: transport}
 }
 
@@ -118,19 +133,17 @@ func NewReverseProxy(
 		zap.String("rewriteURL", config.RewriteURL),
 	)
 
-	// increase idle connection per host, timeout and HTTP/2
-	// any use of those fileds conservatively disables HTTP/2
-	// so we need to force attempt to try to connect to backend via HTTP/2
-	// it will falback to HTTP/1.1 if backend does not support ver. 2
-	transporter := http.DefaultTransport
-	transporter.(*http.Transport).MaxIdleConnsPerHost = 32
-	transporter.(*http.Transport).IdleConnTimeout = 30 * time.Second
-	transporter.(*http.Transport).ForceAttemptHTTP2 = true
-
 	reverseProxy := prx.proxy
 	reverseProxy.Director = prx.director
 	reverseProxy.ModifyResponse = prx.modifyResponse
-	reverseProxy.Transport = NewTransport(transporter, config.SkipTLSVerify)
+	reverseProxy.Transport = NewTransport(config.TLSConfig)
+	if config.Protocol == ProtocolH2C {
+		// h2c backends (e.g. gRPC servers) do not speak HTTP/1.1 so HTTP/2 is used with prior knowledge.
+		reverseProxy.Transport = &Transport{transport: h2cTransport}
+	}
+	if config.ProxyProtocol != "" {
+		reverseProxy.Transport = &Transport{transport: newProxyProtocolTransport(config.ProxyProtocol, config.TLSConfig)}
+	}
 	reverseProxy.ErrorHandler = prx.errorHandler
 	reverseProxy.BufferPool = NewBufferPool()
 
@@ -168,11 +181,10 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 }
 
 // updateRequestHeaders modifies the HTTP request headers before forwarding the request to the backend.
-// Sets the X-Forwarded-Host and X-Forwarded-For headers to preserve the original host information.
+// Sets the forwarding headers according to the ForwardedHeaders policy of the service handling the request.
 func (p *URLRewriteProxy) updateRequestHeaders(req *http.Request) {
-	originalHost := req.Host
-	req.Header.Set(HeaderXForwardedHost, originalHost)
-	req.Header.Set(HeaderXForwardedFor, originalHost)
+	policy, _ := req.Context().Value(ForwardedHeadersKey).(*ForwardedHeaders)
+	policy.apply(req)
 }
 
 // handleRedirect processes HTTP redirect responses from the backend server.
@@ -228,17 +240,30 @@ func isRedirect(statusCode int) bool {
 	}
 }
 
-// Logs unexpected errors and sends a generic error response to the client.
+// Logs unexpected errors and sends an error response to the client.
+// The error is recorded on the request attempt (if any) so that the caller can decide whether to retry.
 func (p *URLRewriteProxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if attempt := GetAttemptFromContext(r.Context()); attempt != nil {
+		attempt.Err = err
+	}
+
+	timedOut := IsTimeout(r.Context(), err)
+
 	// this is a Go reverseproxy problem since Go doesn't return any meaningful cause
 	// and Go maintainers says that it is expected since client has disconnected the session
 	// so as for Go 1.23 this is still an issue and we have to live with it
 	// We don't want to overflow logs with this error as this can happen quite often
 	// so we just ignore it for now until Go team provide a better solution
-	if errors.Is(err, context.Canceled) {
+	if errors.Is(err, context.Canceled) && !timedOut {
+		return
+	}
+
+	if timedOut {
+		p.logger.Warn("Backend timed out", zap.String("target", p.target.String()), zap.Error(err))
+		WriteError(w, r, "Gateway Timeout", http.StatusGatewayTimeout)
 		return
 	}
 
 	p.logger.Error("Unexpected error in proxy", zap.Error(err))
-	http.Error(w, "Something went wrong", http.StatusInternalServerError)
+	WriteError(w, r, "Bad Gateway", http.StatusBadGateway)
 }
@@ -0,0 +1,60 @@
+package pool
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/pkg/proxyproto"
+)
+
+// proxyProtocolTransport sends requests to backends expecting a PROXY protocol header.
+// The header announces a single client per connection, so connections are never shared between requests.
+// Each request is sent over a new HTTP/1.1 connection which is closed with the response.
+type proxyProtocolTransport struct {
+	version   string
+	tlsConfig *tls.Config
+	dialer    *net.Dialer
+}
+
+func newProxyProtocolTransport(version string, tlsConfig *tls.Config) *proxyProtocolTransport {
+	return &proxyProtocolTransport{
+		version:   version,
+		tlsConfig: tlsConfig,
+		dialer:    &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+	}
+}
+
+// RoundTrip sends the request over a connection announcing the client of the request.
+// The destination is the address of the listener the client connected to.
+func (t *proxyProtocolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var src, dst net.Addr
+	if ap, err := netip.ParseAddrPort(req.RemoteAddr); err == nil {
+		src = net.TCPAddrFromAddrPort(ap)
+	}
+	dst, _ = req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+
+	// A transport per request makes sure the connection dialed with this header is not handed to another request
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := t.dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			if err := proxyproto.WriteHeader(conn, t.version, src, dst); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		},
+		TLSClientConfig:     t.tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		DisableKeepAlives:   true,
+		// HTTP/2 multiplexes requests of many clients
+		TLSNextProto: make(map[string]func(string, *tls.Conn) http.RoundTripper),
+	}
+	return transport.RoundTrip(req)
+}
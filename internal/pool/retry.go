@@ -0,0 +1,234 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+)
+
+// Conditions which can be listed in the retry_on option of a retry policy.
+const (
+	RetryOnConnectFailure = "connect-failure" // The connection to the backend could not be established.
+	RetryOnTimeout        = "timeout"         // The backend did not respond in time.
+	RetryOnReset          = "reset"           // The connection was reset before a response was received.
+	RetryOnGatewayError   = "gateway-error"   // The backend responded with 502, 503 or 504.
+	RetryOn5xx            = "5xx"             // The backend responded with any 5xx status code.
+)
+
+// Defaults applied to retry policies.
+const (
+	DefaultRetryBackoff     = 25 * time.Millisecond
+	DefaultRetryMaxBackoff  = time.Second
+	DefaultRetryMaxBodySize = 64 << 10 // 64 KiB
+)
+
+// DefaultRetryOn is used when a retry policy does not list any retry conditions.
+var DefaultRetryOn = []string{RetryOnConnectFailure, RetryOnTimeout, RetryOnReset, RetryOnGatewayError}
+
+// ErrPerTryTimeout is the cancellation cause of an attempt that exceeded the per-try timeout.
+var ErrPerTryTimeout = errors.New("per-try timeout exceeded")
+
+// RetryPolicy decides whether and how a failed request is retried.
+// A nil RetryPolicy never retries.
+type RetryPolicy struct {
+	attempts         int
+	perTryTimeout    time.Duration
+	backoff          time.Duration
+	maxBackoff       time.Duration
+	maxBodySize      int64
+	nonIdempotent    bool
+	onConnectFailure bool
+	onTimeout        bool
+	onReset          bool
+	statusCodes      map[int]bool
+}
+
+// NewRetryPolicy builds a RetryPolicy from the provided configuration.
+// Returns nil if the configuration is nil or allows a single attempt only.
+func NewRetryPolicy(cfg *config.RetryConfig) (*RetryPolicy, error) {
+	if cfg == nil || cfg.Attempts <= 1 {
+		return nil, nil
+	}
+
+	p := &RetryPolicy{
+		attempts:      cfg.Attempts,
+		perTryTimeout: cfg.PerTryTimeout,
+		backoff:       cfg.Backoff,
+		maxBackoff:    cfg.MaxBackoff,
+		maxBodySize:   cfg.MaxBodySize,
+		nonIdempotent: cfg.RetryNonIdempotent,
+		statusCodes:   make(map[int]bool),
+	}
+
+	if p.backoff <= 0 {
+		p.backoff = DefaultRetryBackoff
+	}
+	if p.maxBackoff <= 0 {
+		p.maxBackoff = DefaultRetryMaxBackoff
+	}
+	if p.maxBodySize <= 0 {
+		p.maxBodySize = DefaultRetryMaxBodySize
+	}
+
+	retryOn := cfg.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = DefaultRetryOn
+	}
+
+	for _, cond := range retryOn {
+		switch cond {
+		case RetryOnConnectFailure:
+			p.onConnectFailure = true
+		case RetryOnTimeout:
+			p.onTimeout = true
+		case RetryOnReset:
+			p.onReset = true
+		case RetryOnGatewayError:
+			p.statusCodes[http.StatusBadGateway] = true
+			p.statusCodes[http.StatusServiceUnavailable] = true
+			p.statusCodes[http.StatusGatewayTimeout] = true
+		case RetryOn5xx:
+			for code := 500; code < 600; code++ {
+				p.statusCodes[code] = true
+			}
+		default:
+			return nil, fmt.Errorf("unknown retry condition %q", cond)
+		}
+	}
+
+	for _, code := range cfg.StatusCodes {
+		if code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid retry status code %d", code)
+		}
+		p.statusCodes[code] = true
+	}
+
+	return p, nil
+}
+
+// Attempts returns the maximum number of attempts for the given request.
+// Requests with non-idempotent methods are attempted once unless the policy opts in.
+func (p *RetryPolicy) Attempts(r *http.Request) int {
+	if p == nil {
+		return 1
+	}
+
+	if !p.nonIdempotent && !isIdempotent(r) {
+		return 1
+	}
+
+	return p.attempts
+}
+
+// PerTryTimeout returns the timeout of a single attempt or zero if not limited.
+func (p *RetryPolicy) PerTryTimeout() time.Duration {
+	if p == nil {
+		return 0
+	}
+	return p.perTryTimeout
+}
+
+// MaxBodySize returns the maximum request body size buffered for replay.
+func (p *RetryPolicy) MaxBodySize() int64 {
+	if p == nil {
+		return 0
+	}
+	return p.maxBodySize
+}
+
+// Backoff returns the delay before the given retry (starting at 1).
+// The delay grows exponentially and is jittered to avoid retry storms.
+func (p *RetryPolicy) Backoff(retry int) time.Duration {
+	if p == nil || retry <= 0 {
+		return 0
+	}
+
+	delay := p.backoff << (retry - 1)
+	if delay <= 0 || delay > p.maxBackoff {
+		delay = p.maxBackoff
+	}
+
+	// Jitter between 50% and 100% of the computed delay.
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// ShouldRetryStatus reports whether a response with the given status code should be retried.
+func (p *RetryPolicy) ShouldRetryStatus(code int) bool {
+	return p != nil && p.statusCodes[code]
+}
+
+// ShouldRetryError reports whether a transport error should be retried.
+// ctx is the context of the failed attempt, used to tell per-try timeouts from client cancellation.
+func (p *RetryPolicy) ShouldRetryError(ctx context.Context, err error) bool {
+	if p == nil || err == nil {
+		return false
+	}
+
+	if IsTimeout(ctx, err) {
+		return p.onTimeout
+	}
+
+	// Client went away, there is nobody to retry for.
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return p.onConnectFailure
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return p.onConnectFailure
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return p.onReset
+	}
+
+	return false
+}
+
+// IsTimeout reports whether an attempt failed because it timed out.
+func IsTimeout(ctx context.Context, err error) bool {
+	if errors.Is(context.Cause(ctx), ErrPerTryTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isIdempotent reports whether the request method is idempotent as defined by RFC 9110.
+func isIdempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// Attempt records the outcome of proxying a request to a single backend.
+type Attempt struct {
+	Err error // Transport error reported by the reverse proxy, if any.
+}
+
+// GetAttemptFromContext returns the attempt stored in the context or nil.
+func GetAttemptFromContext(ctx context.Context) *Attempt {
+	attempt, _ := ctx.Value(AttemptKey).(*Attempt)
+	return attempt
+}
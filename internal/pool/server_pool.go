@@ -2,9 +2,11 @@ package pool
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"reflect"
 	"sync/atomic"
 
 	"github.com/unkn0wn-root/terraster/internal/config"
@@ -17,6 +19,10 @@ type contextKey int
 const (
 	// RetryKey is used as a key to store and retrieve retry counts from the request context.
 	RetryKey contextKey = iota
+	// AttemptKey is used as a key to store the Attempt of the current proxy request.
+	AttemptKey
+	// ForwardedHeadersKey is used as a key to store the ForwardedHeaders policy of the service handling the request.
+	ForwardedHeadersKey
 )
 
 type PoolConfig struct {
@@ -24,6 +30,12 @@ type PoolConfig struct {
 	MaxConns  int32  `json:"max_connections"` // The maximum number of concurrent connections allowed per backend.
 }
 
+// algorithmHolder wraps an algorithm so that implementations of different types
+// can be stored in the same atomic.Value.
+type algorithmHolder struct {
+	algorithm.Algorithm
+}
+
 // BackendSnapshot represents a snapshot of the current state of backends in the ServerPool.
 type BackendSnapshot struct {
 	Backends     []*Backend          // Slice of all backend servers in the pool.
@@ -32,11 +44,13 @@ type BackendSnapshot struct {
 
 // ServerPool manages a pool of backend servers, handling load balancing and connection management.
 type ServerPool struct {
-	backends       atomic.Value // Atomic value storing the current BackendSnapshot.
-	current        uint64       // Atomic counter used for round-robin load balancing.
-	algorithm      atomic.Value // Atomic value storing the current load balancing algorithm.
-	maxConnections atomic.Int32 // Atomic integer representing the maximum allowed connections per backend.
-	log            *zap.Logger  // Logger instance for logging pool activities.
+	backends       atomic.Value                    // Atomic value storing the current BackendSnapshot.
+	current        uint64                          // Atomic counter used for round-robin load balancing.
+	algorithm      atomic.Value                    // Atomic value storing the current load balancing algorithm (algorithmHolder).
+	maxConnections atomic.Int32                    // Atomic integer representing the maximum allowed connections per backend.
+	log            *zap.Logger                     // Logger instance for logging pool activities.
+	outlier        atomic.Pointer[OutlierDetector] // Passive outlier detection. Nil if disabled.
+	circuit        atomic.Pointer[CircuitBreaker]  // Per backend circuit breaking. Nil if disabled.
 }
 
 func NewServerPool(logger *zap.Logger) *ServerPool {
@@ -46,7 +60,7 @@ func NewServerPool(logger *zap.Logger) *ServerPool {
 		BackendCache: make(map[string]*Backend),
 	}
 	pool.backends.Store(initialSnapshot)
-	pool.algorithm.Store(algorithm.CreateAlgorithm("round-robin"))
+	pool.algorithm.Store(algorithmHolder{algorithm.CreateAlgorithm("round-robin")})
 	pool.maxConnections.Store(1000)
 	return pool
 }
@@ -60,11 +74,56 @@ func (s *ServerPool) AddBackend(
 	rc RouteConfig,
 	hcCfg *config.HealthCheckConfig,
 ) error {
-	url, err := url.Parse(cfg.URL)
+	backend, err := s.newBackend(cfg, rc, hcCfg)
 	if err != nil {
 		return err
 	}
 
+	currentSnapshot := s.backends.Load().(*BackendSnapshot)
+	newBackends := make([]*Backend, len(currentSnapshot.Backends)+1)
+	copy(newBackends, currentSnapshot.Backends)
+	newBackends[len(currentSnapshot.Backends)] = backend
+
+	newBackendCache := make(map[string]*Backend, len(currentSnapshot.BackendCache)+1)
+	for k, v := range currentSnapshot.BackendCache {
+		newBackendCache[k] = v
+	}
+	newBackendCache[backend.URL.String()] = backend
+
+	// Create a new BackendSnapshot and atomically replace the old one.
+	newSnapshot := &BackendSnapshot{
+		Backends:     newBackends,
+		BackendCache: newBackendCache,
+	}
+	s.backends.Store(newSnapshot)
+
+	return nil
+}
+
+// newBackend creates a backend and its reverse proxy from the configuration.
+// The backend is alive until health checks report otherwise.
+func (s *ServerPool) newBackend(
+	cfg config.BackendConfig,
+	rc RouteConfig,
+	hcCfg *config.HealthCheckConfig,
+) (*Backend, error) {
+	url, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	// The connections to h2c backends are shared by many clients, a PROXY protocol header announces only one
+	if rc.ProxyProtocol != "" && rc.Protocol == ProtocolH2C {
+		return nil, fmt.Errorf("backend %s: proxy_protocol is not supported for h2c backends", cfg.URL)
+	}
+
+	route := rc
+	route.TLSConfig = nil
+	rc.TLSConfig, err = NewBackendTLSConfig(url, cfg.SkipTLSVerify, cfg.TLS, s.log)
+	if err != nil {
+		return nil, fmt.Errorf("backend %s: %w", cfg.URL, err)
+	}
+
 	createProxy := &httputil.ReverseProxy{}
 	rp := NewReverseProxy(
 		url,
@@ -90,30 +149,18 @@ func (s *ServerPool) AddBackend(
 		MaxConnections: maxConnections,
 		Proxy:          rp,
 		HealthCheckCfg: hcCfg,
+		ProxyProtocol:  cfg.ProxyProtocol,
+		TLSConfig:      rc.TLSConfig,
+		id:             backendID(url.String()),
+		cfg:            cfg,
+		route:          route,
 	}
+	backend.Draining.Store(cfg.Drain)
 	backend.Alive.Store(true)                   // Mark the backend as initially alive.
 	atomic.StoreInt32(&backend.SuccessCount, 0) // Initialize success count.
 	atomic.StoreInt32(&backend.FailureCount, 0) // Initialize failure count.
 
-	currentSnapshot := s.backends.Load().(*BackendSnapshot)
-	newBackends := make([]*Backend, len(currentSnapshot.Backends)+1)
-	copy(newBackends, currentSnapshot.Backends)
-	newBackends[len(currentSnapshot.Backends)] = backend
-
-	newBackendCache := make(map[string]*Backend, len(currentSnapshot.BackendCache)+1)
-	for k, v := range currentSnapshot.BackendCache {
-		newBackendCache[k] = v
-	}
-	newBackendCache[url.String()] = backend
-
-	// Create a new BackendSnapshot and atomically replace the old one.
-	newSnapshot := &BackendSnapshot{
-		Backends:     newBackends,
-		BackendCache: newBackendCache,
-	}
-	s.backends.Store(newSnapshot)
-
-	return nil
+	return backend, nil
 }
 
 // RemoveBackend removes an existing backend from the ServerPool based on its URL.
@@ -167,7 +214,7 @@ func (s *ServerPool) GetNextPeer() *Backend {
 	}
 
 	if backendCount == 1 {
-		if backends[0].Alive.Load() {
+		if s.IsAvailable(backends[0]) {
 			return backends[0] // Only one backend and it's alive.
 		}
 		return nil
@@ -176,8 +223,8 @@ func (s *ServerPool) GetNextPeer() *Backend {
 	for i := uint64(0); i < backendCount; i++ {
 		next := atomic.AddUint64(&s.current, 1)
 		idx := next % backendCount
-		if backends[idx].Alive.Load() {
-			return backends[idx] // Return the first alive backend found.
+		if s.IsAvailable(backends[idx]) {
+			return backends[idx] // Return the first available backend found.
 		}
 	}
 
@@ -185,16 +232,23 @@ func (s *ServerPool) GetNextPeer() *Backend {
 }
 
 // MarkBackendStatus updates the alive status of a backend based on its URL.
+// Backends ejected by outlier detection stay out of rotation until the ejection ends,
+// the active health check result is applied once they are restored.
 // It is used by health checkers to mark backends as alive or dead.
 func (s *ServerPool) MarkBackendStatus(backendUrl *url.URL, alive bool) {
 	currentSnapshot := s.backends.Load().(*BackendSnapshot)
 	backend, exists := currentSnapshot.BackendCache[backendUrl.String()]
 	if exists {
+		backend.healthCheckFailed.Store(!alive)
+		if alive && backend.IsEjected() {
+			return
+		}
 		backend.Alive.Store(alive) // Update the alive status.
 	}
 }
 
 // GetBackends returns a slice of all backend servers converted to algorithm.Server type for use in load balancing algorithms.
+// A server is alive if the backend is available, i.e. alive and its circuit lets requests through.
 func (s *ServerPool) GetBackends() []*algorithm.Server {
 	currentSnapshot := s.backends.Load().(*BackendSnapshot)
 	currentBackends := currentSnapshot.Backends
@@ -204,20 +258,24 @@ func (s *ServerPool) GetBackends() []*algorithm.Server {
 		server := &algorithm.Server{
 			URL:             backend.URL.String(),
 			Weight:          backend.Weight,
-			ConnectionCount: backend.ConnectionCount,
+			ConnectionCount: atomic.LoadInt32(&backend.ConnectionCount),
 			MaxConnections:  backend.MaxConnections,
 		}
-		server.Alive.Store(backend.Alive.Load())
+		// Backends with an open circuit are reported as not alive, so that algorithms skip them.
+		server.Alive.Store(s.IsAvailable(backend))
 		server.CurrentWeight.Store(backend.CurrentWeight.Load())
 		servers[i] = server
 	}
 	return servers
 }
 
-// UpdateBackends completely replaces the existing list of backends with a new set based on the provided configurations.
-// It updates the load balancing algorithm and health check settings for each backend.
-// Returns an error if any backend configuration is invalid.
-func (s *ServerPool) UpdateBackends(configs []config.BackendConfig, serviceHealthCheck *config.HealthCheckConfig) error {
+// UpdateBackends replaces the backends of the pool with the configured ones.
+// Backends whose configuration did not change are kept with their health, outlier and circuit breaker state
+// and their active connections. Backends which are new or whose configuration changed are created anew.
+// The route settings of rc apply to all backends, protocol and PROXY protocol are taken from each backend configuration,
+// the health check from the backend configuration or else hcCfg.
+// Returns an error if any backend configuration is invalid, the pool is left unchanged in that case.
+func (s *ServerPool) UpdateBackends(configs []config.BackendConfig, rc RouteConfig, hcCfg *config.HealthCheckConfig) error {
 	newBackends := make([]*Backend, 0, len(configs))
 	newBackendCache := make(map[string]*Backend, len(configs))
 
@@ -230,48 +288,33 @@ func (s *ServerPool) UpdateBackends(configs []config.BackendConfig, serviceHealt
 			return err
 		}
 
-		// Check if the backend already exists in the current backends.
-		var existing *Backend
-		if b, exists := currentBackendsMap[url.String()]; exists {
-			existing = b
-			existing.Weight = cfg.Weight
-			if cfg.MaxConnections != 0 {
-				existing.MaxConnections = cfg.MaxConnections
-			}
-			if cfg.HealthCheck.Type != "" {
-				existing.HealthCheckCfg = cfg.HealthCheck
-			}
+		route := rc
+		route.Protocol = cfg.Protocol
+		route.ProxyProtocol = cfg.ProxyProtocol
+		route.TLSConfig = nil
 
+		backendHealthCheck := hcCfg
+		if cfg.HealthCheck != nil {
+			backendHealthCheck = cfg.HealthCheck
+		}
+		if backendHealthCheck == nil {
+			backendHealthCheck = config.DefaultHealthCheck.Copy()
+		}
+
+		// Keep the backend if it already exists with the same configuration.
+		if existing, exists := currentBackendsMap[url.String()]; exists && existing.route == route &&
+			reflect.DeepEqual(existing.cfg, cfg) && reflect.DeepEqual(existing.HealthCheckCfg, backendHealthCheck) {
 			newBackends = append(newBackends, existing)
 			newBackendCache[url.String()] = existing
-		} else {
-			// Create a new backend as it does not exist in the current pool.
-			proxy := &httputil.ReverseProxy{}
-			rp := NewReverseProxy(
-				url,
-				RouteConfig{},
-				proxy,
-				s.log,
-			)
-
-			maxConns := cfg.MaxConnections
-			if maxConns == 0 {
-				maxConns = s.GetMaxConnections() // Use pool's default if not specified.
-			}
-
-			backend := &Backend{
-				URL:            url,
-				Weight:         cfg.Weight,
-				MaxConnections: maxConns,
-				Proxy:          rp,
-				HealthCheckCfg: serviceHealthCheck,
-			}
-			atomic.StoreInt32(&backend.SuccessCount, 0)
-			atomic.StoreInt32(&backend.FailureCount, 0)
-			backend.Alive.Store(true)
-			newBackends = append(newBackends, backend)
-			newBackendCache[url.String()] = backend
+			continue
 		}
+
+		backend, err := s.newBackend(cfg, route, backendHealthCheck)
+		if err != nil {
+			return err
+		}
+		newBackends = append(newBackends, backend)
+		newBackendCache[url.String()] = backend
 	}
 
 	newSnapshot := &BackendSnapshot{
@@ -283,6 +326,19 @@ func (s *ServerPool) UpdateBackends(configs []config.BackendConfig, serviceHealt
 	return nil
 }
 
+// Clone returns a new pool with the backends and settings of the pool.
+// Outlier detection and circuit breaking are not copied.
+// Pools built from a changed configuration start as a clone of the pool they replace,
+// so that UpdateBackends keeps the state of unchanged backends without modifying the pool still in use.
+func (s *ServerPool) Clone() *ServerPool {
+	clone := NewServerPool(s.log)
+	clone.backends.Store(s.backends.Load())
+	clone.algorithm.Store(s.algorithm.Load())
+	clone.maxConnections.Store(s.maxConnections.Load())
+	atomic.StoreUint64(&clone.current, atomic.LoadUint64(&s.current))
+	return clone
+}
+
 // GetNextProxy retrieves the next available backend proxy based on the load balancing algorithm and increments its connection count.
 // Returns the selected URLRewriteProxy or nil if no suitable backend is available.
 func (s *ServerPool) GetNextProxy(r *http.Request) *URLRewriteProxy {
@@ -316,26 +372,26 @@ func (s *ServerPool) UpdateConfig(update PoolConfig) {
 	}
 
 	if update.Algorithm != "" {
-		s.algorithm.Store(algorithm.CreateAlgorithm(update.Algorithm))
+		s.algorithm.Store(algorithmHolder{algorithm.CreateAlgorithm(update.Algorithm)})
 	}
 }
 
 // GetConfig retrieves the current configuration of the ServerPool, including the load balancing algorithm and maximum connections.
 func (s *ServerPool) GetConfig() PoolConfig {
 	return PoolConfig{
-		Algorithm: s.algorithm.Load().(algorithm.Algorithm).Name(),
+		Algorithm: s.GetAlgorithm().Name(),
 		MaxConns:  s.maxConnections.Load(),
 	}
 }
 
 // GetAlgorithm returns the current load balancing algorithm used by the ServerPool.
 func (s *ServerPool) GetAlgorithm() algorithm.Algorithm {
-	return s.algorithm.Load().(algorithm.Algorithm)
+	return s.algorithm.Load().(algorithmHolder).Algorithm
 }
 
 // SetAlgorithm sets a new load balancing algorithm for the ServerPool.
 func (s *ServerPool) SetAlgorithm(algorithm algorithm.Algorithm) {
-	s.algorithm.Store(algorithm)
+	s.algorithm.Store(algorithmHolder{algorithm})
 }
 
 // GetMaxConnections retrieves the current maximum number of connections allowed per backend.
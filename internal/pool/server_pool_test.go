@@ -0,0 +1,98 @@
+package pool
+
+import (
+	"testing"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+)
+
+func TestUpdateBackendsKeepsUnchangedBackends(t *testing.T) {
+	p := newTestPool(t, "http://127.0.0.1:9001", "http://127.0.0.1:9002")
+	before := make(map[string]*Backend)
+	for _, b := range p.GetAllBackends() {
+		before[b.URL.String()] = b
+	}
+
+	// State of the unchanged backend has to survive the update.
+	kept := before["http://127.0.0.1:9001"]
+	kept.IncrementConnections()
+	p.MarkBackendStatus(kept.URL, false)
+
+	err := p.UpdateBackends([]config.BackendConfig{
+		{URL: "http://127.0.0.1:9001"},
+		{URL: "http://127.0.0.1:9002", Weight: 5},
+		{URL: "http://127.0.0.1:9003"},
+	}, RouteConfig{Path: "/"}, config.DefaultHealthCheck.Copy())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := make(map[string]*Backend)
+	for _, b := range p.GetAllBackends() {
+		after[b.URL.String()] = b
+	}
+	if len(after) != 3 {
+		t.Fatalf("expected 3 backends, got %d", len(after))
+	}
+
+	if b := after["http://127.0.0.1:9001"]; b != kept || b.GetConnectionCount() != 1 || b.IsAlive() {
+		t.Fatal("expected the unchanged backend to keep its connections and health")
+	}
+	if b := after["http://127.0.0.1:9002"]; b == before["http://127.0.0.1:9002"] || b.Weight != 5 {
+		t.Fatal("expected the changed backend to be created anew")
+	}
+	if b := after["http://127.0.0.1:9003"]; b == nil || !b.IsAlive() {
+		t.Fatal("expected the new backend to be alive")
+	}
+
+	// A changed route recreates all backends.
+	if err := p.UpdateBackends([]config.BackendConfig{{URL: "http://127.0.0.1:9001"}},
+		RouteConfig{Path: "/api"}, config.DefaultHealthCheck.Copy()); err != nil {
+		t.Fatal(err)
+	}
+	if p.GetAllBackends()[0] == kept {
+		t.Fatal("expected a backend with a changed route to be created anew")
+	}
+}
+
+func TestUpdateBackendsInvalid(t *testing.T) {
+	p := newTestPool(t, "http://127.0.0.1:9001")
+	kept := p.GetAllBackends()[0]
+
+	err := p.UpdateBackends([]config.BackendConfig{
+		{URL: "http://127.0.0.1:9002"},
+		{URL: "http://127.0.0.1:9003", Protocol: ProtocolH2C, ProxyProtocol: "v1"},
+	}, RouteConfig{Path: "/"}, config.DefaultHealthCheck.Copy())
+	if err == nil {
+		t.Fatal("expected h2c with PROXY protocol to be rejected")
+	}
+	if backends := p.GetAllBackends(); len(backends) != 1 || backends[0] != kept {
+		t.Fatal("expected the pool to be unchanged after a failed update")
+	}
+}
+
+func TestClone(t *testing.T) {
+	p := newTestPool(t, "http://127.0.0.1:9001")
+	cb, err := NewCircuitBreaker(&config.CircuitBreaker{}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetCircuitBreaker(cb)
+
+	clone := p.Clone()
+	if clone.GetAllBackends()[0] != p.GetAllBackends()[0] {
+		t.Fatal("expected the clone to share the backends")
+	}
+	if clone.SetCircuitState(clone.GetAllBackends()[0], CircuitOpen) == nil {
+		t.Fatal("expected the clone to start without circuit breaker")
+	}
+
+	// Updating the clone leaves the original pool unchanged.
+	if err := clone.UpdateBackends([]config.BackendConfig{{URL: "http://127.0.0.1:9002"}},
+		RouteConfig{Path: "/"}, config.DefaultHealthCheck.Copy()); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.GetAllBackends()[0].URL.String(); got != "http://127.0.0.1:9001" {
+		t.Fatalf("expected the original pool to keep its backends, got %s", got)
+	}
+}
@@ -0,0 +1,160 @@
+package pool
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+)
+
+// DefaultStickyCookieName is used when a sticky session configuration does not set a cookie name.
+const DefaultStickyCookieName = "terraster_sticky"
+
+// StickySession pins clients to a backend with a cookie issued by the load balancer.
+// The cookie holds an opaque backend identifier, optionally signed with HMAC-SHA256
+// so that clients cannot pick a backend by forging the cookie.
+type StickySession struct {
+	cookieName string
+	path       string
+	ttl        time.Duration
+	sameSite   http.SameSite
+	secure     bool
+	secret     []byte
+}
+
+// NewStickySession builds a StickySession from the provided configuration.
+// Returns nil if the configuration is nil.
+func NewStickySession(cfg *config.StickyConfig) (*StickySession, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	s := &StickySession{
+		cookieName: cfg.CookieName,
+		path:       cfg.Path,
+		ttl:        cfg.TTL,
+		secure:     cfg.Secure,
+	}
+
+	if s.cookieName == "" {
+		s.cookieName = DefaultStickyCookieName
+	}
+	if s.path == "" {
+		s.path = "/"
+	}
+	if cfg.Secret != "" {
+		s.secret = []byte(cfg.Secret)
+	}
+
+	switch strings.ToLower(cfg.SameSite) {
+	case "", "lax":
+		s.sameSite = http.SameSiteLaxMode
+	case "strict":
+		s.sameSite = http.SameSiteStrictMode
+	case "none":
+		// Browsers reject SameSite=None cookies without the Secure flag.
+		s.sameSite = http.SameSiteNoneMode
+		s.secure = true
+	default:
+		return nil, fmt.Errorf("invalid sticky same_site %q, must be lax, strict or none", cfg.SameSite)
+	}
+
+	return s, nil
+}
+
+// Backend returns the backend the request is pinned to.
+// Returns nil if there is no valid cookie, or the backend is gone, not available or at max capacity.
+func (s *StickySession) Backend(r *http.Request, p *ServerPool) *Backend {
+	if s == nil {
+		return nil
+	}
+
+	cookie, err := r.Cookie(s.cookieName)
+	if err != nil {
+		return nil
+	}
+
+	id, ok := s.verify(cookie.Value)
+	if !ok {
+		return nil
+	}
+
+	for _, b := range p.GetAllBackends() {
+		if b.id != id {
+			continue
+		}
+
+		if !p.IsAvailable(b) || atomic.LoadInt32(&b.ConnectionCount) >= b.MaxConnections {
+			return nil
+		}
+		return b
+	}
+
+	return nil
+}
+
+// Cookie returns the cookie pinning the client to the given backend.
+// Returns nil for draining backends, which keep existing sessions but do not get new ones.
+func (s *StickySession) Cookie(b *Backend) *http.Cookie {
+	if s == nil || b.Draining.Load() {
+		return nil
+	}
+
+	cookie := &http.Cookie{
+		Name:     s.cookieName,
+		Value:    s.sign(b.id),
+		Path:     s.path,
+		Secure:   s.secure,
+		HttpOnly: true,
+		SameSite: s.sameSite,
+	}
+
+	if s.ttl > 0 {
+		cookie.MaxAge = int(s.ttl.Seconds())
+		cookie.Expires = time.Now().Add(s.ttl)
+	}
+
+	return cookie
+}
+
+// sign appends the signature to the backend id if a secret is configured.
+func (s *StickySession) sign(id string) string {
+	if s.secret == nil {
+		return id
+	}
+	return id + "." + s.mac(id)
+}
+
+// verify checks the signature of a cookie value and returns the backend id.
+func (s *StickySession) verify(value string) (string, bool) {
+	if s.secret == nil {
+		return value, value != ""
+	}
+
+	id, sig, found := strings.Cut(value, ".")
+	if !found || !hmac.Equal([]byte(sig), []byte(s.mac(id))) {
+		return "", false
+	}
+
+	return id, true
+}
+
+func (s *StickySession) mac(id string) string {
+	m := hmac.New(sha256.New, s.secret)
+	m.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil)[:16])
+}
+
+// backendID derives an opaque, stable identifier from the backend URL.
+// It does not reveal the backend address to clients.
+func backendID(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:8])
+}
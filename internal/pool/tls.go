@@ -0,0 +1,118 @@
+package pool
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+	"go.uber.org/zap"
+)
+
+// CertCheckInterval is how often client certificate files of backends are checked for changes.
+const CertCheckInterval = time.Minute
+
+// NewBackendTLSConfig creates the TLS configuration of connections to the backend.
+// Returns nil for plaintext backends.
+func NewBackendTLSConfig(target *url.URL, skipTLSVerify bool, cfg *config.BackendTLSConfig, logger *zap.Logger) (*tls.Config, error) {
+	if target.Scheme != "https" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: skipTLSVerify,
+	}
+	if cfg == nil {
+		return tlsConfig, nil
+	}
+
+	minVersion, err := config.ParseTLSVersion(cfg.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.MinVersion = minVersion
+	tlsConfig.ServerName = cfg.ServerName
+
+	if cfg.CAFile != "" {
+		pemCAs, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca_file: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pemCAs) {
+			return nil, fmt.Errorf("no certificates found in ca_file %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	if cfg.CertFile != "" {
+		cert := &clientCertificate{certFile: cfg.CertFile, keyFile: cfg.KeyFile, logger: logger}
+		if err := cert.load(); err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = cert.get
+	}
+
+	return tlsConfig, nil
+}
+
+// clientCertificate presents a client certificate to backends.
+// The files are checked for changes at most every CertCheckInterval, so rotated certificates are picked up.
+type clientCertificate struct {
+	certFile string
+	keyFile  string
+	logger   *zap.Logger
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func (c *clientCertificate) load() error {
+	info, err := os.Stat(c.certFile)
+	if err != nil {
+		return fmt.Errorf("failed to read cert_file: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load client certificate: %w", err)
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.modTime = info.ModTime()
+	c.checkedAt = time.Now()
+	c.mu.Unlock()
+	return nil
+}
+
+// get returns the client certificate, reloading it if the certificate file changed.
+// A certificate which fails to load keeps the previous one in use.
+func (c *clientCertificate) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	stale := time.Since(c.checkedAt) >= CertCheckInterval
+	if stale {
+		c.checkedAt = time.Now()
+	}
+	modTime := c.modTime
+	c.mu.Unlock()
+
+	if stale {
+		if info, err := os.Stat(c.certFile); err == nil && !info.ModTime().Equal(modTime) {
+			if err := c.load(); err != nil {
+				c.logger.Error("Failed to reload backend client certificate, keeping the previous one",
+					zap.String("cert_file", c.certFile), zap.Error(err))
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert, nil
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"crypto/tls"
+
+	certmanager "github.com/unkn0wn-root/terraster/internal/crypto"
+)
+
+// clientAuthConfig returns the GetConfigForClient callback of an HTTPS port.
+// Services sharing the port are told apart by the server name (SNI) of the ClientHello, so clients connecting to
+// a service with client_auth are asked for a certificate verified against the CAs of that service.
+// Routes are loaded on every handshake so that a reload takes effect without restarting the listener.
+func (s *Server) clientAuthConfig(port int, base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		// The ACME server has no client certificate
+		if certmanager.IsACMEChallenge(hello) {
+			return nil, nil
+		}
+
+		route := s.findRoute(port, hello.ServerName)
+		if route == nil || route.service.ClientAuth == nil {
+			return nil, nil
+		}
+
+		cfg := base.Clone()
+		cfg.GetConfigForClient = nil
+		route.service.ClientAuth.Apply(cfg)
+		return cfg, nil
+	}
+}
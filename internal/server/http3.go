@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/unkn0wn-root/terraster/internal/service"
+	"go.uber.org/zap"
+)
+
+// AltSvcMaxAge is how long clients may remember that a service is reachable over HTTP/3.
+const AltSvcMaxAge = 24 * time.Hour
+
+// altSvcHeader returns the Alt-Svc value advertising HTTP/3 on the UDP port of the listener.
+func altSvcHeader(port int) string {
+	return fmt.Sprintf(`h3=":%d"; ma=%d`, port, int(AltSvcMaxAge.Seconds()))
+}
+
+// startHTTP3Server starts an HTTP/3 (QUIC) server on the UDP port of an HTTPS service which enabled it.
+// Services sharing the port share the server. Requests are dispatched by host just like on the TCP listener,
+// so only services with HTTP/3 enabled advertise it, see portHandler.
+func (s *Server) startHTTP3Server(svc *service.ServiceInfo, lns *boundListeners) {
+	if !svc.HTTP3() {
+		return
+	}
+
+	port := s.servicePort(svc.Port)
+	if _, running := s.http3Servers[port]; running {
+		return
+	}
+
+	// QUIC requires TLS 1.3. Certificates and client authentication are shared with the TCP listener.
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS13,
+		GetCertificate: s.certManager.GetCertificate,
+	}
+	tlsConfig.GetConfigForClient = s.clientAuthConfig(port, tlsConfig)
+
+	server := &http3.Server{
+		Addr:        fmt.Sprintf(":%d", port),
+		Handler:     s.portHandler(port),
+		TLSConfig:   http3.ConfigureTLSConfig(tlsConfig),
+		IdleTimeout: IdleTimeout,
+	}
+
+	s.http3Servers[port] = server
+
+	s.wg.Add(1)
+	go s.runHTTP3Server(server, lns.udp[port], svc.Name)
+
+	s.logger.Info("HTTP/3 enabled",
+		zap.String("service", svc.Name),
+		zap.String("host", svc.Host),
+		zap.Int("port", port))
+}
+
+// runHTTP3Server serves HTTP/3 on the provided UDP connection until the server is shut down.
+// Runs in a separate goroutine
+func (s *Server) runHTTP3Server(server *http3.Server, conn net.PacketConn, name string) {
+	defer s.wg.Done()
+	n := strings.ToUpper(name)
+	s.logger.Info("HTTP/3 server started", zap.String("service_name", n), zap.String("listen_on", server.Addr))
+
+	err := server.Serve(conn)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.logger.Error("Error starting HTTP/3 server", zap.String("server_name", n), zap.Error(err))
+		defer s.cancel()
+		s.errorChan <- err
+	} else {
+		s.logger.Info("HTTP/3 server stopped gracefully", zap.String("server_name", n))
+	}
+	conn.Close()
+}
+
+// stopUnusedHTTP3Servers gracefully shuts down HTTP/3 servers of ports on which no service has HTTP/3 enabled anymore.
+func (s *Server) stopUnusedHTTP3Servers(routes map[int][]*serviceRoute) {
+	for port, server := range s.http3Servers {
+		used := false
+		for _, route := range routes[port] {
+			if route.service.HTTP3() {
+				used = true
+				break
+			}
+		}
+		if used {
+			continue
+		}
+
+		delete(s.http3Servers, port)
+		go func(port int, server *http3.Server) {
+			ctx, cancel := context.WithTimeout(context.Background(), ShutdownGracePeriod)
+			defer cancel()
+
+			if err := server.Shutdown(ctx); err != nil {
+				s.logger.Error("Failed to shutdown unused HTTP/3 server", zap.Int("port", port), zap.Error(err))
+				return
+			}
+			s.logger.Info("HTTP/3 server for unused port stopped", zap.Int("port", port))
+		}(port, server)
+	}
+}
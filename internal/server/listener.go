@@ -0,0 +1,264 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+	"github.com/unkn0wn-root/terraster/internal/service"
+	"github.com/unkn0wn-root/terraster/pkg/clientip"
+	"github.com/unkn0wn-root/terraster/pkg/proxyproto"
+	"go.uber.org/zap"
+)
+
+// DefaultProxyHeaderTimeout limits the time trusted sources have to send their PROXY header.
+const DefaultProxyHeaderTimeout = 5 * time.Second
+
+// boundListeners holds the sockets of ports which are not served yet, keyed by port.
+type boundListeners struct {
+	tcp map[int]net.Listener
+	udp map[int]net.PacketConn
+}
+
+// bindListeners binds the tcp and udp sockets of all ports the services need which are not served by
+// a running server or proxy. Binding happens before a configuration is applied, so that errors
+// (e.g. port already in use) leave the running configuration untouched.
+// If any socket can not be bound, the sockets bound so far are closed.
+func (s *Server) bindListeners(services []*service.ServiceInfo) (*boundListeners, error) {
+	lns := &boundListeners{
+		tcp: make(map[int]net.Listener),
+		udp: make(map[int]net.PacketConn),
+	}
+
+	for _, svc := range services {
+		port := s.servicePort(svc.Port)
+
+		var tcp, udp bool
+		switch svc.Protocol {
+		case config.ProtocolTCP:
+			_, running := s.streamProxies[streamKey(config.ProtocolTCP, port)]
+			tcp = !running
+		case config.ProtocolUDP:
+			_, running := s.streamProxies[streamKey(config.ProtocolUDP, port)]
+			udp = !running
+		default:
+			_, running := s.portServers[port]
+			tcp = !running
+			_, running = s.http3Servers[port]
+			udp = svc.HTTP3() && !running
+		}
+
+		addr := fmt.Sprintf(":%d", port)
+		if _, bound := lns.tcp[port]; tcp && !bound {
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				lns.close()
+				return nil, fmt.Errorf("failed to listen on tcp port %d for service %s: %w", port, svc.Name, err)
+			}
+			lns.tcp[port] = ln
+		}
+		if _, bound := lns.udp[port]; udp && !bound {
+			conn, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				lns.close()
+				return nil, fmt.Errorf("failed to listen on udp port %d for service %s: %w", port, svc.Name, err)
+			}
+			lns.udp[port] = conn
+		}
+	}
+
+	return lns, nil
+}
+
+// close closes all bound sockets.
+func (l *boundListeners) close() {
+	for _, ln := range l.tcp {
+		ln.Close()
+	}
+	for _, conn := range l.udp {
+		conn.Close()
+	}
+}
+
+// acceptQueue hands connections prepared in the background to Accept of a wrapping listener,
+// so that slow clients never block accepting other connections.
+type acceptQueue struct {
+	accepts chan acceptResult
+	done    chan struct{}
+	once    sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newAcceptQueue() acceptQueue {
+	return acceptQueue{
+		accepts: make(chan acceptResult),
+		done:    make(chan struct{}),
+	}
+}
+
+// deliver hands the result to Accept. Returns false if the listener was closed.
+func (q *acceptQueue) deliver(r acceptResult) bool {
+	select {
+	case q.accepts <- r:
+		return true
+	case <-q.done:
+		return false
+	}
+}
+
+// accept returns the next delivered connection.
+func (q *acceptQueue) accept() (net.Conn, error) {
+	select {
+	case r := <-q.accepts:
+		return r.conn, r.err
+	case <-q.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// close stops delivering connections. Safe to call more than once.
+func (q *acceptQueue) close() {
+	q.once.Do(func() { close(q.done) })
+}
+
+// serve accepts connections of the listener until it is closed and prepares each of them in its own goroutine.
+// prepare returns the connection to deliver, or nil if it was taken care of.
+// Accept errors are delivered as well, so the server backs off on temporary errors as usual.
+func (q *acceptQueue) serve(ln net.Listener, needsPrepare func(net.Conn) bool, prepare func(net.Conn) net.Conn) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !q.deliver(acceptResult{err: err}) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		if !needsPrepare(conn) {
+			if !q.deliver(acceptResult{conn: conn}) {
+				conn.Close()
+				return
+			}
+			continue
+		}
+
+		go func() {
+			if c := prepare(conn); c != nil && !q.deliver(acceptResult{conn: c}) {
+				c.Close()
+			}
+		}()
+	}
+}
+
+// proxyProtocolSettings are the PROXY protocol settings of a listening port.
+type proxyProtocolSettings struct {
+	trusted *clientip.Resolver
+	timeout time.Duration
+}
+
+// buildProxyProtocol returns the PROXY protocol settings of every port with services which enabled it.
+// Services sharing a port use the same settings, see validatePorts.
+func (s *Server) buildProxyProtocol(services []*service.ServiceInfo) map[int]*proxyProtocolSettings {
+	settings := make(map[int]*proxyProtocolSettings)
+	for _, svc := range services {
+		if svc.ProxyProtocol == nil {
+			continue
+		}
+
+		// Networks are validated with the configuration
+		trusted, err := clientip.NewResolver(svc.ProxyProtocol.TrustedCIDRs)
+		if err != nil {
+			s.logger.Error("Invalid proxy_protocol trusted_cidrs", zap.String("service", svc.Name), zap.Error(err))
+			continue
+		}
+
+		timeout := svc.ProxyProtocol.HeaderTimeout
+		if timeout <= 0 {
+			timeout = DefaultProxyHeaderTimeout
+		}
+		settings[s.servicePort(svc.Port)] = &proxyProtocolSettings{trusted: trusted, timeout: timeout}
+	}
+
+	return settings
+}
+
+// proxyProtocolSettingsFor returns the PROXY protocol settings of the port, nil if it is not enabled.
+func (s *Server) proxyProtocolSettingsFor(port int) *proxyProtocolSettings {
+	settings, _ := s.proxyProtocol.Load().(map[int]*proxyProtocolSettings)
+	return settings[port]
+}
+
+// proxyProtocolListener reads PROXY protocol headers of connections from trusted sources, e.g. a cloud load balancer.
+// The client address of the header becomes the remote address of the connection, and so the address
+// seen by load balancing algorithms, logs and rate limits. Connections from other sources are used as they are,
+// a PROXY header sent by them is not parsed and fails the request.
+// Settings are looked up per connection, so enabling or changing them takes effect on reload.
+type proxyProtocolListener struct {
+	net.Listener
+	acceptQueue
+	port   int
+	server *Server
+}
+
+// newProxyProtocolListener wraps a TCP listener of the port and starts accepting connections.
+func (s *Server) newProxyProtocolListener(ln net.Listener, port int) *proxyProtocolListener {
+	l := &proxyProtocolListener{
+		Listener:    ln,
+		acceptQueue: newAcceptQueue(),
+		port:        port,
+		server:      s,
+	}
+	go l.serve(ln, l.trusted, l.readHeader)
+	return l
+}
+
+// trusted reports whether the connection comes from a source allowed to send a PROXY header.
+func (l *proxyProtocolListener) trusted(conn net.Conn) bool {
+	settings := l.server.proxyProtocolSettingsFor(l.port)
+	if settings == nil {
+		return false
+	}
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	return ok && settings.trusted.IsTrusted(addr.IP)
+}
+
+// readHeader reads the PROXY header of a connection from a trusted source.
+// Connections with a malformed header, or without one in time, are closed.
+func (l *proxyProtocolListener) readHeader(conn net.Conn) net.Conn {
+	timeout := DefaultProxyHeaderTimeout
+	if settings := l.server.proxyProtocolSettingsFor(l.port); settings != nil {
+		timeout = settings.timeout
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	pc, err := proxyproto.NewConn(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		l.server.logger.Warn("Failed to read PROXY protocol header",
+			zap.Int("port", l.port),
+			zap.String("remote_addr", conn.RemoteAddr().String()),
+			zap.Error(err))
+		conn.Close()
+		return nil
+	}
+
+	return pc
+}
+
+// Accept returns the next connection, with the client address of its PROXY header if it had one.
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	return l.accept()
+}
+
+// Close closes the wrapped listener.
+func (l *proxyProtocolListener) Close() error {
+	l.close()
+	return l.Listener.Close()
+}
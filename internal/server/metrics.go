@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/internal/service"
+	"github.com/unkn0wn-root/terraster/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// metricsWriter counts the number of bytes written to the client.
+type metricsWriter struct {
+	http.ResponseWriter
+	bytes int64
+}
+
+func (w *metricsWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush delegates to the underlying ResponseWriter so that streaming responses are not buffered.
+func (w *metricsWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack delegates to the underlying ResponseWriter so that protocol upgrades keep working.
+func (w *metricsWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, fmt.Errorf("upstream ResponseWriter does not implement http.Hijacker")
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *metricsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	bytes atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes.Add(int64(n))
+	return n, err
+}
+
+// requestMetrics holds the label values recorded for a proxied request.
+type requestMetrics struct {
+	service  string
+	location string
+	backend  string
+}
+
+// recordUnavailable records a request that could not be sent to any backend.
+func (m requestMetrics) recordUnavailable(status int) {
+	metrics.RequestsTotal.WithLabelValues(m.service, m.location, "", strconv.Itoa(status)).Inc()
+}
+
+// record records the outcome of a request proxied to a backend.
+func (m requestMetrics) record(status int, written int64, body *countingBody, duration time.Duration) {
+	metrics.RequestsTotal.WithLabelValues(m.service, m.location, m.backend, strconv.Itoa(status)).Inc()
+	metrics.RequestDuration.WithLabelValues(m.service, m.location, m.backend).Observe(duration.Seconds())
+	metrics.ResponseBytes.WithLabelValues(m.service, m.location, m.backend).Add(float64(written))
+	if body != nil {
+		metrics.RequestBytes.WithLabelValues(m.service, m.location, m.backend).Add(float64(body.bytes.Load()))
+	}
+}
+
+// startMetricsServer starts a dedicated HTTP server exposing metrics if a metrics port is configured.
+// Without a dedicated port, metrics are served by the admin API.
+func (s *Server) startMetricsServer() error {
+	cfg := s.apiConfig.Metrics
+	if !cfg.Enabled || cfg.Port == 0 {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(s.apiConfig.MetricsPath(), metrics.Handler())
+
+	addr := fmt.Sprintf(":%d", cfg.Port)
+	s.metricsServer = &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  ReadTimeout,
+		WriteTimeout: WriteTimeout,
+		IdleTimeout:  IdleTimeout,
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on metrics port: %w", err)
+	}
+
+	s.wg.Add(1)
+	go s.runServer(s.metricsServer, ln, s.errorChan, "metrics", service.HTTP)
+
+	s.shutdown.AddHandler(func(ctx context.Context) error {
+		if err := s.metricsServer.Shutdown(ctx); err != nil {
+			s.logger.Error("Metrics server shutdown error", zap.Error(err))
+			return err
+		}
+		s.logger.Info("Metrics server shutdown successfully")
+		return nil
+	})
+
+	return nil
+}
@@ -1,7 +1,9 @@
 package server
 
 import (
-	"net/http"
+	"fmt"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
 
 	"github.com/unkn0wn-root/terraster/internal/middleware"
 	"github.com/unkn0wn-root/terraster/internal/service"
@@ -11,11 +13,13 @@ import (
 // createServiceMiddleware constructs and configures the middleware chain for a specific service.
 // It applies global middleware based on the server's configuration and allows overriding or adding
 // middleware specific to the service. Finally, it appends a logging middleware to the chain.
-func (s *Server) createServiceMiddleware(svc *service.ServiceInfo) http.Handler {
-	baseHandler := http.HandlerFunc(s.handleRequest)
-
+// Returns an error if a rate limiter cannot be created, so that the configuration is rejected
+// rather than served without the limit.
+func (s *Server) createServiceMiddleware(cfg *config.Config, svc *service.ServiceInfo) (*middleware.MiddlewareChain, error) {
 	chain := middleware.NewMiddlewareChain()
-	chain.AddConfiguredMiddlewares(s.config, svc.Logger)
+	if err := chain.AddConfiguredMiddlewares(cfg, svc.Logger); err != nil {
+		return nil, err
+	}
 
 	// Check if the service has any specific middleware configurations to override or add.
 	if svc.Middleware != nil {
@@ -23,32 +27,34 @@ func (s *Server) createServiceMiddleware(svc *service.ServiceInfo) http.Handler
 			switch {
 			case mw.RateLimit != nil:
 				// If a rate limiter configuration is provided, create and replace the existing rate limiter middleware.
-				rl := middleware.NewRateLimiterMiddleware(mw.RateLimit.RequestsPerSecond, mw.RateLimit.Burst)
+				rl, err := middleware.NewRateLimiterMiddleware(*mw.RateLimit)
+				if err != nil {
+					return nil, fmt.Errorf("service %s: failed to configure rate limiter: %w", svc.Name, err)
+				}
 				chain.Replace(rl)
 
 				s.logger.Info("Service Rate Limiter middleware overridden",
 					zap.String("service", svc.Name),
 					zap.Float64("requests_per_second", mw.RateLimit.RequestsPerSecond),
-					zap.Int("burst", mw.RateLimit.Burst))
+					zap.Int("burst", mw.RateLimit.Burst),
+					zap.String("key", mw.RateLimit.Key),
+					zap.String("backend", mw.RateLimit.Backend))
 			case mw.CircuitBreaker != nil:
-				// If a circuit breaker configuration is provided, create and replace the existing circuit breaker middleware.
-				cb := middleware.NewCircuitBreaker(mw.CircuitBreaker.FailureThreshold, mw.CircuitBreaker.ResetTimeout)
-				chain.Replace(cb)
-
-				s.logger.Info("Service Circuit Breaker middleware overridden",
+				// Circuit breakers are applied to the backends of the service's locations by the service manager.
+				s.logger.Info("Service Circuit Breaker configured for backends of all locations",
 					zap.String("service", svc.Name),
 					zap.Int("failure_threshold", mw.CircuitBreaker.FailureThreshold),
 					zap.Duration("reset_timeout", mw.CircuitBreaker.ResetTimeout))
 			case mw.Security != nil:
 				// If a security configuration is provided, create and replace the existing security middleware.
-				sec := middleware.NewSecurityMiddleware(s.config)
+				sec := middleware.NewSecurityMiddleware(cfg)
 				chain.Replace(sec)
 
 				s.logger.Info("Service Security middleware overridden",
 					zap.String("service", svc.Name))
 			case mw.CORS != nil:
 				// If a CORS configuration is provided, create and replace the existing CORS middleware.
-				cors := middleware.NewCORSMiddleware(s.config)
+				cors := middleware.NewCORSMiddleware(cfg)
 				chain.Replace(cors)
 
 				s.logger.Info("Service CORS middleware overridden",
@@ -72,5 +78,5 @@ func (s *Server) createServiceMiddleware(svc *service.ServiceInfo) http.Handler
 
 	chain.Use(logger)
 
-	return chain.Then(baseHandler)
+	return chain, nil
 }
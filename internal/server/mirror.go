@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/internal/service"
+	"github.com/unkn0wn-root/terraster/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// discardWriter records the status of a mirrored response and drops everything else.
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *discardWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+// mirrorRequest sends a copy of the request to the location's mirror in the background.
+// The mirror gets its own context, so it is neither cancelled with the client request
+// nor able to delay or fail the response to the client. The body must already be buffered.
+func (s *Server) mirrorRequest(r *http.Request, srvc *service.LocationInfo, rm requestMetrics, body []byte) {
+	mirror := srvc.Mirror
+	if !mirror.Acquire() {
+		metrics.MirrorSkippedTotal.WithLabelValues(rm.service, rm.location, "max_concurrent").Inc()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), mirror.Timeout())
+	req := r.Clone(ctx)
+	req.Body = http.NoBody
+	if body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+
+	go func() {
+		defer mirror.Release()
+		defer cancel()
+
+		backend := mirror.NextBackend(req)
+		if backend == nil {
+			metrics.MirrorSkippedTotal.WithLabelValues(rm.service, rm.location, "no_backend").Inc()
+			return
+		}
+
+		if !backend.IncrementConnections() {
+			metrics.MirrorSkippedTotal.WithLabelValues(rm.service, rm.location, "max_connections").Inc()
+			return
+		}
+		defer backend.DecrementConnections()
+
+		backendURL := backend.URL.String()
+		w := &discardWriter{header: make(http.Header)}
+
+		start := time.Now()
+		backend.Proxy.ServeHTTP(w, req)
+		duration := time.Since(start)
+
+		status := w.status
+		if status == 0 {
+			// The proxy writes nothing if the request was cancelled, e.g. by the mirror timeout.
+			status = http.StatusGatewayTimeout
+		}
+
+		metrics.MirrorRequestsTotal.WithLabelValues(rm.service, rm.location, backendURL, strconv.Itoa(status)).Inc()
+		metrics.MirrorRequestDuration.WithLabelValues(rm.service, rm.location, backendURL).Observe(duration.Seconds())
+
+		if status >= http.StatusInternalServerError {
+			s.logger.Debug("Mirrored request failed",
+				zap.String("backend", backendURL),
+				zap.String("path", req.URL.Path),
+				zap.Int("status", status),
+				zap.Duration("duration", duration))
+		}
+	}()
+}
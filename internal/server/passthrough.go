@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/internal/service"
+	"github.com/unkn0wn-root/terraster/internal/stream"
+)
+
+// ClientHelloTimeout limits the time a client has to send its ClientHello on HTTPS ports with TLS passthrough services.
+const ClientHelloTimeout = 10 * time.Second
+
+// errClientHelloRead aborts the handshake once the ClientHello was read.
+var errClientHelloRead = errors.New("client hello read")
+
+// passthroughKey identifies the proxy of a TLS passthrough service, e.g. "tls-passthrough:443:app.example.com".
+func passthroughKey(svc *service.ServiceInfo, port int) string {
+	return fmt.Sprintf("%s:%s", streamKey(svc.Protocol, port), svc.Host)
+}
+
+// passthroughProxy returns the proxy forwarding connections of a TLS passthrough service.
+// The proxy is created on first use and switched to the new service configuration on reload.
+func (s *Server) passthroughProxy(svc *service.ServiceInfo) *stream.TCPProxy {
+	key := passthroughKey(svc, s.servicePort(svc.Port))
+	if p, ok := s.streamProxies[key].(*stream.TCPProxy); ok {
+		p.Update(svc)
+		return p
+	}
+
+	p := stream.NewTCPProxy(nil, svc, s.logger)
+	s.streamProxies[key] = p
+	return p
+}
+
+// findPassthrough returns the route of the TLS passthrough service matching the server name on the port.
+func (s *Server) findPassthrough(port int, serverName string) *serviceRoute {
+	routes, _ := s.routes.Load().(map[int][]*serviceRoute)
+	for _, route := range routes[port] {
+		if route.proxy != nil && route.service.MatchesHost(serverName) {
+			return route
+		}
+	}
+	return nil
+}
+
+// hasPassthrough reports whether any TLS passthrough service is served on the port.
+func (s *Server) hasPassthrough(port int) bool {
+	routes, _ := s.routes.Load().(map[int][]*serviceRoute)
+	for _, route := range routes[port] {
+		if route.proxy != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// sniListener wraps the listener of an HTTPS port. If TLS passthrough services are served on the port,
+// it reads the ClientHello of every connection and hands connections for those services to their proxy as they are.
+// All other connections, including the bytes read, are returned by Accept to be terminated by the HTTPS server.
+type sniListener struct {
+	net.Listener
+	acceptQueue
+	port   int
+	server *Server
+}
+
+// newSNIListener wraps the listener of an HTTPS port and starts accepting connections.
+func (s *Server) newSNIListener(ln net.Listener, port int) *sniListener {
+	l := &sniListener{
+		Listener:    ln,
+		acceptQueue: newAcceptQueue(),
+		port:        port,
+		server:      s,
+	}
+	// The ClientHello is only read if it matters, i.e. a passthrough service is served on the port
+	go l.serve(ln, func(net.Conn) bool { return s.hasPassthrough(port) }, l.route)
+	return l
+}
+
+// route reads the ClientHello of the connection and forwards it to the matching passthrough service.
+// Connections without a matching service are returned to be passed on to the HTTPS server.
+func (l *sniListener) route(conn net.Conn) net.Conn {
+	conn.SetReadDeadline(time.Now().Add(ClientHelloTimeout))
+	serverName, hello, err := readClientHello(conn)
+	conn.SetReadDeadline(time.Time{})
+
+	peeked := &peekedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(hello), conn)}
+	if err == nil && serverName != "" {
+		if route := l.server.findPassthrough(l.port, serverName); route != nil {
+			route.proxy.ServeConn(peeked)
+			return nil
+		}
+	}
+
+	// Failed handshakes are left to the HTTPS server, it reports them like for any other connection
+	return peeked
+}
+
+// Accept returns the next connection to be terminated by the HTTPS server.
+func (l *sniListener) Accept() (net.Conn, error) {
+	return l.accept()
+}
+
+// Close closes the wrapped listener. Connections forwarded to passthrough services are not affected.
+func (l *sniListener) Close() error {
+	l.close()
+	return l.Listener.Close()
+}
+
+// readClientHello reads the ClientHello of a TLS connection and returns the server name sent by the client (SNI)
+// along with all bytes read, which have to be replayed to whoever handles the connection.
+func readClientHello(r io.Reader) (string, []byte, error) {
+	var hello bytes.Buffer
+	var serverName string
+
+	// The handshake is aborted as soon as the ClientHello is parsed, nothing is written to the client
+	err := tls.Server(readOnlyConn{r: io.TeeReader(r, &hello)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = info.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+
+	if !errors.Is(err, errClientHelloRead) {
+		return "", hello.Bytes(), err
+	}
+	return serverName, hello.Bytes(), nil
+}
+
+// readOnlyConn lets crypto/tls parse a ClientHello from a reader. Writes fail.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// peekedConn replays the bytes read from the connection before reading from it again.
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite keeps half-closing working for passthrough connections.
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// clientHello returns the ClientHello a TLS client sends for the server name.
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		defer client.Close()
+		tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	}()
+
+	// The ClientHello is the first record, its length is part of the 5 bytes record header.
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(server, record); err != nil {
+		t.Fatal(err)
+	}
+	return append(header, record...)
+}
+
+func TestReadClientHello(t *testing.T) {
+	tests := []struct {
+		name       string
+		serverName string
+	}{
+		{name: "server name", serverName: "app.example.com"},
+		{name: "without server name", serverName: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello := clientHello(t, tt.serverName)
+			data := append(append([]byte{}, hello...), "rest"...)
+
+			serverName, read, err := readClientHello(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if serverName != tt.serverName {
+				t.Fatalf("expected server name %q, got %q", tt.serverName, serverName)
+			}
+			if !bytes.Equal(read, data[:len(read)]) || len(read) < len(hello) {
+				t.Fatal("expected all bytes read to be returned for replay")
+			}
+		})
+	}
+}
+
+func TestReadClientHelloNotTLS(t *testing.T) {
+	data := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	serverName, read, err := readClientHello(bytes.NewReader(data))
+	if err == nil || serverName != "" {
+		t.Fatalf("expected an error for plain HTTP, got %q, %v", serverName, err)
+	}
+	if !bytes.Equal(read, data[:len(read)]) {
+		t.Fatal("expected the bytes read to be returned for replay")
+	}
+}
+
+func TestPeekedConnReplays(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	hello := clientHello(t, "app.example.com")
+	go func() {
+		defer client.Close()
+		client.Write(hello)
+		client.Write([]byte("rest"))
+	}()
+
+	_, read, err := readClientHello(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Whoever handles the connection reads it from the start.
+	peeked := &peekedConn{Conn: server, r: io.MultiReader(bytes.NewReader(read), server)}
+	data, _ := io.ReadAll(peeked)
+	want := append(append([]byte{}, hello...), "rest"...)
+	if !bytes.Equal(data, want) {
+		t.Fatalf("expected the connection to be replayed from the start, got %d bytes, want %d", len(data), len(want))
+	}
+}
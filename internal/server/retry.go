@@ -0,0 +1,326 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/internal/middleware"
+	"github.com/unkn0wn-root/terraster/internal/pool"
+	"github.com/unkn0wn-root/terraster/internal/service"
+	"github.com/unkn0wn-root/terraster/pkg/metrics"
+)
+
+// Errors of requests which no backend admitted.
+var (
+	errCircuitOpen = errors.New("Backend circuit open")
+	errMaxCapacity = errors.New("Server at max capacity")
+)
+
+// retryWriter holds back the response of an attempt until it is known not to be retried.
+// Headers are collected in a private map and copied to the client response on commit.
+// Responses for which retryable returns true are discarded. A nil retryable commits everything (final attempt).
+type retryWriter struct {
+	mw        *metricsWriter
+	header    http.Header
+	retryable func(status int) bool
+	onCommit  func()
+	status    int
+	committed bool
+	discarded bool
+}
+
+func newRetryWriter(w http.ResponseWriter) *retryWriter {
+	return &retryWriter{
+		mw:     &metricsWriter{ResponseWriter: w},
+		header: make(http.Header),
+	}
+}
+
+func (w *retryWriter) Header() http.Header {
+	if w.committed {
+		return w.mw.Header()
+	}
+	return w.header
+}
+
+func (w *retryWriter) WriteHeader(status int) {
+	if w.committed {
+		w.mw.WriteHeader(status)
+		return
+	}
+
+	if w.discarded {
+		return
+	}
+
+	// Informational responses are not forwarded before we know the final response is not retried.
+	if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols {
+		return
+	}
+
+	w.status = status
+	if w.retryable != nil && w.retryable(status) {
+		w.discarded = true
+		return
+	}
+
+	w.commit()
+	w.mw.WriteHeader(status)
+}
+
+func (w *retryWriter) Write(b []byte) (int, error) {
+	if !w.committed && !w.discarded {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.discarded {
+		return len(b), nil
+	}
+
+	return w.mw.Write(b)
+}
+
+// commit copies the collected headers to the client response.
+func (w *retryWriter) commit() {
+	dst := w.mw.Header()
+	for k, v := range w.header {
+		dst[k] = append(dst[k], v...)
+	}
+	w.committed = true
+
+	if w.onCommit != nil {
+		w.onCommit()
+	}
+}
+
+// Flush flushes committed responses only, there is nothing to flush before.
+func (w *retryWriter) Flush() {
+	if w.committed {
+		w.mw.Flush()
+	}
+}
+
+// Hijack commits the response and hands over the connection (e.g. for protocol upgrades).
+func (w *retryWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.discarded {
+		return nil, nil, fmt.Errorf("response already discarded")
+	}
+
+	if !w.committed {
+		w.status = http.StatusSwitchingProtocols
+		w.commit()
+	}
+
+	return w.mw.Hijack()
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *retryWriter) Unwrap() http.ResponseWriter {
+	return w.mw
+}
+
+// statusCode returns the status of the attempt, defaulting to 200 if nothing was written.
+func (w *retryWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// bufferRequestBody reads the request body into memory so that it can be replayed on retries.
+// If the body is larger than maxSize, it is left streaming and replayable is false.
+func bufferRequestBody(r *http.Request, maxSize int64) (body []byte, replayable bool, err error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+
+	if r.ContentLength > maxSize {
+		return nil, false, nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r.Body, maxSize+1))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if int64(len(buf)) > maxSize {
+		// Too large to buffer. Stitch the consumed part back in front of the rest of the body.
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return nil, false, nil
+	}
+
+	r.Body.Close()
+	return buf, true, nil
+}
+
+// waitBackoff waits for the given duration. Returns false if the client went away in the meantime.
+func waitBackoff(r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return r.Context().Err() == nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// selectRetryBackend selects a backend that was not tried yet, see LocationInfo.NextUntried.
+// If all backends were tried, the algorithm's choice is reused.
+func (s *Server) selectRetryBackend(
+	srvc *service.LocationInfo,
+	r *http.Request,
+	tried map[*pool.Backend]bool,
+) (*pool.Backend, error) {
+	if backend := srvc.NextUntried(r, tried); backend != nil {
+		return backend, nil
+	}
+	return s.getBackend(srvc, r)
+}
+
+// acquireBackend selects the backend of an attempt, preferring first if set, and admits the request to it.
+// It takes a probe slot of the backend's circuit and counts the request against MaxConnections.
+// The circuit may have opened, its half-open probes been taken or the backend filled up by concurrent requests
+// since the backend was found available, in which case another backend is selected.
+// Selected backends are marked as tried. The acquired backend has to be released by proxyAttempt.
+func (s *Server) acquireBackend(
+	srvc *service.LocationInfo,
+	r *http.Request,
+	first *pool.Backend,
+	tried map[*pool.Backend]bool,
+) (*pool.Backend, error) {
+	skipped := make(map[*pool.Backend]bool)
+	err := errCircuitOpen
+	backend := first
+	for {
+		if backend == nil {
+			var selectErr error
+			backend, selectErr = s.selectRetryBackend(srvc, r, tried)
+			if selectErr != nil {
+				return nil, selectErr
+			}
+		}
+
+		if skipped[backend] {
+			// Every backend the algorithm offers was already refused
+			return nil, err
+		}
+		tried[backend] = true
+
+		switch {
+		case !srvc.ServerPool.AcquireCircuit(backend):
+			err = errCircuitOpen
+		case !backend.IncrementConnections():
+			srvc.ServerPool.ReleaseCircuit(backend)
+			err = errMaxCapacity
+		default:
+			return backend, nil
+		}
+
+		skipped[backend] = true
+		backend = nil
+	}
+}
+
+// proxyAttempt proxies the request to a single backend.
+// Unless final is set, a retryable failure is not written to the client and true is returned,
+// so that the caller can retry the request on another backend.
+// A non nil cookie is only sent to the client if the response of this attempt is committed.
+func (s *Server) proxyAttempt(
+	w http.ResponseWriter,
+	r *http.Request,
+	srvc *service.LocationInfo,
+	backend *pool.Backend,
+	rm requestMetrics,
+	attempt int,
+	final bool,
+	replay []byte,
+	cookie *http.Cookie,
+) bool {
+	defer backend.DecrementConnections()
+
+	backendURL := backend.URL.String()
+	rm.backend = backendURL
+
+	active := metrics.ActiveConnections.WithLabelValues(rm.service, rm.location, rm.backend)
+	active.Inc()
+	defer active.Dec()
+
+	result := &pool.Attempt{}
+	ctx := context.WithValue(r.Context(), middleware.BackendKey, backendURL)
+	ctx = context.WithValue(ctx, pool.RetryKey, attempt)
+	ctx = context.WithValue(ctx, pool.AttemptKey, result)
+
+	rw := newRetryWriter(w)
+	if cookie != nil {
+		rw.header.Add("Set-Cookie", cookie.String())
+	}
+
+	// The per-try timeout limits the time to response headers. Once committed, the response is streamed as is.
+	if timeout := srvc.Retry.PerTryTimeout(); timeout > 0 {
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(ctx)
+		defer cancel(nil)
+
+		timer := time.AfterFunc(timeout, func() { cancel(pool.ErrPerTryTimeout) })
+		defer timer.Stop()
+		rw.onCommit = func() { timer.Stop() }
+	}
+
+	if !final {
+		rw.retryable = func(status int) bool {
+			if result.Err != nil {
+				return srvc.Retry.ShouldRetryError(ctx, result.Err)
+			}
+			return srvc.Retry.ShouldRetryStatus(status)
+		}
+	}
+
+	req := r.WithContext(ctx)
+	if replay != nil {
+		req.Body = io.NopCloser(bytes.NewReader(replay))
+		req.ContentLength = int64(len(replay))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(replay)), nil
+		}
+	}
+
+	var body *countingBody
+	if req.Body != nil && req.Body != http.NoBody {
+		body = &countingBody{ReadCloser: req.Body}
+		req.Body = body
+	}
+
+	start := time.Now()
+	backend.Proxy.ServeHTTP(rw, req)
+	duration := time.Since(start)
+
+	// Record the response time for performance-based load balancing algorithms.
+	s.recordResponseTime(srvc, backendURL, duration)
+	rm.record(rw.statusCode(), rw.mw.bytes, body, duration)
+
+	// Feed the result to the circuit breaker and passive outlier detection.
+	// Client cancellations say nothing about the backend.
+	if result.Err == nil || !errors.Is(result.Err, context.Canceled) || pool.IsTimeout(ctx, result.Err) {
+		srvc.ServerPool.ReportResult(backend, result.Err != nil || rw.statusCode() >= 500)
+	} else {
+		srvc.ServerPool.ReleaseCircuit(backend)
+	}
+
+	return rw.discarded
+}
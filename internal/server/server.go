@@ -8,11 +8,16 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/quic-go/quic-go/http3"
 	"github.com/unkn0wn-root/terraster/internal/admin"
 	auth_service "github.com/unkn0wn-root/terraster/internal/auth/service"
 	"github.com/unkn0wn-root/terraster/internal/config"
@@ -21,10 +26,16 @@ import (
 	"github.com/unkn0wn-root/terraster/internal/middleware"
 	"github.com/unkn0wn-root/terraster/internal/pool"
 	"github.com/unkn0wn-root/terraster/internal/service"
+	"github.com/unkn0wn-root/terraster/internal/stream"
 	"github.com/unkn0wn-root/terraster/pkg/algorithm"
+	"github.com/unkn0wn-root/terraster/pkg/clientip"
 	"github.com/unkn0wn-root/terraster/pkg/logger"
+	"github.com/unkn0wn-root/terraster/pkg/metrics"
 	"github.com/unkn0wn-root/terraster/pkg/shutdown"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 // default configurations
@@ -48,14 +59,19 @@ type Server struct {
 	healthChecker  *health.Checker             // Global health checker (if any)
 	adminAPI       *admin.AdminAPI             // Admin API handler
 	adminServer    *http.Server                // HTTP server for admin API
+	metricsServer  *http.Server                // Dedicated HTTP server for metrics (if configured)
 	healthCheckers map[string]*health.Checker  // Individual health checkers per service
 	serviceManager *service.Manager            // Manages the lifecycle and configuration of services
 	tlsConfigs     map[string]*tls.Certificate // Loaded TLS certificates
 	certManager    *certmanager.CertManager    // Manages TLS certificates
 	serverPool     *pool.ServerPool            // Pool of server instances
 	servers        []*http.Server              // Slice of all HTTP/HTTPS servers
-	serviceCache   *sync.Map                   // Concurrent map for caching service lookups
 	portServers    map[int]*http.Server        // Mapping of ports to their corresponding servers
+	portProtocols  map[int]service.ServiceType // Protocol served on each port
+	http3Servers   map[int]*http3.Server       // HTTP/3 servers sharing the UDP port of HTTPS servers
+	streamProxies  map[string]streamProxy      // Layer 4 and TLS passthrough proxies keyed by protocol and port, e.g. "tcp:5432"
+	routes         atomic.Value                // map[int][]*serviceRoute - per port service handlers, swapped on reload
+	proxyProtocol  atomic.Value                // map[int]*proxyProtocolSettings - PROXY protocol settings per port, swapped on reload
 	logger         *zap.Logger                 // Logger instance for logging server activities
 	logManager     *logger.LoggerManager       // Manages different loggers
 	mu             sync.RWMutex                // Mutex for synchronizing access to shared resources
@@ -66,6 +82,15 @@ type Server struct {
 	shutdown       *shutdown.GracefulShutdown  // Graceful shutdown manager
 }
 
+// serviceRoute binds a service to the handler chain serving its requests.
+// Routes of TLS passthrough services have a proxy instead, their connections never reach the HTTPS server.
+type serviceRoute struct {
+	service *service.ServiceInfo
+	chain   *middleware.MiddlewareChain // Middleware of the handler, reused on reload while its configuration is unchanged.
+	handler http.Handler
+	proxy   *stream.TCPProxy
+}
+
 // Sets up health checkers for each service,
 // initializes the admin API,
 // setup service log (if any) and prepares the server for startup.
@@ -83,23 +108,24 @@ func NewServer(
 		return nil, err
 	}
 
-	var adminAPI *admin.AdminAPI
-	if apiCfg.AdminAPI.Enabled {
-		adminAPI = admin.NewAdminAPI(serviceManager, apiCfg, authSrvc, zLog)
-	}
-
 	// Initialize CertManager with alerting configurations
 	// This could be done in loop for health checker
 	// but for better readablity and since it's done only on startup - we do this here
 	domains := []string{}
 	for _, svc := range serviceManager.GetServices() {
-		if svc.ServiceType() == service.HTTPS {
+		if svc.ServiceType() == service.HTTPS && !svc.Passthrough() {
 			domains = append(domains, svc.Host)
 		}
 	}
 
-	// get and put all certificates in cache
-	certCache := certmanager.NewInMemoryCertCache()
+	// Certificates issued through ACME are stored on disk, so that they are not requested again on restart
+	var certCache certmanager.CertCache = certmanager.NewInMemoryCertCache()
+	if cfg.CertManager.CertDir != "" {
+		certCache, err = certmanager.NewDiskCertCache(filepath.Join(cfg.CertManager.CertDir, "acme"), zLog)
+		if err != nil {
+			return nil, err
+		}
+	}
 	alerting := certmanager.NewAlertingConfig(cfg)
 
 	certManager, err := certmanager.NewCertManager(
@@ -114,6 +140,11 @@ func NewServer(
 		return nil, err
 	}
 
+	var adminAPI *admin.AdminAPI
+	if apiCfg.AdminAPI.Enabled {
+		adminAPI = admin.NewAdminAPI(serviceManager, certManager, apiCfg, authSrvc, zLog)
+	}
+
 	ctx, cancel := context.WithCancel(srvCtx)
 
 	s := &Server{
@@ -126,33 +157,48 @@ func NewServer(
 		ctx:            ctx,
 		cancel:         cancel,
 		servers:        make([]*http.Server, 0),
-		serviceCache:   &sync.Map{},
 		portServers:    make(map[int]*http.Server),
-		errorChan:      make(chan error),
+		portProtocols:  make(map[int]service.ServiceType),
+		http3Servers:   make(map[int]*http3.Server),
+		streamProxies:  make(map[string]streamProxy),
+		errorChan:      errChan,
 		logger:         zLog,
 		logManager:     logManager,
 		shutdown:       shutdown.NewGracefulShutdown(),
 	}
 
+	services := serviceManager.GetServices()
+	s.assignServiceLoggers(serviceManager, services)
+	s.healthCheckers = s.createHealthCheckers(services)
+
+	return s, nil
+}
+
+// assignServiceLoggers assigns a logger to every service of the manager that does not have one yet.
+func (s *Server) assignServiceLoggers(m *service.Manager, services []*service.ServiceInfo) {
 	// setup default logger for services in case of if log_name is not defined on service
 	// this is defined in log.config.json file but if not found, we fallback to default server logManager
 	// which will output to service_default.log file and stderr to service_default_error.log
-	defaultSrvcLog, err := logManager.GetLogger(DefaultLogName)
+	defaultSrvcLog, err := s.logManager.GetLogger(DefaultLogName)
 	if err != nil {
 		// fallback to default logger in case of error
-		defaultSrvcLog = zLog
+		defaultSrvcLog = s.logger
 	}
 
-	for _, svc := range serviceManager.GetServices() {
+	for _, svc := range services {
+		if svc.Logger != nil {
+			continue
+		}
+
 		// if log_name is specified in config, we will try to get logger from logManager
 		// in case if this fails, we will fallback to default logger
 		var svcLogger *zap.Logger
 		if svc.LogName != "" {
-			svcLogger, err = logManager.GetLogger(svc.LogName)
+			svcLogger, err = s.logManager.GetLogger(svc.LogName)
 			if err != nil {
 				// fallback to default logger in case of error
 				svcLogger = defaultSrvcLog
-				zLog.Warn("Specified logger not found. Using default logger", zap.String("service_name", svc.Name), zap.Error(err))
+				s.logger.Warn("Specified logger not found. Using default logger", zap.String("service_name", svc.Name), zap.Error(err))
 			}
 		} else {
 			// not defined - use default logger
@@ -160,38 +206,50 @@ func NewServer(
 		}
 
 		// Assign logger to service
-		serviceManager.AssignLogger(svc.Name, svcLogger)
+		m.AssignLogger(svc.Name, svcLogger)
+	}
+}
+
+// createHealthCheckers creates a health checker for each service and registers the server pools of its locations.
+// Checkers are not started.
+func (s *Server) createHealthCheckers(services []*service.ServiceInfo) map[string]*health.Checker {
+	checkers := make(map[string]*health.Checker, len(services))
+	for _, svc := range services {
+		if !svc.ActiveHealthCheck() {
+			continue
+		}
 
-		// setup helt checkers for each service
-		// this will run in own goroutine
 		hcCfg := svc.HealthCheck
-		if (&config.HealthCheckConfig{}) == hcCfg {
-			hcCfg = cfg.HealthCheck
+		if hcCfg == nil {
+			hcCfg = s.config.HealthCheck
 		}
 
 		prefix := "[HealthChecker-" + svc.Name + "]"
 		hc := health.NewChecker(
+			svc.Name,
 			hcCfg.Interval,
 			hcCfg.Timeout,
-			svcLogger,
+			svc.Logger,
 			prefix,
 		)
-		s.healthCheckers[svc.Name] = hc
+		checkers[svc.Name] = hc
 
 		for _, loc := range svc.Locations {
-			hc.RegisterPool(loc.ServerPool)
+			for _, p := range loc.Pools() {
+				hc.RegisterPool(p)
+			}
+			if loc.Mirror != nil {
+				hc.RegisterPool(loc.Mirror.Pool)
+			}
 		}
 	}
 
-	return s, nil
+	return checkers
 }
 
-// Start initializes and starts all configured HTTP/HTTPS servers along with the admin server.
-// It sets up TLS configurations, loads certificates, and begins listening for incoming requests.
-// Also starts all health checkers in separate goroutines.
-// Returns an error if any server fails to start.
-func (s *Server) Start() error {
-	for svcName, hc := range s.healthCheckers {
+// startHealthCheckers starts every provided health checker in its own goroutine.
+func (s *Server) startHealthCheckers(checkers map[string]*health.Checker) {
+	for svcName, hc := range checkers {
 		s.wg.Add(1)
 		go func(name string, checker *health.Checker) {
 			defer s.wg.Done()
@@ -199,17 +257,53 @@ func (s *Server) Start() error {
 			checker.Start(s.ctx)
 		}(svcName, hc)
 	}
+}
 
-	for _, svc := range s.serviceManager.GetServices() {
-		if err := s.startServiceServer(svc); err != nil {
-			s.cancel()
-			return err
-		}
+// Start initializes and starts all configured HTTP/HTTPS servers along with the admin server.
+// It sets up TLS configurations, loads certificates, and begins listening for incoming requests.
+// Also starts all health checkers in separate goroutines.
+// Returns an error if any server fails to start.
+func (s *Server) Start() error {
+	s.mu.Lock()
+	s.startHealthCheckers(s.healthCheckers)
+
+	services := s.serviceManager.GetServices()
+	if err := s.validatePorts(services); err != nil {
+		s.mu.Unlock()
+		s.cancel()
+		return err
+	}
+	routes, err := s.buildRoutes(s.config, services)
+	if err != nil {
+		s.mu.Unlock()
+		s.cancel()
+		return err
 	}
+	lns, err := s.bindListeners(services)
+	if err != nil {
+		s.mu.Unlock()
+		s.cancel()
+		return err
+	}
+	s.routes.Store(routes)
+	s.proxyProtocol.Store(s.buildProxyProtocol(services))
+
+	for _, svc := range services {
+		s.startServiceServer(svc, lns)
+	}
+	s.mu.Unlock()
+
+	// Challenges of the ACME server can be answered now that listeners are up
+	s.certManager.ObtainCertificates()
 
 	// Register shutdown handlers
 	s.registerShutdownHandlers()
 
+	if err := s.startMetricsServer(); err != nil {
+		s.cancel()
+		return err
+	}
+
 	if s.adminAPI == nil {
 		s.logger.Warn("Admin API is not enabled. Bypassing admin server setup")
 		return nil
@@ -223,48 +317,384 @@ func (s *Server) Start() error {
 	return nil
 }
 
-// startServiceServer sets up and starts HTTP and HTTPS servers for a given service.
-// Ensures that services sharing the same port use the same underlying server instance to optimize resource usage.
-// It also handles protocol mismatches and logs appropriate information.
-func (s *Server) startServiceServer(svc *service.ServiceInfo) error {
-	port := s.servicePort(svc.Port)
-	protocol := svc.ServiceType()
+// Reload applies a new configuration to the running server without restarting listeners.
+// Services, locations, server pools, health checkers and middleware chains are rebuilt and swapped atomically.
+// Locations with unchanged configuration keep their server pools, so backend health and connection counts survive.
+// Changed locations keep the backends whose configuration did not change, with the same state.
+// Servers for newly configured ports are started and servers for ports no longer in use are shut down gracefully.
+// Changing the protocol (HTTP/HTTPS) of a port that is already served requires a restart and is rejected.
+// Sockets of new ports are bound before anything is swapped, so on error the running configuration is left untouched.
+func (s *Server) Reload(cfg *config.Config) error {
+	// The ACME account, certificate storage and alert channels are set up on startup
+	if cfg.CertManager.CertDir != s.config.CertManager.CertDir ||
+		!reflect.DeepEqual(cfg.CertManager.ACME, s.config.CertManager.ACME) {
+		return errors.New("cert_manager cert_dir and acme settings cannot be changed on reload. Restart is required")
+	}
+	if !reflect.DeepEqual(cfg.CertManager.Alerting, s.config.CertManager.Alerting) {
+		return errors.New("cert_manager alerting settings cannot be changed on reload. Restart is required")
+	}
 
-	// Check if a server is already running on the desired port.
-	if server := s.portServers[port]; server != nil {
-		// Prevent mixing HTTP and HTTPS protocols on the same port.
-		if (server.TLSConfig != nil) != (protocol == service.HTTPS) {
+	next, err := s.serviceManager.Rebuild(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to build services from new configuration: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	services := next.GetServices()
+	if err := s.validatePorts(services); err != nil {
+		return err
+	}
+
+	// Handler chains are built first, so that a middleware which cannot be created rejects the configuration
+	s.assignServiceLoggers(next, services)
+	routes, err := s.buildRoutes(cfg, services)
+	if err != nil {
+		return err
+	}
+	lns, err := s.bindListeners(services)
+	if err != nil {
+		return err
+	}
+
+	diff := s.serviceManager.Swap(next)
+	s.config = cfg
+
+	// Health checkers hold references to the pools of the previous configuration.
+	// Replace all of them. Reused pools keep their backend state so nothing is lost.
+	previousCheckers := s.healthCheckers
+	s.healthCheckers = s.createHealthCheckers(services)
+	for _, hc := range previousCheckers {
+		hc.Stop()
+	}
+	s.startHealthCheckers(s.healthCheckers)
+
+	s.routes.Store(routes)
+	s.proxyProtocol.Store(s.buildProxyProtocol(services))
+
+	for _, svc := range services {
+		s.startServiceServer(svc, lns)
+	}
+	s.stopUnusedServers(routes)
+	s.stopUnusedHTTP3Servers(routes)
+	s.stopUnusedStreamProxies(services)
+
+	s.certManager.Reload(cfg, httpsDomains(services))
+	s.certManager.ObtainCertificates()
+
+	s.logger.Info("Configuration reloaded",
+		zap.Strings("added", diff.Added),
+		zap.Strings("removed", diff.Removed),
+		zap.Strings("updated", diff.Updated))
+
+	return nil
+}
+
+// validatePorts ensures that services do not mix HTTP and HTTPS on the same port,
+// neither among themselves nor with servers that are already running.
+// Ports of layer 4 services are checked by validateStreamPorts.
+func (s *Server) validatePorts(services []*service.ServiceInfo) error {
+	if err := s.validateStreamPorts(services); err != nil {
+		return err
+	}
+
+	// The PROXY protocol is enabled on the listener, so services sharing it have to agree on the settings
+	proxyProtocol := make(map[int]*service.ServiceInfo)
+	for _, svc := range services {
+		if svc.Protocol == config.ProtocolUDP {
+			continue
+		}
+		port := s.servicePort(svc.Port)
+		if other, exists := proxyProtocol[port]; exists && !reflect.DeepEqual(other.ProxyProtocol, svc.ProxyProtocol) {
+			return fmt.Errorf("services %s and %s on port %d must use the same proxy_protocol settings", other.Name, svc.Name, port)
+		}
+		proxyProtocol[port] = svc
+	}
+
+	protocols := make(map[int]service.ServiceType)
+	for _, svc := range services {
+		if svc.IsStream() {
+			continue
+		}
+
+		port := s.servicePort(svc.Port)
+		protocol := svc.ServiceType()
+
+		if p, running := s.portProtocols[port]; running && p != protocol {
+			return fmt.Errorf(
+				"protocol mismatch: port %d is already served with a different protocol than service %s requires. Restart is required",
+				port,
+				svc.Name,
+			)
+		}
+
+		if p, exists := protocols[port]; exists && p != protocol {
 			return fmt.Errorf(
 				"protocol mismatch: cannot mix HTTP and HTTPS on port %d for service %s",
 				port,
 				svc.Name,
 			)
 		}
+		protocols[port] = protocol
+	}
+
+	return nil
+}
+
+// stopUnusedServers gracefully shuts down servers listening on ports that no longer have any service.
+func (s *Server) stopUnusedServers(routes map[int][]*serviceRoute) {
+	for port, server := range s.portServers {
+		if _, used := routes[port]; used {
+			continue
+		}
+
+		delete(s.portServers, port)
+		delete(s.portProtocols, port)
+		for i, srv := range s.servers {
+			if srv == server {
+				s.servers = append(s.servers[:i], s.servers[i+1:]...)
+				break
+			}
+		}
+
+		go func(port int, server *http.Server) {
+			ctx, cancel := context.WithTimeout(context.Background(), ShutdownGracePeriod)
+			defer cancel()
+
+			if err := server.Shutdown(ctx); err != nil {
+				s.logger.Error("Failed to shutdown unused server", zap.Int("port", port), zap.Error(err))
+				return
+			}
+			s.logger.Info("Server for unused port stopped", zap.Int("port", port))
+		}(port, server)
+	}
+}
+
+// httpsDomains returns hosts of all services whose TLS connections are terminated by Terraster.
+func httpsDomains(services []*service.ServiceInfo) []string {
+	domains := []string{}
+	for _, svc := range services {
+		if svc.ServiceType() == service.HTTPS && !svc.Passthrough() {
+			domains = append(domains, svc.Host)
+		}
+	}
+
+	return domains
+}
+
+// buildRoutes creates the handler chain of every service with the middleware of the configuration
+// and groups them by listening port.
+// Services with exact hosts are matched before services with wildcard hosts.
+func (s *Server) buildRoutes(cfg *config.Config, services []*service.ServiceInfo) (map[int][]*serviceRoute, error) {
+	routes := make(map[int][]*serviceRoute)
+	for _, svc := range services {
+		// Layer 4 services are not served by the HTTP listeners
+		if svc.IsStream() {
+			continue
+		}
+
+		port := s.servicePort(svc.Port)
+		if svc.Passthrough() {
+			routes[port] = append(routes[port], &serviceRoute{service: svc, proxy: s.passthroughProxy(svc)})
+			continue
+		}
+
+		if svc.ServiceType() == service.HTTP && svc.HTTPRedirect {
+			routes[port] = append(routes[port], &serviceRoute{service: svc, handler: s.createRedirectHandler(svc)})
+			continue
+		}
+
+		chain, err := s.serviceChain(cfg, svc)
+		if err != nil {
+			return nil, err
+		}
+		handler := chain.Then(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.handleRequest(w, r, svc)
+		}))
+
+		routes[port] = append(routes[port], &serviceRoute{service: svc, chain: chain, handler: handler})
+	}
+
+	for _, portRoutes := range routes {
+		sort.SliceStable(portRoutes, func(i, j int) bool {
+			return !strings.Contains(portRoutes[i].service.Host, "*") &&
+				strings.Contains(portRoutes[j].service.Host, "*")
+		})
+	}
+
+	return routes, nil
+}
+
+// serviceChain returns the middleware chain of the service. The chain currently serving the service is reused
+// if neither the global nor the service middleware configuration changed, so that a reload does not reset
+// the state of its middleware, e.g. the limits of rate limited clients.
+func (s *Server) serviceChain(cfg *config.Config, svc *service.ServiceInfo) (*middleware.MiddlewareChain, error) {
+	if reflect.DeepEqual(cfg.Middleware, s.config.Middleware) {
+		routes, _ := s.routes.Load().(map[int][]*serviceRoute)
+		for _, route := range routes[s.servicePort(svc.Port)] {
+			if route.chain != nil &&
+				route.service.Name == svc.Name &&
+				route.service.Host == svc.Host &&
+				route.service.Logger == svc.Logger &&
+				reflect.DeepEqual(route.service.Middleware, svc.Middleware) {
+				return route.chain, nil
+			}
+		}
+	}
+
+	return s.createServiceMiddleware(cfg, svc)
+}
+
+// portHandler returns the handler of a listening port.
+// It dispatches each request to the handler chain of the service matching the request host.
+// Routes are loaded on every request so that a reload takes effect without restarting the listener.
+func (s *Server) portHandler(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// HTTP-01 challenges of the ACME server are answered on every plaintext port,
+		// including ports of redirecting services, before any service handles the request.
+		if r.TLS == nil && s.certManager.ServeHTTPChallenge(w, r) {
+			return
+		}
+
+		host, _, err := parseHostPort(r.Host, r.TLS)
+		if err != nil {
+			pool.WriteError(w, r, "Invalid host + port", http.StatusBadRequest)
+			return
+		}
+
+		route := s.findRoute(port, host)
+		if route == nil {
+			pool.WriteError(w, r, "Service not found", http.StatusNotFound)
+			return
+		}
+
+		// Client certificates are verified by the service matching the server name of the connection.
+		// Requests for a service with client_auth over a connection made for another host are rejected.
+		if route.service.ClientAuth != nil && r.TLS != nil {
+			if !route.service.MatchesHost(r.TLS.ServerName) {
+				pool.WriteError(w, r, "Misdirected Request", http.StatusMisdirectedRequest)
+				return
+			}
+			route.service.ClientAuth.SetHeaders(r)
+		}
+
+		// Plaintext listeners accept h2c connections, but only services which enabled it may be served over them.
+		if r.ProtoMajor == 2 && r.TLS == nil && !route.service.H2C {
+			pool.WriteError(w, r, "HTTP/2 over cleartext is not enabled", http.StatusHTTPVersionNotSupported)
+			return
+		}
+
+		// Advertise HTTP/3 to clients connected over TCP.
+		if r.ProtoMajor < 3 && route.service.HTTP3() {
+			w.Header().Set("Alt-Svc", altSvcHeader(port))
+		}
+
+		// gRPC streams may live far longer than the server read and write timeouts.
+		if pool.IsGRPC(r) {
+			rc := http.NewResponseController(w)
+			_ = rc.SetReadDeadline(time.Time{})
+			_ = rc.SetWriteDeadline(time.Time{})
+		}
+
+		// The client IP is resolved once, so that algorithms, rate limits and logs agree on it.
+		ctx := context.WithValue(r.Context(), middleware.ServiceKey, route.service.Name)
+		ctx = context.WithValue(ctx, pool.ForwardedHeadersKey, route.service.Forwarding)
+		ctx = clientip.NewContext(ctx, route.service.Forwarding.ClientIP(r))
+
+		route.handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// findRoute returns the route of the service bound to the port matching the host, nil if there is none.
+func (s *Server) findRoute(port int, host string) *serviceRoute {
+	routes, _ := s.routes.Load().(map[int][]*serviceRoute)
+	for _, route := range routes[port] {
+		if route.proxy == nil && route.service.MatchesHost(host) {
+			return route
+		}
+	}
+	return nil
+}
+
+// h2cHandler serves HTTP/2 over cleartext on plaintext listeners, both with prior knowledge
+// and through the HTTP/1.1 Upgrade mechanism. Upgrades are only accepted for services which enabled h2c,
+// other services keep answering them over HTTP/1.1. Prior knowledge connections do not carry a host
+// before the first request, so portHandler rejects their requests to services without h2c.
+func (s *Server) h2cHandler(port int, next http.Handler) http.Handler {
+	h2cNext := h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The request which upgraded the connection still carries the upgrade headers.
+		// They must not reach the backend, which would either reject them or try to upgrade as well.
+		if strings.EqualFold(r.Header.Get("Upgrade"), "h2c") {
+			r.Header.Del("Connection")
+			r.Header.Del("Upgrade")
+			r.Header.Del("Http2-Settings")
+		}
+		next.ServeHTTP(w, r)
+	}), &http2.Server{IdleTimeout: IdleTimeout})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PRI" && r.URL.Path == "*" {
+			h2cNext.ServeHTTP(w, r)
+			return
+		}
+
+		if strings.EqualFold(r.Header.Get("Upgrade"), "h2c") {
+			if host, _, err := parseHostPort(r.Host, r.TLS); err == nil {
+				if route := s.findRoute(port, host); route != nil && route.service.H2C {
+					h2cNext.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// startServiceServer sets up and starts HTTP and HTTPS servers for a given service.
+// Ensures that services sharing the same port use the same underlying server instance to optimize resource usage.
+// Sockets of ports without a running server are taken from the listeners bound by bindListeners.
+func (s *Server) startServiceServer(svc *service.ServiceInfo, lns *boundListeners) {
+	if svc.IsStream() {
+		s.startStreamProxy(svc, lns)
+		return
+	}
+
+	port := s.servicePort(svc.Port)
+
+	// Check if a server is already running on the desired port.
+	// Protocols of services sharing the port were checked by validatePorts.
+	if _, running := s.portProtocols[port]; running {
 		s.logger.Info("Service port already registered. Binding to the same socket",
 			zap.String("service", svc.Name),
 			zap.String("host", svc.Host),
 			zap.Int("port", port))
-		return nil
+		s.startHTTP3Server(svc, lns)
+		return
 	}
 
 	svcType := svc.ServiceType()
-	server, err := s.createServer(svc, svcType)
-	if err != nil {
-		return fmt.Errorf("failed to create server for port %d: %w", port, err)
+	server := s.createServer(svc, svcType)
+
+	// PROXY protocol and TLS passthrough services can be enabled on reload, so listeners are always wrapped
+	var ln net.Listener = s.newProxyProtocolListener(lns.tcp[port], port)
+	if svcType == service.HTTPS {
+		ln = s.newSNIListener(ln, port)
 	}
 
 	s.portServers[port] = server
+	s.portProtocols[port] = svcType
 	s.servers = append(s.servers, server)
 
 	s.wg.Add(1)
-	go s.runServer(server, s.errorChan, svc.Name, svcType)
+	go s.runServer(server, ln, s.errorChan, svc.Name, svcType)
 
 	s.logger.Info("Service registered",
 		zap.String("service", svc.Name),
 		zap.String("host", svc.Host),
 		zap.Int("port", port))
 
-	return nil
+	s.startHTTP3Server(svc, lns)
 }
 
 // startAdminServer sets up and starts the administrative HTTP server.
@@ -308,62 +738,80 @@ func (s *Server) startAdminServer() error {
 		svcType = service.HTTPS
 	}
 
+	ln, err := net.Listen("tcp", adminAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on admin port: %w", err)
+	}
+
 	s.wg.Add(1)
-	go s.runServer(s.adminServer, s.errorChan, "admin", svcType)
+	go s.runServer(s.adminServer, ln, s.errorChan, "admin", svcType)
 
 	return nil
 }
 
 // createServer constructs and configures an HTTP or HTTPS server based on the provided service information.
 // It sets up TLS configurations, including certificate retrieval from the cache for HTTPS servers.
-// If the service requires HTTP to HTTPS redirection, it configures the appropriate handler.
+// The server handler dispatches requests to services bound to the port, see portHandler.
 func (s *Server) createServer(
 	svc *service.ServiceInfo,
 	protocol service.ServiceType,
-) (*http.Server, error) {
+) *http.Server {
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%d", s.servicePort(svc.Port)),
 		ReadTimeout:  ReadTimeout,
 		WriteTimeout: WriteTimeout,
 		IdleTimeout:  IdleTimeout,
-		Handler:      s.createServiceMiddleware(svc),
+		Handler:      s.portHandler(s.servicePort(svc.Port)),
 	}
 
+	// If the service is HTTP, return the server. No need to configure TLS.
+	// HTTPS servers negotiate HTTP/2 through ALPN, plaintext servers are wrapped to also accept h2c.
 	if protocol == service.HTTP {
-		if svc.HTTPRedirect {
-			server.Handler = s.createRedirectHandler(svc)
-			return server, nil
-		}
-
-		// If the service is HTTP, return the server. No need to configure TLS.
-		return server, nil
+		server.Handler = s.h2cHandler(s.servicePort(svc.Port), server.Handler)
+		return server
 	}
 
 	server.TLSConfig = &tls.Config{
 		MinVersion:     TLSMinVersion,
 		GetCertificate: s.certManager.GetCertificate,
 	}
+	server.TLSConfig.GetConfigForClient = s.clientAuthConfig(s.servicePort(svc.Port), server.TLSConfig)
+
+	// TLS passthrough services do not configure termination
+	tlsCfg := svc.TLS
+	if tlsCfg == nil {
+		tlsCfg = &config.TLSConfig{}
+	}
 
 	// set cipher suites, session tickets and next protos if provided
-	if svc.TLS.CipherSuites != nil {
-		server.TLSConfig.CipherSuites = svc.TLS.CipherSuites
-		s.logger.Info("Setting custom cipher suites", zap.Uint16s("cipher_suites", svc.TLS.CipherSuites))
+	if tlsCfg.CipherSuites != nil {
+		server.TLSConfig.CipherSuites = tlsCfg.CipherSuites
+		s.logger.Info("Setting custom cipher suites", zap.Uint16s("cipher_suites", tlsCfg.CipherSuites))
 	} else {
 		// default cipher suites
 		server.TLSConfig.CipherSuites = certmanager.TerrasterCiphers
 	}
 
-	if svc.TLS.SessionTicketsDisabled {
+	if tlsCfg.SessionTicketsDisabled {
 		server.TLSConfig.SessionTicketsDisabled = true // disable session tickets - false by default
 		s.logger.Info("Session tickets disabled")
 	}
 
-	if svc.TLS.NextProtos != nil {
-		server.TLSConfig.NextProtos = svc.TLS.NextProtos
-		s.logger.Info("Setting custom next protocols", zap.Strings("next_protos", svc.TLS.NextProtos))
+	if tlsCfg.NextProtos != nil {
+		server.TLSConfig.NextProtos = tlsCfg.NextProtos
+		s.logger.Info("Setting custom next protocols", zap.Strings("next_protos", tlsCfg.NextProtos))
+	}
+
+	// Accept TLS-ALPN-01 challenges of the ACME server. Clients never offer this protocol.
+	if s.certManager.ACMEEnabled() {
+		protos := server.TLSConfig.NextProtos
+		if protos == nil {
+			protos = []string{"h2", "http/1.1"}
+		}
+		server.TLSConfig.NextProtos = append(protos[:len(protos):len(protos)], acme.ALPNProto)
 	}
 
-	return server, nil
+	return server
 }
 
 // runServer starts the provided HTTP or HTTPS server and listens for incoming connections.
@@ -372,6 +820,7 @@ func (s *Server) createServer(
 // Runs in a separate goroutine
 func (s *Server) runServer(
 	server *http.Server,
+	ln net.Listener,
 	errorChan chan<- error,
 	name string,
 	serviceType service.ServiceType,
@@ -382,9 +831,9 @@ func (s *Server) runServer(
 
 	var err error
 	if serviceType == service.HTTPS {
-		err = server.ListenAndServeTLS("", "")
+		err = server.ServeTLS(ln, "", "")
 	} else {
-		err = server.ListenAndServe()
+		err = server.Serve(ln)
 	}
 
 	if err != nil && err != http.ErrServerClosed {
@@ -424,95 +873,94 @@ func (s *Server) defaultHandler(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte("Hello, World!"))
 }
 
-// handleRequest processes incoming HTTP requests by determining the appropriate backend service.
-// Handles service discovery, load balancing, and proxying requests to backend servers.
-func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
-	host, port, err := parseHostPort(r.Host, r.TLS)
-	if err != nil {
-		http.Error(w, "Invalid host + port", http.StatusBadRequest)
+// handleRequest processes incoming HTTP requests of a service.
+// Handles location matching, load balancing, and proxying requests to backend servers.
+// The service is bound to the handler chain when routes are built, so requests in flight during a reload
+// finish with the configuration they started with.
+func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request, svc *service.ServiceInfo) {
+	// Locations are matched per request as they may depend on the path, headers, cookies or client address.
+	location := svc.MatchLocation(r)
+	if location == nil {
+		pool.WriteError(w, r, "Service not found", http.StatusNotFound)
 		return
 	}
 
-	protocol := getProtocol(r)
+	// Locations with backend groups split their traffic by weight.
+	srvc := location.SelectGroup(r)
 
-	// Construct a unique service key for caching services
-	key := getServiceKey(host, port, protocol)
+	svcName, _ := r.Context().Value(middleware.ServiceKey).(string)
+	rm := requestMetrics{service: svcName, location: srvc.Path}
 
-	srvc, err := s.getServiceFromCache(key)
-	if err != nil {
-		// If not cache hit - retrieve it from the service manager.
-		srvc, err = s.getServiceFromManager(host, r.URL.Path, port)
+	// Requests are replayed on retries and mirrors, so the body has to be buffered up front.
+	// gRPC calls may stream their body for as long as the call lives, so they are neither retried nor mirrored.
+	attempts, mirror := 1, false
+	if !pool.IsGRPC(r) {
+		attempts = srvc.Retry.Attempts(r)
+		mirror = srvc.Mirror.Sample()
+	}
+	var replay []byte
+	if attempts > 1 || mirror {
+		var limit int64
+		if attempts > 1 {
+			limit = srvc.Retry.MaxBodySize()
+		}
+		if mirror {
+			limit = max(limit, srvc.Mirror.MaxBodySize())
+		}
+
+		body, replayable, err := bufferRequestBody(r, limit)
 		if err != nil {
-			http.Error(w, "Service not found", http.StatusNotFound)
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
 			return
 		}
-
-		s.cacheService(key, srvc)
-	}
-
-	// Select an appropriate backend based on the configured load balancing algorithm.
-	backend, err := s.getBackend(srvc, r)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
-		return
+		if !replayable || int64(len(body)) > srvc.Retry.MaxBodySize() {
+			attempts = 1
+		}
+		if mirror && (!replayable || int64(len(body)) > srvc.Mirror.MaxBodySize()) {
+			metrics.MirrorSkippedTotal.WithLabelValues(rm.service, rm.location, "body_too_large").Inc()
+			mirror = false
+		}
+		replay = body
 	}
 
-	// Increment the connection count for the selected backend.
-	if !backend.IncrementConnections() {
-		http.Error(w, "Server at max capacity", http.StatusServiceUnavailable)
-		return
+	if mirror {
+		s.mirrorRequest(r, srvc, rm, replay)
 	}
-	defer backend.DecrementConnections()
 
-	start := time.Now()
-	backend.Proxy.ServeHTTP(w, r.WithContext(
-		context.WithValue(r.Context(), middleware.BackendKey, backend.URL.String())),
-	)
-	duration := time.Since(start)
-
-	// Record the response time for performance-based load balancing algorithms.
-	s.recordResponseTime(srvc, backend.URL.String(), duration)
-}
-
-// getProtocol determines the protocol (HTTP or HTTPS) of the incoming request based on TLS information.
-// Returns service.HTTPS if the request is over TLS, otherwise service.HTTP.
-func getProtocol(r *http.Request) service.ServiceType {
-	if r.TLS != nil {
-		return service.HTTPS
-	}
-	return service.HTTP
-}
-
-// getServiceKey constructs a unique key for a service based on its host, port, and protocol.
-func getServiceKey(host string, port int, protocol service.ServiceType) string {
-	return service.ServiceKey{
-		Host:     host,
-		Port:     port,
-		Protocol: protocol,
-	}.String()
-}
+	pinned := srvc.Sticky.Backend(r, srvc.ServerPool)
+	tried := make(map[*pool.Backend]bool, attempts)
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if !waitBackoff(r, srvc.Retry.Backoff(attempt)) {
+				return
+			}
+			metrics.RetriesTotal.WithLabelValues(rm.service, rm.location).Inc()
+		}
 
-// getServiceFromCache retrieves the service information from the cache using the provided key.
-func (s *Server) getServiceFromCache(key string) (*service.LocationInfo, error) {
-	cachedService, found := s.serviceCache.Load(key)
-	if found {
-		return cachedService.(*service.LocationInfo), nil
-	}
-	return nil, errors.New("service not found in cache")
-}
+		// Honour the sticky session on the first attempt, as long as the pinned backend can take the request.
+		// Otherwise select an appropriate backend based on the configured load balancing algorithm.
+		// On retries, backends which were already tried are avoided.
+		var first *pool.Backend
+		if attempt == 0 {
+			first = pinned
+		}
+		backend, err := s.acquireBackend(srvc, r, first, tried)
+		if err != nil {
+			rm.recordUnavailable(http.StatusServiceUnavailable)
+			pool.WriteError(w, r, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
 
-// cacheService stores the provided service information in the cache using the specified key.
-func (s *Server) cacheService(key string, srvc *service.LocationInfo) {
-	s.serviceCache.Store(key, srvc)
-}
+		// Pin the client to the backend unless it is already pinned to it.
+		var cookie *http.Cookie
+		if backend != pinned {
+			cookie = srvc.Sticky.Cookie(backend)
+		}
 
-// getServiceFromManager retrieves the service information from the service manager based on host, path, and port.
-func (s *Server) getServiceFromManager(host, path string, port int) (*service.LocationInfo, error) {
-	_, srvc, err := s.serviceManager.GetService(host, path, port, false)
-	if err != nil {
-		return nil, err
+		if !s.proxyAttempt(w, r, srvc, backend, rm, attempt, attempt == attempts-1, replay, cookie) {
+			return
+		}
 	}
-	return srvc, nil
 }
 
 // getBackend selects an appropriate backend server from the service's server pool based on the load balancing algorithm.
@@ -551,26 +999,85 @@ func (s *Server) registerShutdownHandlers() {
 		})
 	}
 
-	// Service servers shutdown handlers
-	for _, srv := range s.servers {
-		s.shutdown.AddHandler(func(ctx context.Context) error {
-			if err := srv.Shutdown(ctx); err != nil {
-				s.logger.Error("Server shutdown error", zap.Error(err))
-				return err
-			}
+	// Service servers shutdown handler
+	// Servers and health checkers can change on reload so they are resolved at shutdown time
+	s.shutdown.AddHandler(func(ctx context.Context) error {
+		s.mu.RLock()
+		fns := make([]func(context.Context) error, 0, len(s.servers))
+		for _, srv := range s.servers {
+			fns = append(fns, srv.Shutdown)
+		}
+		s.mu.RUnlock()
 
-			return nil
-		})
-	}
+		if err := shutdownAll(ctx, fns); err != nil {
+			s.logger.Error("Server shutdown error", zap.Error(err))
+			return err
+		}
+		return nil
+	})
 
-	// Health checkers shutdown handlers
-	for svcName, hc := range s.healthCheckers {
-		s.shutdown.AddHandler(func(ctx context.Context) error {
+	// HTTP/3 servers shutdown handler
+	// Clients receive a GOAWAY and running requests are completed until the context expires
+	s.shutdown.AddHandler(func(ctx context.Context) error {
+		s.mu.RLock()
+		fns := make([]func(context.Context) error, 0, len(s.http3Servers))
+		for _, srv := range s.http3Servers {
+			fns = append(fns, srv.Shutdown)
+		}
+		s.mu.RUnlock()
+
+		if err := shutdownAll(ctx, fns); err != nil {
+			s.logger.Error("HTTP/3 server shutdown error", zap.Error(err))
+			return err
+		}
+		return nil
+	})
+
+	// Layer 4 proxies shutdown handler
+	// tcp connections are drained until the context expires, udp sessions are closed right away
+	s.shutdown.AddHandler(func(ctx context.Context) error {
+		s.mu.RLock()
+		fns := make([]func(context.Context) error, 0, len(s.streamProxies))
+		for _, p := range s.streamProxies {
+			fns = append(fns, p.Shutdown)
+		}
+		s.mu.RUnlock()
+
+		if err := shutdownAll(ctx, fns); err != nil {
+			s.logger.Error("Stream proxy shutdown error", zap.Error(err))
+			return err
+		}
+		return nil
+	})
+
+	// Health checkers shutdown handler
+	s.shutdown.AddHandler(func(ctx context.Context) error {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		for svcName, hc := range s.healthCheckers {
 			hc.Stop()
 			s.logger.Info("Health checker stopped", zap.String("name", svcName))
-			return nil
-		})
+		}
+		return nil
+	})
+}
+
+// shutdownAll runs the shutdown functions concurrently and waits for all of them to return.
+// Returns the errors of all failed functions joined together.
+func shutdownAll(ctx context.Context, fns []func(context.Context) error) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(fns))
+	for i, fn := range fns {
+		wg.Add(1)
+		go func(i int, fn func(context.Context) error) {
+			defer wg.Done()
+			errs[i] = fn(ctx)
+		}(i, fn)
 	}
+	wg.Wait()
+
+	return errors.Join(errs...)
 }
 
 // Shutdown gracefully shuts down all running servers, including the admin server and all service servers.
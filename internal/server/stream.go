@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+	"github.com/unkn0wn-root/terraster/internal/service"
+	"github.com/unkn0wn-root/terraster/internal/stream"
+	"go.uber.org/zap"
+)
+
+// streamProxy is a layer 4 (tcp or udp) proxy serving a single service on its port.
+// Proxies of TLS passthrough services do not listen, they are handed connections by the HTTPS listener of their port.
+type streamProxy interface {
+	Update(svc *service.ServiceInfo)
+	Serve() error
+	Shutdown(ctx context.Context) error
+}
+
+// streamKey identifies the listener of a layer 4 service, e.g. "udp:53".
+func streamKey(protocol string, port int) string {
+	return fmt.Sprintf("%s:%d", protocol, port)
+}
+
+// startStreamProxy starts the tcp or udp proxy of a layer 4 service.
+// If the proxy is already running (e.g. on reload), it switches to the new service configuration.
+// Established connections and sessions keep their backends.
+func (s *Server) startStreamProxy(svc *service.ServiceInfo, lns *boundListeners) {
+	port := s.servicePort(svc.Port)
+	key := streamKey(svc.Protocol, port)
+
+	if p, running := s.streamProxies[key]; running {
+		p.Update(svc)
+		return
+	}
+
+	var p streamProxy
+	if svc.Protocol == config.ProtocolTCP {
+		p = stream.NewTCPProxy(s.newProxyProtocolListener(lns.tcp[port], port), svc, s.logger)
+	} else {
+		p = stream.NewUDPProxy(lns.udp[port], svc, s.logger)
+	}
+
+	s.streamProxies[key] = p
+
+	s.wg.Add(1)
+	go s.runStreamProxy(p, key, svc.Name)
+
+	s.logger.Info("Service registered",
+		zap.String("service", svc.Name),
+		zap.String("protocol", svc.Protocol),
+		zap.Int("port", port))
+}
+
+// runStreamProxy serves the layer 4 proxy until it is shut down.
+// Runs in a separate goroutine
+func (s *Server) runStreamProxy(p streamProxy, key, name string) {
+	defer s.wg.Done()
+	n := strings.ToUpper(name)
+	s.logger.Info("Stream proxy started", zap.String("service_name", n), zap.String("listen_on", key))
+
+	if err := p.Serve(); err != nil && !errors.Is(err, net.ErrClosed) {
+		s.logger.Error("Error starting stream proxy", zap.String("server_name", n), zap.Error(err))
+		defer s.cancel()
+		s.errorChan <- err
+	} else {
+		s.logger.Info("Stream proxy stopped gracefully", zap.String("server_name", n))
+	}
+}
+
+// stopUnusedStreamProxies gracefully shuts down layer 4 and TLS passthrough proxies whose service was removed
+// or moved to another port or protocol.
+func (s *Server) stopUnusedStreamProxies(services []*service.ServiceInfo) {
+	used := make(map[string]bool)
+	for _, svc := range services {
+		switch {
+		case svc.IsStream():
+			used[streamKey(svc.Protocol, s.servicePort(svc.Port))] = true
+		case svc.Passthrough():
+			used[passthroughKey(svc, s.servicePort(svc.Port))] = true
+		}
+	}
+
+	for key, p := range s.streamProxies {
+		if used[key] {
+			continue
+		}
+
+		delete(s.streamProxies, key)
+		go func(key string, p streamProxy) {
+			ctx, cancel := context.WithTimeout(context.Background(), ShutdownGracePeriod)
+			defer cancel()
+
+			if err := p.Shutdown(ctx); err != nil {
+				s.logger.Error("Failed to shutdown unused stream proxy", zap.String("listen_on", key), zap.Error(err))
+				return
+			}
+			s.logger.Info("Stream proxy for unused port stopped", zap.String("listen_on", key))
+		}(key, p)
+	}
+}
+
+// validateStreamPorts ensures that a port is used by at most one layer 4 service per protocol
+// and that tcp services do not share their port with HTTP services, nor udp services with HTTP/3.
+// Ports which are served by a listener of another kind right now can not be taken over on reload.
+func (s *Server) validateStreamPorts(services []*service.ServiceInfo) error {
+	streams := make(map[string]string)
+	httpPorts := make(map[int]bool)
+	http3Ports := make(map[int]bool)
+	for _, svc := range services {
+		port := s.servicePort(svc.Port)
+		if !svc.IsStream() {
+			httpPorts[port] = true
+			if svc.HTTP3() {
+				http3Ports[port] = true
+			}
+			continue
+		}
+
+		key := streamKey(svc.Protocol, port)
+		if other, exists := streams[key]; exists {
+			return fmt.Errorf("services %s and %s cannot share %s port %d", other, svc.Name, svc.Protocol, port)
+		}
+		streams[key] = svc.Name
+	}
+
+	for _, svc := range services {
+		port := s.servicePort(svc.Port)
+		switch {
+		case svc.Protocol == config.ProtocolTCP:
+			if httpPorts[port] {
+				return fmt.Errorf("tcp service %s cannot share port %d with HTTP services", svc.Name, port)
+			}
+			if _, running := s.portServers[port]; running {
+				return fmt.Errorf("port %d is already served over HTTP and cannot be used by tcp service %s. Restart is required", port, svc.Name)
+			}
+		case svc.Protocol == config.ProtocolUDP:
+			if http3Ports[port] {
+				return fmt.Errorf("udp service %s cannot share port %d with HTTP/3 services", svc.Name, port)
+			}
+			if _, running := s.http3Servers[port]; running {
+				return fmt.Errorf("port %d is already served over HTTP/3 and cannot be used by udp service %s. Restart is required", port, svc.Name)
+			}
+		default:
+			if _, running := s.streamProxies[streamKey(config.ProtocolTCP, port)]; running {
+				return fmt.Errorf("port %d is already served by a tcp service and cannot be used by service %s. Restart is required", port, svc.Name)
+			}
+			if _, running := s.streamProxies[streamKey(config.ProtocolUDP, port)]; running && svc.HTTP3() {
+				return fmt.Errorf("port %d is already served by a udp service and cannot be used for HTTP/3 by service %s. Restart is required", port, svc.Name)
+			}
+		}
+	}
+
+	return nil
+}
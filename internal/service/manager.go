@@ -3,10 +3,13 @@ package service
 import (
 	"errors"
 	"fmt"
+	"net/http"
+	"reflect"
 	"strings"
 	"sync"
 
 	"github.com/unkn0wn-root/terraster/internal/config"
+	certmanager "github.com/unkn0wn-root/terraster/internal/crypto"
 	"github.com/unkn0wn-root/terraster/internal/pool"
 	"github.com/unkn0wn-root/terraster/pkg/algorithm"
 	"go.uber.org/zap"
@@ -14,7 +17,7 @@ import (
 
 var (
 	ErrServiceAlreadyExists = errors.New("service already exists")
-	ErrDuplicateLocation    = errors.New("duplicate location path")
+	ErrDuplicateLocation    = errors.New("duplicate location path and match rules")
 	ErrNotDefined           = errors.New("service must have either host or name defined")
 )
 
@@ -35,28 +38,58 @@ type Manager struct {
 
 // ServiceInfo contains comprehensive information about a service, including its routing and backend configurations.
 type ServiceInfo struct {
-	Name         string                    // The unique name of the service.
-	Host         string                    // The host address where the service is accessible.
-	Port         int                       // The port number on which the service listens.
-	TLS          *config.TLSConfig         // TLS configuration for the service, if HTTPS is enabled.
-	HTTPRedirect bool                      // Indicates whether HTTP requests should be redirected to HTTPS.
-	RedirectPort int                       // The port to which HTTP requests are redirected for HTTPS.
-	HealthCheck  *config.HealthCheckConfig // Health check configuration specific to the service.
-	Locations    []*LocationInfo           // A slice of LocationInfo representing different routing paths for the service.
-	Middleware   []config.Middleware       // Middleware configurations for the service.
-	LogName      string                    // LogName will be used to get service logger from config.
-	Logger       *zap.Logger               // Logger instance for logging service activities.
+	Name          string                      // The unique name of the service.
+	Host          string                      // The host address where the service is accessible.
+	Port          int                         // The port number on which the service listens.
+	TLS           *config.TLSConfig           // TLS configuration for the service, if HTTPS is enabled.
+	HTTPRedirect  bool                        // Indicates whether HTTP requests should be redirected to HTTPS.
+	RedirectPort  int                         // The port to which HTTP requests are redirected for HTTPS.
+	HealthCheck   *config.HealthCheckConfig   // Health check configuration specific to the service.
+	Locations     []*LocationInfo             // A slice of LocationInfo representing different routing paths for the service.
+	Middleware    []config.Middleware         // Middleware configurations for the service.
+	LogName       string                      // LogName will be used to get service logger from config.
+	H2C           bool                        // Accept HTTP/2 over cleartext (h2c) from clients.
+	Protocol      string                      // config.ProtocolTCP, config.ProtocolUDP or config.ProtocolTLSPassthrough for layer 4 services, empty or http otherwise.
+	Stream        config.StreamConfig         // Options of layer 4 services.
+	ProxyProtocol *config.ProxyProtocolConfig // PROXY protocol settings of the listener, nil if disabled.
+	Forwarding    *pool.ForwardedHeaders      // Policy for forwarding headers, resolves the client IP of requests.
+	ClientAuth    *certmanager.ClientAuth     // Client certificate verification (mutual TLS), nil if disabled.
+	Logger        *zap.Logger                 // Logger instance for logging service activities.
+	cfg           config.Service              // Configuration the service was built from. Used to diff on reload.
+	routes        []*LocationInfo             // Locations in the order they are matched against requests.
 }
 
 // ServiceType determines the protocol type of the service based on its TLS configuration.
 // It returns HTTPS if TLS is enabled, otherwise HTTP.
 func (s *ServiceInfo) ServiceType() ServiceType {
-	if s.TLS != nil && s.TLS.Enabled {
+	if s.TLS != nil && s.TLS.Enabled || s.Passthrough() {
 		return HTTPS
 	}
 	return HTTP
 }
 
+// IsStream reports whether the service is load balanced at layer 4 (tcp or udp) on a listener of its own.
+func (s *ServiceInfo) IsStream() bool {
+	return s.Protocol == config.ProtocolTCP || s.Protocol == config.ProtocolUDP
+}
+
+// Passthrough reports whether TLS connections of the service are forwarded to its backends without terminating them.
+// Passthrough services share the listener of HTTPS services on their port.
+func (s *ServiceInfo) Passthrough() bool {
+	return s.Protocol == config.ProtocolTLSPassthrough
+}
+
+// ActiveHealthCheck reports whether the backends of the service are actively health checked.
+// udp backends can not be checked in a generic way, so udp services are only checked if they configure a health check.
+func (s *ServiceInfo) ActiveHealthCheck() bool {
+	return s.Protocol != config.ProtocolUDP || s.cfg.HealthCheck != nil
+}
+
+// HTTP3 reports whether the service is also served over HTTP/3 (QUIC).
+func (s *ServiceInfo) HTTP3() bool {
+	return s.TLS != nil && s.TLS.Enabled && s.TLS.HTTP3
+}
+
 // LocationInfo contains routing and backend information for a specific path within a service.
 // Defines how incoming requests matching the path should be handled and which backend servers to proxy to.
 type LocationInfo struct {
@@ -64,12 +97,42 @@ type LocationInfo struct {
 	Rewrite    string              // The URL rewrite rule applied to incoming requests.
 	Algorithm  algorithm.Algorithm // The load balancing algorithm used to select a backend server.
 	ServerPool *pool.ServerPool    // The pool of backend servers associated with this location.
+	Retry      *pool.RetryPolicy   // Retry policy for failed requests. Nil if retries are disabled.
+	Sticky     *pool.StickySession // Cookie based session affinity. Nil if disabled.
+	Mirror     *pool.Mirror        // Shadow traffic to a secondary pool. Nil if disabled.
+	Group      string              // Name of the backend group. Empty unless this is a group of a location.
+	Groups     []*LocationInfo     // Backend groups the traffic is split across, each with its own pool and algorithm.
+	matcher    *RouteMatcher       // Path and match rules deciding which requests the location handles.
+	split      *TrafficSplit       // Weights of the backend groups. Nil if the location has no groups.
+	cfg        config.Location     // Configuration the location was built from. Used to diff on reload.
+	hcCfg      config.HealthCheckConfig
+}
+
+// ReloadDiff describes which services were affected by swapping in a new configuration.
+type ReloadDiff struct {
+	Added   []string // Services that did not exist before.
+	Removed []string // Services that no longer exist.
+	Updated []string // Services whose configuration changed.
 }
 
 // NewManager initializes and returns a new instance of Manager.
 // It sets up services based on the provided configuration and initializes their respective server pools.
 // If no services are defined in the configuration but backends are provided, it creates a default service.
 func NewManager(cfg *config.Config, logger *zap.Logger) (*Manager, error) {
+	return buildManager(cfg, logger, nil)
+}
+
+// Rebuild creates a new Manager from the provided configuration without modifying the current one.
+// Locations whose configuration did not change are carried over from the current Manager,
+// so their server pools keep backend health state and active connection counts.
+// Changed locations keep the state of the backends whose own configuration did not change.
+func (m *Manager) Rebuild(cfg *config.Config) (*Manager, error) {
+	return buildManager(cfg, m.logger, m)
+}
+
+// buildManager sets up services based on the provided configuration.
+// If prev is not nil, unchanged locations are reused from it.
+func buildManager(cfg *config.Config, logger *zap.Logger, prev *Manager) (*Manager, error) {
 	m := &Manager{
 		services: make(map[string]*ServiceInfo),
 		logger:   logger,
@@ -95,7 +158,9 @@ func NewManager(cfg *config.Config, logger *zap.Logger) (*Manager, error) {
 				},
 			},
 		}
-		if err := m.AddService(defaultService, cfg.HealthCheck); err != nil {
+		defaultService = inheritCircuitBreaker(defaultService, cfg.Middleware)
+		defaultService.ForwardedHeaders = cfg.ForwardedHeaders
+		if err := m.addService(defaultService, cfg.HealthCheck, prev); err != nil {
 			return nil, err
 		}
 	} else {
@@ -104,8 +169,17 @@ func NewManager(cfg *config.Config, logger *zap.Logger) (*Manager, error) {
 			hcCfg := svc.HealthCheck
 			if hcCfg == nil {
 				hcCfg = cfg.HealthCheck
+				// Backends of layer 4 services do not speak HTTP, they are checked by connecting to them.
+				if svc.IsStream() && hcCfg != nil {
+					hcCfg = hcCfg.Copy()
+					hcCfg.Type = "tcp"
+				}
 			}
-			if err := m.AddService(svc, hcCfg); err != nil {
+			svc = inheritCircuitBreaker(svc, cfg.Middleware)
+			if svc.ForwardedHeaders == nil {
+				svc.ForwardedHeaders = cfg.ForwardedHeaders
+			}
+			if err := m.addService(svc, hcCfg, prev); err != nil {
 				return nil, err
 			}
 		}
@@ -114,9 +188,91 @@ func NewManager(cfg *config.Config, logger *zap.Logger) (*Manager, error) {
 	return m, nil
 }
 
+// inheritCircuitBreaker applies the circuit_breaker middleware of the service, or else the global one,
+// to the locations of the service without their own circuit breaker configuration.
+// The locations are copied, so the global configuration is not modified.
+func inheritCircuitBreaker(svc config.Service, global []config.Middleware) config.Service {
+	var cb *config.CircuitBreaker
+	for _, mws := range [][]config.Middleware{svc.Middleware, global} {
+		for _, mw := range mws {
+			if mw.CircuitBreaker != nil {
+				cb = mw.CircuitBreaker
+				break
+			}
+		}
+		if cb != nil {
+			break
+		}
+	}
+
+	if cb == nil {
+		return svc
+	}
+
+	locations := make([]config.Location, len(svc.Locations))
+	copy(locations, svc.Locations)
+	for i := range locations {
+		if locations[i].CircuitBreaker == nil {
+			locations[i].CircuitBreaker = cb
+		}
+	}
+	svc.Locations = locations
+
+	return svc
+}
+
+// Swap atomically replaces the services of the Manager with the services of next.
+// Loggers already assigned to services that still exist are preserved.
+// Returns a description of added, removed and updated services.
+func (m *Manager) Swap(next *Manager) ReloadDiff {
+	next.mu.RLock()
+	services := make(map[string]*ServiceInfo, len(next.services))
+	for k, v := range next.services {
+		services[k] = v
+	}
+	next.mu.RUnlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var diff ReloadDiff
+	for k, svc := range services {
+		old, exists := m.services[k]
+		if !exists {
+			diff.Added = append(diff.Added, k)
+			continue
+		}
+
+		if svc.Logger == nil && svc.LogName == old.LogName {
+			svc.Logger = old.Logger
+		}
+
+		if !reflect.DeepEqual(old.cfg, svc.cfg) {
+			diff.Updated = append(diff.Updated, k)
+		}
+	}
+
+	for k := range m.services {
+		if _, exists := services[k]; !exists {
+			diff.Removed = append(diff.Removed, k)
+		}
+	}
+
+	deleteStaleMetrics(m.services, services)
+	m.services = services
+
+	return diff
+}
+
 // AddService adds a new service to the Manager with the provided configuration and health check settings.
 // Processes each location within the service, creates corresponding server pools, and ensures no duplicate services or locations exist.
 func (m *Manager) AddService(service config.Service, globalHealthCheck *config.HealthCheckConfig) error {
+	return m.addService(service, globalHealthCheck, nil)
+}
+
+// addService builds the service and its locations. If prev is not nil and it contains
+// the same service with an identical location configuration, that location is reused as is.
+func (m *Manager) addService(service config.Service, globalHealthCheck *config.HealthCheckConfig, prev *Manager) error {
 	locations := make([]*LocationInfo, 0, len(service.Locations))
 	locationPaths := make(map[string]bool)
 	for _, location := range service.Locations {
@@ -125,29 +281,83 @@ func (m *Manager) AddService(service config.Service, globalHealthCheck *config.H
 		}
 
 		// Check for duplicate location paths within the service.
-		if _, exist := locationPaths[location.Path]; exist {
+		// Locations may share a path as long as their match rules differ.
+		if _, exist := locationPaths[routeKey(location)]; exist {
 			return ErrDuplicateLocation
 		}
 
 		// Ensure that each location has at least one backend defined.
-		if len(location.Backends) == 0 {
+		if len(location.Backends) == 0 && len(location.Groups) == 0 {
 			return fmt.Errorf("service %s, location %s: no backends defined",
 				service.Name, location.Path)
 		}
 
-		locationPaths[location.Path] = true
+		if len(location.Backends) > 0 && len(location.Groups) > 0 {
+			return fmt.Errorf("service %s, location %s: backends and groups are mutually exclusive",
+				service.Name, location.Path)
+		}
+
+		locationPaths[routeKey(location)] = true
+
+		if existing := prev.findLocation(service.Name, location, globalHealthCheck); existing != nil {
+			locations = append(locations, existing)
+			continue
+		}
+
+		// The backends of a changed location keep their state unless their own configuration changed.
+		previous := prev.findRoute(service.Name, location)
+
+		retry, err := pool.NewRetryPolicy(location.Retry)
+		if err != nil {
+			return fmt.Errorf("service %s, location %s: %w", service.Name, location.Path, err)
+		}
+
+		matcher, err := NewRouteMatcher(location)
+		if err != nil {
+			return fmt.Errorf("service %s, location %s: %w", service.Name, location.Path, err)
+		}
+
+		sticky, err := pool.NewStickySession(location.Sticky)
+		if err != nil {
+			return fmt.Errorf("service %s, location %s: %w", service.Name, location.Path, err)
+		}
+
+		loc := &LocationInfo{
+			Path:    location.Path,
+			Rewrite: location.Rewrite,
+			Retry:   retry,
+			Sticky:  sticky,
+			matcher: matcher,
+			cfg:     location,
+		}
+
+		loc.Mirror, err = m.createMirror(location, globalHealthCheck, previous.mirrorPool())
+		if err != nil {
+			return fmt.Errorf("service %s, location %s: %w", service.Name, location.Path, err)
+		}
 
-		serverPool, err := m.createServerPool(location, globalHealthCheck)
+		if len(location.Groups) > 0 {
+			err = m.createGroups(loc, location, globalHealthCheck, previous)
+		} else {
+			loc.Algorithm, loc.ServerPool, err = m.createBackends(location, globalHealthCheck, previous.groupPool(""))
+		}
 		if err != nil {
-			return err
+			return fmt.Errorf("service %s, location %s: %w", service.Name, location.Path, err)
+		}
+
+		breaker, err := pool.NewCircuitBreaker(location.CircuitBreaker, service.Name)
+		if err != nil {
+			return fmt.Errorf("service %s, location %s: %w", service.Name, location.Path, err)
+		}
+		for _, p := range loc.Pools() {
+			p.SetCircuitBreaker(breaker)
+		}
+
+		if globalHealthCheck != nil {
+			loc.hcCfg = *globalHealthCheck
 		}
 
-		locations = append(locations, &LocationInfo{
-			Path:       location.Path,
-			Algorithm:  algorithm.CreateAlgorithm(location.LoadBalancer),
-			Rewrite:    location.Rewrite,
-			ServerPool: serverPool,
-		})
+		locations = append(locations, loc)
 	}
 
 	// Determine the key for the service map. Use the service name if available; otherwise, use the host.
@@ -171,29 +381,56 @@ func (m *Manager) AddService(service config.Service, globalHealthCheck *config.H
 		serviceHealthCheck = service.HealthCheck
 	}
 
+	forwarding, err := pool.NewForwardedHeaders(service.ForwardedHeaders)
+	if err != nil {
+		return fmt.Errorf("service %s: %w", service.Name, err)
+	}
+
+	var clientAuth *certmanager.ClientAuth
+	if service.TLS != nil && service.TLS.Enabled && service.TLS.ClientAuth != nil {
+		clientAuth, err = certmanager.NewClientAuth(service.TLS.ClientAuth, m.logger)
+		if err != nil {
+			return fmt.Errorf("service %s: %w", service.Name, err)
+		}
+	}
+
+	var stream config.StreamConfig
+	if service.Stream != nil {
+		stream = *service.Stream
+	}
+
 	m.mu.Lock()
 	m.services[k] = &ServiceInfo{
-		Name:         service.Name,
-		Host:         service.Host,
-		Port:         service.Port,
-		TLS:          service.TLS,
-		HTTPRedirect: service.HTTPRedirect, // Indicates if HTTP should be redirected to HTTPS.
-		RedirectPort: service.RedirectPort, // Custom port for redirection if applicable.
-		HealthCheck:  serviceHealthCheck,
-		Locations:    locations, // Associated locations with their backends.
-		Middleware:   service.Middleware,
-		LogName:      service.LogName,
+		Name:          service.Name,
+		Host:          service.Host,
+		Port:          service.Port,
+		TLS:           service.TLS,
+		HTTPRedirect:  service.HTTPRedirect, // Indicates if HTTP should be redirected to HTTPS.
+		RedirectPort:  service.RedirectPort, // Custom port for redirection if applicable.
+		HealthCheck:   serviceHealthCheck,
+		Locations:     locations, // Associated locations with their backends.
+		routes:        sortRoutes(locations),
+		Middleware:    service.Middleware,
+		LogName:       service.LogName,
+		H2C:           service.H2C,
+		Protocol:      service.Protocol,
+		Stream:        stream,
+		ProxyProtocol: service.ProxyProtocol,
+		Forwarding:    forwarding,
+		ClientAuth:    clientAuth,
+		cfg:           service,
 	}
 	m.mu.Unlock()
 
 	return nil
 }
 
-// GetService retrieves the service and location information based on the provided host, path, and port.
+// GetService retrieves the service and location information based on the provided host, port and request.
 // If hostOnly is true, it returns only the ServiceInfo without matching a specific location.
 func (m *Manager) GetService(
-	host, path string,
+	host string,
 	port int,
+	r *http.Request,
 	hostOnly bool,
 ) (*ServiceInfo, *LocationInfo, error) {
 	m.mu.RLock()
@@ -201,6 +438,9 @@ func (m *Manager) GetService(
 
 	var matchedService *ServiceInfo
 	for _, service := range m.services {
+		if service.IsStream() || service.Passthrough() {
+			continue
+		}
 		if matchHost(service.Host, host) && service.Port == port {
 			if hostOnly {
 				return service, nil, nil
@@ -214,20 +454,144 @@ func (m *Manager) GetService(
 		return nil, nil, fmt.Errorf("service not found for host %s", host)
 	}
 
-	var matchedLocation *LocationInfo
-	var matchedLen int
-	for _, location := range matchedService.Locations {
-		if strings.HasPrefix(path, location.Path) && len(location.Path) > matchedLen {
-			matchedLocation = location
-			matchedLen = len(location.Path)
+	matchedLocation := matchedService.MatchLocation(r)
+	if matchedLocation == nil {
+		return nil, nil, fmt.Errorf("location not found for path %s", r.URL.Path)
+	}
+
+	return matchedService, matchedLocation, nil
+}
+
+// MatchLocation returns the first location, in match order, whose path and match rules meet the request.
+// Returns nil if no location matches.
+func (s *ServiceInfo) MatchLocation(r *http.Request) *LocationInfo {
+	for _, location := range s.routes {
+		if location.matcher.Match(r) {
+			return location
 		}
 	}
+	return nil
+}
 
-	if matchedLocation == nil {
-		return nil, nil, fmt.Errorf("location not found for path %s", path)
+// ProxyPath returns the path prefix stripped from requests before they are proxied.
+// Regex locations do not strip anything.
+func (l *LocationInfo) ProxyPath() string {
+	return proxyPath(l.cfg)
+}
+
+// NextUntried selects a backend of the location that was not tried yet, e.g. for a retry or a failed dial.
+// The location's algorithm is asked first. If it keeps returning tried backends (e.g. hash based algorithms),
+// any available untried backend is used. Returns nil if every available backend was tried.
+func (l *LocationInfo) NextUntried(r *http.Request, tried map[*pool.Backend]bool) *pool.Backend {
+	backends := l.ServerPool.GetAllBackends()
+	for i := 0; i < len(backends); i++ {
+		server := l.Algorithm.NextServer(l.ServerPool, r)
+		if server == nil {
+			break
+		}
+		backend := l.ServerPool.GetBackendByURL(server.URL)
+		if backend != nil && !tried[backend] {
+			return backend
+		}
 	}
 
-	return matchedService, matchedLocation, nil
+	for _, backend := range backends {
+		if l.ServerPool.IsAvailable(backend) && !tried[backend] {
+			return backend
+		}
+	}
+
+	return nil
+}
+
+// findLocation returns the location of the named service if its configuration
+// (including the effective health check) is identical to the provided one.
+// Safe to call on a nil Manager.
+func (m *Manager) findLocation(
+	serviceName string,
+	location config.Location,
+	hcCfg *config.HealthCheckConfig,
+) *LocationInfo {
+	if m == nil || serviceName == "" {
+		return nil
+	}
+
+	svc := m.GetServiceByName(serviceName)
+	if svc == nil {
+		return nil
+	}
+
+	var hc config.HealthCheckConfig
+	if hcCfg != nil {
+		hc = *hcCfg
+	}
+
+	for _, loc := range svc.Locations {
+		if loc.Path == location.Path && loc.hcCfg == hc && reflect.DeepEqual(loc.cfg, location) {
+			return loc
+		}
+	}
+
+	return nil
+}
+
+// findRoute returns the location of the named service with the same path and match rules as the provided one,
+// regardless of the rest of its configuration. Safe to call on a nil Manager.
+func (m *Manager) findRoute(serviceName string, location config.Location) *LocationInfo {
+	if m == nil || serviceName == "" {
+		return nil
+	}
+
+	svc := m.GetServiceByName(serviceName)
+	if svc == nil {
+		return nil
+	}
+
+	key := routeKey(location)
+	for _, loc := range svc.Locations {
+		if routeKey(loc.cfg) == key {
+			return loc
+		}
+	}
+
+	return nil
+}
+
+// groupPool returns the server pool of the named backend group, or of the location itself if group is empty.
+// Returns nil if there is no such pool. Safe to call on a nil LocationInfo.
+func (l *LocationInfo) groupPool(group string) *pool.ServerPool {
+	if l == nil {
+		return nil
+	}
+
+	if group == "" {
+		if len(l.Groups) == 0 {
+			return l.ServerPool
+		}
+		return nil
+	}
+
+	for _, g := range l.Groups {
+		if g.Group == group {
+			return g.ServerPool
+		}
+	}
+
+	return nil
+}
+
+// mirrorPool returns the server pool of the location's mirror, nil if there is none.
+// Safe to call on a nil LocationInfo.
+func (l *LocationInfo) mirrorPool() *pool.ServerPool {
+	if l == nil || l.Mirror == nil {
+		return nil
+	}
+	return l.Mirror.Pool
+}
+
+// MatchesHost reports whether the given host matches the service host pattern.
+func (s *ServiceInfo) MatchesHost(host string) bool {
+	return matchHost(s.Host, host)
 }
 
 // GetServiceByName retrieves a service based on its unique name.
@@ -266,30 +630,108 @@ func (m *Manager) AssignLogger(serviceName string, logger *zap.Logger) {
 	}
 }
 
+// algorithmOptions converts the load balancing options of a location to algorithm options.
+func algorithmOptions(location config.Location) ([]algorithm.Option, error) {
+	if location.Hash == nil {
+		return nil, nil
+	}
+
+	key, err := algorithm.ParseHashKey(location.Hash.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return []algorithm.Option{
+		algorithm.WithHashKey(key),
+		algorithm.WithVirtualNodes(location.Hash.VirtualNodes),
+		algorithm.WithLoadFactor(location.Hash.LoadFactor),
+	}, nil
+}
+
+// createBackends creates the load balancing algorithm and the server pool for the backends of a location.
+// If prev is not nil, the pool is built from it, see createServerPool.
+func (m *Manager) createBackends(
+	location config.Location,
+	serviceHealthCheck *config.HealthCheckConfig,
+	prev *pool.ServerPool,
+) (algorithm.Algorithm, *pool.ServerPool, error) {
+	algoOpts, err := algorithmOptions(location)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serverPool, err := m.createServerPool(location, serviceHealthCheck, prev)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return algorithm.CreateAlgorithm(location.LoadBalancer, algoOpts...), serverPool, nil
+}
+
+// createMirror creates the mirror of a location with its own pool of backends.
+// The mirror backends share the location's path handling and, unless set, its lb_policy.
+func (m *Manager) createMirror(
+	location config.Location,
+	serviceHealthCheck *config.HealthCheckConfig,
+	prev *pool.ServerPool,
+) (*pool.Mirror, error) {
+	if location.Mirror == nil {
+		return nil, nil
+	}
+
+	if len(location.Mirror.Backends) == 0 {
+		return nil, errors.New("mirror: no backends defined")
+	}
+
+	mirrorCfg := location
+	mirrorCfg.Backends = location.Mirror.Backends
+	mirrorCfg.Groups = nil
+	mirrorCfg.OutlierDetection = nil
+	if location.Mirror.LoadBalancer != "" {
+		mirrorCfg.LoadBalancer = location.Mirror.LoadBalancer
+		mirrorCfg.Hash = nil
+	}
+
+	algo, serverPool, err := m.createBackends(mirrorCfg, serviceHealthCheck, prev)
+	if err != nil {
+		return nil, fmt.Errorf("mirror: %w", err)
+	}
+
+	return pool.NewMirror(location.Mirror, serverPool, algo)
+}
+
 // createServerPool initializes and configures a ServerPool for a given service location.
 // It sets up the load balancing algorithm and adds all backends associated with the location to the pool.
-func (m *Manager) createServerPool(srvc config.Location, serviceHealthCheck *config.HealthCheckConfig) (*pool.ServerPool, error) {
+// If prev is not nil, the pool replacing it is built from a clone of it, so that backends whose configuration
+// did not change keep their health, ejections, circuit state and active connections. prev itself is not modified.
+func (m *Manager) createServerPool(
+	srvc config.Location,
+	serviceHealthCheck *config.HealthCheckConfig,
+	prev *pool.ServerPool,
+) (*pool.ServerPool, error) {
 	serverPool := pool.NewServerPool(m.logger)
+	if prev != nil {
+		serverPool = prev.Clone()
+	}
 	serverPool.UpdateConfig(pool.PoolConfig{
 		Algorithm: srvc.LoadBalancer,
 	})
 
-	for _, backend := range srvc.Backends {
-		rc := pool.RouteConfig{
-			Path:          srvc.Path,             // The path associated with the backend.
-			RewriteURL:    srvc.Rewrite,          // URL rewrite rules for the backend.
-			Redirect:      srvc.Redirect,         // Redirect settings if applicable.
-			SkipTLSVerify: backend.SkipTLSVerify, // TLS verification settings for the backend.
-		}
+	outlier, err := pool.NewOutlierDetector(srvc.OutlierDetection)
+	if err != nil {
+		return nil, fmt.Errorf("location %s: %w", srvc.Path, err)
+	}
+	serverPool.SetOutlierDetector(outlier)
 
-		backendHealthCheck := serviceHealthCheck
-		if backend.HealthCheck != nil {
-			backendHealthCheck = backend.HealthCheck
-		}
+	rc := pool.RouteConfig{
+		Path:       proxyPath(srvc), // The path associated with the backends.
+		RewriteURL: srvc.Rewrite,    // URL rewrite rules for the backends.
+		Redirect:   srvc.Redirect,   // Redirect settings if applicable.
+	}
 
-		if err := serverPool.AddBackend(backend, rc, backendHealthCheck); err != nil {
-			return nil, err
-		}
+	// Protocol, PROXY protocol and health check are taken from each backend's configuration.
+	if err := serverPool.UpdateBackends(srvc.Backends, rc, serviceHealthCheck); err != nil {
+		return nil, err
 	}
 
 	return serverPool, nil
@@ -0,0 +1,307 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+	certmanager "github.com/unkn0wn-root/terraster/internal/crypto"
+	"github.com/unkn0wn-root/terraster/pkg/clientip"
+)
+
+// Path types of a location.
+const (
+	PathPrefix = "prefix"
+	PathExact  = "exact"
+	PathRegex  = "regex"
+)
+
+// RouteMatcher decides whether a request is handled by a location.
+// It is compiled once from the location configuration and safe for concurrent use.
+type RouteMatcher struct {
+	pathType   string
+	path       string
+	pathRe     *regexp.Regexp
+	methods    map[string]bool
+	headers    []valueMatcher
+	query      []valueMatcher
+	cookies    []valueMatcher
+	networks   []*net.IPNet
+	clientCert *config.ClientCertMatch
+	priority   int
+}
+
+// valueMatcher matches a single named value. Without value and regex, the name only has to be present.
+type valueMatcher struct {
+	name  string
+	value string
+	re    *regexp.Regexp
+}
+
+// NewRouteMatcher compiles the path and match rules of a location.
+func NewRouteMatcher(location config.Location) (*RouteMatcher, error) {
+	m := &RouteMatcher{
+		pathType: strings.ToLower(location.PathType),
+		path:     location.Path,
+		priority: location.Priority,
+	}
+
+	switch m.pathType {
+	case "", PathPrefix:
+		m.pathType = PathPrefix
+	case PathExact:
+	case PathRegex:
+		re, err := regexp.Compile(location.Path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path regex %q: %w", location.Path, err)
+		}
+		m.pathRe = re
+	default:
+		return nil, fmt.Errorf("invalid path_type %q, must be prefix, exact or regex", location.PathType)
+	}
+
+	match := location.Match
+	if match == nil {
+		return m, nil
+	}
+
+	if len(match.Methods) > 0 {
+		m.methods = make(map[string]bool, len(match.Methods))
+		for _, method := range match.Methods {
+			m.methods[strings.ToUpper(method)] = true
+		}
+	}
+
+	var err error
+	if m.headers, err = compileValueMatchers("header", match.Headers); err != nil {
+		return nil, err
+	}
+	for i := range m.headers {
+		m.headers[i].name = http.CanonicalHeaderKey(m.headers[i].name)
+	}
+	if m.query, err = compileValueMatchers("query", match.Query); err != nil {
+		return nil, err
+	}
+	if m.cookies, err = compileValueMatchers("cookie", match.Cookies); err != nil {
+		return nil, err
+	}
+
+	for _, cidr := range match.SourceCIDRs {
+		network, err := clientip.ParseNetwork(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source CIDR: %w", err)
+		}
+		m.networks = append(m.networks, network)
+	}
+
+	m.clientCert = match.ClientCert
+
+	return m, nil
+}
+
+func compileValueMatchers(kind string, cfgs []config.ValueMatchConfig) ([]valueMatcher, error) {
+	matchers := make([]valueMatcher, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("%s match requires a name", kind)
+		}
+
+		vm := valueMatcher{name: cfg.Name, value: cfg.Value}
+		if cfg.Regex != "" {
+			re, err := regexp.Compile(cfg.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %s regex %q: %w", kind, cfg.Name, cfg.Regex, err)
+			}
+			vm.re = re
+		}
+		matchers = append(matchers, vm)
+	}
+
+	return matchers, nil
+}
+
+// Match reports whether the request meets the path and all match rules.
+func (m *RouteMatcher) Match(r *http.Request) bool {
+	if !m.matchPath(r.URL.Path) {
+		return false
+	}
+
+	if m.methods != nil && !m.methods[r.Method] {
+		return false
+	}
+
+	for _, h := range m.headers {
+		if !h.matchAny(r.Header.Values(h.name)) {
+			return false
+		}
+	}
+
+	if len(m.query) > 0 {
+		query := r.URL.Query()
+		for _, q := range m.query {
+			if !q.matchAny(query[q.name]) {
+				return false
+			}
+		}
+	}
+
+	for _, c := range m.cookies {
+		cookie, err := r.Cookie(c.name)
+		if err != nil || !c.matchAny([]string{cookie.Value}) {
+			return false
+		}
+	}
+
+	if len(m.networks) > 0 && !m.matchSource(clientip.FromRequest(r)) {
+		return false
+	}
+
+	if m.clientCert != nil {
+		cert := certmanager.PeerCertificate(r)
+		if cert == nil || !certmanager.MatchIdentity(cert, m.clientCert.Subjects, m.clientCert.SANs) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m *RouteMatcher) matchPath(path string) bool {
+	switch m.pathType {
+	case PathExact:
+		return path == m.path
+	case PathRegex:
+		return m.pathRe.MatchString(path)
+	default:
+		return strings.HasPrefix(path, m.path)
+	}
+}
+
+func (m *RouteMatcher) matchSource(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range m.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchAny reports whether any of the values satisfies the matcher.
+func (vm valueMatcher) matchAny(values []string) bool {
+	if len(values) == 0 {
+		return false
+	}
+
+	for _, v := range values {
+		switch {
+		case vm.re != nil:
+			if vm.re.MatchString(v) {
+				return true
+			}
+		case vm.value != "":
+			if v == vm.value {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+
+	return false
+}
+
+// conditions returns the number of match rules besides the path.
+func (m *RouteMatcher) conditions() int {
+	n := len(m.headers) + len(m.query) + len(m.cookies)
+	if m.methods != nil {
+		n++
+	}
+	if len(m.networks) > 0 {
+		n++
+	}
+	if m.clientCert != nil {
+		n++
+	}
+	return n
+}
+
+// pathRank orders path types like nginx does: exact paths first, then regular expressions, then prefixes.
+func (m *RouteMatcher) pathRank() int {
+	switch m.pathType {
+	case PathExact:
+		return 2
+	case PathRegex:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// sortRoutes orders locations in the order they are matched:
+// higher priority first, then exact paths, regular expressions and longer prefixes,
+// and finally locations with more match rules. Ties keep the configuration order.
+func sortRoutes(locations []*LocationInfo) []*LocationInfo {
+	routes := make([]*LocationInfo, len(locations))
+	copy(routes, locations)
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i].matcher, routes[j].matcher
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+		if a.pathRank() != b.pathRank() {
+			return a.pathRank() > b.pathRank()
+		}
+		if a.pathType == PathPrefix && len(a.path) != len(b.path) {
+			return len(a.path) > len(b.path)
+		}
+		return a.conditions() > b.conditions()
+	})
+
+	return routes
+}
+
+// proxyPath returns the path prefix stripped from requests proxied by the location.
+func proxyPath(location config.Location) string {
+	if strings.EqualFold(location.PathType, PathRegex) {
+		return "/"
+	}
+	return location.Path
+}
+
+// routeKey identifies the path and match rules of a location. Locations with the same key can never both match.
+func routeKey(location config.Location) string {
+	pathType := strings.ToLower(location.PathType)
+	if pathType == "" {
+		pathType = PathPrefix
+	}
+
+	var match config.MatchConfig
+	if location.Match != nil {
+		match = *location.Match
+	}
+
+	// The client certificate rule is a pointer, its fields are what distinguishes locations
+	clientCert := "-"
+	if match.ClientCert != nil {
+		clientCert = fmt.Sprintf("%+v", *match.ClientCert)
+		match.ClientCert = nil
+	}
+
+	return fmt.Sprintf("%s %s %+v %s", pathType, location.Path, match, clientCert)
+}
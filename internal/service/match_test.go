@@ -0,0 +1,324 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+	"github.com/unkn0wn-root/terraster/pkg/clientip"
+)
+
+// request builds a request for the target, modified by the options.
+func request(method, target string, opts ...func(*http.Request)) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+func withHeader(name, value string) func(*http.Request) {
+	return func(r *http.Request) { r.Header.Add(name, value) }
+}
+
+func withCookie(name, value string) func(*http.Request) {
+	return func(r *http.Request) { r.AddCookie(&http.Cookie{Name: name, Value: value}) }
+}
+
+func withClientIP(ip string) func(*http.Request) {
+	return func(r *http.Request) {
+		*r = *r.WithContext(clientip.NewContext(r.Context(), ip))
+	}
+}
+
+func TestRouteMatcher(t *testing.T) {
+	tests := []struct {
+		name     string
+		location config.Location
+		req      *http.Request
+		want     bool
+	}{
+		{
+			name:     "prefix",
+			location: config.Location{Path: "/api"},
+			req:      request(http.MethodGet, "/api/users"),
+			want:     true,
+		},
+		{
+			name:     "prefix mismatch",
+			location: config.Location{Path: "/api"},
+			req:      request(http.MethodGet, "/web"),
+		},
+		{
+			name:     "exact",
+			location: config.Location{Path: "/health", PathType: "exact"},
+			req:      request(http.MethodGet, "/health"),
+			want:     true,
+		},
+		{
+			name:     "exact does not match longer paths",
+			location: config.Location{Path: "/health", PathType: "exact"},
+			req:      request(http.MethodGet, "/health/live"),
+		},
+		{
+			name:     "regex",
+			location: config.Location{Path: `^/users/[0-9]+$`, PathType: "regex"},
+			req:      request(http.MethodGet, "/users/42"),
+			want:     true,
+		},
+		{
+			name:     "regex mismatch",
+			location: config.Location{Path: `^/users/[0-9]+$`, PathType: "regex"},
+			req:      request(http.MethodGet, "/users/me"),
+		},
+		{
+			name:     "path type is case insensitive",
+			location: config.Location{Path: "/health", PathType: "EXACT"},
+			req:      request(http.MethodGet, "/health/live"),
+		},
+		{
+			name:     "method",
+			location: config.Location{Path: "/", Match: &config.MatchConfig{Methods: []string{"get", "HEAD"}}},
+			req:      request(http.MethodGet, "/"),
+			want:     true,
+		},
+		{
+			name:     "method mismatch",
+			location: config.Location{Path: "/", Match: &config.MatchConfig{Methods: []string{"GET"}}},
+			req:      request(http.MethodPost, "/"),
+		},
+		{
+			name: "header value",
+			location: config.Location{Path: "/", Match: &config.MatchConfig{
+				Headers: []config.ValueMatchConfig{{Name: "x-version", Value: "2"}},
+			}},
+			req:  request(http.MethodGet, "/", withHeader("X-Version", "1"), withHeader("X-Version", "2")),
+			want: true,
+		},
+		{
+			name: "header value mismatch",
+			location: config.Location{Path: "/", Match: &config.MatchConfig{
+				Headers: []config.ValueMatchConfig{{Name: "X-Version", Value: "2"}},
+			}},
+			req: request(http.MethodGet, "/", withHeader("X-Version", "20")),
+		},
+		{
+			name: "header regex",
+			location: config.Location{Path: "/", Match: &config.MatchConfig{
+				Headers: []config.ValueMatchConfig{{Name: "User-Agent", Regex: "(?i)mobile"}},
+			}},
+			req:  request(http.MethodGet, "/", withHeader("User-Agent", "Foo Mobile Safari")),
+			want: true,
+		},
+		{
+			name: "header presence",
+			location: config.Location{Path: "/", Match: &config.MatchConfig{
+				Headers: []config.ValueMatchConfig{{Name: "Authorization"}},
+			}},
+			req:  request(http.MethodGet, "/", withHeader("Authorization", "Bearer x")),
+			want: true,
+		},
+		{
+			name: "missing header",
+			location: config.Location{Path: "/", Match: &config.MatchConfig{
+				Headers: []config.ValueMatchConfig{{Name: "Authorization"}},
+			}},
+			req: request(http.MethodGet, "/"),
+		},
+		{
+			name: "query",
+			location: config.Location{Path: "/", Match: &config.MatchConfig{
+				Query: []config.ValueMatchConfig{{Name: "beta", Value: "1"}},
+			}},
+			req:  request(http.MethodGet, "/?beta=1"),
+			want: true,
+		},
+		{
+			name: "query mismatch",
+			location: config.Location{Path: "/", Match: &config.MatchConfig{
+				Query: []config.ValueMatchConfig{{Name: "beta", Value: "1"}},
+			}},
+			req: request(http.MethodGet, "/?beta=0"),
+		},
+		{
+			name: "cookie",
+			location: config.Location{Path: "/", Match: &config.MatchConfig{
+				Cookies: []config.ValueMatchConfig{{Name: "canary", Regex: "^(yes|true)$"}},
+			}},
+			req:  request(http.MethodGet, "/", withCookie("canary", "true")),
+			want: true,
+		},
+		{
+			name: "missing cookie",
+			location: config.Location{Path: "/", Match: &config.MatchConfig{
+				Cookies: []config.ValueMatchConfig{{Name: "canary"}},
+			}},
+			req: request(http.MethodGet, "/", withCookie("session", "1")),
+		},
+		{
+			name: "source cidr of the resolved client ip",
+			location: config.Location{Path: "/", Match: &config.MatchConfig{
+				SourceCIDRs: []string{"10.0.0.0/8", "192.168.1.7"},
+			}},
+			req:  request(http.MethodGet, "/", withClientIP("10.1.2.3")),
+			want: true,
+		},
+		{
+			name: "source single host",
+			location: config.Location{Path: "/", Match: &config.MatchConfig{
+				SourceCIDRs: []string{"10.0.0.0/8", "192.168.1.7"},
+			}},
+			req:  request(http.MethodGet, "/", withClientIP("192.168.1.7")),
+			want: true,
+		},
+		{
+			name: "source outside the networks",
+			location: config.Location{Path: "/", Match: &config.MatchConfig{
+				SourceCIDRs: []string{"10.0.0.0/8"},
+			}},
+			req: request(http.MethodGet, "/", withClientIP("203.0.113.9")),
+		},
+		{
+			name: "source falls back to the peer",
+			location: config.Location{Path: "/", Match: &config.MatchConfig{
+				SourceCIDRs: []string{"2001:db8::/32"},
+			}},
+			req: request(http.MethodGet, "/", func(r *http.Request) {
+				r.RemoteAddr = "[2001:db8::1]:4000"
+			}),
+			want: true,
+		},
+		{
+			name:     "client certificate required",
+			location: config.Location{Path: "/", Match: &config.MatchConfig{ClientCert: &config.ClientCertMatch{}}},
+			req:      request(http.MethodGet, "/"),
+		},
+		{
+			name: "all rules have to match",
+			location: config.Location{Path: "/api", Match: &config.MatchConfig{
+				Methods: []string{"POST"},
+				Headers: []config.ValueMatchConfig{{Name: "X-Version", Value: "2"}},
+			}},
+			req: request(http.MethodPost, "/api", withHeader("X-Version", "1")),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewRouteMatcher(tt.location)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.Match(tt.req); got != tt.want {
+				t.Fatalf("expected match %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNewRouteMatcherErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		location config.Location
+	}{
+		{name: "invalid path type", location: config.Location{Path: "/", PathType: "glob"}},
+		{name: "invalid path regex", location: config.Location{Path: "^/(", PathType: "regex"}},
+		{
+			name: "header without name",
+			location: config.Location{Path: "/", Match: &config.MatchConfig{
+				Headers: []config.ValueMatchConfig{{Value: "1"}},
+			}},
+		},
+		{
+			name: "invalid cookie regex",
+			location: config.Location{Path: "/", Match: &config.MatchConfig{
+				Cookies: []config.ValueMatchConfig{{Name: "a", Regex: "("}},
+			}},
+		},
+		{
+			name: "invalid source cidr",
+			location: config.Location{Path: "/", Match: &config.MatchConfig{
+				SourceCIDRs: []string{"10.0.0.0/40"},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewRouteMatcher(tt.location); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestMatchLocationOrder(t *testing.T) {
+	// Locations are listed in an order different from the match order.
+	locations := []config.Location{
+		{Path: "/"},
+		{Path: "/api"},
+		{Path: "/api/v2"},
+		{Path: "/api", Match: &config.MatchConfig{Headers: []config.ValueMatchConfig{{Name: "X-Canary"}}}},
+		{Path: `^/api/v[0-9]+/status$`, PathType: "regex"},
+		{Path: "/api/v2/status", PathType: "exact"},
+		{Path: "/admin", Priority: -1},
+		{Path: "/", Priority: 10, Match: &config.MatchConfig{Query: []config.ValueMatchConfig{{Name: "debug"}}}},
+	}
+
+	svc := &ServiceInfo{}
+	for i, location := range locations {
+		matcher, err := NewRouteMatcher(location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		svc.Locations = append(svc.Locations, &LocationInfo{Path: location.Path, matcher: matcher, cfg: locations[i]})
+	}
+	svc.routes = sortRoutes(svc.Locations)
+
+	tests := []struct {
+		req  *http.Request
+		want int // Index of the matching location.
+	}{
+		{req: request(http.MethodGet, "/"), want: 0},
+		{req: request(http.MethodGet, "/api/users"), want: 1},
+		{req: request(http.MethodGet, "/api/users", withHeader("X-Canary", "1")), want: 3},
+		{req: request(http.MethodGet, "/api/v2/users"), want: 2},
+		{req: request(http.MethodGet, "/api/v2/status"), want: 5},
+		{req: request(http.MethodGet, "/api/v3/status"), want: 4},
+		{req: request(http.MethodGet, "/admin"), want: 0},
+		{req: request(http.MethodGet, "/api/v2/status?debug=1"), want: 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.req.URL.String(), func(t *testing.T) {
+			got := svc.MatchLocation(tt.req)
+			if got != svc.Locations[tt.want] {
+				t.Fatalf("expected location %d (%s), got %+v", tt.want, locations[tt.want].Path, got.cfg)
+			}
+		})
+	}
+}
+
+func TestRouteKey(t *testing.T) {
+	base := config.Location{Path: "/api", Match: &config.MatchConfig{ClientCert: &config.ClientCertMatch{SANs: []string{"a"}}}}
+
+	same := base
+	same.Match = &config.MatchConfig{ClientCert: &config.ClientCertMatch{SANs: []string{"a"}}}
+	same.Backends = []config.BackendConfig{{URL: "http://127.0.0.1:8080"}}
+	if routeKey(base) != routeKey(same) {
+		t.Fatal("expected locations with equal path and match rules to have the same key")
+	}
+
+	other := base
+	other.Match = &config.MatchConfig{ClientCert: &config.ClientCertMatch{SANs: []string{"b"}}}
+	if routeKey(base) == routeKey(other) {
+		t.Fatal("expected locations with different client certificate rules to have different keys")
+	}
+
+	exact := base
+	exact.PathType = "exact"
+	if routeKey(base) == routeKey(exact) {
+		t.Fatal("expected locations with different path types to have different keys")
+	}
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"github.com/unkn0wn-root/terraster/pkg/metrics"
+)
+
+// backendSeries identifies the gauges exported for a backend of a location.
+type backendSeries struct {
+	service  string
+	location string
+	backend  string
+}
+
+// backendMetricSeries returns the series of all backends of the services, including backends of mirror pools.
+func backendMetricSeries(services map[string]*ServiceInfo) map[backendSeries]bool {
+	series := make(map[backendSeries]bool)
+	for _, svc := range services {
+		for _, loc := range svc.Locations {
+			pools := loc.Pools()
+			if loc.Mirror != nil {
+				pools = append(pools, loc.Mirror.Pool)
+			}
+			for _, p := range pools {
+				for _, b := range p.GetAllBackends() {
+					series[backendSeries{service: svc.Name, location: loc.Path, backend: b.URL.String()}] = true
+				}
+			}
+		}
+	}
+	return series
+}
+
+// deleteStaleMetrics removes gauges of backends which are no longer part of any service,
+// so that their last value (e.g. backend_up 1) is not exported forever.
+func deleteStaleMetrics(prev, next map[string]*ServiceInfo) {
+	current := backendMetricSeries(next)
+	backends := make(map[string]bool)
+	serviceBackends := make(map[[2]string]bool)
+	for s := range current {
+		backends[s.backend] = true
+		serviceBackends[[2]string{s.service, s.backend}] = true
+	}
+
+	for s := range backendMetricSeries(prev) {
+		if !current[s] {
+			metrics.ActiveConnections.DeleteLabelValues(s.service, s.location, s.backend)
+		}
+		if !serviceBackends[[2]string{s.service, s.backend}] {
+			metrics.BackendUp.DeleteLabelValues(s.service, s.backend)
+			metrics.CircuitBreakerState.DeleteLabelValues(s.service, s.backend)
+		}
+		if !backends[s.backend] {
+			metrics.BackendEjected.DeleteLabelValues(s.backend)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+	"github.com/unkn0wn-root/terraster/internal/pool"
+	"github.com/unkn0wn-root/terraster/pkg/algorithm"
+)
+
+// TrafficSplit distributes the requests of a location across its backend groups by weight.
+// Weights can be changed at runtime, e.g. to shift traffic to a canary release step by step.
+type TrafficSplit struct {
+	groups    []*LocationInfo
+	weights   []atomic.Int32
+	key       algorithm.HashKey
+	stickyKey bool // Whether clients are assigned to groups by hashing the key instead of at random.
+}
+
+// GroupWeight is the traffic weight of a backend group.
+type GroupWeight struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+}
+
+// newTrafficSplit validates the backend groups of a location and prepares their weights.
+func newTrafficSplit(location config.Location) (*TrafficSplit, error) {
+	s := &TrafficSplit{weights: make([]atomic.Int32, len(location.Groups))}
+
+	names := make(map[string]bool, len(location.Groups))
+	total := 0
+	for i, group := range location.Groups {
+		if group.Name == "" {
+			return nil, errors.New("backend group requires a name")
+		}
+		if names[group.Name] {
+			return nil, fmt.Errorf("duplicate backend group %s", group.Name)
+		}
+		names[group.Name] = true
+
+		if len(group.Backends) == 0 {
+			return nil, fmt.Errorf("backend group %s: no backends defined", group.Name)
+		}
+		if group.Weight < 0 {
+			return nil, fmt.Errorf("backend group %s: weight must not be negative", group.Name)
+		}
+
+		s.weights[i].Store(int32(group.Weight))
+		total += group.Weight
+	}
+
+	if total == 0 {
+		return nil, errors.New("at least one backend group needs a positive weight")
+	}
+
+	if location.Split != nil && location.Split.StickyKey != "" {
+		key, err := algorithm.ParseHashKey(location.Split.StickyKey)
+		if err != nil {
+			return nil, err
+		}
+		s.key = key
+		s.stickyKey = true
+	}
+
+	return s, nil
+}
+
+// createGroups builds a pool and algorithm per backend group of the location.
+// Groups inherit the location's lb_policy and hash options unless they set their own.
+// The location itself points to the first group, so code unaware of groups keeps working.
+// The pools of groups the previous location had are built from its pools, see createServerPool.
+func (m *Manager) createGroups(
+	loc *LocationInfo,
+	location config.Location,
+	hcCfg *config.HealthCheckConfig,
+	prev *LocationInfo,
+) error {
+	split, err := newTrafficSplit(location)
+	if err != nil {
+		return err
+	}
+
+	for _, group := range location.Groups {
+		groupCfg := location
+		groupCfg.Groups = nil
+		groupCfg.Backends = group.Backends
+		if group.LoadBalancer != "" {
+			groupCfg.LoadBalancer = group.LoadBalancer
+		}
+		if group.Hash != nil {
+			groupCfg.Hash = group.Hash
+		}
+
+		algo, serverPool, err := m.createBackends(groupCfg, hcCfg, prev.groupPool(group.Name))
+		if err != nil {
+			return fmt.Errorf("backend group %s: %w", group.Name, err)
+		}
+
+		view := *loc
+		view.Group = group.Name
+		view.Algorithm = algo
+		view.ServerPool = serverPool
+		loc.Groups = append(loc.Groups, &view)
+	}
+
+	split.groups = loc.Groups
+	loc.split = split
+	loc.Algorithm = loc.Groups[0].Algorithm
+	loc.ServerPool = loc.Groups[0].ServerPool
+
+	return nil
+}
+
+// SelectGroup returns the backend group which handles the request.
+// Returns the location itself if it has no backend groups.
+func (l *LocationInfo) SelectGroup(r *http.Request) *LocationInfo {
+	if l.split == nil {
+		return l
+	}
+	return l.split.selectGroup(r)
+}
+
+// Pools returns the server pools of the location, one per backend group.
+func (l *LocationInfo) Pools() []*pool.ServerPool {
+	if len(l.Groups) == 0 {
+		return []*pool.ServerPool{l.ServerPool}
+	}
+
+	pools := make([]*pool.ServerPool, 0, len(l.Groups))
+	for _, group := range l.Groups {
+		pools = append(pools, group.ServerPool)
+	}
+	return pools
+}
+
+// GroupWeights returns the current traffic weights of the backend groups.
+func (l *LocationInfo) GroupWeights() []GroupWeight {
+	if l.split == nil {
+		return nil
+	}
+
+	weights := make([]GroupWeight, len(l.split.groups))
+	for i, group := range l.split.groups {
+		weights[i] = GroupWeight{Name: group.Group, Weight: int(l.split.weights[i].Load())}
+	}
+	return weights
+}
+
+// SetGroupWeights changes the traffic weights of the named backend groups.
+// Groups which are not mentioned keep their weight. The update is rejected as a whole
+// if a group is unknown, a weight is negative or all weights would be zero.
+func (l *LocationInfo) SetGroupWeights(weights map[string]int) error {
+	if l.split == nil {
+		return errors.New("location has no backend groups")
+	}
+
+	updated := make([]int32, len(l.split.groups))
+	for i := range l.split.groups {
+		updated[i] = l.split.weights[i].Load()
+	}
+
+	for name, weight := range weights {
+		if weight < 0 {
+			return fmt.Errorf("backend group %s: weight must not be negative", name)
+		}
+
+		found := false
+		for i, group := range l.split.groups {
+			if group.Group == name {
+				updated[i] = int32(weight)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("backend group %s not found", name)
+		}
+	}
+
+	var total int32
+	for _, weight := range updated {
+		total += weight
+	}
+	if total == 0 {
+		return errors.New("at least one backend group needs a positive weight")
+	}
+
+	for i, weight := range updated {
+		l.split.weights[i].Store(weight)
+	}
+
+	return nil
+}
+
+// selectGroup picks a group proportional to the weights.
+// With a sticky key, the key is hashed to a point in [0, total) so a client keeps its group
+// while weights stay the same. Shifting weight from one group to its neighbour only moves
+// clients between those two groups.
+// Groups without alive backends are skipped as long as another group can take the request.
+func (s *TrafficSplit) selectGroup(r *http.Request) *LocationInfo {
+	var total int64
+	weights := make([]int64, len(s.groups))
+	for i := range s.groups {
+		weights[i] = int64(s.weights[i].Load())
+		total += weights[i]
+	}
+
+	var point int64
+	if s.stickyKey {
+		// Scale the hash to [0, total) rather than taking the modulo, so the point moves
+		// proportionally instead of jumping when the total weight changes.
+		hi, _ := bits.Mul64(s.key.Hash(r), uint64(total))
+		point = int64(hi)
+	} else {
+		point = rand.Int63n(total)
+	}
+
+	selected := 0
+	for i, weight := range weights {
+		if point < weight {
+			selected = i
+			break
+		}
+		point -= weight
+	}
+
+	if hasAliveBackend(s.groups[selected].ServerPool) {
+		return s.groups[selected]
+	}
+
+	for i, group := range s.groups {
+		if i != selected && weights[i] > 0 && hasAliveBackend(group.ServerPool) {
+			return group
+		}
+	}
+
+	return s.groups[selected]
+}
+
+func hasAliveBackend(p *pool.ServerPool) bool {
+	for _, backend := range p.GetAllBackends() {
+		if p.IsAvailable(backend) {
+			return true
+		}
+	}
+	return false
+}
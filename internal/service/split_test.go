@@ -0,0 +1,240 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+	"go.uber.org/zap"
+)
+
+// newTestManager returns an empty Manager which does not log.
+func newTestManager() *Manager {
+	return &Manager{services: make(map[string]*ServiceInfo), logger: zap.NewNop()}
+}
+
+// addTestService adds a service with the locations to the manager and returns it.
+func addTestService(t *testing.T, m *Manager, locations ...config.Location) *ServiceInfo {
+	t.Helper()
+
+	svc := config.Service{Name: "test", Host: "example.com", Port: 8080, Locations: locations}
+	if err := m.AddService(svc, config.DefaultHealthCheck.Copy()); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetServiceByName("test")
+}
+
+func splitLocation(weights ...int) config.Location {
+	location := config.Location{Path: "/"}
+	for i, weight := range weights {
+		location.Groups = append(location.Groups, config.BackendGroupConfig{
+			Name:     fmt.Sprintf("g%d", i),
+			Weight:   weight,
+			Backends: []config.BackendConfig{{URL: fmt.Sprintf("http://127.0.0.1:%d", 9000+i)}},
+		})
+	}
+	return location
+}
+
+func TestNewTrafficSplitErrors(t *testing.T) {
+	backends := []config.BackendConfig{{URL: "http://127.0.0.1:9000"}}
+
+	tests := []struct {
+		name   string
+		groups []config.BackendGroupConfig
+		split  *config.SplitConfig
+		want   string
+	}{
+		{
+			name:   "missing name",
+			groups: []config.BackendGroupConfig{{Weight: 1, Backends: backends}},
+			want:   "requires a name",
+		},
+		{
+			name: "duplicate name",
+			groups: []config.BackendGroupConfig{
+				{Name: "a", Weight: 1, Backends: backends},
+				{Name: "a", Weight: 1, Backends: backends},
+			},
+			want: "duplicate backend group a",
+		},
+		{
+			name:   "no backends",
+			groups: []config.BackendGroupConfig{{Name: "a", Weight: 1}},
+			want:   "no backends defined",
+		},
+		{
+			name:   "negative weight",
+			groups: []config.BackendGroupConfig{{Name: "a", Weight: -1, Backends: backends}},
+			want:   "must not be negative",
+		},
+		{
+			name: "all weights zero",
+			groups: []config.BackendGroupConfig{
+				{Name: "a", Backends: backends},
+				{Name: "b", Backends: backends},
+			},
+			want: "positive weight",
+		},
+		{
+			name:   "invalid sticky key",
+			groups: []config.BackendGroupConfig{{Name: "a", Weight: 1, Backends: backends}},
+			split:  &config.SplitConfig{StickyKey: "header"},
+			want:   "requires a name",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newTrafficSplit(config.Location{Path: "/", Groups: tt.groups, Split: tt.split})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestTrafficSplitWeights(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+	}{
+		{name: "even", weights: []int{1, 1}},
+		{name: "canary", weights: []int{90, 10}},
+		{name: "three groups", weights: []int{50, 30, 20}},
+		{name: "paused group", weights: []int{0, 100}},
+	}
+
+	const requests = 20000
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc := addTestService(t, newTestManager(), splitLocation(tt.weights...)).Locations[0]
+
+			counts := make(map[string]int)
+			for i := 0; i < requests; i++ {
+				counts[loc.SelectGroup(request(http.MethodGet, "/")).Group]++
+			}
+
+			total := 0
+			for _, weight := range tt.weights {
+				total += weight
+			}
+			for i, weight := range tt.weights {
+				name := fmt.Sprintf("g%d", i)
+				want := float64(weight) / float64(total)
+				got := float64(counts[name]) / requests
+				if weight == 0 && counts[name] != 0 {
+					t.Fatalf("group %s without weight got %d requests", name, counts[name])
+				}
+				if got < want-0.02 || got > want+0.02 {
+					t.Errorf("group %s: expected share %.2f, got %.3f", name, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestTrafficSplitStickyKey(t *testing.T) {
+	location := splitLocation(50, 50)
+	location.Split = &config.SplitConfig{StickyKey: "header:X-User"}
+	loc := addTestService(t, newTestManager(), location).Locations[0]
+
+	assign := func() map[string]string {
+		groups := make(map[string]string)
+		for i := 0; i < 1000; i++ {
+			user := fmt.Sprintf("user-%d", i)
+			groups[user] = loc.SelectGroup(request(http.MethodGet, "/", withHeader("X-User", user))).Group
+		}
+		return groups
+	}
+
+	before := assign()
+	if again := assign(); fmt.Sprint(again) != fmt.Sprint(before) {
+		t.Fatal("expected clients to keep their group while weights are unchanged")
+	}
+
+	// Shifting weight to g0 only moves clients of g1 to g0.
+	if err := loc.SetGroupWeights(map[string]int{"g0": 70, "g1": 30}); err != nil {
+		t.Fatal(err)
+	}
+	after := assign()
+	moved := 0
+	for user, group := range after {
+		if before[user] == "g0" && group != "g0" {
+			t.Fatalf("client %s moved from g0 to %s", user, group)
+		}
+		if before[user] != group {
+			moved++
+		}
+	}
+	if moved < 100 || moved > 300 {
+		t.Fatalf("expected about 20%% of the clients to move, got %d of 1000", moved)
+	}
+}
+
+func TestTrafficSplitSkipsGroupsWithoutAliveBackends(t *testing.T) {
+	loc := addTestService(t, newTestManager(), splitLocation(100, 1)).Locations[0]
+
+	for _, backend := range loc.Groups[0].ServerPool.GetAllBackends() {
+		loc.Groups[0].ServerPool.MarkBackendStatus(backend.URL, false)
+	}
+
+	for i := 0; i < 100; i++ {
+		if group := loc.SelectGroup(request(http.MethodGet, "/")).Group; group != "g1" {
+			t.Fatalf("expected the group with alive backends, got %s", group)
+		}
+	}
+}
+
+func TestSetGroupWeights(t *testing.T) {
+	tests := []struct {
+		name    string
+		update  map[string]int
+		want    []GroupWeight
+		wantErr bool
+	}{
+		{
+			name:   "partial update",
+			update: map[string]int{"g1": 5},
+			want:   []GroupWeight{{Name: "g0", Weight: 90}, {Name: "g1", Weight: 5}},
+		},
+		{
+			name:   "pause a group",
+			update: map[string]int{"g0": 0, "g1": 100},
+			want:   []GroupWeight{{Name: "g0", Weight: 0}, {Name: "g1", Weight: 100}},
+		},
+		{name: "unknown group", update: map[string]int{"g0": 1, "g9": 1}, wantErr: true},
+		{name: "negative weight", update: map[string]int{"g0": -1}, wantErr: true},
+		{name: "all weights zero", update: map[string]int{"g0": 0, "g1": 0}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc := addTestService(t, newTestManager(), splitLocation(90, 10)).Locations[0]
+
+			err := loc.SetGroupWeights(tt.update)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+
+			want := tt.want
+			if tt.wantErr {
+				// Rejected updates leave all weights unchanged.
+				want = []GroupWeight{{Name: "g0", Weight: 90}, {Name: "g1", Weight: 10}}
+			}
+			if got := loc.GroupWeights(); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("expected weights %v, got %v", want, got)
+			}
+		})
+	}
+
+	loc := addTestService(t, newTestManager(), config.Location{
+		Path:     "/",
+		Backends: []config.BackendConfig{{URL: "http://127.0.0.1:9000"}},
+	}).Locations[0]
+	if err := loc.SetGroupWeights(map[string]int{"g0": 1}); err == nil {
+		t.Fatal("expected an error for a location without groups")
+	}
+}
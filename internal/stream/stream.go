@@ -0,0 +1,76 @@
+// Package stream implements layer 4 load balancing. Connections (tcp) and datagrams (udp)
+// of a service are forwarded as they are to the backends of its location, selected by the
+// location's load balancing algorithm.
+package stream
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/internal/pool"
+	"github.com/unkn0wn-root/terraster/internal/service"
+)
+
+// Defaults applied to stream options which are not set.
+const (
+	DefaultConnectTimeout = 5 * time.Second
+	DefaultTCPIdleTimeout = 10 * time.Minute
+	DefaultUDPIdleTimeout = 30 * time.Second
+	DefaultMaxSessions    = 10000
+)
+
+var (
+	errNoBackend      = errors.New("no backend available")
+	errBackendsFailed = errors.New("all backends failed")
+)
+
+// bufferPool provides the buffers used for copying tcp connections.
+var bufferPool = pool.NewBufferPool()
+
+// location returns the single location of a layer 4 service.
+func location(svc *service.ServiceInfo) *service.LocationInfo {
+	if len(svc.Locations) == 0 {
+		return nil
+	}
+	return svc.Locations[0]
+}
+
+// clientRequest builds the request handed to load balancing algorithms. Layer 4 traffic has no HTTP request,
+// but the client address lets ip based algorithms (ip-hash, consistent-hash) keep a client on the same backend.
+func clientRequest(addr net.Addr) *http.Request {
+	return &http.Request{
+		RemoteAddr: addr.String(),
+		Header:     make(http.Header),
+		URL:        &url.URL{},
+	}
+}
+
+// acquire admits a connection or session to the backend. It takes a probe slot of the backend's circuit
+// and counts the connection against MaxConnections. Returns false if the backend must not be used.
+// Every acquired backend has to be released with release.
+func acquire(p *pool.ServerPool, b *pool.Backend) bool {
+	if !p.AcquireCircuit(b) {
+		return false
+	}
+	if !b.IncrementConnections() {
+		p.ReleaseCircuit(b)
+		return false
+	}
+	return true
+}
+
+// release gives back the connection slot of the backend.
+func release(b *pool.Backend) {
+	b.DecrementConnections()
+}
+
+// orDefault returns d if v is not set.
+func orDefault[T int | time.Duration](v, d T) T {
+	if v <= 0 {
+		return d
+	}
+	return v
+}
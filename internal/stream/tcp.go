@@ -0,0 +1,296 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/internal/pool"
+	"github.com/unkn0wn-root/terraster/internal/service"
+	"github.com/unkn0wn-root/terraster/pkg/metrics"
+	"github.com/unkn0wn-root/terraster/pkg/proxyproto"
+	"go.uber.org/zap"
+)
+
+// TCPProxy forwards tcp connections accepted on the port of a service to its backends.
+// Each client connection is spliced to a connection to one backend until either side closes it
+// or no data was sent in either direction for the idle timeout.
+type TCPProxy struct {
+	listener net.Listener
+	service  atomic.Pointer[service.ServiceInfo]
+	logger   *zap.Logger
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewTCPProxy creates a proxy for the service serving connections accepted by the listener.
+// The listener is nil for proxies which are only handed connections through ServeConn, e.g. for TLS passthrough.
+func NewTCPProxy(listener net.Listener, svc *service.ServiceInfo, logger *zap.Logger) *TCPProxy {
+	p := &TCPProxy{
+		listener: listener,
+		logger:   logger,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	p.service.Store(svc)
+	return p
+}
+
+// Update replaces the service after a configuration reload. Established connections are not affected.
+func (p *TCPProxy) Update(svc *service.ServiceInfo) {
+	p.service.Store(svc)
+}
+
+// Serve accepts connections until the proxy is shut down. It returns net.ErrClosed after Shutdown.
+func (p *TCPProxy) Serve() error {
+	var delay time.Duration
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return net.ErrClosed
+			}
+			// Back off on other errors, e.g. too many open files, like net/http does
+			delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+			p.logger.Warn("Failed to accept tcp connection", zap.Error(err), zap.Duration("retry_in", delay))
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		if !p.track(conn, true) {
+			conn.Close()
+			return net.ErrClosed
+		}
+
+		go func() {
+			defer p.track(conn, false)
+			p.handle(conn)
+		}()
+	}
+}
+
+// ServeConn forwards a connection accepted elsewhere to a backend and returns once it is done.
+// The connection is closed right away if the proxy is shut down.
+func (p *TCPProxy) ServeConn(conn net.Conn) {
+	if !p.track(conn, true) {
+		conn.Close()
+		return
+	}
+
+	defer p.track(conn, false)
+	p.handle(conn)
+}
+
+// Shutdown stops accepting connections and waits for established connections to finish
+// until the context is done. Remaining connections are closed then.
+func (p *TCPProxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	var err error
+	if p.listener != nil {
+		err = p.listener.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		p.mu.Lock()
+		for conn := range p.conns {
+			conn.Close()
+		}
+		p.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// track adds or removes a client connection. Returns false if the proxy is shut down.
+// Connections are counted in the wait group under the lock, so Shutdown never waits while one is added.
+func (p *TCPProxy) track(conn net.Conn, add bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !add {
+		delete(p.conns, conn)
+		p.wg.Done()
+		return true
+	}
+	if p.closed {
+		return false
+	}
+	p.conns[conn] = struct{}{}
+	p.wg.Add(1)
+	return true
+}
+
+// handle connects the client to a backend and forwards data in both directions.
+func (p *TCPProxy) handle(client net.Conn) {
+	defer client.Close()
+
+	svc := p.service.Load()
+	loc := location(svc)
+	if loc == nil {
+		return
+	}
+
+	backend, upstream, err := p.dial(svc, loc, client)
+	if err != nil {
+		p.logger.Warn("Failed to connect client to a backend",
+			zap.String("service", svc.Name),
+			zap.String("client", client.RemoteAddr().String()),
+			zap.Error(err))
+		return
+	}
+	defer release(backend)
+	defer upstream.Close()
+
+	backendURL := backend.URL.String()
+	active := metrics.ActiveConnections.WithLabelValues(svc.Name, loc.Path, backendURL)
+	active.Inc()
+	defer active.Dec()
+
+	idle := orDefault(svc.Stream.IdleTimeout, DefaultTCPIdleTimeout)
+	sent, received := splice(client, upstream, idle)
+
+	metrics.RequestBytes.WithLabelValues(svc.Name, loc.Path, backendURL).Add(float64(sent))
+	metrics.ResponseBytes.WithLabelValues(svc.Name, loc.Path, backendURL).Add(float64(received))
+}
+
+// dial connects to a backend selected by the location's algorithm.
+// Backends which fail to accept the connection are reported and the next one is tried.
+// Backends expecting the PROXY protocol are sent the addresses of the client connection first.
+// The returned backend has been acquired and must be released once the connection is done.
+func (p *TCPProxy) dial(svc *service.ServiceInfo, loc *service.LocationInfo, client net.Conn) (*pool.Backend, net.Conn, error) {
+	r := clientRequest(client.RemoteAddr())
+	dialer := net.Dialer{
+		Timeout:   orDefault(svc.Stream.ConnectTimeout, DefaultConnectTimeout),
+		KeepAlive: 30 * time.Second,
+	}
+
+	tried := make(map[*pool.Backend]bool)
+	err := errNoBackend
+	for {
+		backend := loc.NextUntried(r, tried)
+		if backend == nil {
+			return nil, nil, err
+		}
+		tried[backend] = true
+
+		if !acquire(loc.ServerPool, backend) {
+			continue
+		}
+
+		conn, dialErr := dialer.Dial("tcp", backend.URL.Host)
+		if dialErr == nil && backend.ProxyProtocol != "" {
+			if dialErr = proxyproto.WriteHeader(conn, backend.ProxyProtocol, client.RemoteAddr(), client.LocalAddr()); dialErr != nil {
+				conn.Close()
+			}
+		}
+		loc.ServerPool.ReportResult(backend, dialErr != nil)
+		if dialErr == nil {
+			return backend, conn, nil
+		}
+
+		release(backend)
+		err = errBackendsFailed
+		p.logger.Warn("Failed to connect to backend",
+			zap.String("service", svc.Name),
+			zap.String("backend", backend.URL.String()),
+			zap.Error(dialErr))
+	}
+}
+
+// splice copies data between the client and the backend in both directions.
+// When one side finishes sending, the write side of the other connection is closed so that half-closed
+// connections keep working. Both connections are closed once no data was sent in either direction
+// for the idle timeout. Returns the number of bytes sent to the backend and received from it.
+func splice(client, upstream net.Conn, idle time.Duration) (sent, received int64) {
+	var lastActivity atomic.Int64
+	lastActivity.Store(time.Now().UnixNano())
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		received = copyIdle(client, upstream, idle, &lastActivity)
+	}()
+	sent = copyIdle(upstream, client, idle, &lastActivity)
+	wg.Wait()
+
+	return sent, received
+}
+
+// copyIdle copies from src to dst until src is done or the connection is idle.
+// On an idle timeout both connections are closed so that the other direction stops as well.
+func copyIdle(dst, src net.Conn, idle time.Duration, lastActivity *atomic.Int64) int64 {
+	buf := bufferPool.Get()
+	defer bufferPool.Put(buf)
+
+	var written int64
+	for {
+		src.SetReadDeadline(time.Now().Add(idle))
+		n, err := src.Read(buf)
+		if n > 0 {
+			lastActivity.Store(time.Now().UnixNano())
+			dst.SetWriteDeadline(time.Now().Add(idle))
+			m, werr := dst.Write(buf[:n])
+			written += int64(m)
+			if werr != nil {
+				src.Close()
+				dst.Close()
+				return written
+			}
+		}
+		if err == nil {
+			continue
+		}
+
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			// The other direction may have been active in the meantime
+			if time.Since(time.Unix(0, lastActivity.Load())) < idle {
+				continue
+			}
+			src.Close()
+			dst.Close()
+			return written
+		}
+
+		if errors.Is(err, io.EOF) {
+			closeWrite(dst)
+		} else {
+			src.Close()
+			dst.Close()
+		}
+		return written
+	}
+}
+
+// closeWrite signals the end of data to the peer while the other direction stays open.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
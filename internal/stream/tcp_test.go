@@ -0,0 +1,254 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+	"github.com/unkn0wn-root/terraster/internal/service"
+	"github.com/unkn0wn-root/terraster/pkg/proxyproto"
+	"go.uber.org/zap"
+)
+
+// newStreamService builds a layer 4 service of the protocol forwarding to the backends.
+func newStreamService(t *testing.T, protocol string, stream config.StreamConfig, backends ...config.BackendConfig) *service.ServiceInfo {
+	t.Helper()
+
+	m, err := service.NewManager(&config.Config{Services: []config.Service{{
+		Name:      "stream",
+		Port:      9000,
+		Protocol:  protocol,
+		Stream:    &stream,
+		Locations: []config.Location{{Path: "/", LoadBalancer: "round-robin", Backends: backends}},
+	}}}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.GetServiceByName("stream")
+}
+
+// startTCPBackend serves each connection accepted on a local port with handle and returns the backend URL.
+func startTCPBackend(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+
+	return "tcp://" + ln.Addr().String()
+}
+
+// echo writes back everything it reads until the client finished sending.
+func echo(conn net.Conn) {
+	io.Copy(conn, conn)
+}
+
+// startTCPProxy serves the service on a local port and returns the address of the proxy.
+func startTCPProxy(t *testing.T, svc *service.ServiceInfo) (*TCPProxy, string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewTCPProxy(ln, svc, zap.NewNop())
+	go p.Serve()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		p.Shutdown(ctx)
+	})
+
+	return p, ln.Addr().String()
+}
+
+func dialProxy(t *testing.T, addr string) *net.TCPConn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn.(*net.TCPConn)
+}
+
+func TestTCPProxyHalfClose(t *testing.T) {
+	svc := newStreamService(t, config.ProtocolTCP, config.StreamConfig{}, config.BackendConfig{URL: startTCPBackend(t, echo)})
+	_, addr := startTCPProxy(t, svc)
+
+	conn := dialProxy(t, addr)
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	// The backend only finishes its reply once it saw the end of the request.
+	conn.CloseWrite()
+
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "hello" {
+		t.Fatalf("expected the echo, got %q", reply)
+	}
+}
+
+func TestTCPProxyIdleTimeout(t *testing.T) {
+	const idle = 100 * time.Millisecond
+	svc := newStreamService(t, config.ProtocolTCP, config.StreamConfig{IdleTimeout: idle}, config.BackendConfig{URL: startTCPBackend(t, echo)})
+	_, addr := startTCPProxy(t, svc)
+
+	t.Run("active connection stays open", func(t *testing.T) {
+		conn := dialProxy(t, addr)
+		r := bufio.NewReader(conn)
+		for i := 0; i < 6; i++ {
+			if _, err := conn.Write([]byte("ping\n")); err != nil {
+				t.Fatal(err)
+			}
+			if line, err := r.ReadString('\n'); err != nil || line != "ping\n" {
+				t.Fatalf("expected the echo after %s, got %q, %v", time.Duration(i)*idle/2, line, err)
+			}
+			time.Sleep(idle / 2)
+		}
+	})
+
+	t.Run("one direction keeps the connection open", func(t *testing.T) {
+		// The backend only reads, the connection is active from client to backend.
+		url := startTCPBackend(t, func(conn net.Conn) { io.Copy(io.Discard, conn) })
+		svc := newStreamService(t, config.ProtocolTCP, config.StreamConfig{IdleTimeout: idle}, config.BackendConfig{URL: url})
+		_, addr := startTCPProxy(t, svc)
+
+		conn := dialProxy(t, addr)
+		for i := 0; i < 6; i++ {
+			if _, err := conn.Write([]byte("ping\n")); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(idle / 2)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(idle / 2))
+		if _, err := conn.Read(make([]byte, 1)); !isTimeout(err) {
+			t.Fatalf("expected the connection to be open, got %v", err)
+		}
+	})
+
+	t.Run("idle connection is closed", func(t *testing.T) {
+		conn := dialProxy(t, addr)
+		start := time.Now()
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("expected the proxy to close the connection, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < idle || elapsed > 10*idle {
+			t.Fatalf("expected the connection to be closed after %s, got %s", idle, elapsed)
+		}
+	})
+}
+
+func TestTCPProxyFailover(t *testing.T) {
+	// Nothing listens on the port of a closed listener.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "tcp://" + ln.Addr().String()
+	ln.Close()
+
+	svc := newStreamService(t, config.ProtocolTCP, config.StreamConfig{},
+		config.BackendConfig{URL: down},
+		config.BackendConfig{URL: startTCPBackend(t, echo)})
+	_, addr := startTCPProxy(t, svc)
+
+	for i := 0; i < 2; i++ {
+		conn := dialProxy(t, addr)
+		conn.Write([]byte("hello"))
+		conn.CloseWrite()
+		if reply, _ := io.ReadAll(conn); string(reply) != "hello" {
+			t.Fatalf("expected the connection to fail over to the second backend, got %q", reply)
+		}
+	}
+}
+
+func TestTCPProxyNoBackend(t *testing.T) {
+	svc := newStreamService(t, config.ProtocolTCP, config.StreamConfig{}, config.BackendConfig{URL: startTCPBackend(t, echo)})
+	loc := svc.Locations[0]
+	for _, b := range loc.ServerPool.GetAllBackends() {
+		loc.ServerPool.MarkBackendStatus(b.URL, false)
+	}
+	_, addr := startTCPProxy(t, svc)
+
+	conn := dialProxy(t, addr)
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be closed without backend, got %v", err)
+	}
+}
+
+func TestTCPProxyProxyProtocol(t *testing.T) {
+	headers := make(chan *proxyproto.Header, 1)
+	url := startTCPBackend(t, func(conn net.Conn) {
+		header, err := proxyproto.ReadHeader(bufio.NewReader(conn))
+		if err != nil {
+			t.Error(err)
+		}
+		headers <- header
+	})
+	svc := newStreamService(t, config.ProtocolTCP, config.StreamConfig{}, config.BackendConfig{URL: url, ProxyProtocol: proxyproto.Version2})
+	_, addr := startTCPProxy(t, svc)
+
+	conn := dialProxy(t, addr)
+	io.ReadAll(conn)
+
+	header := <-headers
+	if header == nil || header.Source.String() != conn.LocalAddr().String() || header.Destination.String() != addr {
+		t.Fatalf("expected the client connection %s -> %s, got %+v", conn.LocalAddr(), addr, header)
+	}
+}
+
+func TestTCPProxyShutdown(t *testing.T) {
+	svc := newStreamService(t, config.ProtocolTCP, config.StreamConfig{}, config.BackendConfig{URL: startTCPBackend(t, echo)})
+	p, addr := startTCPProxy(t, svc)
+
+	conn := dialProxy(t, addr)
+	conn.Write([]byte("ping"))
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Established connections are closed once the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to pass with an open connection, got %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("expected the listener to be closed")
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,314 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/internal/pool"
+	"github.com/unkn0wn-root/terraster/internal/service"
+	"github.com/unkn0wn-root/terraster/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// maxDatagramSize is the largest UDP payload.
+const maxDatagramSize = 64 * 1024
+
+// UDPProxy forwards udp datagrams received on the port of a service to its backends.
+// Datagrams of a client address form a session which sticks to one backend. Replies of the backend
+// are sent back to the client from the service port. A session ends once the backend sent the
+// configured number of responses or no datagram was exchanged for the idle timeout.
+type UDPProxy struct {
+	conn    net.PacketConn
+	service atomic.Pointer[service.ServiceInfo]
+	logger  *zap.Logger
+
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// udpSession is the flow of datagrams between a client and the backend selected for it.
+type udpSession struct {
+	client       net.Addr
+	backend      *pool.Backend
+	backendURL   string
+	upstream     *net.UDPConn
+	svc          *service.ServiceInfo
+	loc          *service.LocationInfo
+	lastActivity atomic.Int64
+	reported     atomic.Bool
+	closeOnce    sync.Once
+}
+
+// NewUDPProxy creates a proxy for the service serving datagrams received on the connection.
+func NewUDPProxy(conn net.PacketConn, svc *service.ServiceInfo, logger *zap.Logger) *UDPProxy {
+	p := &UDPProxy{
+		conn:     conn,
+		logger:   logger,
+		sessions: make(map[string]*udpSession),
+	}
+	p.service.Store(svc)
+	return p
+}
+
+// Update replaces the service after a configuration reload. Established sessions are not affected.
+func (p *UDPProxy) Update(svc *service.ServiceInfo) {
+	p.service.Store(svc)
+}
+
+// Serve reads datagrams until the proxy is shut down. It returns net.ErrClosed after Shutdown.
+func (p *UDPProxy) Serve() error {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return net.ErrClosed
+			}
+			p.logger.Warn("Failed to read udp datagram", zap.Error(err))
+			continue
+		}
+
+		sess := p.session(addr)
+		if sess == nil {
+			continue
+		}
+
+		sess.lastActivity.Store(time.Now().UnixNano())
+		if _, err := sess.upstream.Write(buf[:n]); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				sess.report(true)
+				p.logger.Warn("Failed to send datagram to backend",
+					zap.String("service", sess.svc.Name),
+					zap.String("backend", sess.backendURL),
+					zap.Error(err))
+				p.closeSession(sess)
+			}
+			continue
+		}
+		metrics.RequestBytes.WithLabelValues(sess.svc.Name, sess.loc.Path, sess.backendURL).Add(float64(n))
+	}
+}
+
+// Shutdown stops reading datagrams and ends all sessions.
+// Replies still in flight are dropped, there is nothing to drain for datagrams.
+func (p *UDPProxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	sessions := p.sessions
+	p.sessions = make(map[string]*udpSession)
+	p.mu.Unlock()
+
+	err := p.conn.Close()
+	for _, sess := range sessions {
+		sess.close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// session returns the session of the client, creating it on the first datagram.
+// Returns nil if the datagram has to be dropped because the session limit is reached or no backend is available.
+func (p *UDPProxy) session(addr net.Addr) *udpSession {
+	key := addr.String()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	if sess, ok := p.sessions[key]; ok {
+		return sess
+	}
+
+	svc := p.service.Load()
+	loc := location(svc)
+	if loc == nil {
+		return nil
+	}
+
+	if len(p.sessions) >= orDefault(svc.Stream.MaxSessions, DefaultMaxSessions) {
+		p.logger.Warn("udp session limit reached, dropping datagram",
+			zap.String("service", svc.Name),
+			zap.String("client", key))
+		return nil
+	}
+
+	backend, upstream, err := p.dial(svc, loc, addr)
+	if err != nil {
+		p.logger.Warn("Failed to connect client to a backend",
+			zap.String("service", svc.Name),
+			zap.String("client", key),
+			zap.Error(err))
+		return nil
+	}
+
+	sess := &udpSession{
+		client:     addr,
+		backend:    backend,
+		backendURL: backend.URL.String(),
+		upstream:   upstream,
+		svc:        svc,
+		loc:        loc,
+	}
+	sess.lastActivity.Store(time.Now().UnixNano())
+	p.sessions[key] = sess
+
+	p.wg.Add(1)
+	go p.serveSession(sess)
+
+	return sess
+}
+
+// dial creates the socket of a session to a backend selected by the location's algorithm.
+// The returned backend has been acquired and must be released once the session ends.
+func (p *UDPProxy) dial(svc *service.ServiceInfo, loc *service.LocationInfo, client net.Addr) (*pool.Backend, *net.UDPConn, error) {
+	r := clientRequest(client)
+
+	tried := make(map[*pool.Backend]bool)
+	err := errNoBackend
+	for {
+		backend := loc.NextUntried(r, tried)
+		if backend == nil {
+			return nil, nil, err
+		}
+		tried[backend] = true
+
+		if !acquire(loc.ServerPool, backend) {
+			continue
+		}
+
+		// Connecting a udp socket does not send anything, it fails only if the address can not be resolved
+		raddr, dialErr := net.ResolveUDPAddr("udp", backend.URL.Host)
+		if dialErr == nil {
+			var conn *net.UDPConn
+			conn, dialErr = net.DialUDP("udp", nil, raddr)
+			if dialErr == nil {
+				return backend, conn, nil
+			}
+		}
+
+		loc.ServerPool.ReportResult(backend, true)
+		release(backend)
+		err = errBackendsFailed
+		p.logger.Warn("Failed to connect to backend",
+			zap.String("service", svc.Name),
+			zap.String("backend", backend.URL.String()),
+			zap.Error(dialErr))
+	}
+}
+
+// serveSession forwards replies of the backend to the client until the session ends.
+// Runs in a separate goroutine
+func (p *UDPProxy) serveSession(sess *udpSession) {
+	defer p.wg.Done()
+	defer p.closeSession(sess)
+
+	svc, loc := sess.svc, sess.loc
+	idle := orDefault(svc.Stream.IdleTimeout, DefaultUDPIdleTimeout)
+	expected := svc.Stream.Responses
+
+	active := metrics.ActiveConnections.WithLabelValues(svc.Name, loc.Path, sess.backendURL)
+	active.Inc()
+	defer active.Dec()
+
+	received := metrics.ResponseBytes.WithLabelValues(svc.Name, loc.Path, sess.backendURL)
+	buf := make([]byte, maxDatagramSize)
+	responses := 0
+	for {
+		sess.upstream.SetReadDeadline(time.Now().Add(idle))
+		n, err := sess.upstream.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				// The client may have sent datagrams in the meantime
+				if time.Since(time.Unix(0, sess.lastActivity.Load())) < idle {
+					continue
+				}
+				// A backend which does not answer at all is only a failure if answers are expected
+				if expected > 0 && responses == 0 {
+					sess.report(true)
+				}
+				return
+			}
+			if !errors.Is(err, net.ErrClosed) {
+				// e.g. connection refused, reported by ICMP port unreachable
+				sess.report(true)
+				p.logger.Warn("Failed to read datagram from backend",
+					zap.String("service", svc.Name),
+					zap.String("backend", sess.backendURL),
+					zap.Error(err))
+			}
+			return
+		}
+
+		sess.lastActivity.Store(time.Now().UnixNano())
+		sess.report(false)
+		if _, err := p.conn.WriteTo(buf[:n], sess.client); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				p.logger.Warn("Failed to send datagram to client",
+					zap.String("service", svc.Name),
+					zap.String("client", sess.client.String()),
+					zap.Error(err))
+			}
+			return
+		}
+		received.Add(float64(n))
+
+		responses++
+		if expected > 0 && responses >= expected {
+			return
+		}
+	}
+}
+
+// closeSession removes the session and releases its backend. Safe to call more than once.
+func (p *UDPProxy) closeSession(sess *udpSession) {
+	p.mu.Lock()
+	if p.sessions[sess.client.String()] == sess {
+		delete(p.sessions, sess.client.String())
+	}
+	p.mu.Unlock()
+
+	sess.close()
+}
+
+// close closes the socket of the session and releases its backend. Safe to call more than once.
+func (s *udpSession) close() {
+	s.closeOnce.Do(func() {
+		s.upstream.Close()
+		// Sessions which never got a reply say nothing about the backend
+		if !s.reported.Load() {
+			s.loc.ServerPool.ReleaseCircuit(s.backend)
+		}
+		release(s.backend)
+	})
+}
+
+// report records the result of the session on its backend once.
+func (s *udpSession) report(failed bool) {
+	if s.reported.CompareAndSwap(false, true) {
+		s.loc.ServerPool.ReportResult(s.backend, failed)
+	}
+}
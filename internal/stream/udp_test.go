@@ -0,0 +1,189 @@
+package stream
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/unkn0wn-root/terraster/internal/config"
+	"github.com/unkn0wn-root/terraster/internal/service"
+	"go.uber.org/zap"
+)
+
+// startUDPBackend answers every datagram received on a local port with the same datagram and returns the backend URL.
+func startUDPBackend(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	return "udp://" + conn.LocalAddr().String()
+}
+
+// startUDPProxy serves the service on a local port and returns the address of the proxy.
+func startUDPProxy(t *testing.T, svc *service.ServiceInfo) (*UDPProxy, string) {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewUDPProxy(conn, svc, zap.NewNop())
+	go p.Serve()
+	t.Cleanup(func() { p.Shutdown(context.Background()) })
+
+	return p, conn.LocalAddr().String()
+}
+
+func dialUDP(t *testing.T, addr string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// exchange sends the datagram and returns the reply, or an error if none arrives within the timeout.
+func exchange(conn net.Conn, msg string, timeout time.Duration) (string, error) {
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return "", err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, maxDatagramSize)
+	n, err := conn.Read(buf)
+	return string(buf[:n]), err
+}
+
+func (p *UDPProxy) sessionCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.sessions)
+}
+
+// waitSessions waits until the proxy has n sessions.
+func waitSessions(t *testing.T, p *UDPProxy, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for p.sessionCount() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d sessions, got %d", n, p.sessionCount())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestUDPProxySession(t *testing.T) {
+	svc := newStreamService(t, config.ProtocolUDP, config.StreamConfig{},
+		config.BackendConfig{URL: startUDPBackend(t)},
+		config.BackendConfig{URL: startUDPBackend(t)})
+	p, addr := startUDPProxy(t, svc)
+
+	conn := dialUDP(t, addr)
+	var backend string
+	for _, msg := range []string{"one", "two", "three"} {
+		reply, err := exchange(conn, msg, time.Second)
+		if err != nil || reply != msg {
+			t.Fatalf("expected the echo of %q, got %q, %v", msg, reply, err)
+		}
+
+		// Datagrams of a client stick to one backend.
+		p.mu.Lock()
+		sess := p.sessions[conn.LocalAddr().String()]
+		p.mu.Unlock()
+		if sess == nil {
+			t.Fatal("expected a session of the client")
+		}
+		if backend != "" && sess.backendURL != backend {
+			t.Fatalf("expected the session to stay on %s, got %s", backend, sess.backendURL)
+		}
+		backend = sess.backendURL
+	}
+
+	if p.sessionCount() != 1 {
+		t.Fatalf("expected a single session, got %d", p.sessionCount())
+	}
+}
+
+func TestUDPProxyResponses(t *testing.T) {
+	svc := newStreamService(t, config.ProtocolUDP, config.StreamConfig{Responses: 1}, config.BackendConfig{URL: startUDPBackend(t)})
+	p, addr := startUDPProxy(t, svc)
+
+	conn := dialUDP(t, addr)
+	if reply, err := exchange(conn, "query", time.Second); err != nil || reply != "query" {
+		t.Fatalf("expected the echo, got %q, %v", reply, err)
+	}
+
+	// The session ends with the expected reply and releases its backend.
+	waitSessions(t, p, 0)
+	if b := svc.Locations[0].ServerPool.GetAllBackends()[0]; b.GetConnectionCount() != 0 {
+		t.Fatalf("expected the backend to be released, got %d connections", b.GetConnectionCount())
+	}
+
+	// The next datagram starts a new session.
+	if reply, err := exchange(conn, "again", time.Second); err != nil || reply != "again" {
+		t.Fatalf("expected the echo, got %q, %v", reply, err)
+	}
+}
+
+func TestUDPProxyIdleTimeout(t *testing.T) {
+	const idle = 100 * time.Millisecond
+	svc := newStreamService(t, config.ProtocolUDP, config.StreamConfig{IdleTimeout: idle}, config.BackendConfig{URL: startUDPBackend(t)})
+	p, addr := startUDPProxy(t, svc)
+
+	conn := dialUDP(t, addr)
+	for i := 0; i < 6; i++ {
+		if reply, err := exchange(conn, "ping", time.Second); err != nil || reply != "ping" {
+			t.Fatalf("expected the echo, got %q, %v", reply, err)
+		}
+		time.Sleep(idle / 2)
+		if p.sessionCount() != 1 {
+			t.Fatal("expected the active session to stay open")
+		}
+	}
+
+	start := time.Now()
+	waitSessions(t, p, 0)
+	if elapsed := time.Since(start); elapsed < idle/4 {
+		t.Fatalf("expected the session to end after the idle timeout, got %s", elapsed)
+	}
+}
+
+func TestUDPProxyMaxSessions(t *testing.T) {
+	svc := newStreamService(t, config.ProtocolUDP, config.StreamConfig{MaxSessions: 1}, config.BackendConfig{URL: startUDPBackend(t)})
+	_, addr := startUDPProxy(t, svc)
+
+	first := dialUDP(t, addr)
+	if reply, err := exchange(first, "first", time.Second); err != nil || reply != "first" {
+		t.Fatalf("expected the echo, got %q, %v", reply, err)
+	}
+
+	// Datagrams of new clients are dropped while the limit is reached.
+	second := dialUDP(t, addr)
+	if reply, err := exchange(second, "second", 100*time.Millisecond); !isTimeout(err) {
+		t.Fatalf("expected the datagram to be dropped, got %q, %v", reply, err)
+	}
+
+	// Clients with a session are still served.
+	if reply, err := exchange(first, "again", time.Second); err != nil || reply != "again" {
+		t.Fatalf("expected the echo, got %q, %v", reply, err)
+	}
+}
@@ -27,7 +27,43 @@ type Server struct {
 	LastResponseTime time.Duration
 }
 
-func CreateAlgorithm(name string) Algorithm {
+// Options holds optional settings of algorithms. Algorithms ignore options they do not use.
+type Options struct {
+	HashKey      HashKey // Part of the request hashed by consistent-hash.
+	VirtualNodes int     // Virtual nodes per unit of weight for consistent-hash.
+	LoadFactor   float64 // Bounded load factor for consistent-hash. Values <= 1 disable bounded load.
+}
+
+// Option configures Options.
+type Option func(*Options)
+
+// WithHashKey sets the part of the request that is hashed.
+func WithHashKey(key HashKey) Option {
+	return func(o *Options) {
+		o.HashKey = key
+	}
+}
+
+// WithVirtualNodes sets the number of virtual nodes per unit of backend weight.
+func WithVirtualNodes(n int) Option {
+	return func(o *Options) {
+		o.VirtualNodes = n
+	}
+}
+
+// WithLoadFactor sets the bounded load factor.
+func WithLoadFactor(f float64) Option {
+	return func(o *Options) {
+		o.LoadFactor = f
+	}
+}
+
+func CreateAlgorithm(name string, opts ...Option) Algorithm {
+	var options Options
+	for _, opt := range opts {
+		opt(&options)
+	}
+
 	switch name {
 	case "round-robin":
 		return &RoundRobin{}
@@ -39,6 +75,8 @@ func CreateAlgorithm(name string) Algorithm {
 		return &IPHash{}
 	case "least-response-time":
 		return NewLeastResponseTime()
+	case "consistent-hash":
+		return NewConsistentHash(options)
 	default:
 		return &RoundRobin{} // default algorithm
 	}
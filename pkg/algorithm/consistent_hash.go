@@ -0,0 +1,259 @@
+package algorithm
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/unkn0wn-root/terraster/pkg/clientip"
+)
+
+// Defaults of the consistent hash algorithm.
+const (
+	DefaultVirtualNodes = 160
+	DefaultLoadFactor   = 1.25
+)
+
+// Sources the consistent hash key can be taken from.
+const (
+	HashKeyIP     = "ip"
+	HashKeyHeader = "header"
+	HashKeyCookie = "cookie"
+	HashKeyQuery  = "query"
+	HashKeyPath   = "path"
+)
+
+// HashKey describes which part of the request is hashed.
+type HashKey struct {
+	Source string // One of HashKeyIP, HashKeyHeader, HashKeyCookie, HashKeyQuery or HashKeyPath.
+	Name   string // Header, cookie or query parameter name.
+}
+
+// ParseHashKey parses a hash key definition such as "ip", "path", "header:X-User-ID",
+// "cookie:session" or "query:user". An empty definition hashes the client IP.
+func ParseHashKey(def string) (HashKey, error) {
+	if def == "" {
+		return HashKey{Source: HashKeyIP}, nil
+	}
+
+	source, name, _ := strings.Cut(def, ":")
+	source = strings.ToLower(strings.TrimSpace(source))
+	name = strings.TrimSpace(name)
+
+	switch source {
+	case HashKeyIP, HashKeyPath:
+		return HashKey{Source: source}, nil
+	case HashKeyHeader, HashKeyCookie, HashKeyQuery:
+		if name == "" {
+			return HashKey{}, fmt.Errorf("hash key %q requires a name, e.g. %s:name", def, source)
+		}
+		if source == HashKeyHeader {
+			name = http.CanonicalHeaderKey(name)
+		}
+		return HashKey{Source: source, Name: name}, nil
+	default:
+		return HashKey{}, fmt.Errorf("unknown hash key source %q", source)
+	}
+}
+
+// Hash returns the hash of the key extracted from the request.
+func (k HashKey) Hash(r *http.Request) uint64 {
+	return hashString(k.value(r))
+}
+
+// value extracts the key from the request. It falls back to the client IP if the key is not present.
+func (k HashKey) value(r *http.Request) string {
+	switch k.Source {
+	case HashKeyHeader:
+		if v := r.Header.Get(k.Name); v != "" {
+			return v
+		}
+	case HashKeyCookie:
+		if c, err := r.Cookie(k.Name); err == nil && c.Value != "" {
+			return c.Value
+		}
+	case HashKeyQuery:
+		if v := r.URL.Query().Get(k.Name); v != "" {
+			return v
+		}
+	case HashKeyPath:
+		return r.URL.Path
+	}
+
+	return clientip.FromRequest(r)
+}
+
+// ConsistentHash maps requests to backends with a hash ring.
+// Every backend gets virtual nodes proportional to its weight, so adding or removing a backend
+// only moves the keys of that backend. With a load factor greater than 1, a backend is skipped
+// once it has more than loadFactor times the average number of connections, spilling hot keys
+// over to the next backend on the ring.
+type ConsistentHash struct {
+	key          HashKey
+	virtualNodes int
+	loadFactor   float64
+	ring         atomic.Pointer[hashRing]
+}
+
+// hashRing is an immutable ring built from a set of backends.
+type hashRing struct {
+	members []ringMember // Backends the ring was built from, used to detect changes.
+	points  []ringPoint  // Virtual nodes sorted by hash.
+}
+
+type ringMember struct {
+	url    string
+	weight int
+}
+
+type ringPoint struct {
+	hash  uint64
+	index int // Index into the backends slice the ring was built from.
+}
+
+// NewConsistentHash creates a consistent hash algorithm.
+// Options which are not set fall back to hashing the client IP with DefaultVirtualNodes and DefaultLoadFactor.
+func NewConsistentHash(opts Options) *ConsistentHash {
+	ch := &ConsistentHash{
+		key:          opts.HashKey,
+		virtualNodes: opts.VirtualNodes,
+		loadFactor:   opts.LoadFactor,
+	}
+
+	if ch.key.Source == "" {
+		ch.key.Source = HashKeyIP
+	}
+	if ch.virtualNodes <= 0 {
+		ch.virtualNodes = DefaultVirtualNodes
+	}
+	if ch.loadFactor == 0 {
+		ch.loadFactor = DefaultLoadFactor
+	}
+
+	return ch
+}
+
+func (ch *ConsistentHash) Name() string {
+	return "consistent-hash"
+}
+
+func (ch *ConsistentHash) NextServer(pool ServerPool, r *http.Request) *Server {
+	servers := pool.GetBackends()
+	if len(servers) == 0 {
+		return nil
+	}
+
+	ring := ch.getRing(servers)
+
+	// Bounded load: capacity = ceil(loadFactor * (total + 1) / alive)
+	alive := 0
+	var total int64
+	for _, server := range servers {
+		if server.Alive.Load() {
+			alive++
+			total += int64(atomic.LoadInt32(&server.ConnectionCount))
+		}
+	}
+	if alive == 0 {
+		return nil
+	}
+
+	bounded := ch.loadFactor > 1
+	capacity := int32(math.Ceil(ch.loadFactor * float64(total+1) / float64(alive)))
+
+	hash := ch.key.Hash(r)
+	start := sort.Search(len(ring.points), func(i int) bool {
+		return ring.points[i].hash >= hash
+	})
+
+	var fallback *Server
+	for i := 0; i < len(ring.points); i++ {
+		server := servers[ring.points[(start+i)%len(ring.points)].index]
+		if !server.Alive.Load() {
+			continue
+		}
+
+		if fallback == nil {
+			fallback = server
+		}
+
+		if !bounded || atomic.LoadInt32(&server.ConnectionCount) < capacity {
+			return server
+		}
+	}
+
+	// All alive backends are above capacity. Stick to the primary choice.
+	return fallback
+}
+
+// getRing returns the ring for the given backends, rebuilding it only if the set of backends or their weights changed.
+func (ch *ConsistentHash) getRing(servers []*Server) *hashRing {
+	if ring := ch.ring.Load(); ring != nil && ring.matches(servers) {
+		return ring
+	}
+
+	ring := ch.buildRing(servers)
+	ch.ring.Store(ring)
+	return ring
+}
+
+func (ch *ConsistentHash) buildRing(servers []*Server) *hashRing {
+	ring := &hashRing{members: make([]ringMember, len(servers))}
+	for i, server := range servers {
+		ring.members[i] = ringMember{url: server.URL, weight: server.Weight}
+
+		weight := server.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+
+		for v := 0; v < ch.virtualNodes*weight; v++ {
+			ring.points = append(ring.points, ringPoint{
+				hash:  hashString(server.URL + "#" + strconv.Itoa(v)),
+				index: i,
+			})
+		}
+	}
+
+	sort.Slice(ring.points, func(i, j int) bool {
+		return ring.points[i].hash < ring.points[j].hash
+	})
+
+	return ring
+}
+
+// matches reports whether the ring was built from the given backends in the same order.
+func (r *hashRing) matches(servers []*Server) bool {
+	if len(r.members) != len(servers) {
+		return false
+	}
+
+	for i, server := range servers {
+		if r.members[i].url != server.URL || r.members[i].weight != server.Weight {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hashString hashes a string with FNV-1a and mixes the result to spread similar keys over the ring.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+
+	// splitmix64 finalizer
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	return x
+}
@@ -3,7 +3,8 @@ package algorithm
 import (
 	"hash/fnv"
 	"net/http"
-	"strings"
+
+	"github.com/unkn0wn-root/terraster/pkg/clientip"
 )
 
 type IPHash struct{}
@@ -19,7 +20,7 @@ func (ih *IPHash) NextServer(pool ServerPool, r *http.Request) *Server {
 	}
 
 	// Get IP from request
-	ip := strings.Split(r.RemoteAddr, ":")[0]
+	ip := clientip.FromRequest(r)
 
 	// Generate hash
 	h := fnv.New32a()
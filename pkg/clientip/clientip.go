@@ -0,0 +1,175 @@
+// Package clientip determines the address of the client that sent a request,
+// taking trusted reverse proxies in front of Terraster into account.
+package clientip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// contextKey is the key of the client IP in the request context.
+type contextKey struct{}
+
+// NewContext returns a copy of the context carrying the client IP, as resolved when the request was received.
+func NewContext(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, contextKey{}, ip)
+}
+
+// FromContext returns the client IP stored in the context.
+func FromContext(ctx context.Context) (string, bool) {
+	ip, ok := ctx.Value(contextKey{}).(string)
+	return ip, ok && ip != ""
+}
+
+// FromRequest returns the client IP of the request. It is the address resolved when the request was received
+// if there is one, the address of the peer otherwise.
+func FromRequest(req *http.Request) string {
+	if ip, ok := FromContext(req.Context()); ok {
+		return ip
+	}
+	return RemoteIP(req)
+}
+
+// Resolver resolves the client IP of requests.
+// Forwarding headers are only honoured if the request comes from a trusted proxy,
+// otherwise any client could spoof its address.
+type Resolver struct {
+	trusted []*net.IPNet
+}
+
+// NewResolver creates a Resolver trusting the given proxies.
+// Proxies are networks in CIDR notation or plain IP addresses.
+func NewResolver(trustedProxies []string) (*Resolver, error) {
+	r := &Resolver{}
+	for _, proxy := range trustedProxies {
+		network, err := ParseNetwork(proxy)
+		if err != nil {
+			return nil, err
+		}
+		r.trusted = append(r.trusted, network)
+	}
+
+	return r, nil
+}
+
+// ParseNetwork parses a network in CIDR notation. A plain IP address is treated as a single host network.
+func ParseNetwork(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address or CIDR %q", s)
+		}
+		bits := 8 * net.IPv4len
+		if ip.To4() == nil {
+			bits = 8 * net.IPv6len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %q: %w", s, err)
+	}
+	return network, nil
+}
+
+// ClientIP returns the IP address of the client.
+// If the peer is a trusted proxy, X-Forwarded-For (or the for parameters of Forwarded, RFC 7239, without it)
+// is walked from right to left and the first address which is not a trusted proxy is returned.
+// If an entry is not an IP address before such an address is found, the peer is returned.
+// X-Real-IP is used if neither header is present. Safe to call on a nil Resolver, which trusts nobody.
+func (r *Resolver) ClientIP(req *http.Request) string {
+	remote := RemoteIP(req)
+	if !r.TrustsPeer(req) {
+		return remote
+	}
+
+	var hops []string
+	for _, value := range req.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	if len(hops) == 0 {
+		hops = forwardedFor(req.Header.Values("Forwarded"))
+	}
+
+	if len(hops) == 0 {
+		if real := strings.TrimSpace(req.Header.Get("X-Real-IP")); net.ParseIP(real) != nil {
+			return real
+		}
+		return remote
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// Garbage in the header, everything left of it is untrustworthy
+			// and everything right of it is a trusted proxy, not the client.
+			return remote
+		}
+		if !r.IsTrusted(ip) {
+			return hops[i]
+		}
+	}
+
+	// All hops are trusted proxies, the leftmost one is the closest to the client.
+	return hops[0]
+}
+
+// TrustsPeer reports whether the peer of the request is a trusted proxy, i.e. its forwarding headers can be relied on.
+func (r *Resolver) TrustsPeer(req *http.Request) bool {
+	return r != nil && len(r.trusted) > 0 && r.IsTrusted(net.ParseIP(RemoteIP(req)))
+}
+
+// IsTrusted reports whether the IP address belongs to a trusted proxy.
+func (r *Resolver) IsTrusted(ip net.IP) bool {
+	if r == nil || ip == nil {
+		return false
+	}
+
+	for _, network := range r.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoteIP returns the IP address of the peer without port.
+func RemoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// forwardedFor returns the addresses of the for parameters of Forwarded headers (RFC 7239), in order.
+// Ports and IPv6 brackets are removed. Obfuscated identifiers like "unknown" are returned as they are.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(name, "for") {
+					continue
+				}
+
+				v = strings.Trim(v, `"`)
+				if host, _, err := net.SplitHostPort(v); err == nil {
+					v = host
+				}
+				hops = append(hops, strings.Trim(v, "[]"))
+			}
+		}
+	}
+	return hops
+}
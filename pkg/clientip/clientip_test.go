@@ -0,0 +1,202 @@
+package clientip
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseNetwork(t *testing.T) {
+	tests := []struct {
+		in       string
+		contains string
+		excludes string
+		wantErr  bool
+	}{
+		{in: "10.0.0.0/8", contains: "10.1.2.3", excludes: "11.0.0.1"},
+		{in: " 192.168.1.7 ", contains: "192.168.1.7", excludes: "192.168.1.8"},
+		{in: "2001:db8::/32", contains: "2001:db8::1", excludes: "2001:db9::1"},
+		{in: "::1", contains: "::1", excludes: "::2"},
+		{in: "10.0.0.0/33", wantErr: true},
+		{in: "proxy.local", wantErr: true},
+		{in: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			network, err := ParseNetwork(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !network.Contains(net.ParseIP(tt.contains)) {
+				t.Errorf("expected %s to contain %s", network, tt.contains)
+			}
+			if network.Contains(net.ParseIP(tt.excludes)) {
+				t.Errorf("expected %s not to contain %s", network, tt.excludes)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	resolver, err := NewResolver([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		resolver *Resolver
+		remote   string
+		headers  map[string][]string
+		want     string
+	}{
+		{
+			name:     "untrusted peer ignores headers",
+			resolver: resolver,
+			remote:   "203.0.113.9:4000",
+			headers:  map[string][]string{"X-Forwarded-For": {"198.51.100.1"}, "X-Real-IP": {"198.51.100.2"}},
+			want:     "203.0.113.9",
+		},
+		{
+			name:    "nil resolver trusts nobody",
+			remote:  "10.0.0.1:4000",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.1"}},
+			want:    "10.0.0.1",
+		},
+		{
+			name:     "trusted peer without headers",
+			resolver: resolver,
+			remote:   "10.0.0.1:4000",
+			want:     "10.0.0.1",
+		},
+		{
+			name:     "single hop",
+			resolver: resolver,
+			remote:   "10.0.0.1:4000",
+			headers:  map[string][]string{"X-Forwarded-For": {"198.51.100.1"}},
+			want:     "198.51.100.1",
+		},
+		{
+			name:     "rightmost untrusted hop",
+			resolver: resolver,
+			remote:   "10.0.0.1:4000",
+			headers:  map[string][]string{"X-Forwarded-For": {"1.1.1.1, 198.51.100.1, 10.0.0.2, 192.168.1.1"}},
+			want:     "198.51.100.1",
+		},
+		{
+			name:     "multiple header lines",
+			resolver: resolver,
+			remote:   "10.0.0.1:4000",
+			headers:  map[string][]string{"X-Forwarded-For": {"1.1.1.1", "198.51.100.1, 10.0.0.2"}},
+			want:     "198.51.100.1",
+		},
+		{
+			name:     "all hops trusted",
+			resolver: resolver,
+			remote:   "10.0.0.1:4000",
+			headers:  map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			want:     "10.0.0.3",
+		},
+		{
+			name:     "garbage as the last hop",
+			resolver: resolver,
+			remote:   "10.0.0.1:4000",
+			headers:  map[string][]string{"X-Forwarded-For": {"198.51.100.1, not-an-ip"}},
+			want:     "10.0.0.1",
+		},
+		{
+			name:     "garbage behind trusted hops",
+			resolver: resolver,
+			remote:   "10.0.0.1:4000",
+			headers:  map[string][]string{"X-Forwarded-For": {"198.51.100.1, not-an-ip, 10.0.0.3, 10.0.0.2"}},
+			want:     "10.0.0.1",
+		},
+		{
+			name:     "garbage left of the client",
+			resolver: resolver,
+			remote:   "10.0.0.1:4000",
+			headers:  map[string][]string{"X-Forwarded-For": {"not-an-ip, 198.51.100.1, 10.0.0.2"}},
+			want:     "198.51.100.1",
+		},
+		{
+			name:     "ipv6 hops",
+			resolver: resolver,
+			remote:   "[fd00::1]:4000",
+			headers:  map[string][]string{"X-Forwarded-For": {"2001:db8::7, fd00::2"}},
+			want:     "2001:db8::7",
+		},
+		{
+			name:     "forwarded header",
+			resolver: resolver,
+			remote:   "10.0.0.1:4000",
+			headers:  map[string][]string{"Forwarded": {`for=198.51.100.1;proto=https, for="[2001:db8::7]:8080", for=10.0.0.2`}},
+			want:     "2001:db8::7",
+		},
+		{
+			name:     "forwarded with obfuscated identifier",
+			resolver: resolver,
+			remote:   "10.0.0.1:4000",
+			headers:  map[string][]string{"Forwarded": {"for=unknown, for=10.0.0.2"}},
+			want:     "10.0.0.1",
+		},
+		{
+			name:     "x-forwarded-for takes precedence over forwarded",
+			resolver: resolver,
+			remote:   "10.0.0.1:4000",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"198.51.100.1"},
+				"Forwarded":       {"for=198.51.100.2"},
+			},
+			want: "198.51.100.1",
+		},
+		{
+			name:     "x-real-ip",
+			resolver: resolver,
+			remote:   "10.0.0.1:4000",
+			headers:  map[string][]string{"X-Real-IP": {" 198.51.100.1 "}},
+			want:     "198.51.100.1",
+		},
+		{
+			name:     "invalid x-real-ip",
+			resolver: resolver,
+			remote:   "10.0.0.1:4000",
+			headers:  map[string][]string{"X-Real-IP": {"not-an-ip"}},
+			want:     "10.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remote
+			for name, values := range tt.headers {
+				for _, value := range values {
+					req.Header.Add(name, value)
+				}
+			}
+
+			if got := tt.resolver.ClientIP(req); got != tt.want {
+				t.Fatalf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFromRequest(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "203.0.113.9:4000"
+	if got := FromRequest(req); got != "203.0.113.9" {
+		t.Fatalf("expected the peer without a resolved address, got %s", got)
+	}
+
+	req = req.WithContext(NewContext(context.Background(), "198.51.100.1"))
+	if got := FromRequest(req); got != "198.51.100.1" {
+		t.Fatalf("expected the resolved address, got %s", got)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/unkn0wn-root/terraster/pkg/metrics"
 	"go.uber.org/zap/zapcore"
 )
 
@@ -187,6 +188,7 @@ func (ac *AsyncCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
 	default:
 		// Increment the counter for dropped logs
 		atomic.AddUint64(&ac.droppedLogs, 1)
+		metrics.LogsDroppedTotal.Inc()
 		return nil
 	}
 }
@@ -0,0 +1,428 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are the default histogram buckets (in seconds), suitable for request latencies.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// labelSeparator joins label values into a series key. It cannot appear in valid UTF-8 text.
+const labelSeparator = "\xff"
+
+// collector is implemented by every metric family so that the registry can render it.
+type collector interface {
+	describe() (name, help, kind string)
+	write(w *bufio.Writer)
+}
+
+// Registry holds metric families and renders them in the Prometheus text exposition format.
+// Registration takes a lock, recording values never does.
+type Registry struct {
+	mu         sync.RWMutex
+	collectors map[string]collector
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]collector)}
+}
+
+// DefaultRegistry is the registry used by the package level constructors and by Handler.
+var DefaultRegistry = NewRegistry()
+
+// register adds a collector to the registry. Registering the same name twice panics,
+// since it is always a programming error.
+func (r *Registry) register(c collector) {
+	name, _, _ := c.describe()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.collectors[name]; exists {
+		panic(fmt.Sprintf("metrics: duplicate metric %q", name))
+	}
+	r.collectors[name] = c
+}
+
+// WriteText renders all registered metrics in the Prometheus text exposition format (version 0.0.4).
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	collectors := make([]collector, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		collectors = append(collectors, r.collectors[name])
+	}
+	r.mu.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		name, help, kind := c.describe()
+		fmt.Fprintf(bw, "# HELP %s %s\n", name, escapeHelp(help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, kind)
+		c.write(bw)
+	}
+
+	return bw.Flush()
+}
+
+// Handler returns an HTTP handler exposing the metrics of the DefaultRegistry.
+func Handler() http.Handler {
+	return HandlerFor(DefaultRegistry)
+}
+
+// HandlerFor returns an HTTP handler exposing the metrics of the given registry.
+func HandlerFor(r *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = r.WriteText(w)
+	})
+}
+
+// family is the shared part of all labelled metric types.
+// Series are stored in a sync.Map, so lookups of existing series are lock free.
+type family struct {
+	name   string
+	help   string
+	labels []string
+	series sync.Map // map[string]series
+}
+
+// key builds the series key for the given label values.
+func (f *family) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+
+	switch len(values) {
+	case 0:
+		return ""
+	case 1:
+		return values[0]
+	default:
+		return strings.Join(values, labelSeparator)
+	}
+}
+
+// DeleteLabelValues removes the series for the given label values, e.g. of a backend removed on reload.
+// Returns false if the series did not exist.
+func (f *family) DeleteLabelValues(values ...string) bool {
+	_, loaded := f.series.LoadAndDelete(f.key(values))
+	return loaded
+}
+
+// sortedSeries returns series keys in a stable order for rendering.
+func (f *family) sortedKeys() []string {
+	var keys []string
+	f.series.Range(func(k, _ interface{}) bool {
+		keys = append(keys, k.(string))
+		return true
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+// labelString renders label pairs, optionally with an extra trailing pair (used for histogram "le").
+func (f *family) labelString(key string, extraName, extraValue string) string {
+	var values []string
+	if len(f.labels) > 0 {
+		values = strings.Split(key, labelSeparator)
+	}
+
+	if len(values) == 0 && extraName == "" {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, label := range f.labels {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(label)
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabel(values[i]))
+		sb.WriteByte('"')
+	}
+	if extraName != "" {
+		if len(f.labels) > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(extraName)
+		sb.WriteString(`="`)
+		sb.WriteString(extraValue)
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+
+	return sb.String()
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	bits atomic.Uint64
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add increments the counter by the given non-negative value.
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+	addFloat(&c.bits, v)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(c.bits.Load())
+}
+
+// CounterVec is a family of counters partitioned by label values.
+type CounterVec struct {
+	family
+}
+
+// NewCounterVec creates and registers a CounterVec in the DefaultRegistry.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return DefaultRegistry.NewCounterVec(name, help, labels...)
+}
+
+// NewCounterVec creates and registers a CounterVec.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{family: family{name: name, help: help, labels: labels}}
+	r.register(c)
+	return c
+}
+
+// NewCounter creates and registers an unlabelled counter in the DefaultRegistry.
+func NewCounter(name, help string) *Counter {
+	return NewCounterVec(name, help).WithLabelValues()
+}
+
+// WithLabelValues returns the counter for the given label values, creating it if needed.
+func (c *CounterVec) WithLabelValues(values ...string) *Counter {
+	key := c.key(values)
+	if s, ok := c.series.Load(key); ok {
+		return s.(*Counter)
+	}
+	s, _ := c.series.LoadOrStore(key, &Counter{})
+	return s.(*Counter)
+}
+
+func (c *CounterVec) describe() (string, string, string) {
+	return c.name, c.help, "counter"
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	for _, key := range c.sortedKeys() {
+		s, _ := c.series.Load(key)
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelString(key, "", ""), formatFloat(s.(*Counter).Value()))
+	}
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+// Set sets the gauge to the given value.
+func (g *Gauge) Set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+}
+
+// Add adds the given value (which can be negative) to the gauge.
+func (g *Gauge) Add(v float64) {
+	addFloat(&g.bits, v)
+}
+
+// Inc increments the gauge by one.
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+// Dec decrements the gauge by one.
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+// GaugeVec is a family of gauges partitioned by label values.
+type GaugeVec struct {
+	family
+}
+
+// NewGaugeVec creates and registers a GaugeVec in the DefaultRegistry.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return DefaultRegistry.NewGaugeVec(name, help, labels...)
+}
+
+// NewGaugeVec creates and registers a GaugeVec.
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{family: family{name: name, help: help, labels: labels}}
+	r.register(g)
+	return g
+}
+
+// WithLabelValues returns the gauge for the given label values, creating it if needed.
+func (g *GaugeVec) WithLabelValues(values ...string) *Gauge {
+	key := g.key(values)
+	if s, ok := g.series.Load(key); ok {
+		return s.(*Gauge)
+	}
+	s, _ := g.series.LoadOrStore(key, &Gauge{})
+	return s.(*Gauge)
+}
+
+func (g *GaugeVec) describe() (string, string, string) {
+	return g.name, g.help, "gauge"
+}
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	for _, key := range g.sortedKeys() {
+		s, _ := g.series.Load(key)
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelString(key, "", ""), formatFloat(s.(*Gauge).Value()))
+	}
+}
+
+// Histogram counts observations in configurable buckets.
+type Histogram struct {
+	upperBounds []float64
+	buckets     []atomic.Uint64 // Non-cumulative counts per bucket, the last one is +Inf.
+	count       atomic.Uint64
+	sum         atomic.Uint64 // float64 bits
+}
+
+func newHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		upperBounds: bounds,
+		buckets:     make([]atomic.Uint64, len(bounds)+1),
+	}
+}
+
+// Observe adds a single observation to the histogram.
+func (h *Histogram) Observe(v float64) {
+	idx := sort.SearchFloat64s(h.upperBounds, v)
+	h.buckets[idx].Add(1)
+	addFloat(&h.sum, v)
+	h.count.Add(1)
+}
+
+// HistogramVec is a family of histograms partitioned by label values.
+type HistogramVec struct {
+	family
+	buckets []float64
+}
+
+// NewHistogramVec creates and registers a HistogramVec in the DefaultRegistry.
+// If buckets is nil, DefaultBuckets are used.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return DefaultRegistry.NewHistogramVec(name, help, buckets, labels...)
+}
+
+// NewHistogramVec creates and registers a HistogramVec.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+
+	bounds := make([]float64, len(buckets))
+	copy(bounds, buckets)
+	sort.Float64s(bounds)
+
+	h := &HistogramVec{family: family{name: name, help: help, labels: labels}, buckets: bounds}
+	r.register(h)
+	return h
+}
+
+// WithLabelValues returns the histogram for the given label values, creating it if needed.
+func (h *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	key := h.key(values)
+	if s, ok := h.series.Load(key); ok {
+		return s.(*Histogram)
+	}
+	s, _ := h.series.LoadOrStore(key, newHistogram(h.buckets))
+	return s.(*Histogram)
+}
+
+func (h *HistogramVec) describe() (string, string, string) {
+	return h.name, h.help, "histogram"
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	for _, key := range h.sortedKeys() {
+		s, _ := h.series.Load(key)
+		hist := s.(*Histogram)
+
+		var cumulative uint64
+		for i, bound := range hist.upperBounds {
+			cumulative += hist.buckets[i].Load()
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", formatFloat(bound)), cumulative)
+		}
+		cumulative += hist.buckets[len(hist.upperBounds)].Load()
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", "+Inf"), cumulative)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(key, "", ""), formatFloat(math.Float64frombits(hist.sum.Load())))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(key, "", ""), hist.count.Load())
+	}
+}
+
+// addFloat atomically adds v to a float64 stored as bits.
+func addFloat(bits *atomic.Uint64, v float64) {
+	for {
+		old := bits.Load()
+		updated := math.Float64bits(math.Float64frombits(old) + v)
+		if bits.CompareAndSwap(old, updated) {
+			return
+		}
+	}
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func escapeHelp(v string) string {
+	return helpEscaper.Replace(v)
+}
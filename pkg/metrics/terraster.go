@@ -0,0 +1,123 @@
+package metrics
+
+// Metrics exported by Terraster.
+// All of them are registered in the DefaultRegistry and exposed by Handler.
+var (
+	// Proxy metrics, recorded per service, location and backend.
+	RequestsTotal = NewCounterVec(
+		"terraster_requests_total",
+		"Total number of proxied requests by status code.",
+		"service", "location", "backend", "code",
+	)
+	RequestDuration = NewHistogramVec(
+		"terraster_request_duration_seconds",
+		"Time spent proxying requests to backends.",
+		nil,
+		"service", "location", "backend",
+	)
+	RequestBytes = NewCounterVec(
+		"terraster_request_bytes_total",
+		"Total number of request body bytes sent to backends.",
+		"service", "location", "backend",
+	)
+	ResponseBytes = NewCounterVec(
+		"terraster_response_bytes_total",
+		"Total number of response body bytes sent to clients.",
+		"service", "location", "backend",
+	)
+	RetriesTotal = NewCounterVec(
+		"terraster_retries_total",
+		"Total number of requests retried on another backend.",
+		"service", "location",
+	)
+	MirrorRequestsTotal = NewCounterVec(
+		"terraster_mirror_requests_total",
+		"Total number of mirrored requests by status code.",
+		"service", "location", "backend", "code",
+	)
+	MirrorRequestDuration = NewHistogramVec(
+		"terraster_mirror_request_duration_seconds",
+		"Time spent on mirrored requests.",
+		nil,
+		"service", "location", "backend",
+	)
+	MirrorSkippedTotal = NewCounterVec(
+		"terraster_mirror_skipped_total",
+		"Total number of sampled requests which were not mirrored, by reason.",
+		"service", "location", "reason",
+	)
+	ActiveConnections = NewGaugeVec(
+		"terraster_backend_active_connections",
+		"Number of requests currently in flight to a backend.",
+		"service", "location", "backend",
+	)
+
+	// Health check metrics.
+	HealthChecksTotal = NewCounterVec(
+		"terraster_health_checks_total",
+		"Total number of health checks by result.",
+		"service", "backend", "result",
+	)
+	HealthTransitionsTotal = NewCounterVec(
+		"terraster_health_transitions_total",
+		"Total number of backend health state transitions.",
+		"service", "backend", "state",
+	)
+	BackendUp = NewGaugeVec(
+		"terraster_backend_up",
+		"Whether a backend is considered healthy (1) or not (0).",
+		"service", "backend",
+	)
+	OutlierEjectionsTotal = NewCounterVec(
+		"terraster_outlier_ejections_total",
+		"Total number of backend ejections by outlier detection.",
+		"backend", "reason",
+	)
+	BackendEjected = NewGaugeVec(
+		"terraster_backend_ejected",
+		"Whether a backend is currently ejected by outlier detection (1) or not (0).",
+		"backend",
+	)
+
+	// Middleware metrics.
+	CircuitBreakerState = NewGaugeVec(
+		"terraster_circuit_breaker_state",
+		"Circuit breaker state: 0 closed, 1 half-open, 2 open.",
+		"service", "key",
+	)
+	CircuitBreakerTransitionsTotal = NewCounterVec(
+		"terraster_circuit_breaker_transitions_total",
+		"Total number of circuit breaker state transitions.",
+		"service", "key", "state",
+	)
+	RateLimitRejectionsTotal = NewCounterVec(
+		"terraster_rate_limit_rejections_total",
+		"Total number of requests rejected by the rate limiter.",
+		"service",
+	)
+	RateLimitStoreErrorsTotal = NewCounterVec(
+		"terraster_rate_limit_store_errors_total",
+		"Total number of rate limit checks that failed because the shared store was unreachable.",
+		"service", "failure_mode",
+	)
+
+	// Logging metrics.
+	LogsDroppedTotal = NewCounter(
+		"terraster_logs_dropped_total",
+		"Total number of log entries dropped because the async buffer was full.",
+	)
+
+	// Certificate metrics.
+	CertificateExpiry = NewGaugeVec(
+		"terraster_certificate_expiry_timestamp_seconds",
+		"Expiry time of certificates as a unix timestamp.",
+		"domain",
+	)
+)
+
+// Circuit breaker states as reported by CircuitBreakerState.
+const (
+	CircuitClosed   = 0
+	CircuitHalfOpen = 1
+	CircuitOpen     = 2
+)
@@ -0,0 +1,315 @@
+// Package proxyproto reads and writes PROXY protocol headers (version 1 and 2), which pass the address of
+// the client through proxies forwarding TCP connections. See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Versions of the PROXY protocol.
+const (
+	Version1 = "v1" // Human readable header.
+	Version2 = "v2" // Binary header.
+)
+
+// v1MaxLength is the maximum length of a version 1 header including CRLF.
+const v1MaxLength = 107
+
+// v2Signature starts every version 2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Version 2 commands and address families.
+const (
+	v2CmdLocal = 0x20
+	v2CmdProxy = 0x21
+
+	v2FamUnspec = 0x00
+	v2FamTCP4   = 0x11
+	v2FamUDP4   = 0x12
+	v2FamTCP6   = 0x21
+	v2FamUDP6   = 0x22
+)
+
+// ErrInvalidHeader is returned for connections starting with a malformed PROXY header.
+var ErrInvalidHeader = errors.New("invalid PROXY protocol header")
+
+// Header is a parsed PROXY protocol header.
+type Header struct {
+	Version     string   // Version1 or Version2.
+	Local       bool     // The connection was made by the proxy itself (e.g. a health check), addresses are not set.
+	Source      net.Addr // Address of the client.
+	Destination net.Addr // Address the client connected to.
+}
+
+// ValidVersion reports whether v is a supported version.
+func ValidVersion(v string) bool {
+	return v == Version1 || v == Version2
+}
+
+// ReadHeader reads the PROXY header at the start of the connection.
+// Returns nil without error if the connection does not start with a header, nothing is consumed then.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, noHeader(err)
+	}
+
+	switch first[0] {
+	case 'P':
+		prefix, err := r.Peek(6)
+		if err != nil || string(prefix) != "PROXY " {
+			// e.g. an HTTP POST request
+			return nil, noHeader(err)
+		}
+		return readV1(r)
+	case v2Signature[0]:
+		sig, err := r.Peek(len(v2Signature))
+		if err != nil || !bytes.Equal(sig, v2Signature) {
+			return nil, noHeader(err)
+		}
+		return readV2(r)
+	default:
+		return nil, nil
+	}
+}
+
+// noHeader returns the error to report if the connection does not start with a header.
+// Connections closed before sending enough data for the signature are left to the reader.
+func noHeader(err error) error {
+	if err == nil || errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header is not terminated by CRLF", ErrInvalidHeader)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &Header{Version: Version1, Local: true}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: malformed v1 header", ErrInvalidHeader)
+	}
+
+	src, err := parseV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+
+	return &Header{Version: Version1, Source: src, Destination: dst}, nil
+}
+
+func parseV1Addr(proto, ip, port string) (net.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Zone() != "" || (proto == "TCP4") != addr.Is4() {
+		return nil, fmt.Errorf("%w: invalid address %q", ErrInvalidHeader, ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid port %q", ErrInvalidHeader, port)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	cmd, fam := hdr[12], hdr[13]
+	length := int(binary.BigEndian.Uint16(hdr[14:16]))
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch cmd {
+	case v2CmdLocal:
+		return &Header{Version: Version2, Local: true}, nil
+	case v2CmdProxy:
+	default:
+		return nil, fmt.Errorf("%w: unsupported v2 command 0x%02x", ErrInvalidHeader, cmd)
+	}
+
+	// Addresses are followed by optional TLVs, which are skipped
+	var size int
+	switch fam {
+	case v2FamTCP4, v2FamUDP4:
+		size = net.IPv4len
+	case v2FamTCP6, v2FamUDP6:
+		size = net.IPv6len
+	default:
+		// Unspecified or unix sockets, the addresses of the connection are kept
+		return &Header{Version: Version2, Local: true}, nil
+	}
+	if length < 2*size+4 {
+		return nil, fmt.Errorf("%w: v2 address block too short", ErrInvalidHeader)
+	}
+
+	srcIP, _ := netip.AddrFromSlice(payload[:size])
+	dstIP, _ := netip.AddrFromSlice(payload[size : 2*size])
+	srcPort := binary.BigEndian.Uint16(payload[2*size:])
+	dstPort := binary.BigEndian.Uint16(payload[2*size+2:])
+
+	src, dst := netip.AddrPortFrom(srcIP, srcPort), netip.AddrPortFrom(dstIP, dstPort)
+	if fam == v2FamUDP4 || fam == v2FamUDP6 {
+		return &Header{Version: Version2, Source: net.UDPAddrFromAddrPort(src), Destination: net.UDPAddrFromAddrPort(dst)}, nil
+	}
+	return &Header{Version: Version2, Source: net.TCPAddrFromAddrPort(src), Destination: net.TCPAddrFromAddrPort(dst)}, nil
+}
+
+// WriteHeader writes a PROXY header announcing a TCP connection from src to dst.
+// If either address is nil or they are of different families, the connection is announced as
+// made by the proxy itself (UNKNOWN for version 1, LOCAL for version 2).
+func WriteHeader(w io.Writer, version string, src, dst net.Addr) error {
+	header, err := Format(version, src, dst)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(header)
+	return err
+}
+
+// Format returns the PROXY header announcing a TCP connection from src to dst, see WriteHeader.
+func Format(version string, src, dst net.Addr) ([]byte, error) {
+	srcAP, srcOK := addrPort(src)
+	dstAP, dstOK := addrPort(dst)
+	known := srcOK && dstOK && srcAP.Addr().Is4() == dstAP.Addr().Is4()
+
+	switch version {
+	case Version1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		proto := "TCP4"
+		if !srcAP.Addr().Is4() {
+			proto = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+			proto, srcAP.Addr(), dstAP.Addr(), srcAP.Port(), dstAP.Port())), nil
+	case Version2:
+		header := append([]byte{}, v2Signature...)
+		if !known {
+			return append(header, v2CmdLocal, v2FamUnspec, 0, 0), nil
+		}
+
+		fam, payload := byte(v2FamTCP4), []byte{}
+		if !srcAP.Addr().Is4() {
+			fam = v2FamTCP6
+		}
+		payload = append(payload, srcAP.Addr().AsSlice()...)
+		payload = append(payload, dstAP.Addr().AsSlice()...)
+		payload = binary.BigEndian.AppendUint16(payload, srcAP.Port())
+		payload = binary.BigEndian.AppendUint16(payload, dstAP.Port())
+
+		header = append(header, v2CmdProxy, fam)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+		return append(header, payload...), nil
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol version %q", version)
+	}
+}
+
+// addrPort returns the IP address and port of a TCP or UDP address. IPv4-mapped IPv6 addresses are unmapped.
+func addrPort(addr net.Addr) (netip.AddrPort, bool) {
+	var ap netip.AddrPort
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		if a == nil {
+			return ap, false
+		}
+		ap = a.AddrPort()
+	case *net.UDPAddr:
+		if a == nil {
+			return ap, false
+		}
+		ap = a.AddrPort()
+	default:
+		return ap, false
+	}
+	if !ap.IsValid() {
+		return ap, false
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+}
+
+// Conn is a connection whose addresses were replaced by those of a PROXY header.
+type Conn struct {
+	net.Conn
+	r      *bufio.Reader
+	header *Header
+}
+
+// NewConn reads the PROXY header from the connection. The returned connection reports the addresses
+// of the header, or those of the connection if there was no header or the proxy sent a LOCAL one.
+func NewConn(conn net.Conn) (*Conn, error) {
+	r := bufio.NewReader(conn)
+	header, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, r: r, header: header}, nil
+}
+
+// Read reads data following the PROXY header.
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Header returns the PROXY header of the connection, nil if it had none.
+func (c *Conn) Header() *Header {
+	return c.header
+}
+
+// RemoteAddr returns the address of the client sent in the PROXY header.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to, sent in the PROXY header.
+func (c *Conn) LocalAddr() net.Addr {
+	if c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite shuts down the writing side of the underlying connection.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,318 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func tcpAddr(s string) *net.TCPAddr {
+	addr, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		panic(err)
+	}
+	return addr
+}
+
+// v2Header builds a version 2 header from the command, family and payload.
+func v2Header(cmd, fam byte, payload []byte) []byte {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, cmd, fam)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		src     net.Addr
+		dst     net.Addr
+		want    string
+	}{
+		{
+			name:    "v1 tcp4",
+			version: Version1,
+			src:     tcpAddr("192.0.2.1:56324"),
+			dst:     tcpAddr("198.51.100.1:443"),
+			want:    "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+		},
+		{
+			name:    "v1 tcp6",
+			version: Version1,
+			src:     tcpAddr("[2001:db8::1]:56324"),
+			dst:     tcpAddr("[2001:db8::2]:443"),
+			want:    "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n",
+		},
+		{
+			name:    "v1 ipv4-mapped addresses",
+			version: Version1,
+			src:     &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 1},
+			dst:     &net.TCPAddr{IP: net.ParseIP("198.51.100.1").To4(), Port: 2},
+			want:    "PROXY TCP4 192.0.2.1 198.51.100.1 1 2\r\n",
+		},
+		{
+			name:    "v1 udp addresses",
+			version: Version1,
+			src:     &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1},
+			dst:     &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 2},
+			want:    "PROXY TCP4 192.0.2.1 198.51.100.1 1 2\r\n",
+		},
+		{
+			name:    "v1 mixed families",
+			version: Version1,
+			src:     tcpAddr("192.0.2.1:1"),
+			dst:     tcpAddr("[2001:db8::2]:2"),
+			want:    "PROXY UNKNOWN\r\n",
+		},
+		{
+			name:    "v1 missing address",
+			version: Version1,
+			src:     tcpAddr("192.0.2.1:1"),
+			want:    "PROXY UNKNOWN\r\n",
+		},
+		{
+			name:    "v1 unix socket",
+			version: Version1,
+			src:     &net.UnixAddr{Name: "/tmp/sock", Net: "unix"},
+			dst:     tcpAddr("192.0.2.1:1"),
+			want:    "PROXY UNKNOWN\r\n",
+		},
+		{
+			name:    "v2 tcp4",
+			version: Version2,
+			src:     tcpAddr("192.0.2.1:56324"),
+			dst:     tcpAddr("198.51.100.1:443"),
+			want: string(v2Header(v2CmdProxy, v2FamTCP4, []byte{
+				192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb,
+			})),
+		},
+		{
+			name:    "v2 local",
+			version: Version2,
+			want:    string(v2Header(v2CmdLocal, v2FamUnspec, nil)),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Format(tt.version, tt.src, tt.dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+
+	if _, err := Format("v3", nil, nil); err == nil {
+		t.Fatal("expected an unsupported version to be rejected")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	addrs := []struct {
+		name     string
+		src, dst *net.TCPAddr
+	}{
+		{name: "ipv4", src: tcpAddr("192.0.2.1:56324"), dst: tcpAddr("198.51.100.1:443")},
+		{name: "ipv6", src: tcpAddr("[2001:db8::1]:56324"), dst: tcpAddr("[2001:db8::2]:443")},
+	}
+
+	for _, version := range []string{Version1, Version2} {
+		for _, a := range addrs {
+			t.Run(version+" "+a.name, func(t *testing.T) {
+				var buf bytes.Buffer
+				if err := WriteHeader(&buf, version, a.src, a.dst); err != nil {
+					t.Fatal(err)
+				}
+				buf.WriteString("GET / HTTP/1.1\r\n")
+
+				r := bufio.NewReader(&buf)
+				header, err := ReadHeader(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if header.Version != version || header.Local {
+					t.Fatalf("unexpected header %+v", header)
+				}
+				if header.Source.String() != a.src.String() || header.Destination.String() != a.dst.String() {
+					t.Fatalf("expected %s -> %s, got %s -> %s", a.src, a.dst, header.Source, header.Destination)
+				}
+
+				rest, _ := io.ReadAll(r)
+				if string(rest) != "GET / HTTP/1.1\r\n" {
+					t.Fatalf("expected the data following the header, got %q", rest)
+				}
+			})
+		}
+
+		t.Run(version+" local", func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteHeader(&buf, version, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			header, err := ReadHeader(bufio.NewReader(&buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !header.Local || header.Source != nil || header.Destination != nil {
+				t.Fatalf("expected a local header, got %+v", header)
+			}
+		})
+	}
+}
+
+func TestReadHeaderV2(t *testing.T) {
+	addresses := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0, 1, 0, 2}
+
+	t.Run("udp", func(t *testing.T) {
+		header, err := ReadHeader(bufio.NewReader(bytes.NewReader(v2Header(v2CmdProxy, v2FamUDP4, addresses))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := header.Source.(*net.UDPAddr); !ok || header.Source.String() != "192.0.2.1:1" {
+			t.Fatalf("expected a UDP source address, got %#v", header.Source)
+		}
+	})
+
+	t.Run("tlvs are skipped", func(t *testing.T) {
+		payload := append(append([]byte{}, addresses...), 0x04, 0x00, 0x01, 0xff)
+		r := bufio.NewReader(bytes.NewReader(append(v2Header(v2CmdProxy, v2FamTCP4, payload), "data"...)))
+		header, err := ReadHeader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Destination.String() != "198.51.100.1:2" {
+			t.Fatalf("unexpected destination %s", header.Destination)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "data" {
+			t.Fatalf("expected the data following the header, got %q", rest)
+		}
+	})
+
+	t.Run("unix sockets keep the connection addresses", func(t *testing.T) {
+		header, err := ReadHeader(bufio.NewReader(bytes.NewReader(v2Header(v2CmdProxy, 0x31, make([]byte, 216)))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !header.Local {
+			t.Fatalf("expected a header without addresses, got %+v", header)
+		}
+	})
+}
+
+func TestReadHeaderWithoutHeader(t *testing.T) {
+	for _, data := range []string{"", "GET / HTTP/1.1\r\n", "POST / HTTP/1.1\r\n", "PRO", "\r\n\r\nfoo", "\x16\x03\x01"} {
+		t.Run(data, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(data))
+			header, err := ReadHeader(r)
+			if header != nil || err != nil {
+				t.Fatalf("expected no header, got %+v, %v", header, err)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != data {
+				t.Fatalf("expected nothing to be consumed, got %q", rest)
+			}
+		})
+	}
+}
+
+func TestReadHeaderInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "v1 without crlf", data: "PROXY TCP4 192.0.2.1 198.51.100.1 1 2\n"},
+		{name: "v1 too long", data: "PROXY TCP4 " + strings.Repeat("1", v1MaxLength) + "\r\n"},
+		{name: "v1 missing fields", data: "PROXY TCP4 192.0.2.1 198.51.100.1 1\r\n"},
+		{name: "v1 unknown protocol", data: "PROXY UDP4 192.0.2.1 198.51.100.1 1 2\r\n"},
+		{name: "v1 family mismatch", data: "PROXY TCP4 2001:db8::1 198.51.100.1 1 2\r\n"},
+		{name: "v1 invalid address", data: "PROXY TCP4 192.0.2 198.51.100.1 1 2\r\n"},
+		{name: "v1 zone", data: "PROXY TCP6 fe80::1%eth0 fe80::2 1 2\r\n"},
+		{name: "v1 invalid port", data: "PROXY TCP4 192.0.2.1 198.51.100.1 65536 2\r\n"},
+		{name: "v2 unsupported command", data: string(v2Header(0x22, v2FamTCP4, make([]byte, 12)))},
+		{name: "v2 short address block", data: string(v2Header(v2CmdProxy, v2FamTCP6, make([]byte, 12)))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadHeader(bufio.NewReader(strings.NewReader(tt.data)))
+			if !errors.Is(err, ErrInvalidHeader) {
+				t.Fatalf("expected %v, got %v", ErrInvalidHeader, err)
+			}
+		})
+	}
+
+	truncated := v2Header(v2CmdProxy, v2FamTCP4, make([]byte, 12))[:20]
+	if _, err := ReadHeader(bufio.NewReader(bytes.NewReader(truncated))); err == nil {
+		t.Fatal("expected a truncated v2 header to fail")
+	}
+}
+
+func TestNewConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		WriteHeader(client, Version2, tcpAddr("192.0.2.1:56324"), tcpAddr("198.51.100.1:443"))
+		client.Write([]byte("hello"))
+		client.Close()
+	}()
+
+	conn, err := NewConn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.RemoteAddr().String() != "192.0.2.1:56324" || conn.LocalAddr().String() != "198.51.100.1:443" {
+		t.Fatalf("expected the addresses of the header, got %s -> %s", conn.RemoteAddr(), conn.LocalAddr())
+	}
+	if conn.Header() == nil || conn.Header().Version != Version2 {
+		t.Fatalf("unexpected header %+v", conn.Header())
+	}
+	if data, _ := io.ReadAll(conn); string(data) != "hello" {
+		t.Fatalf("expected the data following the header, got %q", data)
+	}
+}
+
+func TestNewConnWithoutHeader(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		client.Write([]byte("hello"))
+		client.Close()
+	}()
+
+	conn, err := NewConn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.Header() != nil || conn.RemoteAddr() != server.RemoteAddr() {
+		t.Fatalf("expected the addresses of the connection, got header %+v", conn.Header())
+	}
+	if data, _ := io.ReadAll(conn); string(data) != "hello" {
+		t.Fatalf("expected the data to be unchanged, got %q", data)
+	}
+}
+
+func TestValidVersion(t *testing.T) {
+	for _, v := range []string{Version1, Version2} {
+		if !ValidVersion(v) {
+			t.Errorf("expected %s to be valid", v)
+		}
+	}
+	for _, v := range []string{"", "1", "V1", "v3"} {
+		if ValidVersion(v) {
+			t.Errorf("expected %q to be invalid", v)
+		}
+	}
+}
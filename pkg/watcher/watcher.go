@@ -0,0 +1,118 @@
+package watcher
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultInterval is used when a non-positive poll interval is provided.
+const DefaultInterval = 5 * time.Second
+
+// fileState captures the attributes used to detect that a file has changed.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// Watcher polls a set of files and directories and notifies when any of them change.
+// Polling is used instead of inotify/kqueue so it behaves the same on every platform
+// and survives editors that replace files atomically (rename over the original).
+type Watcher struct {
+	paths    []string      // Files or directories to watch. Directories are walked recursively.
+	interval time.Duration // How often the paths are polled.
+	snapshot map[string]fileState
+}
+
+// New creates a Watcher for the given paths. Empty paths are ignored.
+func New(interval time.Duration, paths ...string) *Watcher {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	watched := make([]string, 0, len(paths))
+	for _, p := range paths {
+		if p != "" {
+			watched = append(watched, p)
+		}
+	}
+
+	w := &Watcher{
+		paths:    watched,
+		interval: interval,
+	}
+	w.snapshot = w.scan()
+
+	return w
+}
+
+// Run polls the watched paths until the context is cancelled.
+// onChange is called once per poll cycle in which at least one file was added, removed or modified.
+func (w *Watcher) Run(ctx context.Context, onChange func()) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			current := w.scan()
+			if changed(w.snapshot, current) {
+				w.snapshot = current
+				onChange()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// scan builds a snapshot of all watched files.
+// Missing paths are skipped so that a file re-appearing is reported as a change.
+func (w *Watcher) scan() map[string]fileState {
+	snapshot := make(map[string]fileState)
+	for _, root := range w.paths {
+		info, err := os.Stat(root)
+		if err != nil {
+			continue
+		}
+
+		if !info.IsDir() {
+			snapshot[root] = fileState{modTime: info.ModTime(), size: info.Size()}
+			continue
+		}
+
+		_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+
+			fi, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			snapshot[path] = fileState{modTime: fi.ModTime(), size: fi.Size()}
+
+			return nil
+		})
+	}
+
+	return snapshot
+}
+
+// changed reports whether two snapshots differ.
+func changed(prev, current map[string]fileState) bool {
+	if len(prev) != len(current) {
+		return true
+	}
+
+	for path, state := range current {
+		old, ok := prev[path]
+		if !ok || !old.modTime.Equal(state.modTime) || old.size != state.size {
+			return true
+		}
+	}
+
+	return false
+}